@@ -3,6 +3,7 @@ package base
 import (
 	"github.com/peerless6372/Lplot/env"
 	"github.com/peerless6372/Lplot/klog"
+	"github.com/peerless6372/Lplot/trace"
 	"net/http"
 	"strings"
 
@@ -22,6 +23,9 @@ type ElasticClientConfig struct {
 	HealthCheck bool `yaml:"healthCheck"`
 	Gzip        bool `yaml:"gzip"`
 
+	// 压测流量使用的影子索引后缀，默认 _pt
+	PressureIndexSuffix string `yaml:"pressureIndexSuffix"`
+
 	Decoder       elastic.Decoder
 	RetryStrategy elastic.Retrier
 	HttpClient    *http.Client
@@ -30,6 +34,9 @@ type ElasticClientConfig struct {
 
 func (conf *ElasticClientConfig) checkConfig() {
 	env.CommonSecretChange(esPrefix, *conf, conf)
+	if conf.PressureIndexSuffix == "" {
+		conf.PressureIndexSuffix = defaultPressureIndexSuffix
+	}
 }
 
 func NewESClient(cfg ElasticClientConfig) (*elastic.Client, error) {
@@ -53,9 +60,20 @@ func NewESClient(cfg ElasticClientConfig) (*elastic.Client, error) {
 		options = append(options, elastic.SetBasicAuth(cfg.Username, cfg.Password))
 	}
 
+	// 压测流量路由到影子索引，每次请求创建client span
+	httpClient := &http.Client{}
 	if cfg.HttpClient != nil {
-		options = append(options, elastic.SetHttpClient(cfg.HttpClient))
+		c := *cfg.HttpClient
+		httpClient = &c
 	}
+	next := httpClient.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	next = &trace.Transport{Next: next, System: "elasticsearch", Service: cfg.Service}
+	httpClient.Transport = &esPressureTransport{next: next, suffix: cfg.PressureIndexSuffix}
+	options = append(options, elastic.SetHttpClient(httpClient))
+
 	if cfg.Decoder != nil {
 		options = append(options, elastic.SetDecoder(cfg.Decoder))
 	}
@@ -0,0 +1,241 @@
+package base
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/peerless6372/Lplot/utils/metadata"
+)
+
+// 压测流量默认使用的影子索引后缀
+const defaultPressureIndexSuffix = "_pt"
+
+var errEsNoIndex = errors.New("es pressure test: request item without index")
+
+// 压测流量访问的索引加上后缀：处理url中的索引以及 _bulk/_msearch 请求体中的索引
+// 需要在 Do(ctx) 时传入gin.Context(或由其派生的context)
+type esPressureTransport struct {
+	next   http.RoundTripper
+	suffix string
+}
+
+func (t *esPressureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !metadata.IsPressureTest(req.Context()) {
+		return t.next.RoundTrip(req)
+	}
+
+	path, err := t.shadowPath(req.URL.Path)
+	if err != nil {
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+		return nil, err
+	}
+	r := req.Clone(req.Context())
+	r.URL.Path = path
+	r.URL.RawPath = ""
+
+	if isEsNdjson(r.URL.Path) && req.Body != nil && req.Body != http.NoBody {
+		body, err := t.shadowNdjson(req)
+		if err != nil {
+			return nil, err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+	return t.next.RoundTrip(r)
+}
+
+func (t *esPressureTransport) shadowIndex(index string) string {
+	if index == "" || strings.HasSuffix(index, t.suffix) {
+		return index
+	}
+	return index + t.suffix
+}
+
+// 不带索引的api中只允许：索引由请求体指定并会被替换的 _bulk/_msearch，以及不读写文档的集群信息接口
+var esIndexlessAPIs = map[string]bool{
+	"":         true,
+	"_bulk":    true,
+	"_msearch": true,
+	"_cluster": true,
+	"_cat":     true,
+	"_nodes":   true,
+}
+
+// /index1,index2/_search -> /index1_pt,index2_pt/_search，以 _ 开头的为api路径
+// 无法确定影子索引的请求(如 _all、_mget、/_search)直接拒绝，避免压测流量访问线上索引
+func (t *esPressureTransport) shadowPath(path string) (string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	if parts[0] == "" || strings.HasPrefix(parts[0], "_") {
+		if !esIndexlessAPIs[parts[0]] {
+			return "", fmt.Errorf("es pressure test: %s has no shadow index", path)
+		}
+		return path, nil
+	}
+	if len(parts) > 1 && strings.HasPrefix(parts[1], "_mget") {
+		// 请求体中的文档可以指定其他索引
+		return "", fmt.Errorf("es pressure test: %s is not supported", path)
+	}
+	indices := strings.Split(parts[0], ",")
+	for i := range indices {
+		if indices[i] == "_all" {
+			return "", fmt.Errorf("es pressure test: %s has no shadow index", path)
+		}
+		indices[i] = t.shadowIndex(indices[i])
+	}
+	parts[0] = strings.Join(indices, ",")
+	return "/" + strings.Join(parts, "/"), nil
+}
+
+func isEsNdjson(path string) bool {
+	return strings.HasSuffix(path, "/_bulk") || strings.HasSuffix(path, "/_msearch")
+}
+
+func (t *esPressureTransport) shadowNdjson(req *http.Request) ([]byte, error) {
+	data, err := ioutil.ReadAll(req.Body)
+	_ = req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	gz := req.Header.Get("Content-Encoding") == "gzip"
+	if gz {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = ioutil.ReadAll(zr); err != nil {
+			return nil, err
+		}
+	}
+
+	// url中没有索引时，请求体中的每一项都必须指定索引
+	urlIndex := !strings.HasPrefix(req.URL.Path, "/_")
+	var out []byte
+	if strings.HasSuffix(req.URL.Path, "/_bulk") {
+		out, err = t.shadowBulk(data, urlIndex)
+	} else {
+		out, err = t.shadowMsearch(data, urlIndex)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if gz {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err = zw.Write(out); err != nil {
+			return nil, err
+		}
+		if err = zw.Close(); err != nil {
+			return nil, err
+		}
+		out = buf.Bytes()
+	}
+	return out, nil
+}
+
+// bulk: action行 {"index":{"_index":"x"}}，除delete外后面跟一行文档
+func (t *esPressureTransport) shadowBulk(data []byte, urlIndex bool) ([]byte, error) {
+	var out bytes.Buffer
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(make([]byte, 64*1024), len(data)+1)
+
+	source := false
+	for sc.Scan() {
+		line := sc.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if source {
+			source = false
+			out.Write(line)
+			out.WriteByte('\n')
+			continue
+		}
+
+		var action map[string]map[string]interface{}
+		if err := json.Unmarshal(line, &action); err != nil {
+			return nil, err
+		}
+		for op, meta := range action {
+			if index, ok := meta["_index"].(string); ok {
+				meta["_index"] = t.shadowIndex(index)
+			} else if !urlIndex {
+				return nil, errEsNoIndex
+			}
+			source = op != "delete"
+		}
+		b, err := json.Marshal(action)
+		if err != nil {
+			return nil, err
+		}
+		out.Write(b)
+		out.WriteByte('\n')
+	}
+	return out.Bytes(), sc.Err()
+}
+
+// msearch: header行 {"index":"x"} 与查询行交替出现
+func (t *esPressureTransport) shadowMsearch(data []byte, urlIndex bool) ([]byte, error) {
+	var out bytes.Buffer
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(make([]byte, 64*1024), len(data)+1)
+
+	header := true
+	for sc.Scan() {
+		line := sc.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if !header {
+			header = true
+			out.Write(line)
+			out.WriteByte('\n')
+			continue
+		}
+		header = false
+
+		var h map[string]interface{}
+		if err := json.Unmarshal(line, &h); err != nil {
+			return nil, err
+		}
+		switch index := h["index"].(type) {
+		case string:
+			indices := strings.Split(index, ",")
+			for i := range indices {
+				indices[i] = t.shadowIndex(indices[i])
+			}
+			h["index"] = strings.Join(indices, ",")
+		case []interface{}:
+			for i, v := range index {
+				if s, ok := v.(string); ok {
+					index[i] = t.shadowIndex(s)
+				}
+			}
+		default:
+			if !urlIndex {
+				return nil, errEsNoIndex
+			}
+		}
+		b, err := json.Marshal(h)
+		if err != nil {
+			return nil, err
+		}
+		out.Write(b)
+		out.WriteByte('\n')
+	}
+	return out.Bytes(), sc.Err()
+}
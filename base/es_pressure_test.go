@@ -0,0 +1,144 @@
+package base
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/peerless6372/Lplot/utils/metadata"
+	"github.com/peerless6372/gin"
+)
+
+type esRoundTrip func(*http.Request) (*http.Response, error)
+
+func (f esRoundTrip) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestEsShadowPath(t *testing.T) {
+	tr := &esPressureTransport{suffix: "_pt"}
+	cases := []struct {
+		path string
+		want string
+	}{
+		{"/i1/_search", "/i1_pt/_search"},
+		{"/i1,i2/_search", "/i1_pt,i2_pt/_search"},
+		{"/i1_pt/_doc/1", "/i1_pt/_doc/1"},
+		{"/i1", "/i1_pt"},
+		{"/", "/"},
+		{"/_bulk", "/_bulk"},
+		{"/_msearch", "/_msearch"},
+		{"/_cluster/health", "/_cluster/health"},
+		{"/_cat/indices", "/_cat/indices"},
+		{"/_search", "error"},
+		{"/_count", "error"},
+		{"/_mget", "error"},
+		{"/_all/_search", "error"},
+		{"/i1,_all/_search", "error"},
+		{"/i1/_mget", "error"},
+	}
+	for _, c := range cases {
+		got, err := tr.shadowPath(c.path)
+		if err != nil {
+			got = "error"
+		}
+		if got != c.want {
+			t.Errorf("%s: got %s, want %s", c.path, got, c.want)
+		}
+	}
+}
+
+func TestEsShadowNdjson(t *testing.T) {
+	tr := &esPressureTransport{suffix: "_pt"}
+	cases := []struct {
+		name string
+		path string
+		body string
+		want string
+	}{
+		{"bulk", "/_bulk",
+			`{"index":{"_index":"a"}}` + "\n" + `{"_index":"doc"}` + "\n" + `{"delete":{"_index":"b","_id":"1"}}` + "\n",
+			`{"index":{"_index":"a_pt"}}` + "\n" + `{"_index":"doc"}` + "\n" + `{"delete":{"_id":"1","_index":"b_pt"}}` + "\n"},
+		{"bulk url index", "/i/_bulk",
+			`{"create":{"_id":"1"}}` + "\n" + `{"x":1}` + "\n",
+			`{"create":{"_id":"1"}}` + "\n" + `{"x":1}` + "\n"},
+		{"bulk without index", "/_bulk", `{"index":{"_id":"1"}}` + "\n" + `{"x":1}` + "\n", "error"},
+		{"msearch", "/_msearch",
+			`{"index":"a,b"}` + "\n" + `{"query":{}}` + "\n" + `{"index":["c"]}` + "\n" + `{"query":{}}` + "\n",
+			`{"index":"a_pt,b_pt"}` + "\n" + `{"query":{}}` + "\n" + `{"index":["c_pt"]}` + "\n" + `{"query":{}}` + "\n"},
+		{"msearch url index", "/i/_msearch", "{}\n{\"query\":{}}\n", "{}\n{\"query\":{}}\n"},
+		{"msearch without index", "/_msearch", "{}\n{\"query\":{}}\n", "error"},
+	}
+	for _, c := range cases {
+		for _, gz := range []bool{false, true} {
+			body := []byte(c.body)
+			if gz {
+				var buf bytes.Buffer
+				zw := gzip.NewWriter(&buf)
+				_, _ = zw.Write(body)
+				_ = zw.Close()
+				body = buf.Bytes()
+			}
+			req, _ := http.NewRequest(http.MethodPost, "http://es"+c.path, bytes.NewReader(body))
+			if gz {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+			out, err := tr.shadowNdjson(req)
+			if err == nil && gz {
+				zr, _ := gzip.NewReader(bytes.NewReader(out))
+				out, err = ioutil.ReadAll(zr)
+			}
+			got := string(out)
+			if err != nil {
+				got = "error"
+			}
+			if got != c.want {
+				t.Errorf("%s gzip %v: got %q, want %q", c.name, gz, got, c.want)
+			}
+		}
+	}
+}
+
+func TestEsPressureTransport(t *testing.T) {
+	var path, body string
+	tr := &esPressureTransport{suffix: "_pt", next: esRoundTrip(func(r *http.Request) (*http.Response, error) {
+		path = r.URL.Path
+		body = ""
+		if r.Body != nil {
+			b, _ := ioutil.ReadAll(r.Body)
+			body = string(b)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("{}"))}, nil
+	})}
+	pressure, _ := gin.CreateTestContext(httptest.NewRecorder())
+	pressure.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	metadata.MarkPressureTest(pressure)
+
+	cases := []struct {
+		name     string
+		pressure bool
+		path     string
+		body     string
+		wantPath string
+		wantBody string
+	}{
+		{"online", false, "/i/_search", "", "/i/_search", ""},
+		{"search", true, "/i/_search", "", "/i_pt/_search", ""},
+		{"bulk", true, "/_bulk", `{"index":{"_index":"a"}}` + "\n" + `{"x":1}` + "\n",
+			"/_bulk", `{"index":{"_index":"a_pt"}}` + "\n" + `{"x":1}` + "\n"},
+		{"rejected", true, "/_search", "", "", ""},
+	}
+	for _, c := range cases {
+		path, body = "", ""
+		req, _ := http.NewRequest(http.MethodPost, "http://es"+c.path, strings.NewReader(c.body))
+		if c.pressure {
+			req = req.WithContext(pressure)
+		}
+		_, err := tr.RoundTrip(req)
+		if (err != nil) != (c.wantPath == "") || path != c.wantPath || body != c.wantBody {
+			t.Errorf("%s: err %v path %s body %q", c.name, err, path, body)
+		}
+	}
+}
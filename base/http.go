@@ -1,19 +1,18 @@
 package base
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	json "github.com/json-iterator/go"
-	"github.com/peerless6372/Lplot/env"
 	"github.com/peerless6372/Lplot/klog"
+	"github.com/peerless6372/Lplot/redis"
+	"github.com/peerless6372/Lplot/trace"
 	"github.com/peerless6372/Lplot/utils"
 	"github.com/peerless6372/gin"
 	"io"
 	"io/ioutil"
-	"net"
 	"net/http"
 	"net/http/httptrace"
 	"net/url"
@@ -23,7 +22,16 @@ import (
 )
 
 const HttpHeaderService = "SERVICE"
+
+// 压测流量标记，入口通过header或query参数识别，ApiClient调用下游时通过header透传
 const HttpUrlPressureTestKey = "_call_uri"
+const HttpHeaderPressureTest = "X-Pressure-Test"
+
+// 镜像流量标记，下游据此区分镜像请求，不计入真实业务
+const HttpHeaderMirror = "X-Mirror"
+
+// 泳道(染色)标记，入口读入metadata，ApiClient调用下游时透传并优先路由到同泳道实例
+const HttpHeaderColor = "X-Color"
 
 const (
 	EncodeJson = "_json"
@@ -82,6 +90,18 @@ type HttpRequestOptions struct {
 	RetryPolicy RetryPolicy
 	// 重试间隔机制，可不指定，默认使用`defaultBackOffPolicy`(只有在`api.yaml`中指定retry>0 时生效)
 	BackOffPolicy BackOffPolicy
+
+	// 指标中的path标签，如 /user/:id，未指定时为 Paths 中匹配的key，都没有时为 other
+	PathTemplate string
+
+	// 流式请求体，HttpStream 使用，优先于上面的body参数
+	BodyReader io.Reader
+	// multipart 上传的文件，HttpUpload 使用
+	Files []UploadFile
+
+	stream bool
+	// 反向代理转发：请求体原样转发不压缩，重试用尽时的下游响应原样返回而不是转为错误
+	proxy bool
 }
 
 func (o *HttpRequestOptions) GetData() (string, error) {
@@ -185,7 +205,8 @@ type ApiClient struct {
 	Service        string        `yaml:"service"`
 	AppKey         string        `yaml:"appkey"`
 	AppSecret      string        `yaml:"appsecret"`
-	Domain         string        `yaml:"domain"`
+	Domain         string        `yaml:"domain"`    // 支持 unix:///path/to.sock
+	Endpoints      []string      `yaml:"endpoints"` // 多实例地址，未配置domain时使用第一个
 	Timeout        time.Duration `yaml:"timeout"`
 	ConnectTimeout time.Duration `yaml:"connectTimeout"`
 	Retry          int           `yaml:"retry"`
@@ -196,30 +217,77 @@ type ApiClient struct {
 		Username string `yaml:"username"`
 		Password string `yaml:"password"`
 	}
+	Transport HttpTransportConf `yaml:"transport"`
+	// 录制回放，用于离线测试
+	Replay ReplayConf `yaml:"replay"`
+	// 对冲请求，仅对GET/HEAD/OPTIONS生效
+	Hedge HedgeConf `yaml:"hedge"`
+	// GET 响应缓存，CacheStore 为空时使用本地缓存
+	Cache      HttpCacheConf  `yaml:"cache"`
+	CacheStore HttpCacheStore `yaml:"-"`
+	// client级别拦截器，在全局拦截器之后执行
+	Interceptors []Interceptor `yaml:"-"`
+	// 请求体超过该字节数时gzip压缩，0不压缩
+	GzipThreshold int `yaml:"gzipThreshold"`
+	// 流式请求(HttpStream/HttpUpload/HttpDownload)的整体超时，0不限制
+	StreamTimeout time.Duration `yaml:"streamTimeout"`
+	// 按path覆盖timeout/retry，如耗时较长的导出接口
+	Paths map[string]ApiPathConf `yaml:"paths"`
+	// 泳道 -> 该泳道的实例地址，请求所在泳道未配置时使用默认的domain/endpoints
+	Colors map[string][]string `yaml:"colors"`
+	// OAuth2 client credentials，TokenRedis 不为空时多实例共享token
+	OAuth2     OAuth2Conf   `yaml:"oauth2"`
+	TokenRedis *redis.Redis `yaml:"-"`
 
 	HTTPClient *http.Client
 	clientInit sync.Once
+	initErr    error
+
+	transport *http.Transport
+	transErr  error
+	transInit sync.Once
+
+	pathClients map[time.Duration]*http.Client
+
+	invoker      Invoker
+	streamClient *http.Client
+	hedger       *hedger
+	tokens       *tokenSource
+	cache        *httpCache
+	cacheInit    sync.Once
 }
 
-func (client *ApiClient) GetTransPort() *http.Transport {
-	trans := globalTransport
-	if client.Proxy != "" {
-		trans.Proxy = func(_ *http.Request) (*url.URL, error) {
-			return url.Parse(client.Proxy)
-		}
-	} else {
-		trans.Proxy = nil
+func (client *ApiClient) endpoints() []string {
+	if len(client.Endpoints) > 0 {
+		return client.Endpoints
 	}
+	if client.Domain != "" {
+		return []string{client.Domain}
+	}
+	return nil
+}
 
-	if client.ConnectTimeout != 0 {
-		trans.DialContext = (&net.Dialer{
-			Timeout: client.ConnectTimeout,
-		}).DialContext
-	} else {
-		trans.DialContext = nil
+func (client *ApiClient) getDomain() string {
+	if client.Domain != "" {
+		return client.Domain
 	}
+	if len(client.Endpoints) > 0 {
+		return client.Endpoints[0]
+	}
+	return ""
+}
 
-	return trans
+// 每个client独享一个由全局transport派生的transport，初始化失败时返回nil
+func (client *ApiClient) GetTransPort() *http.Transport {
+	client.transInit.Do(func() {
+		client.transport, client.transErr = client.newTransport()
+		if client.transErr != nil {
+			klog.WarnLogger(nil, "http client init transport error: "+client.transErr.Error(),
+				klog.String(klog.TopicType, klog.LogNameModule),
+				klog.String("service", client.Service))
+		}
+	})
+	return client.transport
 }
 
 func (client *ApiClient) makeRequest(ctx *gin.Context, method, url string, data io.Reader, opts HttpRequestOptions) (*http.Request, error) {
@@ -238,6 +306,8 @@ func (client *ApiClient) makeRequest(ctx *gin.Context, method, url string, data
 		req.Host = client.Host
 	} else if h := req.Header.Get("host"); h != "" {
 		req.Host = h
+	} else if h := defaultHost(req.URL); h != "" {
+		req.Host = h
 	}
 
 	for k, v := range opts.Cookies {
@@ -257,8 +327,11 @@ func (client *ApiClient) makeRequest(ctx *gin.Context, method, url string, data
 	}
 	req.Header.Set("Content-Type", cType)
 
-	req.Header.Set(HttpHeaderService, env.AppName)
-	req.Header.Set(klog.TraceHeaderKey, klog.GetRequestID(ctx))
+	if client.GzipThreshold > 0 && req.ContentLength > int64(client.GzipThreshold) && !opts.proxy {
+		if err = gzipRequestBody(req); err != nil {
+			return nil, err
+		}
+	}
 
 	return req, nil
 }
@@ -271,7 +344,7 @@ func (client *ApiClient) HttpGet(ctx *gin.Context, path string, opts HttpRequest
 		return nil, err
 	}
 
-	domain := client.Domain
+	domain := client.baseURL()
 
 	var u string
 	if urlData == "" {
@@ -286,15 +359,23 @@ func (client *ApiClient) HttpGet(ctx *gin.Context, path string, opts HttpRequest
 		return nil, err
 	}
 
+	var (
+		body   ApiResult
+		fields []klog.Field
+	)
 	t := client.beforeHttpStat(ctx, req)
-	body, fields, err := client.httpDo(ctx, req, &opts)
+	if client.cacheEnable() {
+		body, fields, err = client.cachedGet(ctx, req, &opts)
+	} else {
+		body, fields, err = client.httpDo(ctx, req, &opts)
+	}
 	client.afterHttpStat(ctx, req.URL.Scheme, t)
 
 	klog.DebugLogger(ctx, "http get request",
 		klog.String(klog.TopicType, klog.LogNameModule),
-		klog.String("url", u),
+		klog.String("url", klog.RedactURL(u)),
 		klog.Int("responseCode", body.HttpCode),
-		klog.String("responseBody", string(body.Response)),
+		klog.String("responseBody", klog.RedactBody(string(body.Response))),
 	)
 	msg := "http request success"
 	if err != nil {
@@ -314,7 +395,7 @@ func (client *ApiClient) HttpPost(ctx *gin.Context, path string, opts HttpReques
 		return nil, err
 	}
 
-	domain := client.Domain
+	domain := client.baseURL()
 
 	u := fmt.Sprintf("%s%s", domain, path)
 
@@ -330,10 +411,10 @@ func (client *ApiClient) HttpPost(ctx *gin.Context, path string, opts HttpReques
 
 	klog.DebugLogger(ctx, "http post request",
 		klog.String(klog.TopicType, klog.LogNameModule),
-		klog.String("url", u),
-		klog.String("params", urlData),
+		klog.String("url", klog.RedactURL(u)),
+		klog.String("params", klog.RedactBody(urlData)),
 		klog.Int("responseCode", body.HttpCode),
-		klog.String("responseBody", string(body.Response)),
+		klog.String("responseBody", klog.RedactBody(string(body.Response))),
 	)
 
 	msg := "http request success"
@@ -354,7 +435,7 @@ func (client *ApiClient) HttpPostJson(ctx *gin.Context, path string, opts HttpRe
 		return nil, err
 	}
 
-	domain := client.Domain
+	domain := client.baseURL()
 
 	u := fmt.Sprintf("%s%s", domain, path)
 
@@ -371,10 +452,10 @@ func (client *ApiClient) HttpPostJson(ctx *gin.Context, path string, opts HttpRe
 
 	klog.DebugLogger(ctx, "HttpPostJson",
 		klog.String(klog.TopicType, klog.LogNameModule),
-		klog.String("url", u),
-		klog.String("params", urlData),
+		klog.String("url", klog.RedactURL(u)),
+		klog.String("params", klog.RedactBody(urlData)),
 		klog.Int("responseCode", body.HttpCode),
-		klog.String("responseBody", string(body.Response)),
+		klog.String("responseBody", klog.RedactBody(string(body.Response))),
 	)
 
 	msg := "http request success"
@@ -389,6 +470,7 @@ func (client *ApiClient) HttpPostJson(ctx *gin.Context, path string, opts HttpRe
 type ApiResult struct {
 	HttpCode int
 	Response []byte
+	Header   http.Header
 	Ctx      *gin.Context
 }
 
@@ -399,14 +481,54 @@ func (client *ApiClient) httpDo(ctx *gin.Context, req *http.Request, opts *HttpR
 		klog.String("prot", "http"),
 		klog.String("service", client.Service),
 		klog.String("method", req.Method),
-		klog.String("domain", client.Domain),
+		klog.String("domain", client.getDomain()),
 		klog.String("requestUri", req.URL.Path),
 		klog.String("proxy", client.Proxy),
-		klog.Duration("timeout", client.Timeout),
+		klog.Duration("timeout", client.timeout(req.URL.Path)),
 		klog.String("requestStartTime", utils.GetFormatRequestTime(start)),
 	}
 
+	if err = client.lazyInit(); err != nil {
+		return res, fields, err
+	}
+
+	span := trace.StartSpan(ctx, "HTTP "+req.Method, trace.SpanKindClient)
+	defer span.End()
+	span.Inject(req.Header)
+	span.SetAttr("peer.service", client.Service)
+	span.SetAttr("http.method", req.Method)
+	span.SetAttr("http.target", req.URL.Path)
+
+	inv, resp, err := client.invoke(ctx, req, opts)
+	if resp != nil {
+		res.HttpCode = resp.StatusCode
+		res.Header = resp.Header
+		res.Response, _ = ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		span.SetAttr("http.status_code", resp.StatusCode)
+	}
+	span.SetAttr("retry", inv.Attempt-1)
+	span.SetError(err)
+	client.observe(req.Method, client.metricPath(req.URL.Path, opts), res.HttpCode, start)
+
+	end := time.Now()
+	fields = append(fields,
+		klog.String("retry", fmt.Sprintf("%d/%d", inv.Attempt-1, client.retry(req.URL.Path))),
+		klog.Int("httpCode", res.HttpCode),
+		klog.String("requestEndTime", utils.GetFormatRequestTime(end)),
+		klog.Float64("cost", utils.GetRequestCost(start, end)),
+		klog.Int("ralCode", client.calRalCode(resp, err)),
+	)
+	fields = append(fields, inv.hedge.fields()...)
+
+	return res, fields, err
+}
+
+func (client *ApiClient) lazyInit() error {
 	client.clientInit.Do(func() {
+		if client.Hedge.Enable {
+			client.hedger = newHedger(client.Hedge)
+		}
 		if client.HTTPClient == nil {
 			timeout := 3 * time.Second
 			if client.Timeout > 0 {
@@ -414,104 +536,48 @@ func (client *ApiClient) httpDo(ctx *gin.Context, req *http.Request, opts *HttpR
 			}
 
 			trans := client.GetTransPort()
+			if trans == nil {
+				client.initErr = client.transErr
+				return
+			}
 			client.HTTPClient = &http.Client{
 				Timeout:   timeout,
-				Transport: trans,
-			}
-		}
-	})
-
-	var (
-		resp         *http.Response
-		dataBuffer   *bytes.Reader
-		maxAttempts  int
-		attemptCount int
-		doErr        error
-		shouldRetry  bool
-	)
-
-	attemptCount, maxAttempts = 0, client.Retry
-
-	retryPolicy := opts.GetRetryPolicy()
-	backOffPolicy := opts.GetBackOffPolicy()
-
-	for {
-		if req.GetBody != nil {
-			bodyReadCloser, _ := req.GetBody()
-			req.Body = bodyReadCloser
-		} else if req.Body != nil {
-			if dataBuffer == nil {
-				data, err := ioutil.ReadAll(req.Body)
-				_ = req.Body.Close()
-				if err != nil {
-					return res, fields, err
-				}
-				dataBuffer = bytes.NewReader(data)
-				req.ContentLength = int64(dataBuffer.Len())
-				req.Body = ioutil.NopCloser(dataBuffer)
-			}
-			_, _ = dataBuffer.Seek(0, io.SeekStart)
-		}
-
-		attemptCount++
-		resp, doErr = client.HTTPClient.Do(req)
-		if doErr != nil {
-			f := []klog.Field{
-				klog.String(klog.TopicType, klog.LogNameModule),
-				klog.String("prot", "http"),
-				klog.String("service", client.Service),
-				klog.String("requestUri", req.URL.Path),
-				klog.Duration("timeout", client.Timeout),
-				klog.Int("attemptCount", attemptCount),
+				Transport: newReplayTransport(client.Service, client.Replay, trans),
 			}
-			klog.WarnLogger(ctx, doErr.Error(), f...)
-		}
-
-		shouldRetry = retryPolicy(resp, doErr)
-		if !shouldRetry {
-			break
-		}
-
-		if attemptCount > maxAttempts {
-			break
 		}
-
-		if doErr == nil {
-			drainAndCloseBody(resp, 16384)
+		client.initPathClients()
+		if client.OAuth2.enable() {
+			client.tokens = newTokenSource(client)
 		}
-		wait := backOffPolicy(attemptCount)
-		select {
-		case <-req.Context().Done():
-			return res, fields, req.Context().Err()
-		case <-time.After(wait):
+		// 流式请求不设整体超时，由 StreamTimeout 与 transport 的 responseHeaderTimeout 控制
+		client.streamClient = &http.Client{
+			Timeout:   client.StreamTimeout,
+			Transport: client.HTTPClient.Transport,
 		}
+		client.invoker = client.buildInvoker()
+	})
+	if client.HTTPClient == nil {
+		return client.initErr
 	}
+	return nil
+}
 
-	if resp != nil {
-		res.HttpCode = resp.StatusCode
-		res.Response, err = ioutil.ReadAll(resp.Body)
-		_ = resp.Body.Close()
+// 经过拦截器链发出请求，返回的响应body未读取，由调用方关闭
+func (client *ApiClient) invoke(ctx *gin.Context, req *http.Request, opts *HttpRequestOptions) (*Invocation, *http.Response, error) {
+	inv := &Invocation{
+		Ctx:     ctx,
+		Client:  client,
+		Request: req,
+		Options: opts,
 	}
-
-	err = doErr
-	if err == nil && shouldRetry {
+	resp, err := client.invoker(inv)
+	if err == nil && inv.retryHit && !opts.proxy {
 		err = fmt.Errorf("hit retry policy")
 	}
-
-	end := time.Now()
 	if err != nil {
-		err = fmt.Errorf("giving up after %d attempt(s): %w", attemptCount, err)
+		err = fmt.Errorf("giving up after %d attempt(s): %w", inv.Attempt, err)
 	}
-
-	fields = append(fields,
-		klog.String("retry", fmt.Sprintf("%d/%d", attemptCount-1, client.Retry)),
-		klog.Int("httpCode", res.HttpCode),
-		klog.String("requestEndTime", utils.GetFormatRequestTime(end)),
-		klog.Float64("cost", utils.GetRequestCost(start, end)),
-		klog.Int("ralCode", client.calRalCode(resp, err)),
-	)
-
-	return res, fields, err
+	return inv, resp, err
 }
 
 // 本次请求正确性判断
@@ -531,6 +597,8 @@ type timeTrace struct {
 	tlsHandshakeStartTime,
 	tlsHandshakeDoneTime,
 	finishTime time.Time
+	// 解析结果来自DNS缓存(或复用了并发的解析)
+	dnsCached bool
 }
 
 func (client *ApiClient) beforeHttpStat(ctx *gin.Context, req *http.Request) *timeTrace {
@@ -539,7 +607,25 @@ func (client *ApiClient) beforeHttpStat(ctx *gin.Context, req *http.Request) *ti
 	}
 
 	var t = &timeTrace{}
-	trace := &httptrace.ClientTrace{
+	*req = *req.WithContext(withTimeTrace(t))
+	return t
+}
+
+type timeTraceKey struct{}
+
+func withTimeTrace(t *timeTrace) context.Context {
+	ctx := context.WithValue(context.Background(), timeTraceKey{}, t)
+	return httptrace.WithClientTrace(ctx, newClientTrace(t))
+}
+
+// 请求ctx上的耗时统计，对冲请求据此为每个请求单独统计
+func timeTraceFrom(ctx context.Context) *timeTrace {
+	t, _ := ctx.Value(timeTraceKey{}).(*timeTrace)
+	return t
+}
+
+func newClientTrace(t *timeTrace) *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
 		DNSStart: func(_ httptrace.DNSStartInfo) { t.dnsStartTime = time.Now() },
 		DNSDone:  func(_ httptrace.DNSDoneInfo) { t.dnsDoneTime = time.Now() },
 		ConnectStart: func(_, _ string) {
@@ -555,8 +641,6 @@ func (client *ApiClient) beforeHttpStat(ctx *gin.Context, req *http.Request) *ti
 		TLSHandshakeStart:    func() { t.tlsHandshakeStartTime = time.Now() },
 		TLSHandshakeDone:     func(_ tls.ConnectionState, _ error) { t.tlsHandshakeDoneTime = time.Now() },
 	}
-	*req = *req.WithContext(httptrace.WithClientTrace(context.Background(), trace))
-	return t
 }
 
 func (client *ApiClient) afterHttpStat(ctx *gin.Context, scheme string, t *timeTrace) {
@@ -586,6 +670,7 @@ func (client *ApiClient) afterHttpStat(ctx *gin.Context, scheme string, t *timeT
 			klog.Float64("serverProcessCost", cost(t.gotFirstRespTime.Sub(t.gotConnTime))),               // server processing
 			klog.Float64("contentTransferCost", cost(t.finishTime.Sub(t.gotFirstRespTime))),              // content transfer
 			klog.Float64("totalCost", cost(t.finishTime.Sub(t.dnsStartTime))),                            // total cost
+			klog.Bool("dnsCached", t.dnsCached),
 		}
 		klog.InfoLogger(ctx, "time trace", f...)
 	case "http":
@@ -596,6 +681,7 @@ func (client *ApiClient) afterHttpStat(ctx *gin.Context, scheme string, t *timeT
 			klog.Float64("serverProcessCost", cost(t.gotFirstRespTime.Sub(t.gotConnTime))),  // server processing
 			klog.Float64("contentTransferCost", cost(t.finishTime.Sub(t.gotFirstRespTime))), // content transfer
 			klog.Float64("totalCost", cost(t.finishTime.Sub(t.dnsStartTime))),               // total cost
+			klog.Bool("dnsCached", t.dnsCached),
 		}
 		klog.InfoLogger(ctx, "time trace", f...)
 	}
@@ -0,0 +1,354 @@
+package base
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	json "github.com/json-iterator/go"
+	"github.com/peerless6372/Lplot/gcache"
+	"github.com/peerless6372/Lplot/klog"
+	"github.com/peerless6372/Lplot/redis"
+	"github.com/peerless6372/Lplot/utils"
+	"github.com/peerless6372/Lplot/utils/metadata"
+	"github.com/peerless6372/gin"
+)
+
+// GET 响应缓存配置
+type HttpCacheConf struct {
+	Enable bool `yaml:"enable"`
+	// 按path显式指定缓存时间，优先于响应的 Cache-Control/Expires
+	PathTTL map[string]time.Duration `yaml:"pathTTL"`
+	// 带 ETag/Last-Modified 的响应过期后继续保留的时长，用于发送条件请求，默认10分钟
+	RevalidateTTL time.Duration `yaml:"revalidateTTL"`
+	// 本地缓存分片数，默认16
+	Shards int `yaml:"shards"`
+}
+
+// 缓存存储，内置本地(gcache)与redis两种实现
+type HttpCacheStore interface {
+	Get(ctx *gin.Context, key string) ([]byte, bool)
+	Set(ctx *gin.Context, key string, value []byte, ttl time.Duration)
+}
+
+type localHttpCache struct {
+	c *gcache.BucketCache
+}
+
+func NewLocalHttpCache(shards int) HttpCacheStore {
+	if shards <= 0 {
+		shards = 16
+	}
+	return &localHttpCache{c: gcache.NewBucketCache(gcache.NoExpiration, time.Minute, shards)}
+}
+
+func (l *localHttpCache) Get(_ *gin.Context, key string) ([]byte, bool) {
+	v, ok := l.c.Get(key)
+	if !ok {
+		return nil, false
+	}
+	b, ok := v.([]byte)
+	return b, ok
+}
+
+func (l *localHttpCache) Set(_ *gin.Context, key string, value []byte, ttl time.Duration) {
+	l.c.Set(key, value, ttl)
+}
+
+type redisHttpCache struct {
+	r      *redis.Redis
+	prefix string
+}
+
+func NewRedisHttpCache(r *redis.Redis, prefix string) HttpCacheStore {
+	if prefix == "" {
+		prefix = "httpcache:"
+	}
+	return &redisHttpCache{r: r, prefix: prefix}
+}
+
+func (c *redisHttpCache) Get(ctx *gin.Context, key string) ([]byte, bool) {
+	v, err := c.r.Get(ctx, c.prefix+key)
+	if err != nil || v == nil {
+		return nil, false
+	}
+	return v, true
+}
+
+func (c *redisHttpCache) Set(ctx *gin.Context, key string, value []byte, ttl time.Duration) {
+	sec := int64(ttl / time.Second)
+	if sec < 1 {
+		sec = 1
+	}
+	_ = c.r.Set(ctx, c.prefix+key, value, sec)
+}
+
+type httpCacheEntry struct {
+	HttpCode     int       `json:"code"`
+	Response     []byte    `json:"body"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	FreshUntil   time.Time `json:"freshUntil"`
+}
+
+func (e *httpCacheEntry) validator() bool {
+	return e.ETag != "" || e.LastModified != ""
+}
+
+type httpCache struct {
+	conf  HttpCacheConf
+	store HttpCacheStore
+	group callGroup
+}
+
+func newHttpCache(conf HttpCacheConf, store HttpCacheStore) *httpCache {
+	if conf.RevalidateTTL <= 0 {
+		conf.RevalidateTTL = 10 * time.Minute
+	}
+	if store == nil {
+		store = NewLocalHttpCache(conf.Shards)
+	}
+	return &httpCache{conf: conf, store: store}
+}
+
+func (c *httpCache) load(ctx *gin.Context, key string) *httpCacheEntry {
+	data, ok := c.store.Get(ctx, key)
+	if !ok {
+		return nil
+	}
+	var e httpCacheEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil
+	}
+	return &e
+}
+
+func (c *httpCache) save(ctx *gin.Context, key string, e *httpCacheEntry) {
+	ttl := time.Until(e.FreshUntil)
+	if e.validator() {
+		ttl += c.conf.RevalidateTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	c.store.Set(ctx, key, data, ttl)
+}
+
+// 计算响应的新鲜期，返回 false 表示不可缓存
+// 缓存在多个用户的请求间共享，no-store/private 的响应即使配置了 PathTTL 也不缓存
+func (c *httpCache) freshness(path string, header http.Header) (time.Duration, bool) {
+	cc := strings.ToLower(header.Get("Cache-Control"))
+	if strings.Contains(cc, "no-store") || strings.Contains(cc, "private") {
+		return 0, false
+	}
+
+	if ttl, ok := c.conf.PathTTL[path]; ok {
+		return ttl, ttl > 0
+	}
+
+	if strings.Contains(cc, "no-cache") {
+		// 每次都需要条件请求校验
+		return 0, header.Get("ETag") != "" || header.Get("Last-Modified") != ""
+	}
+	for _, d := range strings.Split(cc, ",") {
+		d = strings.TrimSpace(d)
+		if strings.HasPrefix(d, "max-age=") {
+			if sec, err := strconv.Atoi(strings.TrimPrefix(d, "max-age=")); err == nil {
+				return time.Duration(sec) * time.Second, sec > 0 || header.Get("ETag") != ""
+			}
+		}
+	}
+	if exp := header.Get("Expires"); exp != "" {
+		if t, err := http.ParseTime(exp); err == nil {
+			return time.Until(t), time.Until(t) > 0
+		}
+	}
+
+	// 未声明新鲜期，但带校验器的响应可以通过条件请求复用
+	return 0, header.Get("ETag") != "" || header.Get("Last-Modified") != ""
+}
+
+func (client *ApiClient) cacheEnable() bool {
+	if !client.Cache.Enable {
+		return false
+	}
+	client.cacheInit.Do(func() {
+		client.cache = newHttpCache(client.Cache, client.CacheStore)
+	})
+	return true
+}
+
+// 带缓存与请求合并的GET
+func (client *ApiClient) cachedGet(ctx *gin.Context, req *http.Request, opts *HttpRequestOptions) (ApiResult, []klog.Field, error) {
+	c := client.cache
+	key := client.cacheKey(ctx, req)
+
+	start := time.Now()
+	e := c.load(ctx, key)
+	if e != nil && time.Now().Before(e.FreshUntil) {
+		return ApiResult{HttpCode: e.HttpCode, Response: e.Response, Ctx: ctx}, client.cacheFields(req, start, "hit"), nil
+	}
+
+	v, shared, err := c.group.Do(key, func() (interface{}, error) {
+		if e != nil {
+			if e.ETag != "" {
+				req.Header.Set("If-None-Match", e.ETag)
+			}
+			if e.LastModified != "" {
+				req.Header.Set("If-Modified-Since", e.LastModified)
+			}
+		}
+
+		res, fields, err := client.httpDo(ctx, req, opts)
+		if err != nil {
+			return cacheCall{res: res, fields: fields}, err
+		}
+
+		if e != nil && res.HttpCode == http.StatusNotModified {
+			res.HttpCode, res.Response = e.HttpCode, e.Response
+			fields = append(fields, klog.String("cache", "revalidated"))
+		} else {
+			fields = append(fields, klog.String("cache", "miss"))
+		}
+
+		if header := res.Header; res.HttpCode == http.StatusOK && header != nil {
+			if ttl, ok := c.freshness(req.URL.Path, header); ok {
+				c.save(ctx, key, &httpCacheEntry{
+					HttpCode:     res.HttpCode,
+					Response:     res.Response,
+					ETag:         firstNonEmpty(header.Get("ETag"), eTag(e)),
+					LastModified: firstNonEmpty(header.Get("Last-Modified"), lastModified(e)),
+					FreshUntil:   time.Now().Add(ttl),
+				})
+			}
+		}
+		return cacheCall{res: res, fields: fields}, nil
+	})
+
+	call, _ := v.(cacheCall)
+	res := call.res
+	if !shared {
+		return res, call.fields, err
+	}
+
+	// 合并的请求共享同一份响应，复制一份避免调用方修改
+	res.Response = append([]byte(nil), res.Response...)
+	res.Ctx = ctx
+	return res, client.cacheFields(req, start, "coalesced"), err
+}
+
+// 缓存key为url加上影响响应内容的请求信息：header(含cookie、basic auth)、client凭证、泳道与压测/镜像标记，
+// 避免一个用户的响应返回给其他用户，或压测/泳道的响应返回给线上请求
+func (client *ApiClient) cacheKey(ctx *gin.Context, req *http.Request) string {
+	names := make([]string, 0, len(req.Header))
+	for k := range req.Header {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, k := range names {
+		b.WriteString(k)
+		b.WriteByte(':')
+		b.WriteString(strings.Join(req.Header[k], ","))
+		b.WriteByte('\n')
+	}
+	b.WriteString("oauth2:" + client.OAuth2.TokenURL + " " + client.OAuth2.ClientID + "\n")
+	b.WriteString("color:" + metadata.GetColor(ctx) + "\n")
+	b.WriteString("pressure:" + strconv.FormatBool(metadata.IsPressureTest(ctx)) + "\n")
+	b.WriteString("mirror:" + strconv.FormatBool(metadata.IsMirror(ctx)))
+
+	// 身份信息只以hash出现在key中
+	sum := sha256.Sum256([]byte(b.String()))
+	return req.URL.String() + "#" + hex.EncodeToString(sum[:16])
+}
+
+func (client *ApiClient) cacheFields(req *http.Request, start time.Time, cache string) []klog.Field {
+	end := time.Now()
+	return []klog.Field{
+		klog.String(klog.TopicType, klog.LogNameModule),
+		klog.String("prot", "http"),
+		klog.String("service", client.Service),
+		klog.String("method", req.Method),
+		klog.String("domain", client.getDomain()),
+		klog.String("requestUri", req.URL.Path),
+		klog.String("requestStartTime", utils.GetFormatRequestTime(start)),
+		klog.String("requestEndTime", utils.GetFormatRequestTime(end)),
+		klog.Float64("cost", utils.GetRequestCost(start, end)),
+		klog.String("cache", cache),
+	}
+}
+
+type cacheCall struct {
+	res    ApiResult
+	fields []klog.Field
+}
+
+func eTag(e *httpCacheEntry) string {
+	if e == nil {
+		return ""
+	}
+	return e.ETag
+}
+
+func lastModified(e *httpCacheEntry) string {
+	if e == nil {
+		return ""
+	}
+	return e.LastModified
+}
+
+func firstNonEmpty(s ...string) string {
+	for _, v := range s {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// 相同key的并发调用只执行一次
+type callGroup struct {
+	lock  sync.Mutex
+	calls map[string]*groupCall
+}
+
+type groupCall struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+}
+
+func (g *callGroup) Do(key string, fn func() (interface{}, error)) (v interface{}, shared bool, err error) {
+	g.lock.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*groupCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.lock.Unlock()
+		c.wg.Wait()
+		return c.val, true, c.err
+	}
+	c := new(groupCall)
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.lock.Unlock()
+
+	defer func() {
+		c.wg.Done()
+		g.lock.Lock()
+		delete(g.calls, key)
+		g.lock.Unlock()
+	}()
+	c.val, c.err = fn()
+	return c.val, false, c.err
+}
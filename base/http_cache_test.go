@@ -0,0 +1,159 @@
+package base
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/peerless6372/Lplot/utils/metadata"
+	"github.com/peerless6372/gin"
+)
+
+func TestCacheKey(t *testing.T) {
+	newReq := func(url string, header map[string]string) *http.Request {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		return req
+	}
+	newCtx := func(mark func(c *gin.Context)) *gin.Context {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+		if mark != nil {
+			mark(c)
+		}
+		return c
+	}
+	client := &ApiClient{Service: "svc"}
+	base := client.cacheKey(newCtx(nil), newReq("http://a/x?q=1", map[string]string{"Cookie": "uid=a"}))
+
+	cases := []struct {
+		name   string
+		client *ApiClient
+		ctx    *gin.Context
+		req    *http.Request
+		same   bool
+	}{
+		{"same request", client, newCtx(nil), newReq("http://a/x?q=1", map[string]string{"Cookie": "uid=a"}), true},
+		{"other query", client, newCtx(nil), newReq("http://a/x?q=2", map[string]string{"Cookie": "uid=a"}), false},
+		{"other cookie", client, newCtx(nil), newReq("http://a/x?q=1", map[string]string{"Cookie": "uid=b"}), false},
+		{"authorization", client, newCtx(nil), newReq("http://a/x?q=1", map[string]string{"Cookie": "uid=a", "Authorization": "Basic x"}), false},
+		{"oauth2 client", &ApiClient{Service: "svc", OAuth2: OAuth2Conf{TokenURL: "http://t", ClientID: "c"}},
+			newCtx(nil), newReq("http://a/x?q=1", map[string]string{"Cookie": "uid=a"}), false},
+		{"color", client, newCtx(func(c *gin.Context) { metadata.SetColor(c, "blue") }),
+			newReq("http://a/x?q=1", map[string]string{"Cookie": "uid=a"}), false},
+		{"pressure", client, newCtx(metadata.MarkPressureTest), newReq("http://a/x?q=1", map[string]string{"Cookie": "uid=a"}), false},
+		{"mirror", client, newCtx(metadata.MarkMirror), newReq("http://a/x?q=1", map[string]string{"Cookie": "uid=a"}), false},
+	}
+	for _, c := range cases {
+		key := c.client.cacheKey(c.ctx, c.req)
+		if (key == base) != c.same {
+			t.Errorf("%s: key %s, base %s", c.name, key, base)
+		}
+	}
+
+	// 身份信息不以明文出现在key中
+	if key := client.cacheKey(nil, newReq("http://a/x", map[string]string{"Authorization": "Bearer secret"})); len(key) != len("http://a/x#")+32 {
+		t.Errorf("key %s", key)
+	}
+}
+
+func TestCacheFreshness(t *testing.T) {
+	c := newHttpCache(HttpCacheConf{PathTTL: map[string]time.Duration{"/ttl": time.Minute, "/off": 0}}, nil)
+	cases := []struct {
+		name   string
+		path   string
+		header map[string]string
+		ttl    time.Duration
+		ok     bool
+	}{
+		{"max-age", "/x", map[string]string{"Cache-Control": "public, max-age=30"}, 30 * time.Second, true},
+		{"no-store", "/x", map[string]string{"Cache-Control": "no-store"}, 0, false},
+		{"private", "/x", map[string]string{"Cache-Control": "private, max-age=30"}, 0, false},
+		{"private with path ttl", "/ttl", map[string]string{"Cache-Control": "private"}, 0, false},
+		{"path ttl", "/ttl", nil, time.Minute, true},
+		{"path ttl disabled", "/off", map[string]string{"Cache-Control": "max-age=30"}, 0, false},
+		{"no-cache with etag", "/x", map[string]string{"Cache-Control": "no-cache", "ETag": `"v"`}, 0, true},
+		{"no-cache", "/x", map[string]string{"Cache-Control": "no-cache"}, 0, false},
+		{"max-age=0 with etag", "/x", map[string]string{"Cache-Control": "max-age=0", "ETag": `"v"`}, 0, true},
+		{"validator only", "/x", map[string]string{"Last-Modified": "Mon, 02 Jan 2006 15:04:05 GMT"}, 0, true},
+		{"expires passed", "/x", map[string]string{"Expires": "Mon, 02 Jan 2006 15:04:05 GMT"}, 0, false},
+		{"nothing", "/x", nil, 0, false},
+	}
+	for _, cs := range cases {
+		header := http.Header{}
+		for k, v := range cs.header {
+			header.Set(k, v)
+		}
+		ttl, ok := c.freshness(cs.path, header)
+		if ok != cs.ok || (ok && ttl != cs.ttl) {
+			t.Errorf("%s: got %v %v, want %v %v", cs.name, ttl, ok, cs.ttl, cs.ok)
+		}
+	}
+}
+
+func TestCachedGet(t *testing.T) {
+	var calls, revalidated int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.URL.Path == "/etag" && r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&revalidated, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+		if r.URL.Path == "/etag" {
+			w.Header().Set("ETag", `"v1"`)
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		_, _ = w.Write([]byte("body " + r.URL.Query().Get("u")))
+	}))
+	defer srv.Close()
+	c := &ApiClient{Service: "svc", Domain: srv.URL, Cache: HttpCacheConf{Enable: true}}
+
+	// 并发的相同请求合并为一次
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := c.HttpGet(nil, "/a", HttpRequestOptions{})
+			if err != nil || string(res.Response) != "body " {
+				t.Error(err, res)
+			}
+		}()
+	}
+	wg.Wait()
+
+	cases := []struct {
+		name        string
+		path        string
+		cookie      string
+		want        string
+		calls       int32
+		revalidated int32
+	}{
+		{"fresh hit", "/a", "", "body ", 1, 0},
+		{"other user", "/a?u=b", "uid=b", "body b", 2, 0},
+		{"etag miss", "/etag", "", "body ", 3, 0},
+		{"etag revalidated", "/etag", "", "body ", 4, 1},
+	}
+	for _, cs := range cases {
+		opts := HttpRequestOptions{}
+		if cs.cookie != "" {
+			opts.Headers = map[string]string{"Cookie": cs.cookie}
+		}
+		res, err := c.HttpGet(nil, cs.path, opts)
+		if err != nil || string(res.Response) != cs.want || res.HttpCode != http.StatusOK {
+			t.Errorf("%s: %v %v", cs.name, err, res)
+		}
+		if calls != cs.calls || revalidated != cs.revalidated {
+			t.Errorf("%s: calls %d revalidated %d", cs.name, calls, revalidated)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package base
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/peerless6372/Lplot/utils/metadata"
+	"github.com/peerless6372/gin"
+)
+
+// ColorInterceptor 透传泳道标记，请求所在泳道配置了实例时路由到该泳道，否则走默认泳道
+func ColorInterceptor() Interceptor {
+	return func(inv *Invocation, next Invoker) (*http.Response, error) {
+		color := metadata.GetColor(inv.Ctx)
+		if color == "" {
+			return next(inv)
+		}
+		inv.Request.Header.Set(HttpHeaderColor, color)
+
+		// 重试时轮询泳道内的实例
+		if endpoints := inv.Client.Colors[color]; len(endpoints) > 0 {
+			attempt := inv.Attempt - 1
+			if attempt < 0 {
+				attempt = 0
+			}
+			inv.Client.setEndpoint(inv.Request, endpoints[attempt%len(endpoints)])
+		}
+		return next(inv)
+	}
+}
+
+// 请求所在泳道的实例，泳道未配置时为默认实例
+func (client *ApiClient) colorEndpoints(ctx *gin.Context) []string {
+	if color := metadata.GetColor(ctx); color != "" {
+		if endpoints := client.Colors[color]; len(endpoints) > 0 {
+			return endpoints
+		}
+	}
+	return client.endpoints()
+}
+
+// 把请求改发到指定实例，实例地址带path前缀时替换原实例的前缀
+func (client *ApiClient) setEndpoint(req *http.Request, endpoint string) {
+	u, err := url.Parse(endpointURL(endpoint))
+	if err != nil {
+		return
+	}
+	path := client.relativePath(req.URL)
+	req.URL.Scheme, req.URL.Host = u.Scheme, u.Host
+	req.URL.Path = strings.TrimRight(u.Path, "/") + path
+	req.URL.RawPath = ""
+
+	// 调用方通过header显式指定的Host保持不变
+	if client.Host == "" && req.Header.Get("Host") == "" {
+		req.Host = defaultHost(req.URL)
+	}
+}
+
+// 去掉请求当前所在实例的path前缀
+func (client *ApiClient) relativePath(reqURL *url.URL) string {
+	endpoints := append([]string{client.Domain}, client.Endpoints...)
+	for _, es := range client.Colors {
+		endpoints = append(endpoints, es...)
+	}
+
+	path, prefix := reqURL.Path, ""
+	for _, e := range endpoints {
+		u, err := url.Parse(endpointURL(e))
+		if err != nil || u.Scheme != reqURL.Scheme || u.Host != reqURL.Host {
+			continue
+		}
+		p := strings.TrimRight(u.Path, "/")
+		if len(p) > len(prefix) && strings.HasPrefix(path, p) && (len(path) == len(p) || path[len(p)] == '/') {
+			prefix = p
+		}
+	}
+	return path[len(prefix):]
+}
@@ -0,0 +1,114 @@
+package base
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/peerless6372/Lplot/utils/metadata"
+	"github.com/peerless6372/gin"
+)
+
+func TestRelativePath(t *testing.T) {
+	client := &ApiClient{
+		Domain:    "http://a:80/v1/",
+		Endpoints: []string{"http://b:80"},
+		Colors:    map[string][]string{"blue": {"http://c:80/api", "http://c:80/api/v2"}},
+	}
+	cases := []struct {
+		url  string
+		want string
+	}{
+		{"http://a:80/v1/x/y", "/x/y"},
+		{"http://a:80/v1", ""},
+		{"http://a:80/v10/x", "/v10/x"},
+		{"http://b:80/v1/x", "/v1/x"},
+		{"http://c:80/api/x", "/x"},
+		{"http://c:80/api/v2/x", "/x"},
+		{"https://a:80/v1/x", "/v1/x"},
+		{"http://d:80/v1/x", "/v1/x"},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest(http.MethodGet, c.url, nil)
+		if got := client.relativePath(req.URL); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.url, got, c.want)
+		}
+	}
+}
+
+func TestSetEndpoint(t *testing.T) {
+	cases := []struct {
+		name     string
+		client   *ApiClient
+		url      string
+		host     string
+		endpoint string
+		want     string
+		wantHost string
+	}{
+		{"replace prefix", &ApiClient{Domain: "http://a/v1"}, "http://a/v1/x/y?q=1", "",
+			"http://b/api/v2/", "http://b/api/v2/x/y?q=1", ""},
+		{"back to domain", &ApiClient{Domain: "http://a/v1", Colors: map[string][]string{"blue": {"http://b/api/v2"}}},
+			"http://b/api/v2/x?q=1", "", "http://a/v1", "http://a/v1/x?q=1", ""},
+		{"no prefix", &ApiClient{Domain: "http://a"}, "http://a/x", "", "https://b:8443", "https://b:8443/x", ""},
+		{"escaped path", &ApiClient{Domain: "http://a/v1"}, "http://a/v1/x%2Fy", "", "http://b", "http://b/x/y", ""},
+		{"host header kept", &ApiClient{Domain: "http://a/v1"}, "http://a/v1/x", "custom.host",
+			"http://b/v2", "http://b/v2/x", "custom.host"},
+		{"unix socket", &ApiClient{Domain: "http://a"}, "http://a/x", "",
+			"unix:///tmp/color.sock", "", UnixDefaultHost},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest(http.MethodGet, c.url, nil)
+		if c.host != "" {
+			req.Header.Set("Host", c.host)
+			req.Host = c.host
+		}
+		c.client.setEndpoint(req, c.endpoint)
+		if c.want != "" && req.URL.String() != c.want {
+			t.Errorf("%s: url %s, want %s", c.name, req.URL.String(), c.want)
+		}
+		if req.Host != c.wantHost {
+			t.Errorf("%s: host %q, want %q", c.name, req.Host, c.wantHost)
+		}
+	}
+}
+
+func TestColorRouting(t *testing.T) {
+	mk := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if name == "blue-bad" {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			_, _ = w.Write([]byte(name + " " + r.URL.Path + " " + r.Header.Get(HttpHeaderColor)))
+		}))
+	}
+	def, blue, bad := mk("def"), mk("blue"), mk("blue-bad")
+	defer def.Close()
+	defer blue.Close()
+	defer bad.Close()
+	client := &ApiClient{Service: "svc", Domain: def.URL + "/v1", Retry: 1,
+		Colors: map[string][]string{"blue": {bad.URL + "/b1", blue.URL + "/b2"}}}
+
+	cases := []struct {
+		color string
+		want  string
+	}{
+		{"", "def /v1/a "},
+		// 泳道内重试时换到下一个实例，并替换path前缀
+		{"blue", "blue /b2/a blue"},
+		// 未配置实例的泳道走默认实例，标记继续透传
+		{"red", "def /v1/a red"},
+	}
+	for _, c := range cases {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+		if c.color != "" {
+			metadata.SetColor(ctx, c.color)
+		}
+		res, err := client.HttpGet(ctx, "/a", HttpRequestOptions{})
+		if err != nil || string(res.Response) != c.want {
+			t.Errorf("%s: got %v %v, want %q", c.color, res, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/peerless6372/Lplot/klog"
+)
+
+// 进程内DNS缓存配置
+type DNSCacheConf struct {
+	// 标准库解析拿不到记录的TTL，此时使用该值，默认30s
+	TTL time.Duration `yaml:"ttl"`
+	// TTL 上下限，默认[1s, 10m]
+	MinTTL time.Duration `yaml:"minTTL"`
+	MaxTTL time.Duration `yaml:"maxTTL"`
+	// 解析失败时，过期结果仍可使用的时长，默认10分钟
+	StaleTTL time.Duration `yaml:"staleTTL"`
+	// 单次解析超时，默认2s
+	LookupTimeout time.Duration `yaml:"lookupTimeout"`
+}
+
+// 域名解析函数，ttl<=0 表示未知，使用配置的TTL
+type DNSLookup func(ctx context.Context, host string) (addrs []net.IPAddr, ttl time.Duration, err error)
+
+func defaultDNSLookup(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	return addrs, 0, err
+}
+
+type dnsEntry struct {
+	addrs      []net.IPAddr
+	refreshAt  time.Time
+	expire     time.Time
+	staleUntil time.Time
+	// 轮询下标，使连接分散到各个地址
+	next       uint32
+	refreshing int32
+}
+
+// DNSResolver 缓存A/AAAA解析结果，临近过期时后台刷新，解析失败时使用过期结果
+type DNSResolver struct {
+	conf   DNSCacheConf
+	lookup DNSLookup
+
+	lock    sync.RWMutex
+	entries map[string]*dnsEntry
+	group   callGroup
+}
+
+func NewDNSResolver(conf DNSCacheConf, lookup DNSLookup) *DNSResolver {
+	if conf.TTL <= 0 {
+		conf.TTL = 30 * time.Second
+	}
+	if conf.MinTTL <= 0 {
+		conf.MinTTL = time.Second
+	}
+	if conf.MaxTTL <= 0 {
+		conf.MaxTTL = 10 * time.Minute
+	}
+	if conf.StaleTTL <= 0 {
+		conf.StaleTTL = 10 * time.Minute
+	}
+	if conf.LookupTimeout <= 0 {
+		conf.LookupTimeout = 2 * time.Second
+	}
+	if lookup == nil {
+		lookup = defaultDNSLookup
+	}
+	return &DNSResolver{
+		conf:    conf,
+		lookup:  lookup,
+		entries: make(map[string]*dnsEntry),
+	}
+}
+
+var globalResolver *DNSResolver
+
+// InitDNSCache 开启进程内DNS缓存，对之后初始化的ApiClient生效
+func InitDNSCache(conf DNSCacheConf) {
+	globalResolver = NewDNSResolver(conf, nil)
+}
+
+func (r *DNSResolver) get(host string) *dnsEntry {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.entries[host]
+}
+
+// Resolve 返回host的地址，cached 表示结果来自缓存
+func (r *DNSResolver) Resolve(ctx context.Context, host string) (addrs []net.IPAddr, cached bool, err error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, false, nil
+	}
+
+	now := time.Now()
+	e := r.get(host)
+	if e != nil && now.Before(e.expire) {
+		if !now.Before(e.refreshAt) && atomic.CompareAndSwapInt32(&e.refreshing, 0, 1) {
+			go r.refresh(host)
+		}
+		return e.addrs, true, nil
+	}
+
+	// 并发的解析合并为一次，解析使用独立的超时，避免首个调用方取消时其余调用方一起失败
+	done := make(chan dnsResult, 1)
+	go func() {
+		v, _, err := r.group.Do(host, func() (interface{}, error) {
+			return r.update(context.Background(), host)
+		})
+		done <- dnsResult{v: v, err: err}
+	}()
+	var res dnsResult
+	select {
+	case res = <-done:
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+	if err = res.err; err == nil {
+		return res.v.(*dnsEntry).addrs, false, nil
+	}
+
+	if e != nil && now.Before(e.staleUntil) {
+		klog.WarnLogger(nil, "dns lookup error, use stale answer: "+err.Error(),
+			klog.String(klog.TopicType, klog.LogNameModule),
+			klog.String("prot", "dns"),
+			klog.String("host", host))
+		return e.addrs, true, nil
+	}
+	return nil, false, err
+}
+
+type dnsResult struct {
+	v   interface{}
+	err error
+}
+
+func (r *DNSResolver) refresh(host string) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.conf.LookupTimeout)
+	defer cancel()
+
+	_, _, err := r.group.Do(host, func() (interface{}, error) {
+		return r.update(ctx, host)
+	})
+	if err != nil {
+		if e := r.get(host); e != nil {
+			atomic.StoreInt32(&e.refreshing, 0)
+		}
+		klog.WarnLogger(nil, "dns background refresh error: "+err.Error(),
+			klog.String(klog.TopicType, klog.LogNameModule),
+			klog.String("prot", "dns"),
+			klog.String("host", host))
+	}
+}
+
+func (r *DNSResolver) update(ctx context.Context, host string) (*dnsEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.conf.LookupTimeout)
+	defer cancel()
+
+	addrs, ttl, err := r.lookup(ctx, host)
+	if err == nil && len(addrs) == 0 {
+		err = errors.New("no such host: " + host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if ttl <= 0 {
+		ttl = r.conf.TTL
+	}
+	if ttl < r.conf.MinTTL {
+		ttl = r.conf.MinTTL
+	}
+	if ttl > r.conf.MaxTTL {
+		ttl = r.conf.MaxTTL
+	}
+
+	now := time.Now()
+	e := &dnsEntry{
+		addrs:      addrs,
+		refreshAt:  now.Add(ttl * 4 / 5),
+		expire:     now.Add(ttl),
+		staleUntil: now.Add(ttl + r.conf.StaleTTL),
+	}
+	if old := r.get(host); old != nil {
+		e.next = atomic.LoadUint32(&old.next)
+	}
+
+	r.lock.Lock()
+	r.entries[host] = e
+	r.lock.Unlock()
+	return e, nil
+}
+
+// 依次返回地址，起始位置轮询
+func (r *DNSResolver) ordered(host string, addrs []net.IPAddr) []net.IPAddr {
+	if len(addrs) < 2 {
+		return addrs
+	}
+	start := 0
+	if e := r.get(host); e != nil {
+		start = int(atomic.AddUint32(&e.next, 1) % uint32(len(addrs)))
+	}
+	out := make([]net.IPAddr, 0, len(addrs))
+	out = append(out, addrs[start:]...)
+	return append(out, addrs[:start]...)
+}
+
+// DialContext 使用缓存的解析结果建立连接，地址不通时尝试下一个
+// 主动触发 httptrace 的DNS回调，是否命中缓存记录在 HttpStat 的耗时统计中
+func (r *DNSResolver) DialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
+
+		trace := httptrace.ContextClientTrace(ctx)
+		if trace != nil && trace.DNSStart != nil {
+			trace.DNSStart(httptrace.DNSStartInfo{Host: host})
+		}
+		addrs, cached, err := r.Resolve(ctx, host)
+		if trace != nil && trace.DNSDone != nil {
+			trace.DNSDone(httptrace.DNSDoneInfo{Addrs: addrs, Err: err})
+		}
+		if t := timeTraceFrom(ctx); t != nil {
+			t.dnsCached = cached
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var lastErr error
+		for _, ip := range r.ordered(host, addrs) {
+			if !matchNetwork(network, ip.IP) {
+				continue
+			}
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		if lastErr == nil {
+			lastErr = errors.New("no suitable address found for " + host)
+		}
+		return nil, lastErr
+	}
+}
+
+func matchNetwork(network string, ip net.IP) bool {
+	switch network {
+	case "tcp4", "udp4":
+		return ip.To4() != nil
+	case "tcp6", "udp6":
+		return ip.To4() == nil
+	}
+	return true
+}
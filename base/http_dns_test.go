@@ -0,0 +1,165 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDNSResolve(t *testing.T) {
+	var lookups, fail int32
+	r := NewDNSResolver(DNSCacheConf{TTL: 100 * time.Millisecond, MinTTL: time.Millisecond, StaleTTL: 100 * time.Millisecond},
+		func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+			atomic.AddInt32(&lookups, 1)
+			if atomic.LoadInt32(&fail) == 1 {
+				return nil, 0, errors.New("dns down")
+			}
+			return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, 0, nil
+		})
+
+	cases := []struct {
+		name    string
+		sleep   time.Duration
+		fail    int32
+		err     bool
+		cached  bool
+		lookups int32
+	}{
+		{"first", 0, 0, false, false, 1},
+		{"cached", 0, 0, false, true, 1},
+		// 过期后解析失败，使用过期结果
+		{"stale", 110 * time.Millisecond, 1, false, true, 2},
+		{"stale expired", 110 * time.Millisecond, 1, true, false, 3},
+		{"recover", 0, 0, false, false, 4},
+		// 临近过期时返回缓存并后台刷新
+		{"refresh window", 85 * time.Millisecond, 0, false, true, 5},
+	}
+	for _, c := range cases {
+		time.Sleep(c.sleep)
+		atomic.StoreInt32(&fail, c.fail)
+		addrs, cached, err := r.Resolve(context.Background(), "svc.test")
+		time.Sleep(10 * time.Millisecond)
+		if (err != nil) != c.err || cached != c.cached || (err == nil && len(addrs) != 1) || atomic.LoadInt32(&lookups) != c.lookups {
+			t.Errorf("%s: addrs %v cached %v err %v lookups %d", c.name, addrs, cached, err, lookups)
+		}
+	}
+
+	// ip不解析
+	if addrs, cached, err := r.Resolve(context.Background(), "10.0.0.1"); err != nil || cached || addrs[0].IP.String() != "10.0.0.1" {
+		t.Errorf("ip: %v %v %v", addrs, cached, err)
+	}
+}
+
+func TestDNSOrdered(t *testing.T) {
+	r := NewDNSResolver(DNSCacheConf{}, func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		return []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}, {IP: net.ParseIP("10.0.0.2")}, {IP: net.ParseIP("10.0.0.3")}}, time.Minute, nil
+	})
+	addrs, _, _ := r.Resolve(context.Background(), "svc.test")
+	cases := []string{"10.0.0.2", "10.0.0.3", "10.0.0.1", "10.0.0.2"}
+	for i, want := range cases {
+		got := r.ordered("svc.test", addrs)
+		if len(got) != 3 || got[0].IP.String() != want {
+			t.Errorf("%d: got %v, want first %s", i, got, want)
+		}
+	}
+}
+
+func TestMatchNetwork(t *testing.T) {
+	cases := []struct {
+		network string
+		ip      string
+		want    bool
+	}{
+		{"tcp", "10.0.0.1", true},
+		{"tcp", "::1", true},
+		{"tcp4", "10.0.0.1", true},
+		{"tcp4", "::1", false},
+		{"tcp6", "10.0.0.1", false},
+		{"tcp6", "::1", true},
+	}
+	for _, c := range cases {
+		if got := matchNetwork(c.network, net.ParseIP(c.ip)); got != c.want {
+			t.Errorf("%s %s: got %v", c.network, c.ip, got)
+		}
+	}
+}
+
+func TestDNSDial(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	port := srv.URL[strings.LastIndex(srv.URL, ":"):]
+
+	var lookups int32
+	old := globalResolver
+	defer func() { globalResolver = old }()
+	// 第一个地址不通时尝试下一个
+	globalResolver = NewDNSResolver(DNSCacheConf{}, func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		atomic.AddInt32(&lookups, 1)
+		return []net.IPAddr{{IP: net.ParseIP("127.0.0.2")}, {IP: net.ParseIP("127.0.0.1")}}, time.Minute, nil
+	})
+
+	cases := []struct {
+		name    string
+		disable bool
+		lookups int32
+	}{
+		{"cache", false, 1},
+		{"disabled", true, 0},
+	}
+	for _, c := range cases {
+		atomic.StoreInt32(&lookups, 0)
+		client := &ApiClient{Service: "svc", Domain: "http://localhost" + port, HttpStat: true,
+			Transport: HttpTransportConf{MaxIdleConnsPerHost: -1, DisableDNSCache: c.disable}}
+		for i := 0; i < 3; i++ {
+			res, err := client.HttpGet(nil, "/", HttpRequestOptions{})
+			if err != nil || string(res.Response) != "ok" {
+				t.Fatalf("%s: %v %v", c.name, res, err)
+			}
+		}
+		if n := atomic.LoadInt32(&lookups); n != c.lookups {
+			t.Errorf("%s: lookups %d, want %d", c.name, n, c.lookups)
+		}
+	}
+}
+
+func TestDNSCoalescedCancel(t *testing.T) {
+	r := NewDNSResolver(DNSCacheConf{}, func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		select {
+		case <-time.After(100 * time.Millisecond):
+			return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, time.Minute, nil
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, _, err := r.Resolve(ctx, "svc.test"); err == nil {
+			t.Error("expect canceled")
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	done := make(chan error)
+	go func() {
+		_, _, err := r.Resolve(context.Background(), "svc.test")
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	// 首个调用方取消不影响合并的其他调用方
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,305 @@
+package base
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/peerless6372/Lplot/klog"
+	"github.com/peerless6372/gin"
+)
+
+// 对冲请求配置：主请求在 Delay 内未返回时，向另一个实例发起相同请求，先成功者胜出
+type HedgeConf struct {
+	Enable bool `yaml:"enable"`
+	// 固定对冲延迟，为0时使用近期请求耗时的p95
+	Delay time.Duration `yaml:"delay"`
+	// 动态延迟的下限，默认10ms
+	MinDelay time.Duration `yaml:"minDelay"`
+	// 单次调用最多额外发起的对冲请求数，默认1
+	MaxHedges int `yaml:"maxHedges"`
+	// 对冲请求占总请求的最大比例，默认0.1
+	Budget float64 `yaml:"budget"`
+}
+
+const (
+	hedgeLatencyWindow  = 128
+	hedgeLatencyMinSize = 20
+	hedgeBudgetMaxToken = 10
+)
+
+type hedger struct {
+	conf HedgeConf
+
+	lock      sync.Mutex
+	latencies []time.Duration
+	pos       int
+	tokens    float64
+}
+
+func newHedger(conf HedgeConf) *hedger {
+	if conf.MinDelay <= 0 {
+		conf.MinDelay = 10 * time.Millisecond
+	}
+	if conf.MaxHedges <= 0 {
+		conf.MaxHedges = 1
+	}
+	if conf.Budget <= 0 {
+		conf.Budget = 0.1
+	}
+	return &hedger{
+		conf:      conf,
+		latencies: make([]time.Duration, 0, hedgeLatencyWindow),
+	}
+}
+
+// 仅对幂等的读请求对冲
+func hedgeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+func (h *hedger) delay() time.Duration {
+	if h.conf.Delay > 0 {
+		return h.conf.Delay
+	}
+
+	h.lock.Lock()
+	if len(h.latencies) < hedgeLatencyMinSize {
+		h.lock.Unlock()
+		return h.conf.MinDelay
+	}
+	l := append([]time.Duration(nil), h.latencies...)
+	h.lock.Unlock()
+
+	sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+	d := l[len(l)*95/100]
+	if d < h.conf.MinDelay {
+		d = h.conf.MinDelay
+	}
+	return d
+}
+
+func (h *hedger) observe(d time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if len(h.latencies) < hedgeLatencyWindow {
+		h.latencies = append(h.latencies, d)
+	} else {
+		h.latencies[h.pos] = d
+		h.pos = (h.pos + 1) % hedgeLatencyWindow
+	}
+
+	// 每个主请求积累 Budget 个令牌，每次对冲消耗一个
+	h.tokens += h.conf.Budget
+	if h.tokens > hedgeBudgetMaxToken {
+		h.tokens = hedgeBudgetMaxToken
+	}
+}
+
+func (h *hedger) acquire() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.tokens < 1 {
+		return false
+	}
+	h.tokens--
+	return true
+}
+
+// 本次调用的对冲情况，追加到module日志中
+type hedgeStat struct {
+	attempts []string
+	winner   string
+}
+
+func (s *hedgeStat) fields() []klog.Field {
+	if s == nil || len(s.attempts) == 0 {
+		return nil
+	}
+	return []klog.Field{
+		klog.Int("hedges", len(s.attempts)),
+		klog.Strings("hedgeAttempts", s.attempts),
+		klog.String("hedgeWinner", s.winner),
+	}
+}
+
+type hedgeResult struct {
+	index    int
+	resp     *http.Response
+	err      error
+	endpoint string
+}
+
+// 响应体关闭时才取消请求的ctx，避免胜出请求的body被提前中断
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// 对冲请求只在当前泳道的实例间进行
+// 实例地址可能带path前缀，请求所在实例与配置的实例统一为 scheme://host/前缀 后比较
+func (client *ApiClient) hedgeEndpoints(ctx *gin.Context, req *http.Request) []string {
+	path := req.URL.Path
+	current := req.URL.Scheme + "://" + req.URL.Host + path[:len(path)-len(client.relativePath(req.URL))]
+	endpoints := []string{current}
+	for _, e := range client.colorEndpoints(ctx) {
+		if e = normalizeEndpoint(e); e != "" && e != current {
+			endpoints = append(endpoints, e)
+		}
+	}
+	return endpoints
+}
+
+func normalizeEndpoint(endpoint string) string {
+	u, err := url.Parse(endpointURL(endpoint))
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host + strings.TrimRight(u.Path, "/")
+}
+
+func (client *ApiClient) hedgedDo(ctx *gin.Context, req *http.Request, stat *hedgeStat) (*http.Response, error) {
+	h := client.hedger
+	hc := client.httpClient(req.URL.Path)
+	start := time.Now()
+	endpoints := client.hedgeEndpoints(ctx, req)
+	total := 1 + h.conf.MaxHedges
+
+	// 开启HttpStat时每个请求单独统计耗时，胜出请求的结果写回原统计
+	mainTrace := timeTraceFrom(req.Context())
+	traces := make([]*timeTrace, 0, total)
+
+	results := make(chan hedgeResult, total)
+	cancels := make([]context.CancelFunc, 0, total)
+	launch := func(i int) {
+		endpoint := endpoints[i%len(endpoints)]
+		base := req.Context()
+		if mainTrace != nil {
+			// beforeHttpStat 的ctx只包含耗时统计，不能在其上叠加trace，否则会回调原统计
+			t := &timeTrace{}
+			traces = append(traces, t)
+			base = withTimeTrace(t)
+		}
+		cctx, cancel := context.WithCancel(base)
+		cancels = append(cancels, cancel)
+		r := req.Clone(cctx)
+		var signErr error
+		if i > 0 {
+			client.setEndpoint(r, endpoint)
+			if req.GetBody != nil {
+				r.Body, _ = req.GetBody()
+			}
+			// 签名的nonce不能重复，否则对冲请求会被下游当作重放拒绝
+			if client.signEnable() {
+				signErr = client.signRequest(r, &HttpRequestOptions{})
+			}
+			stat.attempts = append(stat.attempts, endpoint)
+			klog.InfoLogger(ctx, "http hedge request",
+				klog.String(klog.TopicType, klog.LogNameModule),
+				klog.String("prot", "http"),
+				klog.String("service", client.Service),
+				klog.String("requestUri", req.URL.Path),
+				klog.String("hedgeEndpoint", endpoint),
+				klog.Int("hedgeAttempt", i))
+		}
+		go func() {
+			if signErr != nil {
+				results <- hedgeResult{index: i, err: signErr, endpoint: endpoint}
+				return
+			}
+			resp, err := hc.Do(r)
+			results <- hedgeResult{index: i, resp: resp, err: err, endpoint: endpoint}
+		}()
+	}
+
+	launch(0)
+	launched, pending := 1, 1
+	timer := time.NewTimer(h.delay())
+	defer timer.Stop()
+
+	var last hedgeResult
+	for {
+		select {
+		case <-timer.C:
+			if launched < total && h.acquire() {
+				launch(launched)
+				launched++
+				pending++
+				timer.Reset(h.delay())
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil && res.resp.StatusCode < http.StatusInternalServerError {
+				h.observe(time.Since(start))
+				if len(stat.attempts) > 0 {
+					stat.winner = res.endpoint
+				}
+				// 取消其余仍在进行的请求
+				for i, cancel := range cancels {
+					if i != res.index {
+						cancel()
+					}
+				}
+				if last.resp != nil {
+					drainAndCloseBody(last.resp, 16384)
+				}
+				res.resp.Body = &cancelBody{ReadCloser: res.resp.Body, cancel: cancels[res.index]}
+				if mainTrace != nil {
+					*mainTrace = *traces[res.index]
+				}
+				go discardHedgeResults(results, pending)
+				return res.resp, nil
+			}
+
+			if last.resp != nil {
+				drainAndCloseBody(last.resp, 16384)
+				cancels[last.index]()
+			}
+			last = res
+			if pending > 0 {
+				continue
+			}
+			if launched < total && h.acquire() {
+				launch(launched)
+				launched++
+				pending++
+				continue
+			}
+			if last.resp != nil {
+				last.resp.Body = &cancelBody{ReadCloser: last.resp.Body, cancel: cancels[last.index]}
+			} else {
+				cancels[last.index]()
+			}
+			if mainTrace != nil {
+				*mainTrace = *traces[last.index]
+			}
+			return last.resp, last.err
+		}
+	}
+}
+
+// 回收未胜出的请求，释放连接
+func discardHedgeResults(results chan hedgeResult, pending int) {
+	for ; pending > 0; pending-- {
+		res := <-results
+		if res.resp != nil {
+			drainAndCloseBody(res.resp, 16384)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package base
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/peerless6372/Lplot/utils/metadata"
+	"github.com/peerless6372/gin"
+)
+
+func TestHedgeEndpoints(t *testing.T) {
+	cases := []struct {
+		name      string
+		endpoints []string
+		colors    map[string][]string
+		color     string
+		url       string
+		want      []string
+	}{
+		{"no prefix", []string{"http://a:80", "http://b:80/"}, nil, "",
+			"http://a:80/x", []string{"http://a:80", "http://b:80"}},
+		{"path prefix", []string{"http://a:80/api/", "http://b:80/v1"}, nil, "",
+			"http://a:80/api/x", []string{"http://a:80/api", "http://b:80/v1"}},
+		{"current is second", []string{"http://a:80/api", "http://b:80/v1"}, nil, "",
+			"http://b:80/v1/x", []string{"http://b:80/v1", "http://a:80/api"}},
+		{"same host other prefix", []string{"http://a:80/api", "http://a:80/api/v2"}, nil, "",
+			"http://a:80/api/v2/x", []string{"http://a:80/api/v2", "http://a:80/api"}},
+		{"prefix not on segment", []string{"http://a:80/api", "http://b:80"}, nil, "",
+			"http://a:80/apix", []string{"http://a:80", "http://a:80/api", "http://b:80"}},
+		{"color", []string{"http://a:80/api"}, map[string][]string{"blue": {"http://c:80/p", "http://d:80/p"}}, "blue",
+			"http://c:80/p/x", []string{"http://c:80/p", "http://d:80/p"}},
+		{"color not configured", []string{"http://a:80/api", "http://b:80/api"}, map[string][]string{"blue": {"http://c:80"}}, "green",
+			"http://a:80/api/x", []string{"http://a:80/api", "http://b:80/api"}},
+	}
+	for _, c := range cases {
+		client := &ApiClient{Service: "svc", Endpoints: c.endpoints, Colors: c.colors}
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+		if c.color != "" {
+			metadata.SetColor(ctx, c.color)
+		}
+		req := httptest.NewRequest(http.MethodGet, c.url, nil)
+		if got := client.hedgeEndpoints(ctx, req); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestHedgeEndpointPrefix(t *testing.T) {
+	paths := make(chan string, 4)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- "slow " + r.URL.Path
+		select {
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+		}
+		_, _ = w.Write([]byte("slow"))
+	}))
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- "fast " + r.URL.Path
+		_, _ = w.Write([]byte("fast"))
+	}))
+	defer slow.Close()
+	defer fast.Close()
+
+	// 对冲请求发到另一实例并替换path前缀，不会再发回当前实例
+	c := &ApiClient{Service: "svc", Endpoints: []string{slow.URL + "/a", fast.URL + "/b"},
+		Hedge: HedgeConf{Enable: true, Delay: 20 * time.Millisecond, Budget: 1}}
+	if err := c.lazyInit(); err != nil {
+		t.Fatal(err)
+	}
+	c.hedger.tokens = 5
+	res, err := c.HttpGet(nil, "/x", HttpRequestOptions{})
+	if err != nil || string(res.Response) != "fast" {
+		t.Fatal(err, res)
+	}
+	if got := []string{<-paths, <-paths}; got[0] != "slow /a/x" || got[1] != "fast /b/x" {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestHedgeResign(t *testing.T) {
+	var lock sync.Mutex
+	nonces := map[string]bool{}
+	handler := func(delay time.Duration) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			n := r.Header.Get(HttpHeaderNonce)
+			dup := nonces[n]
+			nonces[n] = true
+			lock.Unlock()
+			if dup || n == "" {
+				_, _ = w.Write([]byte("replay"))
+				return
+			}
+			time.Sleep(delay)
+			_, _ = w.Write([]byte("ok"))
+		}
+	}
+	slow := httptest.NewServer(handler(300 * time.Millisecond))
+	fast := httptest.NewServer(handler(0))
+	defer slow.Close()
+	defer fast.Close()
+
+	// 对冲请求重新签名，nonce与原请求不同
+	c := &ApiClient{Service: "svc", AppKey: "k", AppSecret: "s", HttpStat: true, Endpoints: []string{slow.URL, fast.URL},
+		Hedge: HedgeConf{Enable: true, Delay: 20 * time.Millisecond, Budget: 1}}
+	if err := c.lazyInit(); err != nil {
+		t.Fatal(err)
+	}
+	c.hedger.tokens = 5
+	res, err := c.HttpGet(nil, "/", HttpRequestOptions{})
+	lock.Lock()
+	defer lock.Unlock()
+	if err != nil || string(res.Response) != "ok" || len(nonces) != 2 {
+		t.Errorf("got %v %v nonces %v", res, err, nonces)
+	}
+}
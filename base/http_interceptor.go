@@ -0,0 +1,204 @@
+package base
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/peerless6372/Lplot/env"
+	"github.com/peerless6372/Lplot/klog"
+	"github.com/peerless6372/Lplot/trace"
+	"github.com/peerless6372/Lplot/utils/metadata"
+	"github.com/peerless6372/gin"
+)
+
+// Invocation 一次ApiClient调用的上下文，在拦截器链中传递
+type Invocation struct {
+	Ctx     *gin.Context
+	Client  *ApiClient
+	Request *http.Request
+	Options *HttpRequestOptions
+	// 当前是第几次尝试，从1开始，由重试拦截器维护
+	Attempt int
+
+	// 重试次数用尽时仍命中重试策略
+	retryHit bool
+	hedge    hedgeStat
+}
+
+type Invoker func(inv *Invocation) (*http.Response, error)
+
+// Interceptor 调用 next 发出请求，可在前后读取/修改请求、响应或错误
+type Interceptor func(inv *Invocation, next Invoker) (*http.Response, error)
+
+var globalInterceptors []Interceptor
+
+// RegisterInterceptor 注册全局拦截器，对所有ApiClient生效，需在发起请求前调用
+func RegisterInterceptor(interceptors ...Interceptor) {
+	globalInterceptors = append(globalInterceptors, interceptors...)
+}
+
+// Use 追加client级别的拦截器，需在首次请求前调用
+func (client *ApiClient) Use(interceptors ...Interceptor) {
+	client.Interceptors = append(client.Interceptors, interceptors...)
+}
+
+// 拦截器顺序：重试 -> 链路header -> 压测/镜像标记 -> 泳道 -> 日志 -> 全局 -> client -> oauth2 -> 签名 -> 发送
+// 重试之后的拦截器每次尝试都会执行
+func (client *ApiClient) buildInvoker() Invoker {
+	interceptors := []Interceptor{
+		RetryInterceptor(),
+		TraceHeaderInterceptor(),
+		PressureTestInterceptor(),
+		MirrorInterceptor(),
+		ColorInterceptor(),
+		LogInterceptor(),
+	}
+	interceptors = append(interceptors, globalInterceptors...)
+	interceptors = append(interceptors, client.Interceptors...)
+	if client.tokens != nil {
+		interceptors = append(interceptors, oauth2Interceptor)
+	}
+	if client.signEnable() {
+		interceptors = append(interceptors, signInterceptor)
+	}
+
+	invoker := client.send
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(inv *Invocation) (*http.Response, error) {
+			return interceptor(inv, next)
+		}
+	}
+	return invoker
+}
+
+// 链路末端，真正发出请求
+func (client *ApiClient) send(inv *Invocation) (*http.Response, error) {
+	if inv.Options.stream {
+		return client.streamClient.Do(inv.Request)
+	}
+	if client.hedger != nil && hedgeMethod(inv.Request.Method) {
+		return client.hedgedDo(inv.Ctx, inv.Request, &inv.hedge)
+	}
+	return client.httpClient(inv.Request.URL.Path).Do(inv.Request)
+}
+
+// RetryInterceptor 按 RetryPolicy/BackOffPolicy 重试，最多重试 client.Retry 次(可按path覆盖)
+func RetryInterceptor() Interceptor {
+	return func(inv *Invocation, next Invoker) (*http.Response, error) {
+		retry := inv.Client.retry(inv.Request.URL.Path)
+		retryPolicy := inv.Options.GetRetryPolicy()
+		backOffPolicy := inv.Options.GetBackOffPolicy()
+
+		// 不可重放的流式请求体只发送一次
+		if req := inv.Request; inv.Options.stream && req.GetBody == nil && req.Body != nil {
+			inv.Attempt++
+			return next(inv)
+		}
+
+		var dataBuffer *bytes.Reader
+		for {
+			req := inv.Request
+			if req.GetBody != nil {
+				bodyReadCloser, _ := req.GetBody()
+				req.Body = bodyReadCloser
+			} else if req.Body != nil {
+				if dataBuffer == nil {
+					data, err := ioutil.ReadAll(req.Body)
+					_ = req.Body.Close()
+					if err != nil {
+						return nil, err
+					}
+					dataBuffer = bytes.NewReader(data)
+					req.ContentLength = int64(dataBuffer.Len())
+					req.Body = ioutil.NopCloser(dataBuffer)
+				}
+				_, _ = dataBuffer.Seek(0, io.SeekStart)
+			}
+
+			inv.Attempt++
+			resp, err := next(inv)
+
+			inv.retryHit = retryPolicy(resp, err)
+			if !inv.retryHit || inv.Attempt > retry {
+				return resp, err
+			}
+
+			if err == nil {
+				drainAndCloseBody(resp, 16384)
+			}
+			wait := backOffPolicy(inv.Attempt)
+			select {
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			case <-time.After(wait):
+			}
+		}
+	}
+}
+
+// TraceHeaderInterceptor 透传调用方服务名、requestId与traceparent
+func TraceHeaderInterceptor() Interceptor {
+	return func(inv *Invocation, next Invoker) (*http.Response, error) {
+		inv.Request.Header.Set(HttpHeaderService, env.AppName)
+		requestId := klog.GetRequestID(inv.Ctx)
+		inv.Request.Header.Set(klog.TraceHeaderKey, requestId)
+		inv.Request.Header.Set(klog.LogIDHeaderKey, requestId)
+		// httpDo 已注入client span，其余请求(如流式请求)透传当前span
+		if inv.Request.Header.Get(trace.HeaderTraceparent) == "" {
+			trace.SpanFromContext(inv.Ctx).Inject(inv.Request.Header)
+		}
+		return next(inv)
+	}
+}
+
+// PressureTestInterceptor 压测流量调用下游时带上压测标记
+func PressureTestInterceptor() Interceptor {
+	return func(inv *Invocation, next Invoker) (*http.Response, error) {
+		if metadata.IsPressureTest(inv.Ctx) {
+			inv.Request.Header.Set(HttpHeaderPressureTest, "1")
+		}
+		return next(inv)
+	}
+}
+
+// MirrorInterceptor 镜像流量调用下游时带上镜像标记
+func MirrorInterceptor() Interceptor {
+	return func(inv *Invocation, next Invoker) (*http.Response, error) {
+		if metadata.IsMirror(inv.Ctx) {
+			inv.Request.Header.Set(HttpHeaderMirror, "1")
+		}
+		return next(inv)
+	}
+}
+
+// LogInterceptor 每次尝试失败时打印warn日志
+func LogInterceptor() Interceptor {
+	return func(inv *Invocation, next Invoker) (*http.Response, error) {
+		resp, err := next(inv)
+		if err != nil {
+			client := inv.Client
+			f := []klog.Field{
+				klog.String(klog.TopicType, klog.LogNameModule),
+				klog.String("prot", "http"),
+				klog.String("service", client.Service),
+				klog.String("requestUri", inv.Request.URL.Path),
+				klog.Duration("timeout", client.timeout(inv.Request.URL.Path)),
+				klog.Int("attemptCount", inv.Attempt),
+			}
+			klog.WarnLogger(inv.Ctx, err.Error(), f...)
+		}
+		return resp, err
+	}
+}
+
+// 每次尝试重新签名，保证重试时nonce不重复
+func signInterceptor(inv *Invocation, next Invoker) (*http.Response, error) {
+	if err := inv.Client.signRequest(inv.Request, inv.Options); err != nil {
+		return nil, err
+	}
+	return next(inv)
+}
@@ -0,0 +1,138 @@
+package base
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/peerless6372/Lplot/klog"
+	"github.com/peerless6372/Lplot/utils/metadata"
+	"github.com/peerless6372/gin"
+)
+
+func TestInterceptorOrder(t *testing.T) {
+	var hits int32
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		if atomic.AddInt32(&hits, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	old := globalInterceptors
+	defer func() { globalInterceptors = old }()
+	var calls []string
+	record := func(name string) Interceptor {
+		return func(inv *Invocation, next Invoker) (*http.Response, error) {
+			// 内置拦截器在全局/client拦截器之前执行
+			calls = append(calls, fmt.Sprintf("%s %d %v", name, inv.Attempt, inv.Request.Header.Get(klog.TraceHeaderKey) != ""))
+			return next(inv)
+		}
+	}
+	globalInterceptors = []Interceptor{record("global")}
+	client := &ApiClient{Service: "svc", Domain: srv.URL, Retry: 1}
+	client.Use(record("client1"), record("client2"))
+
+	res, err := client.HttpPost(nil, "/a", HttpRequestOptions{Data: map[string]string{"k": "v"}})
+	if err != nil || string(res.Response) != "ok" {
+		t.Fatalf("got %v %v", res, err)
+	}
+	want := []string{"global 1 true", "client1 1 true", "client2 1 true", "global 2 true", "client1 2 true", "client2 2 true"}
+	if strings.Join(calls, ",") != strings.Join(want, ",") {
+		t.Errorf("calls %v, want %v", calls, want)
+	}
+	// 重试时请求体重新发送
+	if len(bodies) != 2 || bodies[0] != "k=v" || bodies[1] != "k=v" {
+		t.Errorf("bodies %q", bodies)
+	}
+}
+
+func TestRetryAttempts(t *testing.T) {
+	var hits, failN int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) <= atomic.LoadInt32(&failN) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	zero, one := 0, 1
+	client := &ApiClient{Service: "svc", Domain: srv.URL, Retry: 2, Paths: map[string]ApiPathConf{
+		"/noretry": {Retry: &zero},
+		"/slow/*":  {Retry: &one},
+	}}
+	never := func(resp *http.Response, err error) bool { return false }
+
+	cases := []struct {
+		name   string
+		path   string
+		fail   int32
+		policy RetryPolicy
+		hits   int32
+		ok     bool
+	}{
+		{"success", "/a", 0, nil, 1, true},
+		{"retry then success", "/a", 1, nil, 2, true},
+		{"retry exhausted", "/a", 10, nil, 3, false},
+		// path级别覆盖重试次数
+		{"path no retry", "/noretry", 10, nil, 1, false},
+		{"path prefix", "/slow/x", 10, nil, 2, false},
+		{"custom policy", "/a", 10, never, 1, false},
+	}
+	for _, c := range cases {
+		atomic.StoreInt32(&hits, 0)
+		atomic.StoreInt32(&failN, c.fail)
+		res, err := client.HttpGet(nil, c.path, HttpRequestOptions{RetryPolicy: c.policy})
+		ok := err == nil && res.HttpCode == http.StatusOK
+		if ok != c.ok || atomic.LoadInt32(&hits) != c.hits {
+			t.Errorf("%s: ok %v hits %d, want %v %d", c.name, ok, hits, c.ok, c.hits)
+		}
+	}
+}
+
+func TestFlagHeaders(t *testing.T) {
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer srv.Close()
+
+	client := &ApiClient{Service: "svc", Domain: srv.URL}
+	cases := []struct {
+		name   string
+		mark   func(*gin.Context)
+		header string
+		want   string
+	}{
+		{"normal", func(*gin.Context) {}, HttpHeaderPressureTest, ""},
+		// 压测流量调用下游时带上压测标记
+		{"pressure", metadata.MarkPressureTest, HttpHeaderPressureTest, "1"},
+		{"not mirror", func(*gin.Context) {}, HttpHeaderMirror, ""},
+		// 镜像流量调用下游时带上镜像标记
+		{"mirror", metadata.MarkMirror, HttpHeaderMirror, "1"},
+	}
+	for _, c := range cases {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+		c.mark(ctx)
+		got = nil
+		if _, err := client.HttpGet(ctx, "/a", HttpRequestOptions{}); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if v := got.Get(c.header); v != c.want {
+			t.Errorf("%s: %s = %q, want %q", c.name, c.header, v, c.want)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package base
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/peerless6372/Lplot/metrics"
+)
+
+// 下游调用的RED指标，code 为http状态码，没有拿到响应时为 error
+var (
+	clientRequests = metrics.NewCounterVec("http_client_requests_total",
+		"Total outbound http requests made by ApiClient.", "service", "path", "method", "code")
+	clientDuration = metrics.NewHistogramVec("http_client_request_duration_seconds",
+		"Outbound http request latency in seconds, retries included.", nil, "service", "path", "method")
+)
+
+// path标签取值有限：调用方指定的模板或 Paths 中匹配的key，其余为 other，避免请求path导致指标无限增长
+func (client *ApiClient) metricPath(path string, opts *HttpRequestOptions) string {
+	if opts != nil && opts.PathTemplate != "" {
+		return opts.PathTemplate
+	}
+	if key, ok := client.pathKey(path); ok {
+		return key
+	}
+	return "other"
+}
+
+func (client *ApiClient) observe(method, path string, code int, start time.Time) {
+	c := "error"
+	if code > 0 {
+		c = strconv.Itoa(code)
+	}
+	clientRequests.With(client.Service, path, method, c).Inc()
+	clientDuration.With(client.Service, path, method).Observe(time.Since(start).Seconds())
+}
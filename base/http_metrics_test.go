@@ -0,0 +1,89 @@
+package base
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/peerless6372/Lplot/metrics"
+)
+
+func TestMetricPath(t *testing.T) {
+	client := &ApiClient{Paths: map[string]ApiPathConf{"/a": {}, "/u/*": {}}}
+	cases := []struct {
+		path string
+		opts *HttpRequestOptions
+		want string
+	}{
+		{"/a", nil, "/a"},
+		{"/u/1", &HttpRequestOptions{}, "/u/*"},
+		// 未配置的path归为other，避免label无限增长
+		{"/zz", nil, "other"},
+		{"/zz", &HttpRequestOptions{PathTemplate: "/z/:id"}, "/z/:id"},
+		{"/u/1", &HttpRequestOptions{PathTemplate: "/u/:id"}, "/u/:id"},
+	}
+	for _, c := range cases {
+		if got := client.metricPath(c.path, c.opts); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.path, got, c.want)
+		}
+	}
+}
+
+// 读取指标当前值，指标为全局累计，按前后差值断言
+func metricValue(series string) float64 {
+	var b bytes.Buffer
+	_ = metrics.DefaultRegistry.WriteText(&b)
+	for _, line := range strings.Split(b.String(), "\n") {
+		if strings.HasPrefix(line, series+" ") {
+			v, _ := strconv.ParseFloat(strings.TrimPrefix(line, series+" "), 64)
+			return v
+		}
+	}
+	return 0
+}
+
+func TestClientMetrics(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	cases := []struct {
+		series string
+		want   float64
+	}{
+		{`http_client_requests_total{service="metric-svc",path="/ok",method="GET",code="200"}`, 3},
+		{`http_client_requests_total{service="metric-svc",path="other",method="GET",code="500"}`, 1},
+		{`http_client_requests_total{service="metric-svc",path="/u/:id",method="GET",code="200"}`, 1},
+		// 没有拿到响应时code为error
+		{`http_client_requests_total{service="metric-down",path="other",method="GET",code="error"}`, 1},
+		{`http_client_request_duration_seconds_count{service="metric-svc",path="/ok",method="GET"}`, 3},
+	}
+	before := make([]float64, len(cases))
+	for i, c := range cases {
+		before[i] = metricValue(c.series)
+	}
+
+	client := &ApiClient{Service: "metric-svc", Domain: srv.URL, Paths: map[string]ApiPathConf{"/ok": {}}}
+	down := &ApiClient{Service: "metric-down", Domain: "http://127.0.0.1:1"}
+	_, _ = client.HttpGet(nil, "/ok", HttpRequestOptions{})
+	_, _ = client.HttpGet(nil, "/ok", HttpRequestOptions{})
+	_, _ = client.HttpGet(nil, "/fail", HttpRequestOptions{})
+	_, _ = client.HttpGet(nil, "/u/1", HttpRequestOptions{PathTemplate: "/u/:id"})
+	s, err := client.HttpStream(nil, http.MethodGet, "/ok", HttpRequestOptions{})
+	if err == nil {
+		_ = s.Body.Close()
+	}
+	_, _ = down.HttpGet(nil, "/x", HttpRequestOptions{})
+
+	for i, c := range cases {
+		if got := metricValue(c.series) - before[i]; got != c.want {
+			t.Errorf("%s: got %v, want %v", c.series, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package base
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/peerless6372/Lplot/klog"
+	"github.com/peerless6372/Lplot/redis"
+	"github.com/peerless6372/Lplot/utils"
+	"github.com/peerless6372/gin"
+)
+
+// OAuth2 client credentials 模式获取token，配置 tokenURL 后生效
+type OAuth2Conf struct {
+	TokenURL     string   `yaml:"tokenURL"`
+	ClientID     string   `yaml:"clientID"`
+	ClientSecret string   `yaml:"clientSecret"`
+	Scopes       []string `yaml:"scopes"`
+	// 额外的表单参数，如 audience / resource
+	Params map[string]string `yaml:"params"`
+	// client凭证放在表单参数中，默认使用basic auth
+	AuthInParams bool `yaml:"authInParams"`
+	// 距过期多久开始刷新，默认60s
+	EarlyExpiry time.Duration `yaml:"earlyExpiry"`
+	// 通过redis共享token时的key前缀，默认 oauth2:token:
+	RedisPrefix string `yaml:"redisPrefix"`
+}
+
+func (conf OAuth2Conf) enable() bool {
+	return conf.TokenURL != ""
+}
+
+type oauth2Token struct {
+	AccessToken string    `json:"accessToken"`
+	TokenType   string    `json:"tokenType"`
+	Expiry      time.Time `json:"expiry"`
+}
+
+// 距过期超过 early 时认为可用，未返回过期时间的token一直可用
+func (t *oauth2Token) valid(early time.Duration) bool {
+	if t == nil || t.AccessToken == "" {
+		return false
+	}
+	return t.Expiry.IsZero() || time.Now().Add(early).Before(t.Expiry)
+}
+
+func (t *oauth2Token) header() string {
+	typ := t.TokenType
+	if typ == "" || strings.EqualFold(typ, "bearer") {
+		typ = "Bearer"
+	}
+	return typ + " " + t.AccessToken
+}
+
+type tokenSource struct {
+	conf    OAuth2Conf
+	service string
+	hc      *http.Client
+	redis   *redis.Redis
+
+	lock  sync.RWMutex
+	token *oauth2Token
+	group callGroup
+}
+
+func newTokenSource(client *ApiClient) *tokenSource {
+	conf := client.OAuth2
+	if conf.EarlyExpiry <= 0 {
+		conf.EarlyExpiry = 60 * time.Second
+	}
+	if conf.RedisPrefix == "" {
+		conf.RedisPrefix = "oauth2:token:"
+	}
+	return &tokenSource{
+		conf:    conf,
+		service: client.Service,
+		redis:   client.TokenRedis,
+		hc: &http.Client{
+			Timeout:   client.timeout(""),
+			Transport: oauth2Transport(client.HTTPClient.Transport),
+		},
+	}
+}
+
+// token接口中的client凭证与token，录制时不落盘明文
+var oauth2RedactParams = []string{"client_secret", "client_assertion", "assertion", "access_token", "refresh_token", "id_token"}
+
+// 录制回放时token接口同样录制(回放时不访问网络)，凭证与token显式脱敏
+func oauth2Transport(rt http.RoundTripper) http.RoundTripper {
+	if t, ok := rt.(*replayTransport); ok {
+		return t.withRedactParams(oauth2RedactParams...)
+	}
+	return rt
+}
+
+func (s *tokenSource) current() *oauth2Token {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.token
+}
+
+// Token 返回可用的token，即将过期时刷新，并发刷新只请求一次
+func (s *tokenSource) Token(ctx *gin.Context) (*oauth2Token, error) {
+	if t := s.current(); t.valid(s.conf.EarlyExpiry) {
+		return t, nil
+	}
+
+	v, _, err := s.group.Do("token", func() (interface{}, error) {
+		old := s.current()
+		if old.valid(s.conf.EarlyExpiry) {
+			return old, nil
+		}
+
+		if t := s.loadShared(ctx); t.valid(s.conf.EarlyExpiry) {
+			s.set(t)
+			return t, nil
+		}
+
+		t, err := s.fetch(ctx)
+		if err != nil {
+			// 刷新失败但旧token尚未过期时继续使用
+			if old.valid(0) {
+				return old, nil
+			}
+			return nil, err
+		}
+		s.set(t)
+		s.saveShared(ctx, t)
+		return t, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*oauth2Token), nil
+}
+
+func (s *tokenSource) set(t *oauth2Token) {
+	s.lock.Lock()
+	s.token = t
+	s.lock.Unlock()
+}
+
+// 服务端拒绝token(401)时丢弃，已被其他请求刷新过则不处理
+func (s *tokenSource) invalidate(ctx *gin.Context, bad *oauth2Token) {
+	s.lock.Lock()
+	if s.token != nil && s.token.AccessToken == bad.AccessToken {
+		s.token = nil
+	}
+	s.lock.Unlock()
+
+	if s.redis == nil {
+		return
+	}
+	if t := s.loadShared(ctx); t != nil && t.AccessToken == bad.AccessToken {
+		_, _ = s.redis.Del(ctx, s.redisKey())
+	}
+}
+
+func (s *tokenSource) redisKey() string {
+	return s.conf.RedisPrefix + s.service + ":" + s.conf.ClientID
+}
+
+// redis中的token使用clientSecret加密，避免redis日志(commandVal)中出现明文
+func (s *tokenSource) loadShared(ctx *gin.Context) *oauth2Token {
+	if s.redis == nil {
+		return nil
+	}
+	v, err := s.redis.Get(ctx, s.redisKey())
+	if err != nil || len(v) == 0 {
+		return nil
+	}
+	data, err := utils.Rc4DecodeBytes([]byte(s.conf.ClientSecret), string(v))
+	if err != nil {
+		return nil
+	}
+	var t oauth2Token
+	if err = json.Unmarshal(data, &t); err != nil {
+		return nil
+	}
+	return &t
+}
+
+func (s *tokenSource) saveShared(ctx *gin.Context, t *oauth2Token) {
+	if s.redis == nil || t.Expiry.IsZero() {
+		return
+	}
+	ttl := int64(time.Until(t.Expiry) / time.Second)
+	if ttl < 1 {
+		return
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return
+	}
+	v, err := utils.Rc4EncodeBytes([]byte(s.conf.ClientSecret), data)
+	if err != nil {
+		return
+	}
+	_ = s.redis.Set(ctx, s.redisKey(), v, ttl)
+}
+
+type oauth2Response struct {
+	AccessToken string      `json:"access_token"`
+	TokenType   string      `json:"token_type"`
+	ExpiresIn   json.Number `json:"expires_in"`
+
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func (s *tokenSource) fetch(ctx *gin.Context) (*oauth2Token, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if len(s.conf.Scopes) > 0 {
+		form.Set("scope", strings.Join(s.conf.Scopes, " "))
+	}
+	for k, v := range s.conf.Params {
+		form.Set(k, v)
+	}
+	if s.conf.AuthInParams {
+		form.Set("client_id", s.conf.ClientID)
+		form.Set("client_secret", s.conf.ClientSecret)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.conf.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if !s.conf.AuthInParams {
+		req.SetBasicAuth(url.QueryEscape(s.conf.ClientID), url.QueryEscape(s.conf.ClientSecret))
+	}
+
+	start := time.Now()
+	t, code, err := s.exchange(req)
+	end := time.Now()
+
+	// 日志中不打印token与client凭证
+	fields := []klog.Field{
+		klog.String(klog.TopicType, klog.LogNameModule),
+		klog.String("prot", "http"),
+		klog.String("service", s.service),
+		klog.String("method", req.Method),
+		klog.String("domain", req.URL.Scheme+"://"+req.URL.Host),
+		klog.String("requestUri", req.URL.Path),
+		klog.Int("httpCode", code),
+		klog.String("requestStartTime", utils.GetFormatRequestTime(start)),
+		klog.String("requestEndTime", utils.GetFormatRequestTime(end)),
+		klog.Float64("cost", utils.GetRequestCost(start, end)),
+	}
+	if err != nil {
+		fields = append(fields, klog.Int("ralCode", -1))
+		klog.WarnLogger(ctx, "oauth2 fetch token error: "+err.Error(), fields...)
+		return nil, err
+	}
+	if !t.Expiry.IsZero() {
+		fields = append(fields, klog.String("tokenExpiry", t.Expiry.Format(time.RFC3339)))
+	}
+	fields = append(fields, klog.Int("ralCode", 0))
+	klog.InfoLogger(ctx, "oauth2 token refreshed", fields...)
+	return t, nil
+}
+
+func (s *tokenSource) exchange(req *http.Request) (*oauth2Token, int, error) {
+	resp, err := s.hc.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, resp.StatusCode, err
+	}
+
+	var r oauth2Response
+	jsonErr := json.Unmarshal(body, &r)
+	if resp.StatusCode != http.StatusOK {
+		if jsonErr == nil && r.Error != "" {
+			return nil, resp.StatusCode, fmt.Errorf("oauth2 token endpoint: %d %s %s", resp.StatusCode, r.Error, r.ErrorDescription)
+		}
+		return nil, resp.StatusCode, fmt.Errorf("oauth2 token endpoint: %d", resp.StatusCode)
+	}
+	// 解析失败时不把响应内容带到错误信息中
+	if jsonErr != nil {
+		return nil, resp.StatusCode, errors.New("oauth2 token endpoint: invalid json response")
+	}
+	if r.AccessToken == "" {
+		return nil, resp.StatusCode, errors.New("oauth2 token endpoint: empty access_token")
+	}
+
+	t := &oauth2Token{AccessToken: r.AccessToken, TokenType: r.TokenType}
+	if sec, err := r.ExpiresIn.Int64(); err == nil && sec > 0 {
+		t.Expiry = time.Now().Add(time.Duration(sec) * time.Second)
+	}
+	return t, resp.StatusCode, nil
+}
+
+// 每次尝试携带当前token，响应401时丢弃该token，刷新后重发一次
+func oauth2Interceptor(inv *Invocation, next Invoker) (*http.Response, error) {
+	s := inv.Client.tokens
+	t, err := s.Token(inv.Ctx)
+	if err != nil {
+		return nil, fmt.Errorf("oauth2 get token error: %w", err)
+	}
+
+	req := inv.Request
+	rewindable := req.GetBody != nil || req.Body == nil || req.Body == http.NoBody
+	if !rewindable && !inv.Options.stream {
+		_, err = requestBodyBytes(req)
+		rewindable = err == nil
+	}
+
+	req.Header.Set("Authorization", t.header())
+	resp, err := next(inv)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || !rewindable {
+		return resp, err
+	}
+
+	drainAndCloseBody(resp, 16384)
+	s.invalidate(inv.Ctx, t)
+	if t, err = s.Token(inv.Ctx); err != nil {
+		return nil, fmt.Errorf("oauth2 get token error: %w", err)
+	}
+	if req.GetBody != nil {
+		req.Body, _ = req.GetBody()
+	}
+	req.Header.Set("Authorization", t.header())
+
+	klog.InfoLogger(inv.Ctx, "oauth2 token rejected, retry with new token",
+		klog.String(klog.TopicType, klog.LogNameModule),
+		klog.String("prot", "http"),
+		klog.String("service", inv.Client.Service),
+		klog.String("requestUri", req.URL.Path))
+	return next(inv)
+}
@@ -0,0 +1,172 @@
+package base
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 每次请求返回新的token：tk1、tk2...
+func newTokenServer(t *testing.T, fetches *int32, delay time.Duration) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, _ := r.BasicAuth(); u != "cid" || p != "csec" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"invalid_client"}`))
+			return
+		}
+		time.Sleep(delay)
+		n := atomic.AddInt32(fetches, 1)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"access_token":"tk%d","token_type":"bearer","expires_in":3600}`, n)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestOAuth2TokenRefresh(t *testing.T) {
+	cases := []struct {
+		name   string
+		expiry time.Duration // 当前token距过期的时间，0表示没有token
+		down   bool          // token接口不可用
+		want   string
+		err    bool
+	}{
+		{"no token", 0, false, "tk1", false},
+		{"valid", 10 * time.Minute, false, "old", false},
+		{"within early expiry", 30 * time.Second, false, "tk1", false},
+		{"expired", -time.Second, false, "tk1", false},
+		{"refresh failed, old still valid", 30 * time.Second, true, "old", false},
+		{"refresh failed, old expired", -time.Second, true, "", true},
+	}
+	for _, c := range cases {
+		var fetches int32
+		srv := newTokenServer(t, &fetches, 0)
+		conf := OAuth2Conf{TokenURL: srv.URL, ClientID: "cid", ClientSecret: "csec"}
+		if c.down {
+			conf.ClientSecret = "bad"
+		}
+		s := newTokenSource(&ApiClient{Service: "svc", OAuth2: conf, HTTPClient: &http.Client{}})
+		if c.expiry != 0 {
+			s.set(&oauth2Token{AccessToken: "old", Expiry: time.Now().Add(c.expiry)})
+		}
+
+		tk, err := s.Token(nil)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expect error, got %v", c.name, tk)
+			}
+			continue
+		}
+		if err != nil || tk.AccessToken != c.want {
+			t.Errorf("%s: got %v %v, want %s", c.name, tk, err, c.want)
+		}
+	}
+}
+
+func TestOAuth2Singleflight(t *testing.T) {
+	var fetches, calls int32
+	tokSrv := newTokenServer(t, &fetches, 50*time.Millisecond)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		_, _ = w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer api.Close()
+
+	c := &ApiClient{Service: "svc", Domain: api.URL, OAuth2: OAuth2Conf{TokenURL: tokSrv.URL, ClientID: "cid", ClientSecret: "csec"}}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := c.HttpGet(nil, "/x", HttpRequestOptions{})
+			if err != nil || string(res.Response) != "Bearer tk1" {
+				t.Error(err, res)
+			}
+		}()
+	}
+	wg.Wait()
+	if fetches != 1 || calls != 20 {
+		t.Fatalf("fetches %d calls %d", fetches, calls)
+	}
+}
+
+func TestOAuth2RetryOn401(t *testing.T) {
+	cases := []struct {
+		name    string
+		reject  func(auth string) bool
+		code    int
+		calls   int32
+		fetches int32
+	}{
+		{"token revoked", func(auth string) bool { return auth == "Bearer tk1" }, 200, 2, 2},
+		{"always rejected", func(string) bool { return true }, 401, 2, 2},
+		{"accepted", func(string) bool { return false }, 200, 1, 1},
+	}
+	for _, c := range cases {
+		var fetches, calls int32
+		tokSrv := newTokenServer(t, &fetches, 0)
+		api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			if c.reject(r.Header.Get("Authorization")) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			b, _ := ioutil.ReadAll(r.Body)
+			_, _ = w.Write(b)
+		}))
+
+		client := &ApiClient{Service: "svc", Domain: api.URL, OAuth2: OAuth2Conf{TokenURL: tokSrv.URL, ClientID: "cid", ClientSecret: "csec"}}
+		res, _ := client.HttpPost(nil, "/y", HttpRequestOptions{Data: map[string]string{"k": "v"}})
+		api.Close()
+		if res == nil || res.HttpCode != c.code || calls != c.calls || fetches != c.fetches {
+			t.Errorf("%s: res %v calls %d fetches %d", c.name, res, calls, fetches)
+			continue
+		}
+		// 重发时请求体完整
+		if c.code == 200 && string(res.Response) != "k=v" {
+			t.Errorf("%s: body %q", c.name, res.Response)
+		}
+	}
+}
+
+func TestOAuth2RecordRedact(t *testing.T) {
+	var fetches int32
+	tokSrv := newTokenServer(t, &fetches, 0)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer api.Close()
+
+	dir := t.TempDir()
+	c := &ApiClient{Service: "svc", Domain: api.URL, Replay: ReplayConf{Mode: ReplayModeRecord, Dir: dir},
+		OAuth2: OAuth2Conf{TokenURL: tokSrv.URL, ClientID: "cid", ClientSecret: "csec", AuthInParams: false}}
+	if _, err := c.HttpGet(nil, "/x", HttpRequestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	files := 0
+	_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		files++
+		b, _ := ioutil.ReadFile(path)
+		for _, s := range []string{"tk1", "csec", "Y2lkOmNzZWM"} {
+			if strings.Contains(string(b), s) {
+				t.Errorf("%s contains %q", path, s)
+			}
+		}
+		return nil
+	})
+	if files != 2 {
+		t.Fatalf("fixtures %d", files)
+	}
+}
@@ -0,0 +1,280 @@
+package base
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	json "github.com/json-iterator/go"
+	"github.com/peerless6372/Lplot/klog"
+	"github.com/peerless6372/gin"
+)
+
+var ErrBadGateway = Error{ErrNo: http.StatusBadGateway, ErrMsg: "bad gateway"}
+
+// 逐跳header，不转发
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+type ReverseProxyConf struct {
+	// 去掉/增加的path前缀，Rewrite 不为空时忽略
+	StripPrefix string
+	AddPrefix   string
+	Rewrite     func(path string) string
+
+	// 请求header增删，先删后加
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	// 响应header增删，先删后加
+	SetResponseHeaders    map[string]string
+	RemoveResponseHeaders []string
+
+	// 请求体不超过该大小时缓存在内存中以支持重试，默认1MB，超过时流式转发且不重试
+	RetryBodyLimit int64
+
+	// 响应写回前调用，可修改状态码、header或替换Body
+	ModifyResponse func(ctx *gin.Context, res *StreamResult) error
+	// 对 DefaultRender 格式的json响应做转换，如裁剪/改写data，非该格式的响应原样返回
+	TransformRender func(ctx *gin.Context, render *DefaultRender) error
+	// 转发失败时的处理，默认返回502及 DefaultRender
+	ErrorHandler func(ctx *gin.Context, err error)
+}
+
+func (conf *ReverseProxyConf) path(p string) string {
+	if conf.Rewrite != nil {
+		return conf.Rewrite(p)
+	}
+	if conf.StripPrefix != "" {
+		p = strings.TrimPrefix(p, conf.StripPrefix)
+		if !strings.HasPrefix(p, "/") {
+			p = "/" + p
+		}
+	}
+	return conf.AddPrefix + p
+}
+
+func defaultProxyErrorHandler(ctx *gin.Context, err error) {
+	setCommonHeader(ctx, ErrBadGateway.ErrNo, ErrBadGateway.ErrMsg)
+	ctx.AbortWithStatusJSON(http.StatusBadGateway, DefaultRender{ErrBadGateway.ErrNo, ErrBadGateway.ErrMsg, gin.H{}})
+}
+
+// ReverseProxy 通过client把请求转发到下游，复用client的地址、重试、拦截器与日志
+// requestId 由拦截器通过 klog.TraceHeaderKey、klog.LogIDHeaderKey 透传
+func ReverseProxy(client *ApiClient, conf ReverseProxyConf) gin.HandlerFunc {
+	if conf.RetryBodyLimit == 0 {
+		conf.RetryBodyLimit = 1 << 20
+	}
+	if conf.ErrorHandler == nil {
+		conf.ErrorHandler = defaultProxyErrorHandler
+	}
+
+	return func(ctx *gin.Context) {
+		req, opts, err := client.proxyRequest(ctx, &conf)
+		if err != nil {
+			klog.WarnLogger(ctx, "reverse proxy make request error: "+err.Error(),
+				klog.String(klog.TopicType, klog.LogNameModule),
+				klog.String("service", client.Service))
+			conf.ErrorHandler(ctx, err)
+			return
+		}
+
+		res, err := client.doStream(ctx, req, opts)
+		if err != nil {
+			conf.ErrorHandler(ctx, err)
+			return
+		}
+		// ModifyResponse/TransformRender 可能替换Body，两者都需要关闭
+		body := res.Body
+		defer func() {
+			_ = body.Close()
+			_ = res.Body.Close()
+		}()
+
+		if conf.ModifyResponse != nil {
+			if err = conf.ModifyResponse(ctx, res); err != nil {
+				conf.ErrorHandler(ctx, err)
+				return
+			}
+		}
+		if conf.TransformRender != nil {
+			if err = transformRender(ctx, res, conf.TransformRender); err != nil {
+				conf.ErrorHandler(ctx, err)
+				return
+			}
+		}
+
+		writeProxyResponse(ctx, res, &conf)
+	}
+}
+
+func (client *ApiClient) proxyRequest(ctx *gin.Context, conf *ReverseProxyConf) (*http.Request, *HttpRequestOptions, error) {
+	in := ctx.Request
+
+	u := client.baseURL() + conf.path(in.URL.Path)
+	if in.URL.RawQuery != "" {
+		u += "?" + in.URL.RawQuery
+	}
+
+	// 小请求体读入内存，可以重试
+	var body io.Reader
+	if in.Body != nil && in.Body != http.NoBody {
+		body = in.Body
+		if in.ContentLength >= 0 && in.ContentLength <= conf.RetryBodyLimit {
+			data, err := ioutil.ReadAll(in.Body)
+			if err != nil {
+				return nil, nil, err
+			}
+			body = bytes.NewReader(data)
+		}
+	}
+
+	opts := &HttpRequestOptions{
+		BodyType:     in.Header.Get("Content-Type"),
+		PathTemplate: ctx.FullPath(),
+		stream:       true,
+		proxy:        true,
+	}
+	req, err := client.makeRequest(ctx, in.Method, u, body, *opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(in.Context())
+	if _, ok := body.(*bytes.Reader); !ok && body != nil {
+		req.ContentLength = in.ContentLength
+	}
+
+	// 下游请求header：透传的header + client自身设置的header(认证、Host等)
+	header := in.Header.Clone()
+	RemoveHopHeaders(header)
+	header.Del("Content-Length")
+	for k, v := range req.Header {
+		header[k] = v
+	}
+	if opts.BodyType == "" {
+		header.Del("Content-Type")
+	}
+	if conf.TransformRender != nil {
+		// 需要解析响应体，由transport处理压缩
+		header.Del("Accept-Encoding")
+	}
+	if ip := ctx.ClientIP(); ip != "" {
+		if prior := header.Get("X-Forwarded-For"); prior != "" {
+			ip = prior + ", " + ip
+		}
+		header.Set("X-Forwarded-For", ip)
+	}
+	for _, k := range conf.RemoveHeaders {
+		header.Del(k)
+	}
+	for k, v := range conf.SetHeaders {
+		header.Set(k, v)
+	}
+	req.Header = header
+
+	return req, opts, nil
+}
+
+// RemoveHopHeaders 删除逐跳header，转发请求/响应前调用
+func RemoveHopHeaders(h http.Header) {
+	// Connection 中列出的header同样是逐跳的
+	for _, f := range h.Values("Connection") {
+		for _, k := range strings.Split(f, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				h.Del(k)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
+func transformRender(ctx *gin.Context, res *StreamResult, fn func(ctx *gin.Context, render *DefaultRender) error) error {
+	if !strings.Contains(res.Header.Get("Content-Type"), "json") {
+		return nil
+	}
+
+	data, err := ioutil.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if err != nil {
+		return err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+	// 非 DefaultRender 格式，原样返回
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(data, &fields); err != nil {
+		return nil
+	}
+	if _, ok := fields["errNo"]; !ok {
+		return nil
+	}
+
+	var render DefaultRender
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err = decoder.Decode(&render); err != nil {
+		return nil
+	}
+	if err = fn(ctx, &render); err != nil {
+		return err
+	}
+
+	if data, err = json.Marshal(render); err != nil {
+		return err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(data))
+	res.Header.Del("Content-Encoding")
+	res.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	return nil
+}
+
+func writeProxyResponse(ctx *gin.Context, res *StreamResult, conf *ReverseProxyConf) {
+	header := ctx.Writer.Header()
+	RemoveHopHeaders(res.Header)
+	for k, v := range res.Header {
+		header[k] = v
+	}
+	for _, k := range conf.RemoveResponseHeaders {
+		header.Del(k)
+	}
+	for k, v := range conf.SetResponseHeaders {
+		header.Set(k, v)
+	}
+	ctx.Status(res.HttpCode)
+	ctx.Writer.WriteHeaderNow()
+
+	// 长度未知的响应(如SSE、chunked)每次写入后立即flush
+	flush := header.Get("Content-Length") == ""
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := res.Body.Read(buf)
+		if n > 0 {
+			if _, werr := ctx.Writer.Write(buf[:n]); werr != nil {
+				return
+			}
+			if flush {
+				ctx.Writer.Flush()
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				klog.WarnLogger(ctx, "reverse proxy copy response error: "+err.Error(),
+					klog.String(klog.TopicType, klog.LogNameModule))
+			}
+			return
+		}
+	}
+}
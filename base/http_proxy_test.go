@@ -0,0 +1,165 @@
+package base
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/peerless6372/Lplot/klog"
+	"github.com/peerless6372/gin"
+)
+
+func TestProxyPath(t *testing.T) {
+	cases := []struct {
+		name string
+		conf ReverseProxyConf
+		path string
+		want string
+	}{
+		{"none", ReverseProxyConf{}, "/a/b", "/a/b"},
+		{"strip", ReverseProxyConf{StripPrefix: "/api"}, "/api/a", "/a"},
+		{"strip all", ReverseProxyConf{StripPrefix: "/api"}, "/api", "/"},
+		{"strip and add", ReverseProxyConf{StripPrefix: "/api", AddPrefix: "/v2"}, "/api/a", "/v2/a"},
+		{"not matched", ReverseProxyConf{StripPrefix: "/api"}, "/other", "/other"},
+		// Rewrite 优先
+		{"rewrite", ReverseProxyConf{StripPrefix: "/api", Rewrite: strings.ToUpper}, "/api/a", "/API/A"},
+	}
+	for _, c := range cases {
+		if got := c.conf.path(c.path); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestRemoveHopHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("Connection", "keep-alive, X-Hop")
+	h.Set("X-Hop", "1")
+	h.Set("Keep-Alive", "timeout=5")
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Upgrade", "websocket")
+	h.Set("X-Keep", "1")
+	RemoveHopHeaders(h)
+	if len(h) != 1 || h.Get("X-Keep") != "1" {
+		t.Errorf("headers %v", h)
+	}
+}
+
+func TestReverseProxy(t *testing.T) {
+	var calls int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch r.URL.Path {
+		case "/v2/echo":
+			b, _ := ioutil.ReadAll(r.Body)
+			w.Header().Set("X-Internal", "1")
+			w.Header().Set("X-Keep", "1")
+			_, _ = fmt.Fprintf(w, "%s|%s|%s|%s|%s|%s|%s", r.Method, r.URL.RawQuery, b, r.Header.Get("Content-Encoding"),
+				r.Header.Get("X-Add"), r.Header.Get("X-Secret"), r.Header.Get(klog.TraceHeaderKey))
+		case "/v2/render":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"errNo":0,"errMsg":"succ","data":{"id":12345678901234567890,"secret":"x"}}`))
+		case "/v2/busy":
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("busy"))
+		}
+	}))
+	defer backend.Close()
+
+	client := &ApiClient{Service: "backend", Domain: backend.URL, Retry: 1, GzipThreshold: 1}
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	r.Any("/api/*path", ReverseProxy(client, ReverseProxyConf{
+		StripPrefix: "/api", AddPrefix: "/v2",
+		SetHeaders: map[string]string{"X-Add": "a"}, RemoveHeaders: []string{"X-Secret"},
+		RemoveResponseHeaders: []string{"X-Internal"},
+		TransformRender: func(ctx *gin.Context, render *DefaultRender) error {
+			delete(render.Data.(map[string]interface{}), "secret")
+			return nil
+		},
+	}))
+	front := httptest.NewServer(r)
+	defer front.Close()
+
+	cases := []struct {
+		name    string
+		method  string
+		path    string
+		body    string
+		headers map[string]string
+		code    int
+		want    string
+		header  string
+		calls   int
+	}{
+		{"echo", http.MethodPost, "/api/echo?q=1", "hello",
+			map[string]string{"X-Secret": "s", klog.TraceHeaderKey: "rid-123"},
+			http.StatusOK, "POST|q=1|hello||a||rid-123", "X-Keep", 1},
+		// 已压缩的请求体不再压缩
+		{"gzip body", http.MethodPost, "/api/echo", "0123456789", map[string]string{"Content-Encoding": "gzip", klog.TraceHeaderKey: "rid-1"},
+			http.StatusOK, "POST||0123456789|gzip|a||rid-1", "X-Keep", 1},
+		// 大整数不丢精度
+		{"render", http.MethodGet, "/api/render", "", nil,
+			http.StatusOK, `{"errNo":0,"errMsg":"succ","data":{"id":12345678901234567890}}`, "", 1},
+		// 重试后透传最终的上游响应
+		{"5xx", http.MethodGet, "/api/busy", "", nil, http.StatusServiceUnavailable, "busy", "Retry-After", 2},
+	}
+	for _, c := range cases {
+		calls = 0
+		req, _ := http.NewRequest(c.method, front.URL+c.path, strings.NewReader(c.body))
+		for k, v := range c.headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != c.code || string(b) != c.want || calls != c.calls ||
+			(c.header != "" && resp.Header.Get(c.header) == "") || resp.Header.Get("X-Internal") != "" {
+			t.Errorf("%s: %d %s calls %d header %v", c.name, resp.StatusCode, b, calls, resp.Header)
+		}
+	}
+
+	backend.Close()
+	resp, err := http.Get(front.URL + "/api/echo")
+	if err != nil || resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("backend down: %v %v", resp, err)
+	}
+}
+
+func TestReverseProxyStream(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 3; i++ {
+			_, _ = fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+
+	r := gin.New()
+	r.Any("/*path", ReverseProxy(&ApiClient{Service: "sse", Domain: backend.URL}, ReverseProxyConf{}))
+	front := httptest.NewServer(r)
+	defer front.Close()
+
+	resp, err := http.Get(front.URL + "/sse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	// 首个事件不等上游结束即返回
+	start := time.Now()
+	buf := make([]byte, 100)
+	n, _ := resp.Body.Read(buf)
+	if string(buf[:n]) != "data: 0\n\n" || time.Since(start) > 40*time.Millisecond {
+		t.Errorf("not streamed: %q", buf[:n])
+	}
+}
@@ -0,0 +1,234 @@
+package base
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/peerless6372/Lplot/env"
+	"gopkg.in/yaml.v2"
+)
+
+// api.yaml 中凭证字段以该前缀引用 conf/secret/api.secret.yaml 中的配置
+const apiPrefix = "@@api."
+
+const DefaultApiConfFile = "api.yaml"
+
+// 单个接口的覆盖配置，未设置的项沿用service级别的配置
+// key 为请求path，以 * 结尾时按前缀匹配(最长前缀优先)
+type ApiPathConf struct {
+	Timeout time.Duration `yaml:"timeout"`
+	// 为空沿用service的retry，显式配置0表示不重试
+	Retry *int `yaml:"retry"`
+}
+
+// 需要做secret替换的字段
+type apiCredential struct {
+	AppKey    string
+	AppSecret string
+	Proxy     string
+	Username  string
+	Password  string
+
+	ClientID     string
+	ClientSecret string
+}
+
+func (client *ApiClient) checkConf() {
+	c := apiCredential{
+		AppKey:    client.AppKey,
+		AppSecret: client.AppSecret,
+		Proxy:     client.Proxy,
+		Username:  client.BasicAuth.Username,
+		Password:  client.BasicAuth.Password,
+
+		ClientID:     client.OAuth2.ClientID,
+		ClientSecret: client.OAuth2.ClientSecret,
+	}
+	env.CommonSecretChange(apiPrefix, c, &c)
+
+	client.AppKey = c.AppKey
+	client.AppSecret = c.AppSecret
+	client.Proxy = c.Proxy
+	client.BasicAuth.Username = c.Username
+	client.BasicAuth.Password = c.Password
+	client.OAuth2.ClientID = c.ClientID
+	client.OAuth2.ClientSecret = c.ClientSecret
+}
+
+func (client *ApiClient) pathConf(path string) (ApiPathConf, bool) {
+	key, ok := client.pathKey(path)
+	if !ok {
+		return ApiPathConf{}, false
+	}
+	return client.Paths[key], true
+}
+
+// Paths 中与path匹配的key，精确匹配优先，其次为最长的 * 前缀
+func (client *ApiClient) pathKey(path string) (string, bool) {
+	if len(client.Paths) == 0 {
+		return "", false
+	}
+	if _, ok := client.Paths[path]; ok {
+		return path, true
+	}
+
+	var (
+		key   string
+		match = -1
+	)
+	for p := range client.Paths {
+		if !strings.HasSuffix(p, "*") {
+			continue
+		}
+		prefix := strings.TrimSuffix(p, "*")
+		if strings.HasPrefix(path, prefix) && len(prefix) > match {
+			key, match = p, len(prefix)
+		}
+	}
+	return key, match >= 0
+}
+
+// 请求path生效的超时时间
+func (client *ApiClient) timeout(path string) time.Duration {
+	if c, ok := client.pathConf(path); ok && c.Timeout > 0 {
+		return c.Timeout
+	}
+	if client.Timeout > 0 {
+		return client.Timeout
+	}
+	return 3 * time.Second
+}
+
+// 请求path生效的重试次数
+func (client *ApiClient) retry(path string) int {
+	if c, ok := client.pathConf(path); ok && c.Retry != nil {
+		return *c.Retry
+	}
+	return client.Retry
+}
+
+// 按path选择http.Client，配置了独立超时的path使用单独的client(共享transport)
+func (client *ApiClient) httpClient(path string) *http.Client {
+	if c, ok := client.pathConf(path); ok && c.Timeout > 0 {
+		if hc, ok := client.pathClients[c.Timeout]; ok {
+			return hc
+		}
+	}
+	return client.HTTPClient
+}
+
+func (client *ApiClient) initPathClients() {
+	for _, c := range client.Paths {
+		if c.Timeout <= 0 {
+			continue
+		}
+		if client.pathClients == nil {
+			client.pathClients = make(map[time.Duration]*http.Client)
+		}
+		client.pathClients[c.Timeout] = &http.Client{
+			Timeout:       c.Timeout,
+			Transport:     client.HTTPClient.Transport,
+			CheckRedirect: client.HTTPClient.CheckRedirect,
+			Jar:           client.HTTPClient.Jar,
+		}
+	}
+}
+
+// ApiRegistry 按名字管理下游服务的ApiClient
+type ApiRegistry struct {
+	lock    sync.RWMutex
+	clients map[string]*ApiClient
+}
+
+func NewApiRegistry() *ApiRegistry {
+	return &ApiRegistry{clients: make(map[string]*ApiClient)}
+}
+
+// Register 注册(或替换)一个client，service为空时使用name
+func (r *ApiRegistry) Register(name string, client *ApiClient) error {
+	if client == nil {
+		return errors.New("api client is nil: " + name)
+	}
+	if client.Service == "" {
+		client.Service = name
+	}
+	if client.getDomain() == "" {
+		return fmt.Errorf("api %s: domain or endpoints required", name)
+	}
+	client.checkConf()
+
+	r.lock.Lock()
+	r.clients[name] = client
+	r.lock.Unlock()
+	return nil
+}
+
+func (r *ApiRegistry) Get(name string) (*ApiClient, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	c, ok := r.clients[name]
+	return c, ok
+}
+
+func (r *ApiRegistry) Names() []string {
+	r.lock.RLock()
+	names := make([]string, 0, len(r.clients))
+	for name := range r.clients {
+		names = append(names, name)
+	}
+	r.lock.RUnlock()
+
+	sort.Strings(names)
+	return names
+}
+
+// Load 解析api.yaml内容，顶层key为服务名
+func (r *ApiRegistry) Load(data []byte) error {
+	clients := make(map[string]*ApiClient)
+	if err := yaml.Unmarshal(data, &clients); err != nil {
+		return fmt.Errorf("api conf unmarshal error: %w", err)
+	}
+	for name, client := range clients {
+		if err := r.Register(name, client); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadFile 加载配置文件，相对路径基于conf目录
+func (r *ApiRegistry) LoadFile(filename string) error {
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(env.GetConfDirPath(), filename)
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	return r.Load(data)
+}
+
+var apiRegistry = NewApiRegistry()
+
+// InitApi 加载 conf/<subConf>/api.yaml 到全局registry，配置错误时panic
+func InitApi(subConf string) {
+	if err := apiRegistry.LoadFile(filepath.Join(subConf, DefaultApiConfFile)); err != nil {
+		panic(DefaultApiConfFile + " load error: " + err.Error())
+	}
+}
+
+// GetApi 从全局registry中获取client
+func GetApi(name string) (*ApiClient, bool) {
+	return apiRegistry.Get(name)
+}
+
+func RegisterApi(name string, client *ApiClient) error {
+	return apiRegistry.Register(name, client)
+}
@@ -0,0 +1,124 @@
+package base
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/peerless6372/Lplot/env"
+)
+
+func TestPathConf(t *testing.T) {
+	zero := 0
+	client := &ApiClient{Timeout: time.Second, Retry: 2, Paths: map[string]ApiPathConf{
+		"/a":       {Timeout: 5 * time.Second},
+		"/a/*":     {Timeout: 6 * time.Second},
+		"/a/b/*":   {Retry: &zero},
+		"/export*": {Timeout: 7 * time.Second, Retry: &zero},
+	}}
+	cases := []struct {
+		path    string
+		key     string
+		timeout time.Duration
+		retry   int
+	}{
+		// 精确匹配优先
+		{"/a", "/a", 5 * time.Second, 2},
+		{"/a/x", "/a/*", 6 * time.Second, 2},
+		// 最长前缀优先，未设置的项沿用service配置
+		{"/a/b/c", "/a/b/*", time.Second, 0},
+		{"/export/big", "/export*", 7 * time.Second, 0},
+		{"/b", "", time.Second, 2},
+	}
+	for _, c := range cases {
+		key, _ := client.pathKey(c.path)
+		if key != c.key || client.timeout(c.path) != c.timeout || client.retry(c.path) != c.retry {
+			t.Errorf("%s: key %q timeout %v retry %d", c.path, key, client.timeout(c.path), client.retry(c.path))
+		}
+	}
+	if d := (&ApiClient{}).timeout("/"); d != 3*time.Second {
+		t.Errorf("default timeout %v", d)
+	}
+}
+
+func TestApiRegistryLoad(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/fast" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		u, p, _ := r.BasicAuth()
+		_, _ = w.Write([]byte(u + ":" + p))
+	}))
+	defer srv.Close()
+
+	root := t.TempDir()
+	_ = os.MkdirAll(filepath.Join(root, "conf", "secret"), 0755)
+	_ = ioutil.WriteFile(filepath.Join(root, "conf", "secret", "api.secret.yaml"), []byte("user_pwd: topsecret\n"), 0644)
+	_ = ioutil.WriteFile(filepath.Join(root, "conf", "api.yaml"), []byte(`
+user:
+  domain: `+srv.URL+`
+  timeout: 100ms
+  basicauth:
+    username: bob
+    password: "@@api.user_pwd"
+  paths:
+    /slow:
+      timeout: 1s
+    /export/*:
+      timeout: 1s
+order:
+  service: order-svc
+  domain: http://order
+`), 0644)
+	env.SetRootPath(root)
+	defer env.SetRootPath("")
+
+	r := NewApiRegistry()
+	if err := r.LoadFile(DefaultApiConfFile); err != nil {
+		t.Fatal(err)
+	}
+	if names := r.Names(); len(names) != 2 || names[0] != "order" || names[1] != "user" {
+		t.Errorf("names %v", names)
+	}
+	if c, ok := r.Get("order"); !ok || c.Service != "order-svc" {
+		t.Errorf("order: %+v", c)
+	}
+
+	client, ok := r.Get("user")
+	if !ok || client.Service != "user" || client.BasicAuth.Password != "topsecret" {
+		t.Fatalf("user: %+v", client)
+	}
+	cases := []struct {
+		path string
+		ok   bool
+	}{
+		{"/fast", true},
+		// path级别超时使用独立的http.Client
+		{"/slow", true},
+		{"/export/big", true},
+		{"/other", false},
+	}
+	for _, c := range cases {
+		res, err := client.HttpGet(nil, c.path, HttpRequestOptions{})
+		if ok := err == nil && string(res.Response) == "bob:topsecret"; ok != c.ok {
+			t.Errorf("%s: got %v %v", c.path, res, err)
+		}
+	}
+
+	bad := []string{
+		"x:\n  timeout: 1s\n",
+		"x: [",
+	}
+	for _, conf := range bad {
+		if err := NewApiRegistry().Load([]byte(conf)); err == nil {
+			t.Errorf("expect error for %q", conf)
+		}
+	}
+	if err := r.Register("nil", nil); err == nil {
+		t.Error("expect error for nil client")
+	}
+}
@@ -0,0 +1,398 @@
+package base
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/peerless6372/Lplot/klog"
+)
+
+// 录制回放模式，环境变量优先于配置，便于CI离线运行
+const (
+	ReplayModeOff    = ""
+	ReplayModeRecord = "record"
+	ReplayModeReplay = "replay"
+
+	EnvHttpReplayMode = "HTTP_REPLAY_MODE"
+	EnvHttpReplayDir  = "HTTP_REPLAY_DIR"
+)
+
+const redactedValue = "***"
+
+// 默认脱敏的header，录制文件中不保留原值
+var defaultRedactHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	HttpHeaderSignature,
+}
+
+// 默认脱敏的query/form/json字段(不区分大小写)，包括请求参数与json/form响应体，如OAuth2的client_secret、access_token
+var defaultRedactParams = []string{
+	"password",
+	"passwd",
+	"secret",
+	"client_secret",
+	"token",
+	"access_token",
+	"refresh_token",
+	"id_token",
+	"api_key",
+	"apikey",
+}
+
+type ReplayConf struct {
+	Mode string `yaml:"mode"`
+	Dir  string `yaml:"dir"`
+	// 额外需要脱敏的header
+	RedactHeaders []string `yaml:"redactHeaders"`
+	// 额外需要脱敏的query/form/json字段，脱敏后的值同样参与匹配
+	RedactParams []string `yaml:"redactParams"`
+}
+
+func (conf ReplayConf) mode() string {
+	if m := os.Getenv(EnvHttpReplayMode); m != "" {
+		return strings.ToLower(m)
+	}
+	return strings.ToLower(conf.Mode)
+}
+
+func (conf ReplayConf) dir() string {
+	if d := os.Getenv(EnvHttpReplayDir); d != "" {
+		return d
+	}
+	if conf.Dir != "" {
+		return conf.Dir
+	}
+	return filepath.Join("testdata", "fixtures")
+}
+
+type replayRequest struct {
+	Method string      `json:"method"`
+	Path   string      `json:"path"`
+	Query  string      `json:"query"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body,omitempty"`
+}
+
+type replayResponse struct {
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body,omitempty"`
+	BodyBase64 bool        `json:"bodyBase64,omitempty"`
+}
+
+type replayFixture struct {
+	Request  replayRequest  `json:"request"`
+	Response replayResponse `json:"response"`
+}
+
+// replayTransport 在record模式下透传请求并落盘，replay模式下只读fixture，不访问网络
+type replayTransport struct {
+	next    http.RoundTripper
+	service string
+	mode    string
+	dir     string
+
+	redactHeaders map[string]bool
+	redactParams  map[string]bool
+}
+
+func newReplayTransport(service string, conf ReplayConf, next http.RoundTripper) http.RoundTripper {
+	mode := conf.mode()
+	if mode != ReplayModeRecord && mode != ReplayModeReplay {
+		return next
+	}
+
+	t := &replayTransport{
+		next:          next,
+		service:       service,
+		mode:          mode,
+		dir:           conf.dir(),
+		redactHeaders: make(map[string]bool),
+		redactParams:  make(map[string]bool),
+	}
+	for _, h := range append(defaultRedactHeaders, conf.RedactHeaders...) {
+		t.redactHeaders[http.CanonicalHeaderKey(h)] = true
+	}
+	for _, p := range append(defaultRedactParams, conf.RedactParams...) {
+		t.redactParams[strings.ToLower(p)] = true
+	}
+	return t
+}
+
+// 复制一份并追加脱敏字段
+func (t *replayTransport) withRedactParams(params ...string) *replayTransport {
+	c := *t
+	c.redactParams = make(map[string]bool, len(t.redactParams)+len(params))
+	for p := range t.redactParams {
+		c.redactParams[p] = true
+	}
+	for _, p := range params {
+		c.redactParams[strings.ToLower(p)] = true
+	}
+	return &c
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTripper 不能修改调用方的请求，读取body前先复制一份
+	req = req.Clone(req.Context())
+	body, err := requestBodyBytes(req)
+	if err != nil {
+		return nil, err
+	}
+
+	r := replayRequest{
+		Method: req.Method,
+		Path:   req.URL.Path,
+		Query:  t.normalizeQuery(req.URL.Query()),
+		Header: t.redactHeader(req.Header),
+		Body:   t.normalizeBody(req.Header.Get("Content-Type"), body),
+	}
+	file := t.fixturePath(r)
+
+	if t.mode == ReplayModeReplay {
+		return t.replay(req, r, file)
+	}
+	return t.record(req, r, file)
+}
+
+func (t *replayTransport) replay(req *http.Request, r replayRequest, file string) (*http.Response, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		klog.ErrorLogger(nil, "http replay: no fixture matched",
+			klog.String(klog.TopicType, klog.LogNameModule),
+			klog.String("service", t.service),
+			klog.String("method", r.Method),
+			klog.String("requestUri", r.Path),
+			klog.String("fixture", file))
+		return nil, fmt.Errorf("http replay: no fixture for %s %s?%s (expect %s)", r.Method, r.Path, r.Query, file)
+	}
+
+	var f replayFixture
+	if err = json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("http replay: bad fixture %s: %w", file, err)
+	}
+
+	respBody := []byte(f.Response.Body)
+	if f.Response.BodyBase64 {
+		if respBody, err = base64.StdEncoding.DecodeString(f.Response.Body); err != nil {
+			return nil, fmt.Errorf("http replay: bad fixture body %s: %w", file, err)
+		}
+	}
+
+	header := f.Response.Header
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", f.Response.StatusCode, http.StatusText(f.Response.StatusCode)),
+		StatusCode:    f.Response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(respBody)),
+		ContentLength: int64(len(respBody)),
+		Request:       req,
+	}, nil
+}
+
+func (t *replayTransport) record(req *http.Request, r replayRequest, file string) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+
+	f := replayFixture{
+		Request: r,
+		Response: replayResponse{
+			StatusCode: resp.StatusCode,
+			Header:     t.redactHeader(resp.Header),
+		},
+	}
+	// 调用方拿到原始响应，落盘的响应体脱敏
+	if b, ok := t.redactResponseBody(resp.Header.Get("Content-Type"), respBody); ok {
+		respBody = b
+	}
+	if utf8.Valid(respBody) {
+		f.Response.Body = string(respBody)
+	} else {
+		f.Response.Body = base64.StdEncoding.EncodeToString(respBody)
+		f.Response.BodyBase64 = true
+	}
+
+	if err := writeFixture(file, f); err != nil {
+		klog.WarnLogger(nil, "http record: write fixture error: "+err.Error(),
+			klog.String(klog.TopicType, klog.LogNameModule),
+			klog.String("service", t.service),
+			klog.String("fixture", file))
+	}
+	return resp, nil
+}
+
+func writeFixture(file string, f replayFixture) error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+var fixtureNameReg = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// fixture 文件名：<dir>/<service>/<method>_<path>_<hash>.json
+func (t *replayTransport) fixturePath(r replayRequest) string {
+	h := sha256.Sum256([]byte(r.Method + "\n" + r.Path + "\n" + r.Query + "\n" + r.Body))
+	name := strings.Trim(fixtureNameReg.ReplaceAllString(r.Path, "_"), "_")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	service := t.service
+	if service == "" {
+		service = "default"
+	}
+	return filepath.Join(t.dir, fixtureNameReg.ReplaceAllString(service, "_"),
+		fmt.Sprintf("%s_%s_%s.json", r.Method, name, hex.EncodeToString(h[:])[:16]))
+}
+
+func (t *replayTransport) redactHeader(h http.Header) http.Header {
+	out := make(http.Header, len(h))
+	for k, vs := range h {
+		if t.redactHeaders[http.CanonicalHeaderKey(k)] {
+			out[k] = []string{redactedValue}
+			continue
+		}
+		out[k] = append([]string(nil), vs...)
+	}
+	// 签名相关header每次请求都会变化，不保留
+	out.Del(HttpHeaderTimestamp)
+	out.Del(HttpHeaderNonce)
+	return out
+}
+
+// query 按key排序，敏感字段替换为占位符
+func (t *replayTransport) normalizeQuery(q url.Values) string {
+	for k := range q {
+		if t.redactParams[strings.ToLower(k)] {
+			q[k] = []string{redactedValue}
+		} else {
+			sort.Strings(q[k])
+		}
+	}
+	return q.Encode()
+}
+
+func (t *replayTransport) normalizeBody(contentType string, body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+
+	if strings.Contains(contentType, "json") {
+		var v interface{}
+		if err := json.Unmarshal(body, &v); err == nil {
+			// encoding/json 输出的map按key排序，保证相同内容得到相同结果
+			v, _ = t.redactJson(v)
+			if b, err := json.Marshal(v); err == nil {
+				return string(b)
+			}
+		}
+	}
+
+	if strings.Contains(contentType, "x-www-form-urlencoded") {
+		if q, err := url.ParseQuery(string(body)); err == nil {
+			return t.normalizeQuery(q)
+		}
+	}
+
+	if utf8.Valid(body) {
+		return string(body)
+	}
+	return base64.StdEncoding.EncodeToString(body)
+}
+
+func (t *replayTransport) redactJson(v interface{}) (interface{}, bool) {
+	changed := false
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, item := range val {
+			if t.redactParams[strings.ToLower(k)] {
+				val[k] = redactedValue
+				changed = true
+			} else if item, c := t.redactJson(item); c {
+				val[k] = item
+				changed = true
+			}
+		}
+	case []interface{}:
+		for i := range val {
+			if item, c := t.redactJson(val[i]); c {
+				val[i] = item
+				changed = true
+			}
+		}
+	}
+	return v, changed
+}
+
+// json与form响应体中的敏感字段脱敏，没有命中时返回false，保持原文
+func (t *replayTransport) redactResponseBody(contentType string, body []byte) ([]byte, bool) {
+	if strings.Contains(contentType, "json") {
+		d := json.NewDecoder(bytes.NewReader(body))
+		d.UseNumber()
+		var v interface{}
+		if err := d.Decode(&v); err != nil {
+			return nil, false
+		}
+		v, changed := t.redactJson(v)
+		if !changed {
+			return nil, false
+		}
+		b, err := json.Marshal(v)
+		return b, err == nil
+	}
+
+	if strings.Contains(contentType, "x-www-form-urlencoded") {
+		q, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, false
+		}
+		changed := false
+		for k := range q {
+			if t.redactParams[strings.ToLower(k)] {
+				q[k] = []string{redactedValue}
+				changed = true
+			}
+		}
+		return []byte(q.Encode()), changed
+	}
+	return nil, false
+}
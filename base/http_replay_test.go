@@ -0,0 +1,137 @@
+package base
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReplayRecordAndReplay(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"access_token":"at-123","expires_in":3600,"nested":[{"refresh_token":"rt-456"}]}`))
+		case "/form":
+			w.Header().Set("Content-Type", "application/x-www-form-urlencoded")
+			_, _ = w.Write([]byte("access_token=at-789&scope=read"))
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			_, _ = w.Write([]byte("plain " + r.URL.Query().Get("a")))
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	conf := ReplayConf{Dir: dir, RedactParams: []string{"userPwd"}}
+
+	cases := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		want     string
+		secrets  []string
+		replayed string
+	}{
+		{"json response", http.MethodPost, "/token", "grant_type=client_credentials&client_id=id&client_secret=cs-1",
+			`{"access_token":"at-123","expires_in":3600,"nested":[{"refresh_token":"rt-456"}]}`,
+			[]string{"at-123", "rt-456", "cs-1"},
+			`{"access_token":"***","expires_in":3600,"nested":[{"refresh_token":"***"}]}`},
+		{"form response", http.MethodPost, "/form", "userpwd=p-1&name=n",
+			"access_token=at-789&scope=read",
+			[]string{"at-789", "p-1"},
+			"access_token=%2A%2A%2A&scope=read"},
+		{"plain", http.MethodGet, "/plain?a=1&token=tk-1", "",
+			"plain 1",
+			[]string{"tk-1"},
+			"plain 1"},
+	}
+
+	do := func(mode string, method, path, body string) (string, error) {
+		conf.Mode = mode
+		client := &http.Client{Transport: newReplayTransport("svc", conf, http.DefaultTransport)}
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		return string(b), err
+	}
+
+	for _, c := range cases {
+		got, err := do(ReplayModeRecord, c.method, c.path, c.body)
+		if err != nil {
+			t.Fatalf("%s: record: %v", c.name, err)
+		}
+		if got != c.want {
+			t.Errorf("%s: record got %q, want %q", c.name, got, c.want)
+		}
+	}
+
+	var fixtures string
+	_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			b, _ := ioutil.ReadFile(path)
+			fixtures += string(b)
+		}
+		return nil
+	})
+	for _, c := range cases {
+		for _, s := range c.secrets {
+			if strings.Contains(fixtures, s) {
+				t.Errorf("%s: fixture contains %q", c.name, s)
+			}
+		}
+	}
+
+	// 脱敏字段不同的值同样命中录制的fixture
+	other := strings.NewReplacer("cs-1", "cs-2", "p-1", "p-2", "tk-1", "tk-2")
+	for _, c := range cases {
+		path, body := other.Replace(c.path), other.Replace(c.body)
+		got, err := do(ReplayModeReplay, c.method, path, body)
+		if err != nil {
+			t.Fatalf("%s: replay: %v", c.name, err)
+		}
+		if got != c.replayed {
+			t.Errorf("%s: replay got %q, want %q", c.name, got, c.replayed)
+		}
+	}
+
+	if _, err := do(ReplayModeReplay, http.MethodGet, "/plain?a=2", ""); err == nil {
+		t.Error("expect no fixture for unrecorded request")
+	}
+}
+
+func TestReplayNoMutate(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	// 录制时读取请求体不修改调用方的请求，重试仍可通过 GetBody 重放
+	rt := newReplayTransport("svc", ReplayConf{Mode: ReplayModeRecord, Dir: t.TempDir()}, http.DefaultTransport)
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/a", strings.NewReader("abc"))
+	body := req.Body
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if req.Body != body {
+		t.Error("request body replaced")
+	}
+	rc, _ := req.GetBody()
+	if b, _ := ioutil.ReadAll(rc); string(b) != "abc" {
+		t.Errorf("GetBody %q", b)
+	}
+}
@@ -0,0 +1,197 @@
+package base
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/peerless6372/Lplot/utils"
+)
+
+// 签名相关header
+const (
+	HttpHeaderAppKey    = "X-App-Key"
+	HttpHeaderTimestamp = "X-App-Timestamp"
+	HttpHeaderNonce     = "X-App-Nonce"
+	HttpHeaderSignature = "X-App-Signature"
+	// 请求体不参与签名时，该header为 UnsignedPayload
+	HttpHeaderContentSha256 = "X-App-Content-Sha256"
+)
+
+// 流式请求体(上传、代理转发)不读入内存计算摘要，规范化请求串中以此代替body的sha256
+const UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+var (
+	ErrSignMissing = errors.New("signature headers missing")
+	ErrSignInvalid = errors.New("signature mismatch")
+)
+
+// 规范化请求串：method \n path \n 排序后的query \n body的sha256 \n timestamp \n nonce
+func CanonicalRequest(method, path string, query url.Values, body []byte, timestamp, nonce string) string {
+	bodyHash := sha256.Sum256(body)
+	return canonicalRequest(method, path, query, hex.EncodeToString(bodyHash[:]), timestamp, nonce)
+}
+
+func canonicalRequest(method, path string, query url.Values, payload, timestamp, nonce string) string {
+	if path == "" {
+		path = "/"
+	}
+
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var q []string
+	for _, k := range keys {
+		vs := append([]string(nil), query[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			q = append(q, url.QueryEscape(k)+"="+url.QueryEscape(v))
+		}
+	}
+
+	return strings.Join([]string{
+		strings.ToUpper(method),
+		path,
+		strings.Join(q, "&"),
+		payload,
+		timestamp,
+		nonce,
+	}, "\n")
+}
+
+func Sign(secret, canonical string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(canonical))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest 为请求生成签名header，每次发送(包括重试)都应重新签名以更换nonce
+func SignRequest(req *http.Request, body []byte, appKey, appSecret string) {
+	bodyHash := sha256.Sum256(body)
+	req.Header.Del(HttpHeaderContentSha256)
+	signRequest(req, hex.EncodeToString(bodyHash[:]), appKey, appSecret)
+}
+
+// SignStreamRequest 签名时不读取请求体，body以 UnsignedPayload 标记，服务端需显式允许
+func SignStreamRequest(req *http.Request, appKey, appSecret string) {
+	req.Header.Set(HttpHeaderContentSha256, UnsignedPayload)
+	signRequest(req, UnsignedPayload, appKey, appSecret)
+}
+
+func signRequest(req *http.Request, payload, appKey, appSecret string) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := utils.GetUuidString()
+	canonical := canonicalRequest(req.Method, req.URL.EscapedPath(), req.URL.Query(), payload, timestamp, nonce)
+
+	req.Header.Set(HttpHeaderAppKey, appKey)
+	req.Header.Set(HttpHeaderTimestamp, timestamp)
+	req.Header.Set(HttpHeaderNonce, nonce)
+	req.Header.Set(HttpHeaderSignature, Sign(appSecret, canonical))
+}
+
+// IsUnsignedPayload 请求体是否未参与签名，为true时 VerifyRequest 不需要传入body
+func IsUnsignedPayload(req *http.Request) bool {
+	return req.Header.Get(HttpHeaderContentSha256) == UnsignedPayload
+}
+
+// VerifyRequest 校验签名，返回签名中的 appKey/timestamp/nonce 供调用方做时钟偏差和防重放检查
+// 请求体未参与签名(IsUnsignedPayload)时忽略body，是否接受由调用方决定
+func VerifyRequest(req *http.Request, body []byte, secret func(appKey string) (string, bool)) (appKey string, timestamp int64, nonce string, err error) {
+	appKey = req.Header.Get(HttpHeaderAppKey)
+	ts := req.Header.Get(HttpHeaderTimestamp)
+	nonce = req.Header.Get(HttpHeaderNonce)
+	signature := req.Header.Get(HttpHeaderSignature)
+	if appKey == "" || ts == "" || nonce == "" || signature == "" {
+		return appKey, 0, nonce, ErrSignMissing
+	}
+
+	timestamp, err = strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return appKey, 0, nonce, ErrSignInvalid
+	}
+
+	appSecret, ok := secret(appKey)
+	if !ok {
+		return appKey, timestamp, nonce, ErrSignInvalid
+	}
+
+	payload := UnsignedPayload
+	if !IsUnsignedPayload(req) {
+		bodyHash := sha256.Sum256(body)
+		payload = hex.EncodeToString(bodyHash[:])
+	}
+	canonical := canonicalRequest(req.Method, req.URL.EscapedPath(), req.URL.Query(), payload, ts, nonce)
+	if !hmac.Equal([]byte(Sign(appSecret, canonical)), []byte(signature)) {
+		return appKey, timestamp, nonce, ErrSignInvalid
+	}
+	return appKey, timestamp, nonce, nil
+}
+
+func (client *ApiClient) signEnable() bool {
+	return client.AppKey != "" && client.AppSecret != ""
+}
+
+// 已在内存中的请求体参与签名，流式请求体(文件上传、大请求体的代理转发)不读入内存，以 UnsignedPayload 签名
+func (client *ApiClient) signRequest(req *http.Request, opts *HttpRequestOptions) error {
+	if !payloadInMemory(req, opts) {
+		SignStreamRequest(req, client.AppKey, client.AppSecret)
+		return nil
+	}
+	body, err := requestBodyBytes(req)
+	if err != nil {
+		return err
+	}
+	SignRequest(req, body, client.AppKey, client.AppSecret)
+	return nil
+}
+
+func payloadInMemory(req *http.Request, opts *HttpRequestOptions) bool {
+	if req.Body == http.NoBody || (req.Body == nil && req.GetBody == nil) {
+		return true
+	}
+	// 流式请求只有长度已知的请求体(代理转发的小请求体)在内存中
+	if opts.stream {
+		return req.GetBody != nil && req.ContentLength > 0
+	}
+	return req.GetBody != nil
+}
+
+// 读取请求体，读取后恢复body
+func requestBodyBytes(req *http.Request) ([]byte, error) {
+	if req.GetBody != nil {
+		rc, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return ioutil.ReadAll(rc)
+	}
+
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadAll(req.Body)
+	_ = req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(data))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	return data, nil
+}
@@ -0,0 +1,412 @@
+package base
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/peerless6372/Lplot/klog"
+	"github.com/peerless6372/Lplot/utils"
+	"github.com/peerless6372/gin"
+)
+
+// multipart 上传的文件，Path 与 Reader 二选一
+// 全部使用 Path 时请求体可重放，支持重试
+type UploadFile struct {
+	FieldName   string
+	FileName    string
+	Path        string
+	Reader      io.Reader
+	ContentType string
+}
+
+type StreamResult struct {
+	HttpCode int
+	Header   http.Header
+	// 调用方必须 Close，关闭时打印本次请求的module日志(含传输字节数)
+	Body io.ReadCloser
+}
+
+// 统计读取的字节数，关闭时归还连接并打印日志
+type streamBody struct {
+	io.ReadCloser
+	n      int64
+	closed int32
+	onEnd  func(n int64)
+}
+
+func (b *streamBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.n, int64(n))
+	return n, err
+}
+
+func (b *streamBody) Close() error {
+	if !atomic.CompareAndSwapInt32(&b.closed, 0, 1) {
+		return nil
+	}
+	// 读完剩余的少量数据，连接才能被连接池复用
+	_, _ = io.CopyN(ioutil.Discard, b.ReadCloser, 16384)
+	err := b.ReadCloser.Close()
+	b.onEnd(atomic.LoadInt64(&b.n))
+	return err
+}
+
+// HttpStream 发出请求并以流的方式返回响应体
+// GET 请求参数拼在query中，其余方法优先使用 opts.BodyReader 作为请求体
+func (client *ApiClient) HttpStream(ctx *gin.Context, method, path string, opts HttpRequestOptions) (*StreamResult, error) {
+	u := client.baseURL() + path
+
+	var body io.Reader
+	if opts.BodyReader != nil && method != http.MethodGet {
+		body = opts.BodyReader
+	} else {
+		data, err := opts.GetData()
+		if err != nil {
+			klog.WarnLogger(ctx, "http client make data error: "+err.Error(), klog.String(klog.TopicType, klog.LogNameModule))
+			return nil, err
+		}
+		if method == http.MethodGet {
+			if data != "" {
+				u += "?" + data
+			}
+		} else {
+			body = strings.NewReader(data)
+		}
+	}
+
+	opts.stream = true
+	req, err := client.makeRequest(ctx, method, u, body, opts)
+	if err != nil {
+		klog.WarnLogger(ctx, "http client makeRequest error: "+err.Error(), klog.String(klog.TopicType, klog.LogNameModule))
+		return nil, err
+	}
+	return client.doStream(ctx, req, &opts)
+}
+
+func (client *ApiClient) doStream(ctx *gin.Context, req *http.Request, opts *HttpRequestOptions) (*StreamResult, error) {
+	start := time.Now()
+	fields := []klog.Field{
+		klog.String(klog.TopicType, klog.LogNameModule),
+		klog.String("prot", "http"),
+		klog.String("service", client.Service),
+		klog.String("method", req.Method),
+		klog.String("domain", client.getDomain()),
+		klog.String("requestUri", req.URL.Path),
+		klog.String("requestStartTime", utils.GetFormatRequestTime(start)),
+		klog.Bool("stream", true),
+	}
+
+	if err := client.lazyInit(); err != nil {
+		return nil, err
+	}
+
+	inv, resp, err := client.invoke(ctx, req, opts)
+	fields = append(fields, klog.String("retry", fmt.Sprintf("%d/%d", inv.Attempt-1, client.retry(req.URL.Path))))
+	if err != nil {
+		if resp != nil {
+			drainAndCloseBody(resp, 16384)
+		}
+		end := time.Now()
+		fields = append(fields,
+			klog.String("requestEndTime", utils.GetFormatRequestTime(end)),
+			klog.Float64("cost", utils.GetRequestCost(start, end)),
+			klog.Int("ralCode", -1),
+		)
+		klog.InfoLogger(ctx, err.Error(), fields...)
+		client.observe(req.Method, client.metricPath(req.URL.Path, opts), 0, start)
+		return nil, err
+	}
+
+	body := &streamBody{ReadCloser: resp.Body}
+	body.onEnd = func(n int64) {
+		end := time.Now()
+		f := append(fields,
+			klog.Int("httpCode", resp.StatusCode),
+			klog.Int64("bytes", n),
+			klog.String("requestEndTime", utils.GetFormatRequestTime(end)),
+			klog.Float64("cost", utils.GetRequestCost(start, end)),
+			klog.Int("ralCode", client.calRalCode(resp, nil)),
+		)
+		klog.InfoLogger(ctx, "http stream success", f...)
+		client.observe(req.Method, client.metricPath(req.URL.Path, opts), resp.StatusCode, start)
+	}
+
+	return &StreamResult{
+		HttpCode: resp.StatusCode,
+		Header:   resp.Header,
+		Body:     body,
+	}, nil
+}
+
+// HttpUpload 以 multipart/form-data 上传文件，表单字段取自 opts.Data 或 opts.RequestBody(map[string]string)
+func (client *ApiClient) HttpUpload(ctx *gin.Context, path string, opts HttpRequestOptions) (*ApiResult, error) {
+	fields := opts.Data
+	if len(fields) == 0 {
+		fields, _ = opts.RequestBody.(map[string]string)
+	}
+
+	boundary := multipart.NewWriter(nil).Boundary()
+	if client.Replay.mode() != ReplayModeOff {
+		// 录制回放按请求体匹配，boundary需要固定
+		boundary = stableBoundary(fields, opts.Files)
+	}
+	newBody := func() io.ReadCloser {
+		pr, pw := io.Pipe()
+		go func() {
+			_ = pw.CloseWithError(writeMultipart(pw, boundary, fields, opts.Files))
+		}()
+		return pr
+	}
+
+	rewindable := true
+	for _, f := range opts.Files {
+		if f.Path == "" {
+			rewindable = false
+		}
+	}
+
+	// 可重放时由重试拦截器通过 GetBody 生成每次的请求体
+	var body io.ReadCloser
+	if !rewindable {
+		body = newBody()
+	}
+
+	u := client.baseURL() + path
+	opts.stream = true
+	opts.BodyType = "multipart/form-data; boundary=" + boundary
+	req, err := client.makeRequest(ctx, http.MethodPost, u, body, opts)
+	if err != nil {
+		if body != nil {
+			// 结束写入请求体的goroutine
+			_ = body.Close()
+		}
+		klog.WarnLogger(ctx, "http client makeRequest error: "+err.Error(), klog.String(klog.TopicType, klog.LogNameModule))
+		return nil, err
+	}
+	if rewindable {
+		req.GetBody = func() (io.ReadCloser, error) {
+			return newBody(), nil
+		}
+	}
+
+	res, logFields, err := client.httpDo(ctx, req, &opts)
+
+	msg := "http request success"
+	if err != nil {
+		msg = err.Error()
+	}
+	klog.InfoLogger(ctx, msg, logFields...)
+
+	return &res, err
+}
+
+// 由表单字段与文件信息生成固定的boundary
+func stableBoundary(fields map[string]string, files []UploadFile) string {
+	h := sha256.New()
+	for _, k := range sortedKeys(fields) {
+		_, _ = fmt.Fprintf(h, "%s=%s\n", k, fields[k])
+	}
+	for _, f := range files {
+		_, _ = fmt.Fprintf(h, "%s:%s:%s\n", f.FieldName, f.FileName, f.Path)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:30]
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeMultipart(w io.Writer, boundary string, fields map[string]string, files []UploadFile) error {
+	mw := multipart.NewWriter(w)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return err
+	}
+
+	// 字段按名字排序，相同参数得到相同的请求体
+	for _, k := range sortedKeys(fields) {
+		if err := mw.WriteField(k, fields[k]); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range files {
+		if err := writeMultipartFile(mw, f); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+func writeMultipartFile(mw *multipart.Writer, f UploadFile) error {
+	r := f.Reader
+	name := f.FileName
+	if f.Path != "" {
+		fd, err := os.Open(f.Path)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+		r = fd
+		if name == "" {
+			name = filepath.Base(f.Path)
+		}
+	}
+	if r == nil {
+		return fmt.Errorf("upload file %q has no content", f.FieldName)
+	}
+
+	cType := f.ContentType
+	if cType == "" {
+		cType = "application/octet-stream"
+	}
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
+		escapeQuotes(f.FieldName), escapeQuotes(name)))
+	h.Set("Content-Type", cType)
+
+	part, err := mw.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, r)
+	return err
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+func escapeQuotes(s string) string {
+	return quoteEscaper.Replace(s)
+}
+
+// HttpDownload 下载到本地文件，中断后再次调用(或重试)会通过 Range 从已下载位置继续
+// 下载过程中写入 dst.part，完成后重命名为 dst
+// 重试只在这里进行(每次从已下载位置继续)，不经过重试拦截器
+func (client *ApiClient) HttpDownload(ctx *gin.Context, path, dst string, opts HttpRequestOptions) (int64, error) {
+	part := dst + ".part"
+	backOffPolicy := opts.GetBackOffPolicy()
+	opts.RetryPolicy = noRetryPolicy
+	for attempt := 0; ; attempt++ {
+		n, err := client.downloadOnce(ctx, path, part, opts)
+		if err == nil {
+			return n, os.Rename(part, dst)
+		}
+		if attempt >= client.retry(path) {
+			return n, err
+		}
+		klog.WarnLogger(ctx, "http download interrupted, resume: "+err.Error(),
+			klog.String(klog.TopicType, klog.LogNameModule),
+			klog.String("service", client.Service),
+			klog.String("requestUri", path),
+			klog.Int64("offset", n),
+			klog.Int("attemptCount", attempt+1))
+		time.Sleep(backOffPolicy(attempt + 1))
+	}
+}
+
+var noRetryPolicy RetryPolicy = func(resp *http.Response, err error) bool {
+	return false
+}
+
+func (client *ApiClient) downloadOnce(ctx *gin.Context, path, part string, opts HttpRequestOptions) (int64, error) {
+	var offset int64
+	if info, err := os.Stat(part); err == nil {
+		offset = info.Size()
+	}
+
+	headers := make(map[string]string, len(opts.Headers)+1)
+	for k, v := range opts.Headers {
+		headers[k] = v
+	}
+	if offset > 0 {
+		headers["Range"] = "bytes=" + strconv.FormatInt(offset, 10) + "-"
+	}
+	opts.Headers = headers
+
+	res, err := client.HttpStream(ctx, http.MethodGet, path, opts)
+	if err != nil {
+		return offset, err
+	}
+	defer res.Body.Close()
+
+	flag := os.O_WRONLY | os.O_CREATE
+	switch res.HttpCode {
+	case http.StatusPartialContent:
+		flag |= os.O_APPEND
+	case http.StatusOK:
+		// 服务端不支持 Range，从头下载
+		offset = 0
+		flag |= os.O_TRUNC
+	case http.StatusRequestedRangeNotSatisfiable:
+		if offset > 0 {
+			// 已下载完整
+			return offset, nil
+		}
+		fallthrough
+	default:
+		return offset, fmt.Errorf("http download unexpected status: %d", res.HttpCode)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(part), 0755); err != nil {
+		return offset, err
+	}
+	fd, err := os.OpenFile(part, flag, 0644)
+	if err != nil {
+		return offset, err
+	}
+	n, err := io.Copy(fd, res.Body)
+	if e := fd.Close(); err == nil {
+		err = e
+	}
+	return offset + n, err
+}
+
+// 请求体gzip压缩，仅处理长度已知且可重放的请求体
+func gzipRequestBody(req *http.Request) error {
+	if req.GetBody == nil || req.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+
+	rc, err := req.GetBody()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err = io.Copy(zw, rc); err != nil {
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		return err
+	}
+
+	data := buf.Bytes()
+	req.Body = ioutil.NopCloser(bytes.NewReader(data))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	req.ContentLength = int64(len(data))
+	req.Header.Set("Content-Encoding", "gzip")
+	return nil
+}
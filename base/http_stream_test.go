@@ -0,0 +1,180 @@
+package base
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHttpDownload(t *testing.T) {
+	content := strings.Repeat("0123456789", 1000)
+	var (
+		hits   int
+		ranges []string
+		handle func(w http.ResponseWriter, start int)
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		ranges = append(ranges, r.Header.Get("Range"))
+		start, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.Header.Get("Range"), "bytes="), "-"))
+		handle(w, start)
+	}))
+	defer srv.Close()
+
+	// 第一次只返回部分内容后断开连接
+	interrupt := func(rangeOK bool) func(w http.ResponseWriter, start int) {
+		return func(w http.ResponseWriter, start int) {
+			if hits == 1 {
+				w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+				_, _ = w.Write([]byte(content[:3000]))
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				_ = conn.Close()
+				return
+			}
+			if rangeOK && start > 0 {
+				w.WriteHeader(http.StatusPartialContent)
+				_, _ = w.Write([]byte(content[start:]))
+				return
+			}
+			_, _ = w.Write([]byte(content))
+		}
+	}
+	cases := []struct {
+		name   string
+		part   string
+		handle func(w http.ResponseWriter, start int)
+		ranges []string
+		ok     bool
+	}{
+		{"resume", "", interrupt(true), []string{"", "bytes=3000-"}, true},
+		// 服务端不支持Range时从头下载
+		{"no range", "", interrupt(false), []string{"", "bytes=3000-"}, true},
+		{"already done", content, func(w http.ResponseWriter, start int) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		}, []string{"bytes=10000-"}, true},
+		// 只在下载层重试，不经过重试拦截器
+		{"retry exhausted", "", func(w http.ResponseWriter, start int) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}, []string{"", "", ""}, false},
+	}
+	client := &ApiClient{Service: "svc", Domain: srv.URL, Retry: 2}
+	for _, c := range cases {
+		hits, ranges, handle = 0, nil, c.handle
+		dst := filepath.Join(t.TempDir(), "out.bin")
+		if c.part != "" {
+			_ = ioutil.WriteFile(dst+".part", []byte(c.part), 0644)
+		}
+		_, err := client.HttpDownload(nil, "/dl", dst, HttpRequestOptions{})
+		b, _ := ioutil.ReadFile(dst)
+		ok := err == nil && string(b) == content
+		if ok != c.ok || strings.Join(ranges, ",") != strings.Join(c.ranges, ",") {
+			t.Errorf("%s: err %v size %d ranges %q", c.name, err, len(b), ranges)
+		}
+	}
+}
+
+func TestHttpUpload(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, h, err := r.FormFile("file")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		b, _ := ioutil.ReadAll(f)
+		_, _ = w.Write([]byte(h.Filename + ":" + r.FormValue("k") + ":" + string(b)))
+	}))
+	defer srv.Close()
+
+	src := filepath.Join(t.TempDir(), "up.txt")
+	_ = ioutil.WriteFile(src, []byte("from file"), 0644)
+	cases := []struct {
+		name string
+		file UploadFile
+		want string
+	}{
+		{"path", UploadFile{FieldName: "file", Path: src}, "up.txt:v:from file"},
+		{"reader", UploadFile{FieldName: "file", FileName: "r.txt", Reader: strings.NewReader("from reader")}, "r.txt:v:from reader"},
+		{"missing file", UploadFile{FieldName: "file", Path: src + ".none"}, "error"},
+	}
+	client := &ApiClient{Service: "svc", Domain: srv.URL}
+	for _, c := range cases {
+		res, err := client.HttpUpload(nil, "/up", HttpRequestOptions{Data: map[string]string{"k": "v"}, Files: []UploadFile{c.file}})
+		got := "error"
+		if err == nil {
+			got = string(res.Response)
+		}
+		if got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+
+	// 录制回放时相同的表单生成相同的boundary
+	fields := map[string]string{"a": "1", "b": "2"}
+	files := []UploadFile{{FieldName: "f", Path: "/x"}}
+	if stableBoundary(fields, files) != stableBoundary(map[string]string{"b": "2", "a": "1"}, files) {
+		t.Error("boundary not stable")
+	}
+
+	// 请求失败时关闭pipe，写goroutine退出
+	bad := &ApiClient{Service: "svc", Domain: "http://[::1"}
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		if _, err := bad.HttpUpload(nil, "/up", HttpRequestOptions{Files: []UploadFile{{FieldName: "f", Reader: strings.NewReader("x")}}}); err == nil {
+			t.Fatal("expect error")
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := runtime.NumGoroutine(); n > before+5 {
+		t.Errorf("goroutine leak %d -> %d", before, n)
+	}
+}
+
+func TestGzipRequestBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = zr
+		}
+		b, _ := ioutil.ReadAll(body)
+		_, _ = w.Write([]byte(r.Header.Get("Content-Encoding") + ":" + strconv.Itoa(len(b))))
+	}))
+	defer srv.Close()
+
+	client := &ApiClient{Service: "svc", Domain: srv.URL, GzipThreshold: 100}
+	cases := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"small", "x", ":3"},
+		{"large", strings.Repeat("x", 200), "gzip:202"},
+	}
+	for _, c := range cases {
+		res, err := client.HttpPost(nil, "/gz", HttpRequestOptions{RequestBody: map[string]string{"a": c.body}})
+		if err != nil || string(res.Response) != c.want {
+			t.Errorf("%s: got %v %v, want %s", c.name, res, err, c.want)
+		}
+	}
+
+	s, err := client.HttpStream(nil, http.MethodGet, "/gz", HttpRequestOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(s.Body)
+	_ = s.Body.Close()
+	if s.HttpCode != http.StatusOK || string(b) != ":0" {
+		t.Errorf("stream: %d %s", s.HttpCode, b)
+	}
+}
@@ -0,0 +1,138 @@
+package base
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// 单个client独立的transport配置，未指定的字段继承全局transport(InitHttp)
+type HttpTransportConf struct {
+	MaxIdleConns          int           `yaml:"maxIdleConns"`
+	MaxIdleConnsPerHost   int           `yaml:"maxIdleConnsPerHost"`
+	MaxConnsPerHost       int           `yaml:"maxConnsPerHost"`
+	IdleConnTimeout       time.Duration `yaml:"idleConnTimeout"`
+	ResponseHeaderTimeout time.Duration `yaml:"responseHeaderTimeout"`
+	// 自定义 dial / tls 后标准库默认不会尝试http2，需显式打开
+	HTTP2 bool        `yaml:"http2"`
+	TLS   HttpTLSConf `yaml:"tls"`
+	// 不使用 InitDNSCache 开启的进程内DNS缓存
+	DisableDNSCache bool `yaml:"disableDNSCache"`
+}
+
+type HttpTLSConf struct {
+	// 自定义CA证书(pem)，为空使用系统证书
+	CAFile string `yaml:"caFile"`
+	// 双向认证(mTLS)时的客户端证书
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// 覆盖证书校验时使用的server name
+	ServerName         string `yaml:"serverName"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+}
+
+func (conf HttpTLSConf) enable() bool {
+	return conf.CAFile != "" || conf.CertFile != "" || conf.KeyFile != "" ||
+		conf.ServerName != "" || conf.InsecureSkipVerify
+}
+
+func (conf HttpTLSConf) tlsConfig() (*tls.Config, error) {
+	c := &tls.Config{
+		ServerName:         conf.ServerName,
+		InsecureSkipVerify: conf.InsecureSkipVerify,
+	}
+
+	if conf.CAFile != "" {
+		pem, err := ioutil.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ca file error: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no valid certificate found in ca file: " + conf.CAFile)
+		}
+		c.RootCAs = pool
+	}
+
+	if conf.CertFile != "" || conf.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate error: %w", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	return c, nil
+}
+
+func defaultTransport() *http.Transport {
+	if globalTransport != nil {
+		return globalTransport
+	}
+	return &http.Transport{
+		MaxIdleConns:        500,
+		MaxIdleConnsPerHost: 100,
+		IdleConnTimeout:     300 * time.Second,
+	}
+}
+
+// 基于全局transport复制出该client独享的transport
+func (client *ApiClient) newTransport() (*http.Transport, error) {
+	trans := defaultTransport().Clone()
+
+	if client.Proxy != "" {
+		proxy, err := url.Parse(client.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q: %w", client.Proxy, err)
+		}
+		trans.Proxy = http.ProxyURL(proxy)
+	} else {
+		trans.Proxy = nil
+	}
+
+	conf := client.Transport
+	dialer := &net.Dialer{
+		Timeout: client.ConnectTimeout,
+	}
+	dial := dialer.DialContext
+	if globalResolver != nil && !conf.DisableDNSCache {
+		dial = globalResolver.DialContext(dialer)
+	}
+	// unix:// 地址转换后的虚拟host走unix socket
+	trans.DialContext = unixDialContext(dial, dialer)
+
+	if conf.MaxIdleConns > 0 {
+		trans.MaxIdleConns = conf.MaxIdleConns
+	}
+	if conf.MaxIdleConnsPerHost > 0 {
+		trans.MaxIdleConnsPerHost = conf.MaxIdleConnsPerHost
+	}
+	if conf.MaxConnsPerHost > 0 {
+		trans.MaxConnsPerHost = conf.MaxConnsPerHost
+	}
+	if conf.IdleConnTimeout > 0 {
+		trans.IdleConnTimeout = conf.IdleConnTimeout
+	}
+	if conf.ResponseHeaderTimeout > 0 {
+		trans.ResponseHeaderTimeout = conf.ResponseHeaderTimeout
+	}
+	if conf.HTTP2 {
+		trans.ForceAttemptHTTP2 = true
+	}
+
+	if conf.TLS.enable() {
+		tlsConf, err := conf.TLS.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		trans.TLSClientConfig = tlsConf
+	}
+
+	return trans, nil
+}
@@ -0,0 +1,160 @@
+package base
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/peerless6372/Lplot/klog"
+)
+
+// 日志写到临时目录
+func TestMain(m *testing.M) {
+	dir, _ := ioutil.TempDir("", "base")
+	klog.InitLog(klog.LogConfig{Level: "debug", Path: dir, Log2File: true})
+	// 提前创建logger，避免并发请求懒加载时竞争
+	klog.GetZapLogger()
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestNewTransport(t *testing.T) {
+	old := globalTransport
+	defer func() { globalTransport = old }()
+	globalTransport = &http.Transport{MaxIdleConns: 10, MaxIdleConnsPerHost: 5, IdleConnTimeout: time.Minute}
+
+	cases := []struct {
+		name  string
+		conf  HttpTransportConf
+		proxy string
+		check func(tr *http.Transport) bool
+		err   bool
+	}{
+		{"inherit global", HttpTransportConf{}, "", func(tr *http.Transport) bool {
+			return tr.MaxIdleConns == 10 && tr.MaxIdleConnsPerHost == 5 && tr.IdleConnTimeout == time.Minute &&
+				tr.Proxy == nil && !tr.ForceAttemptHTTP2
+		}, false},
+		{"override", HttpTransportConf{MaxIdleConns: 1, MaxIdleConnsPerHost: 2, MaxConnsPerHost: 3,
+			IdleConnTimeout: time.Second, ResponseHeaderTimeout: 2 * time.Second, HTTP2: true}, "", func(tr *http.Transport) bool {
+			return tr.MaxIdleConns == 1 && tr.MaxIdleConnsPerHost == 2 && tr.MaxConnsPerHost == 3 &&
+				tr.IdleConnTimeout == time.Second && tr.ResponseHeaderTimeout == 2*time.Second && tr.ForceAttemptHTTP2
+		}, false},
+		{"proxy", HttpTransportConf{}, "http://proxy:3128", func(tr *http.Transport) bool {
+			u, _ := tr.Proxy(httptest.NewRequest(http.MethodGet, "http://a/", nil))
+			return u != nil && u.Host == "proxy:3128"
+		}, false},
+		{"tls", HttpTransportConf{TLS: HttpTLSConf{ServerName: "svc", InsecureSkipVerify: true}}, "", func(tr *http.Transport) bool {
+			return tr.TLSClientConfig != nil && tr.TLSClientConfig.ServerName == "svc" && tr.TLSClientConfig.InsecureSkipVerify
+		}, false},
+		{"invalid proxy", HttpTransportConf{}, "://x", nil, true},
+		{"missing ca", HttpTransportConf{TLS: HttpTLSConf{CAFile: "/nonexistent/ca.pem"}}, "", nil, true},
+		{"missing cert", HttpTransportConf{TLS: HttpTLSConf{CertFile: "/nonexistent/c.pem", KeyFile: "/nonexistent/k.pem"}}, "", nil, true},
+	}
+	for _, c := range cases {
+		client := &ApiClient{Service: "svc", Transport: c.conf, Proxy: c.proxy}
+		tr, err := client.newTransport()
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expect error", c.name)
+			}
+			continue
+		}
+		if err != nil || !c.check(tr) {
+			t.Errorf("%s: %v %+v", c.name, err, tr)
+		}
+		// 每个client独享，不修改全局transport
+		if tr == globalTransport {
+			t.Errorf("%s: shared global transport", c.name)
+		}
+	}
+	if globalTransport.MaxIdleConns != 10 || globalTransport.ForceAttemptHTTP2 || globalTransport.Proxy != nil {
+		t.Errorf("global transport modified %+v", globalTransport)
+	}
+}
+
+// 生成证书，parent为nil时自签
+func newTestCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, isCA bool) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:         isCA,
+
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		parent, parentKey = tpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".key")
+	_ = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	_ = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return cert, key, certFile, keyFile
+}
+
+func TestTransportMTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caFile, _ := newTestCert(t, dir, "ca", nil, nil, true)
+	_, _, serverCert, serverKey := newTestCert(t, dir, "svc.local", ca, caKey, false)
+	_, _, clientCert, clientKey := newTestCert(t, dir, "client", ca, caKey, false)
+
+	srvCert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{srvCert}, ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	srv.StartTLS()
+	defer srv.Close()
+
+	cases := []struct {
+		name string
+		tls  HttpTLSConf
+		ok   bool
+	}{
+		{"mtls", HttpTLSConf{CAFile: caFile, CertFile: clientCert, KeyFile: clientKey, ServerName: "svc.local"}, true},
+		{"server name mismatch", HttpTLSConf{CAFile: caFile, CertFile: clientCert, KeyFile: clientKey}, false},
+		{"unknown ca", HttpTLSConf{CertFile: clientCert, KeyFile: clientKey, ServerName: "svc.local"}, false},
+		{"no client cert", HttpTLSConf{CAFile: caFile, ServerName: "svc.local"}, false},
+		{"skip verify", HttpTLSConf{CertFile: clientCert, KeyFile: clientKey, InsecureSkipVerify: true}, true},
+	}
+	for _, c := range cases {
+		client := &ApiClient{Service: "svc", Domain: srv.URL, Transport: HttpTransportConf{TLS: c.tls}}
+		res, err := client.HttpGet(nil, "/", HttpRequestOptions{})
+		if ok := err == nil && string(res.Response) == "client"; ok != c.ok {
+			t.Errorf("%s: got %v %v", c.name, res, err)
+		}
+	}
+}
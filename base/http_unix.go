@@ -0,0 +1,72 @@
+package base
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// unix socket 地址：unix:///path/to.sock
+const unixScheme = "unix://"
+
+// 请求unix socket时默认的Host header，可通过 ApiClient.Host 覆盖
+const UnixDefaultHost = "localhost"
+
+// 虚拟host -> socket路径
+var unixSockets sync.Map
+
+// 把 unix:///path/to.sock 转换为 http://<虚拟host>，建连时再根据虚拟host找到socket
+// 连接池按虚拟host区分，与tcp地址的复用方式一致
+func endpointURL(endpoint string) string {
+	if !strings.HasPrefix(endpoint, unixScheme) {
+		return endpoint
+	}
+	sock := strings.TrimPrefix(endpoint, unixScheme)
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(sock))
+	host := fmt.Sprintf("unix-%08x.sock", h.Sum32())
+	unixSockets.Store(host, sock)
+	return "http://" + host
+}
+
+func unixSocket(addr string) (string, bool) {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	if !strings.HasPrefix(host, "unix-") {
+		return "", false
+	}
+	v, ok := unixSockets.Load(host)
+	if !ok {
+		return "", false
+	}
+	return v.(string), true
+}
+
+// 请求地址为unix socket时使用默认Host header
+func defaultHost(u *url.URL) string {
+	if _, ok := unixSocket(u.Host); ok {
+		return UnixDefaultHost
+	}
+	return ""
+}
+
+// 虚拟host的连接走unix socket，其余使用 next
+func unixDialContext(next func(ctx context.Context, network, addr string) (net.Conn, error), dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if sock, ok := unixSocket(addr); ok {
+			return dialer.DialContext(ctx, "unix", sock)
+		}
+		return next(ctx, network, addr)
+	}
+}
+
+// 发出请求使用的地址
+func (client *ApiClient) baseURL() string {
+	return endpointURL(client.getDomain())
+}
@@ -0,0 +1,90 @@
+package base
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestEndpointURL(t *testing.T) {
+	a, b := endpointURL("unix:///tmp/a.sock"), endpointURL("unix:///tmp/b.sock")
+	cases := []struct {
+		name     string
+		endpoint string
+		want     string
+		sock     string
+	}{
+		{"tcp", "http://a:80", "http://a:80", ""},
+		// 同一个socket得到相同的虚拟host
+		{"unix", "unix:///tmp/a.sock", a, "/tmp/a.sock"},
+		{"other unix", "unix:///tmp/b.sock", b, "/tmp/b.sock"},
+	}
+	for _, c := range cases {
+		got := endpointURL(c.endpoint)
+		u, _ := url.Parse(got)
+		sock, _ := unixSocket(u.Host + ":80")
+		if got != c.want || sock != c.sock {
+			t.Errorf("%s: got %s sock %q", c.name, got, sock)
+		}
+		if host := defaultHost(u); (host == UnixDefaultHost) != (c.sock != "") {
+			t.Errorf("%s: default host %q", c.name, host)
+		}
+	}
+	if a == b || !strings.HasPrefix(a, "http://unix-") {
+		t.Errorf("virtual hosts %s %s", a, b)
+	}
+	// 未注册的虚拟host不走unix socket
+	if _, ok := unixSocket("unix-00000000.sock:80"); ok {
+		t.Error("unknown virtual host")
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var flaky, conns int32
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/flaky" && atomic.AddInt32(&flaky, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte(r.Host + r.URL.Path))
+	}), ConnState: func(c net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}}
+	go func() { _ = srv.Serve(l) }()
+	defer srv.Close()
+
+	client := &ApiClient{Service: "agent", Domain: "unix://" + sock, Retry: 1, HttpStat: true}
+	withHost := &ApiClient{Service: "agent", Domain: "unix://" + sock, Host: "svc.internal"}
+	cases := []struct {
+		name   string
+		client *ApiClient
+		path   string
+		want   string
+	}{
+		{"get", client, "/v1/x", "localhost/v1/x"},
+		{"keepalive", client, "/v1/y", "localhost/v1/y"},
+		// 重试复用同一个连接
+		{"retry", client, "/flaky", "localhost/flaky"},
+		{"host header", withHost, "/h", "svc.internal/h"},
+	}
+	for _, c := range cases {
+		res, err := c.client.HttpPost(nil, c.path, HttpRequestOptions{Data: map[string]string{"a": "b"}})
+		if err != nil || string(res.Response) != c.want {
+			t.Errorf("%s: got %v %v, want %s", c.name, res, err, c.want)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 2 {
+		t.Errorf("conns %d", n)
+	}
+}
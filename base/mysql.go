@@ -2,14 +2,17 @@ package base
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"github.com/peerless6372/Lplot/env"
 	"github.com/peerless6372/Lplot/klog"
+	"github.com/peerless6372/Lplot/metrics"
+	"github.com/peerless6372/Lplot/trace"
 	"github.com/peerless6372/Lplot/utils"
+	"strings"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
-	"github.com/peerless6372/gin"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
@@ -31,6 +34,12 @@ type MysqlConf struct {
 	ConnTimeOut     time.Duration `yaml:"connTimeOut"`
 	WriteTimeOut    time.Duration `yaml:"writeTimeOut"`
 	ReadTimeOut     time.Duration `yaml:"readTimeOut"`
+	// 压测流量的影子库(同一实例)，配置后压测流量读写该库
+	PressureDataBase string `yaml:"pressureDatabase"`
+	// 压测流量的影子表后缀，未配置影子库时默认 _pt
+	PressureTableSuffix string `yaml:"pressureTableSuffix"`
+	// 泳道流量是否使用 表名_泳道 的影子表
+	ColorTable bool `yaml:"colorTable"`
 }
 
 func (conf *MysqlConf) checkConf() {
@@ -54,16 +63,17 @@ func (conf *MysqlConf) checkConf() {
 	if conf.ReadTimeOut == 0 {
 		conf.ReadTimeOut = 1 * time.Second
 	}
+	if conf.PressureDataBase == "" && conf.PressureTableSuffix == "" {
+		conf.PressureTableSuffix = defaultPressureTableSuffix
+	}
 }
 
-func InitMysqlClient(conf MysqlConf) (client *gorm.DB, err error) {
-	conf.checkConf()
-
+func (conf *MysqlConf) dsn(database string) string {
 	dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s?timeout=%s&readTimeout=%s&writeTimeout=%s&parseTime=True&loc=Asia%%2FShanghai",
 		conf.User,
 		conf.Password,
 		conf.Addr,
-		conf.DataBase,
+		database,
 		conf.ConnTimeOut,
 		conf.ReadTimeOut,
 		conf.WriteTimeOut)
@@ -71,6 +81,13 @@ func InitMysqlClient(conf MysqlConf) (client *gorm.DB, err error) {
 	if conf.Charset != "" {
 		dsn = dsn + "&charset=" + conf.Charset
 	}
+	return dsn
+}
+
+func InitMysqlClient(conf MysqlConf) (client *gorm.DB, err error) {
+	conf.checkConf()
+
+	dsn := conf.dsn(conf.DataBase)
 
 	c := &gorm.Config{
 		SkipDefaultTransaction:                   true,
@@ -108,9 +125,49 @@ func InitMysqlClient(conf MysqlConf) (client *gorm.DB, err error) {
 	// SetConnMaxLifetime 设置了连接可复用的最大时间
 	sqlDB.SetConnMaxLifetime(conf.ConnMaxLifeTime)
 
+	metrics.OnCollect(collectMysqlPool(conf.Service, sqlDB))
+
+	if err = initPressure(client, sqlDB, &conf); err != nil {
+		return client, err
+	}
+
 	return client, nil
 }
 
+// 压测流量隔离：影子库优先，否则使用影子表；泳道流量按配置使用泳道表
+func initPressure(client *gorm.DB, sqlDB *sql.DB, conf *MysqlConf) error {
+	if conf.PressureTableSuffix != "" || conf.ColorTable {
+		if err := registerShadowTable(client, conf.PressureTableSuffix, conf.ColorTable); err != nil {
+			return err
+		}
+	}
+	if conf.PressureDataBase == "" {
+		return nil
+	}
+
+	shadow, err := sql.Open("mysql", conf.dsn(conf.PressureDataBase))
+	if err != nil {
+		return err
+	}
+	shadow.SetMaxIdleConns(conf.MaxIdleConns)
+	shadow.SetMaxOpenConns(conf.MaxOpenConns)
+	shadow.SetConnMaxLifetime(conf.ConnMaxLifeTime)
+
+	pool := &pressureConnPool{db: sqlDB, shadow: shadow}
+	client.ConnPool = pool
+	client.Statement.ConnPool = pool
+	return nil
+}
+
+// sql的第一个关键字，如 SELECT
+func sqlOperation(stmt string) string {
+	stmt = strings.TrimSpace(stmt)
+	if i := strings.IndexAny(stmt, " \n\t("); i > 0 {
+		stmt = stmt[:i]
+	}
+	return strings.ToUpper(stmt)
+}
+
 type ormLogger struct {
 	Service  string
 	Addr     string
@@ -140,38 +197,40 @@ func (l *ormLogger) LogMode(level logger.LogLevel) logger.Interface {
 func (l ormLogger) Info(ctx context.Context, msg string, data ...interface{}) {
 	m := fmt.Sprintf(msg, append([]interface{}{ormUtil.FileWithLineNum()}, data...)...)
 	// 非trace日志改为debug级别输出
-	klog.DebugLogger(nil, m, l.commonFields(ctx)...)
+	klog.DebugContext(ctx, m, l.commonFields(ctx)...)
 }
 
 // Warn print warn messages
 func (l ormLogger) Warn(ctx context.Context, msg string, data ...interface{}) {
 	m := fmt.Sprintf(msg, append([]interface{}{ormUtil.FileWithLineNum()}, data...)...)
-	klog.WarnLogger(nil, m, l.commonFields(ctx)...)
+	klog.WarnContext(ctx, m, l.commonFields(ctx)...)
 }
 
 // Error print error messages
 func (l ormLogger) Error(ctx context.Context, msg string, data ...interface{}) {
 	m := fmt.Sprintf(msg, append([]interface{}{ormUtil.FileWithLineNum()}, data...)...)
-	klog.ErrorLogger(nil, m, l.commonFields(ctx)...)
+	klog.ErrorContext(ctx, m, l.commonFields(ctx)...)
 }
 
 func (l ormLogger) commonFields(ctx context.Context) []klog.Field {
-	var logID, requestID string
-	if c, ok := ctx.(*gin.Context); ok && c != nil {
-		logID, _ = ctx.Value(klog.ContextKeyLogID).(string)
-		requestID, _ = ctx.Value(klog.ContextKeyRequestID).(string)
-	}
+	// requestId、uri、module 由 klog 从ctx中获取
+	logID, _ := ctx.Value(klog.ContextKeyLogID).(string)
 
 	fields := []klog.Field{
 		klog.String(klog.TopicType, klog.LogNameModule),
 		klog.String("logId", logID),
-		klog.String("requestId", requestID),
 		klog.String("prot", "mysql"),
-		klog.String("module", env.GetAppName()),
 		klog.String("service", l.Service),
 		klog.String("addr", l.Addr),
 		klog.String("db", l.Database),
 	}
+	// 没有请求信息时klog不会附加这些字段，保持日志字段一致
+	if !klog.HasLogContext(ctx) {
+		fields = append(fields,
+			klog.String("requestId", ""),
+			klog.String("module", env.GetAppName()),
+		)
+	}
 	return fields
 }
 
@@ -192,6 +251,17 @@ func (l ormLogger) Trace(ctx context.Context, begin time.Time, fc func() (string
 	sql, rows := fc()
 	fileLineNum := ormUtil.FileWithLineNum()
 
+	// 调用结束后才回调，按begin补建span
+	span := trace.StartSpanAt(ctx, "mysql "+sqlOperation(sql), trace.SpanKindClient, begin)
+	span.SetAttr("db.system", "mysql")
+	span.SetAttr("db.name", l.Database)
+	span.SetAttr("db.statement", sql)
+	span.SetAttr("db.rows", rows)
+	span.SetAttr("peer.service", l.Service)
+	span.SetError(err)
+	span.EndAt(end)
+	observeQuery(l.Service, sql, err, elapsed)
+
 	fields := l.commonFields(ctx)
 	fields = append(fields,
 		klog.String("sql", sql),
@@ -203,5 +273,5 @@ func (l ormLogger) Trace(ctx context.Context, begin time.Time, fc func() (string
 		klog.Int("ralCode", ralCode),
 	)
 
-	klog.InfoLogger(nil, msg, fields...)
+	klog.InfoContext(ctx, msg, fields...)
 }
@@ -0,0 +1,58 @@
+package base
+
+import (
+	"database/sql"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/peerless6372/Lplot/metrics"
+	"gorm.io/gorm"
+)
+
+var (
+	mysqlQueries = metrics.NewCounterVec("mysql_queries_total",
+		"Total mysql statements executed through gorm.", "service", "table", "operation", "result")
+	mysqlDuration = metrics.NewHistogramVec("mysql_query_duration_seconds",
+		"Mysql statement latency in seconds.", nil, "service", "table", "operation")
+	mysqlPool = metrics.NewGaugeVec("mysql_pool_connections",
+		"Mysql pool connections by state.", "service", "state")
+	mysqlPoolWait = metrics.NewGaugeVec("mysql_pool_wait_count",
+		"Number of connections waited for since the pool was opened.", "service")
+	mysqlPoolWaitSeconds = metrics.NewGaugeVec("mysql_pool_wait_duration_seconds",
+		"Time blocked waiting for a connection since the pool was opened.", "service")
+)
+
+// 取sql中第一个表名，如 SELECT * FROM `user` -> user
+var sqlTableRe = regexp.MustCompile("(?i)\\b(?:from|into|update|join)\\s+`?([a-zA-Z0-9_.$]+)`?")
+
+func sqlTable(stmt string) string {
+	if m := sqlTableRe.FindStringSubmatch(stmt); m != nil {
+		return strings.ToLower(m[1])
+	}
+	return "unknown"
+}
+
+func observeQuery(service, stmt string, err error, elapsed time.Duration) {
+	table, op := sqlTable(stmt), sqlOperation(stmt)
+	// 查询不到记录不算失败
+	result := "ok"
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		result = "error"
+	}
+	mysqlQueries.With(service, table, op, result).Inc()
+	mysqlDuration.With(service, table, op).Observe(elapsed.Seconds())
+}
+
+// 采集时读取连接池状态
+func collectMysqlPool(service string, db *sql.DB) func() {
+	return func() {
+		s := db.Stats()
+		mysqlPool.With(service, "open").Set(float64(s.OpenConnections))
+		mysqlPool.With(service, "in_use").Set(float64(s.InUse))
+		mysqlPool.With(service, "idle").Set(float64(s.Idle))
+		mysqlPoolWait.With(service).Set(float64(s.WaitCount))
+		mysqlPoolWaitSeconds.With(service).Set(s.WaitDuration.Seconds())
+	}
+}
@@ -0,0 +1,125 @@
+package base
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/peerless6372/Lplot/utils/metadata"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 压测流量默认使用的影子表后缀
+const defaultPressureTableSuffix = "_pt"
+
+// 压测/泳道流量使用影子表：gorm生成的sql中表名加后缀(泳道 _color 在前，压测后缀在后)
+// db.Table 指定的表名与带库名的表(TableExpr)同样加后缀，无法改写的表达式(子查询、带参数等)直接报错，避免读写线上表
+// db.Raw/db.Exec 手写的sql不处理
+func registerShadowTable(db *gorm.DB, pressureSuffix string, colorTable bool) error {
+	fn := func(db *gorm.DB) {
+		suffix := ""
+		if colorTable {
+			if color := metadata.GetColor(db.Statement.Context); color != "" {
+				suffix = "_" + color
+			}
+		}
+		if pressureSuffix != "" && metadata.IsPressureTest(db.Statement.Context) {
+			suffix += pressureSuffix
+		}
+		if suffix == "" {
+			return
+		}
+		if err := shadowStatementTable(db.Statement, suffix); err != nil {
+			_ = db.AddError(err)
+		}
+	}
+
+	name := "lplot:shadow_table"
+	cb := db.Callback()
+	if err := cb.Create().Before("gorm:create").Register(name, fn); err != nil {
+		return err
+	}
+	if err := cb.Query().Before("gorm:query").Register(name, fn); err != nil {
+		return err
+	}
+	if err := cb.Update().Before("gorm:update").Register(name, fn); err != nil {
+		return err
+	}
+	if err := cb.Delete().Before("gorm:delete").Register(name, fn); err != nil {
+		return err
+	}
+	return cb.Row().Before("gorm:row").Register(name, fn)
+}
+
+// 可以改写的表表达式：[库名.]表名[ [AS] 别名]，名称可以带反引号
+var shadowTableExpr = regexp.MustCompile("^((?:`[^`]+`|\\w+)\\.)?(`[^`]+`|\\w+)(\\s+(?:(?i)as\\s+)?(?:`[^`]+`|\\w+))?\\s*$")
+
+var errShadowTableExpr = errors.New("mysql: table expression can not be shadowed")
+
+func shadowStatementTable(stmt *gorm.Statement, suffix string) error {
+	if expr := stmt.TableExpr; expr != nil {
+		m := shadowTableExpr.FindStringSubmatch(expr.SQL)
+		if m == nil || len(expr.Vars) > 0 {
+			return errShadowTableExpr
+		}
+		table := strings.Trim(m[2], "`")
+		if !strings.HasSuffix(table, suffix) {
+			table += suffix
+		}
+		stmt.TableExpr = &clause.Expr{SQL: m[1] + stmt.Quote(table) + m[3]}
+		// 有别名时 Table 为别名，字段仍按别名引用
+		if m[3] == "" {
+			stmt.Table = table
+		}
+		return nil
+	}
+	if t := stmt.Table; t != "" && !strings.HasSuffix(t, suffix) {
+		stmt.Table = t + suffix
+	}
+	return nil
+}
+
+// 压测流量使用影子库：按context选择连接池，手写sql与事务同样生效
+type pressureConnPool struct {
+	db     *sql.DB
+	shadow *sql.DB
+}
+
+func (p *pressureConnPool) pool(ctx context.Context) *sql.DB {
+	if metadata.IsPressureTest(ctx) {
+		return p.shadow
+	}
+	return p.db
+}
+
+func (p *pressureConnPool) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return p.pool(ctx).PrepareContext(ctx, query)
+}
+
+func (p *pressureConnPool) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return p.pool(ctx).ExecContext(ctx, query, args...)
+}
+
+func (p *pressureConnPool) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return p.pool(ctx).QueryContext(ctx, query, args...)
+}
+
+func (p *pressureConnPool) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return p.pool(ctx).QueryRowContext(ctx, query, args...)
+}
+
+func (p *pressureConnPool) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	return p.pool(ctx).BeginTx(ctx, opts)
+}
+
+// client.DB() 返回线上库的连接池
+func (p *pressureConnPool) GetDBConn() (*sql.DB, error) {
+	return p.db, nil
+}
+
+func (p *pressureConnPool) Ping() error {
+	return p.db.Ping()
+}
@@ -0,0 +1,94 @@
+package base
+
+import (
+	"context"
+	"testing"
+
+	"github.com/peerless6372/Lplot/utils/metadata"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+)
+
+type shadowUser struct {
+	ID   int
+	Name string
+}
+
+type shadowSchemaUser struct {
+	ID int
+}
+
+func (shadowSchemaUser) TableName() string { return "app.users" }
+
+func newShadowTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(mysql.New(mysql.Config{
+		DSN:                       "u:p@tcp(127.0.0.1:1)/app",
+		SkipInitializeWithVersion: true,
+	}), &gorm.Config{DryRun: true, SkipDefaultTransaction: true, DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := registerShadowTable(db, defaultPressureTableSuffix, true); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestShadowTable(t *testing.T) {
+	db := newShadowTestDB(t)
+	pressure := metadata.NewContext(context.Background(), metadata.MD{metadata.PressureTest: true})
+	color := metadata.NewContext(context.Background(), metadata.MD{metadata.Color: "blue"})
+	both := metadata.NewContext(context.Background(), metadata.MD{metadata.PressureTest: true, metadata.Color: "blue"})
+
+	cases := []struct {
+		name string
+		ctx  context.Context
+		run  func(tx *gorm.DB) *gorm.DB
+		sql  string
+	}{
+		{"model", pressure, func(tx *gorm.DB) *gorm.DB { return tx.Find(&[]shadowUser{}) },
+			"SELECT * FROM `shadow_users_pt`"},
+		{"online", context.Background(), func(tx *gorm.DB) *gorm.DB { return tx.Find(&[]shadowUser{}) },
+			"SELECT * FROM `shadow_users`"},
+		{"color model", color, func(tx *gorm.DB) *gorm.DB { return tx.Find(&[]shadowUser{}) },
+			"SELECT * FROM `shadow_users_blue`"},
+		{"table", pressure, func(tx *gorm.DB) *gorm.DB { return tx.Table("users").Where("id = ?", 1).Find(&[]shadowUser{}) },
+			"SELECT * FROM `users_pt` WHERE id = ?"},
+		{"table schema", color, func(tx *gorm.DB) *gorm.DB { return tx.Table("app.users").Find(&[]shadowUser{}) },
+			"SELECT * FROM `app`.`users_blue`"},
+		{"table alias", both, func(tx *gorm.DB) *gorm.DB { return tx.Table("users u").Where("u.id = ?", 1).Find(&[]shadowUser{}) },
+			"SELECT * FROM `users_blue_pt` u WHERE u.id = ?"},
+		{"model schema", pressure, func(tx *gorm.DB) *gorm.DB { return tx.Find(&[]shadowSchemaUser{}) },
+			"SELECT * FROM `app`.`users_pt`"},
+		{"update", color, func(tx *gorm.DB) *gorm.DB {
+			return tx.Table("users").Where("id = ?", 1).Update("name", "n")
+		}, "UPDATE `users_blue` SET `name`=? WHERE id = ?"},
+		{"create", pressure, func(tx *gorm.DB) *gorm.DB { return tx.Create(&shadowSchemaUser{ID: 1}) },
+			"INSERT INTO `app`.`users_pt` (`id`) VALUES (?)"},
+	}
+	for _, c := range cases {
+		tx := c.run(db.WithContext(c.ctx))
+		if tx.Error != nil {
+			t.Errorf("%s: %v", c.name, tx.Error)
+			continue
+		}
+		if got := tx.Statement.SQL.String(); got != c.sql {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.sql)
+		}
+	}
+}
+
+func TestShadowTableReject(t *testing.T) {
+	db := newShadowTestDB(t)
+	pressure := metadata.NewContext(context.Background(), metadata.MD{metadata.PressureTest: true})
+
+	tx := db.WithContext(pressure).Table("(?) AS t", db.Table("users")).Find(&[]shadowUser{})
+	if tx.Error == nil {
+		t.Fatalf("expect error, got sql %q", tx.Statement.SQL.String())
+	}
+	// 线上流量不受影响
+	tx = db.WithContext(context.Background()).Table("(?) AS t", db.Table("users")).Find(&[]shadowUser{})
+	if tx.Error != nil {
+		t.Fatal(tx.Error)
+	}
+}
@@ -3,16 +3,49 @@ package base
 import (
 	"net/http"
 	_ "net/http/pprof"
+	"sync"
+
+	"github.com/peerless6372/Lplot/klog"
+	"github.com/peerless6372/Lplot/metrics"
 )
 
 type PprofConfig struct {
 	Enable bool `yaml:"enable"`
 }
 
+// 管理端口，pprof、metrics 与日志级别共用
+const adminAddr = ":6060"
+
+var (
+	adminMux  = http.NewServeMux()
+	adminOnce sync.Once
+)
+
+func startAdmin() {
+	adminOnce.Do(func() {
+		go func() {
+			if err := http.ListenAndServe(adminAddr, adminMux); err != nil {
+				panic("admin server start error: " + err.Error())
+			}
+		}()
+	})
+}
+
 func RegisterProf() {
-	go func() {
-		if err := http.ListenAndServe(":6060", nil); err != nil {
-			panic("pprof server start error: " + err.Error())
-		}
-	}()
+	// net/http/pprof(以及expvar等)注册在 DefaultServeMux 上，未在管理端口注册的path都交给它
+	adminMux.Handle("/", http.DefaultServeMux)
+	startAdmin()
+}
+
+// RegisterMetrics 在管理端口暴露 /metrics，Prometheus text 格式
+func RegisterMetrics() {
+	adminMux.Handle("/metrics", metrics.Handler())
+	startAdmin()
+}
+
+// RegisterLogLevel 在管理端口暴露 /debug/loglevel，运行时查看与修改日志级别
+// 修改级别需要 klog.DebugHeaderKey 签名，见 klog.LevelHandler
+func RegisterLogLevel() {
+	adminMux.Handle("/debug/loglevel", klog.LevelHandler())
+	startAdmin()
 }
@@ -9,7 +9,9 @@ import (
 )
 
 type BootstrapConf struct {
-	Pprof bool `yaml:"pprof"`
+	Pprof    bool `yaml:"pprof"`
+	Metrics  bool `yaml:"metrics"`
+	LogLevel bool `yaml:"logLevel"`
 }
 
 func Bootstraps(router *gin.Engine, conf BootstrapConf) {
@@ -18,6 +20,8 @@ func Bootstraps(router *gin.Engine, conf BootstrapConf) {
 
 	// Global middleware
 	router.Use(middleware.Metadata())
+	// 入口span，未调用 trace.Init 时不做处理
+	router.Use(middleware.Trace())
 	router.Use(middleware.AccessLog())
 	router.Use(gin.Recovery())
 
@@ -31,6 +35,16 @@ func Bootstraps(router *gin.Engine, conf BootstrapConf) {
 		base.RegisterProf()
 	}
 
+	// 监控指标，与pprof共用管理端口
+	if conf.Metrics {
+		base.RegisterMetrics()
+	}
+
+	// 运行时修改日志级别
+	if conf.LogLevel {
+		base.RegisterLogLevel()
+	}
+
 	// 就绪探针
 	router.GET("/ready", base.ReadyProbe())
 }
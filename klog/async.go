@@ -0,0 +1,281 @@
+package klog
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/peerless6372/Lplot/metrics"
+	"go.uber.org/zap/zapcore"
+)
+
+// 异步日志队列满时的策略
+const (
+	// 阻塞直到有空位
+	OverflowBlock = "block"
+	// 优先丢弃debug/info日志，队列中全是warn及以上时丢弃最旧的
+	OverflowDropLow = "dropLow"
+	// 丢弃最旧的日志
+	OverflowDropOldest = "dropOldest"
+)
+
+const (
+	defaultAsyncSize          = 8192
+	defaultDropReportInterval = 10 * time.Second
+)
+
+var logDropped = metrics.NewCounterVec("log_dropped_total",
+	"Log entries dropped by the async writer.", "output", "level")
+
+func overflowValid(policy string) bool {
+	switch policy {
+	case OverflowBlock, OverflowDropLow, OverflowDropOldest:
+		return true
+	default:
+		return false
+	}
+}
+
+// 异步写日志的core，编码在调用方完成，写入在后台goroutine
+type asyncCore struct {
+	zapcore.LevelEnabler
+	enc zapcore.Encoder
+	w   *asyncWriter
+}
+
+func newAsyncCore(enc zapcore.Encoder, w *asyncWriter, enab zapcore.LevelEnabler) zapcore.Core {
+	return &asyncCore{LevelEnabler: enab, enc: enc, w: w}
+}
+
+func (c *asyncCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := &asyncCore{LevelEnabler: c.LevelEnabler, enc: c.enc.Clone(), w: c.w}
+	for _, f := range fields {
+		f.AddTo(clone.enc)
+	}
+	return clone
+}
+
+func (c *asyncCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *asyncCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	buf, err := c.enc.EncodeEntry(ent, fields)
+	if err != nil {
+		return err
+	}
+	c.w.push(ent.Level, buf.Bytes())
+	buf.Free()
+
+	// panic、fatal 之后进程可能退出，等待写完
+	if ent.Level > zapcore.ErrorLevel {
+		return c.Sync()
+	}
+	return nil
+}
+
+func (c *asyncCore) Sync() error {
+	return c.w.Sync()
+}
+
+type asyncEntry struct {
+	level zapcore.Level
+	b     []byte
+}
+
+// 每个输出一个有界环形队列
+type asyncWriter struct {
+	name   string
+	out    zapcore.WriteSyncer
+	policy string
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	buf     []asyncEntry
+	head    int
+	n       int
+	writing bool
+	// 写失败时只在首次输出错误，写失败的日志计入丢弃数
+	failing bool
+
+	// 按级别统计的丢弃数，定期汇报后清零
+	dropped [zapcore.FatalLevel - zapcore.DebugLevel + 1]uint64
+}
+
+var (
+	asyncMu      sync.Mutex
+	asyncWriters []*asyncWriter
+	reporterOnce sync.Once
+)
+
+func newAsyncWriter(name string, out zapcore.WriteSyncer, size int, policy string) *asyncWriter {
+	if size <= 0 {
+		size = defaultAsyncSize
+	}
+	w := &asyncWriter{
+		name:   name,
+		out:    out,
+		policy: policy,
+		buf:    make([]asyncEntry, size),
+	}
+	w.cond = sync.NewCond(&w.mu)
+	go w.run()
+
+	asyncMu.Lock()
+	asyncWriters = append(asyncWriters, w)
+	asyncMu.Unlock()
+	reporterOnce.Do(func() {
+		go reportDroppedLoop(logConfig.AsyncReportInterval)
+	})
+	return w
+}
+
+func (w *asyncWriter) push(lvl zapcore.Level, p []byte) {
+	e := asyncEntry{level: lvl, b: append([]byte(nil), p...)}
+
+	w.mu.Lock()
+	for w.n == len(w.buf) {
+		switch w.policy {
+		case OverflowBlock:
+			w.cond.Wait()
+			continue
+		case OverflowDropOldest:
+			w.dropAt(0)
+		default:
+			if lvl <= zapcore.InfoLevel {
+				w.mu.Unlock()
+				w.drop(lvl)
+				return
+			}
+			if !w.dropLow() {
+				w.dropAt(0)
+			}
+		}
+	}
+	w.buf[(w.head+w.n)%len(w.buf)] = e
+	w.n++
+	w.cond.Broadcast()
+	w.mu.Unlock()
+}
+
+// 丢弃队列中最旧的一条debug/info日志
+func (w *asyncWriter) dropLow() bool {
+	for i := 0; i < w.n; i++ {
+		if w.buf[(w.head+i)%len(w.buf)].level <= zapcore.InfoLevel {
+			w.dropAt(i)
+			return true
+		}
+	}
+	return false
+}
+
+// 丢弃队列中第i条，后面的依次前移
+func (w *asyncWriter) dropAt(i int) {
+	size := len(w.buf)
+	w.drop(w.buf[(w.head+i)%size].level)
+	if i == 0 {
+		w.buf[w.head] = asyncEntry{}
+		w.head = (w.head + 1) % size
+		w.n--
+		return
+	}
+	for j := i; j < w.n-1; j++ {
+		w.buf[(w.head+j)%size] = w.buf[(w.head+j+1)%size]
+	}
+	w.buf[(w.head+w.n-1)%size] = asyncEntry{}
+	w.n--
+}
+
+func (w *asyncWriter) drop(lvl zapcore.Level) {
+	if lvl < zapcore.DebugLevel || lvl > zapcore.FatalLevel {
+		lvl = zapcore.FatalLevel
+	}
+	atomic.AddUint64(&w.dropped[lvl-zapcore.DebugLevel], 1)
+	logDropped.With(w.name, lvl.String()).Inc()
+}
+
+func (w *asyncWriter) run() {
+	var batch []asyncEntry
+	for {
+		w.mu.Lock()
+		for w.n == 0 {
+			w.cond.Wait()
+		}
+		batch = batch[:0]
+		for i := 0; i < w.n; i++ {
+			idx := (w.head + i) % len(w.buf)
+			batch = append(batch, w.buf[idx])
+			w.buf[idx] = asyncEntry{}
+		}
+		w.head, w.n = 0, 0
+		w.writing = true
+		w.cond.Broadcast()
+		w.mu.Unlock()
+
+		for _, e := range batch {
+			if _, err := w.out.Write(e.b); err != nil {
+				w.drop(e.level)
+				if !w.failing {
+					_, _ = fmt.Fprintf(os.Stderr, "async log write(%s): %s\n", w.name, err)
+				}
+				w.failing = true
+			} else {
+				w.failing = false
+			}
+		}
+
+		w.mu.Lock()
+		w.writing = false
+		w.cond.Broadcast()
+		w.mu.Unlock()
+	}
+}
+
+// Sync 等待队列中的日志全部写出
+func (w *asyncWriter) Sync() error {
+	w.mu.Lock()
+	for w.n > 0 || w.writing {
+		w.cond.Wait()
+	}
+	w.mu.Unlock()
+	return w.out.Sync()
+}
+
+func reportDroppedLoop(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultDropReportInterval
+	}
+	for range time.Tick(interval) {
+		reportDropped()
+	}
+}
+
+// 以warn日志汇报上个周期内丢弃的日志数
+func reportDropped() {
+	asyncMu.Lock()
+	writers := append([]*asyncWriter(nil), asyncWriters...)
+	asyncMu.Unlock()
+
+	for _, w := range writers {
+		var total uint64
+		fields := []Field{
+			String(TopicType, LogNameModule),
+			String("prot", "log"),
+			String("output", w.name),
+		}
+		for i := range w.dropped {
+			if n := atomic.SwapUint64(&w.dropped[i], 0); n > 0 {
+				total += n
+				fields = append(fields, Uint64((zapcore.DebugLevel+zapcore.Level(i)).String(), n))
+			}
+		}
+		if total > 0 {
+			GetZapLogger().Warn(fmt.Sprintf("async log dropped %d entries", total), fields...)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package klog
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// 关闭gate之前写入阻塞，模拟慢输出
+type gateWriter struct {
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	gate chan struct{}
+	err  error
+}
+
+func (w *gateWriter) Write(p []byte) (int, error) {
+	<-w.gate
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *gateWriter) Sync() error { return nil }
+
+func (w *gateWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+func TestOverflowValid(t *testing.T) {
+	cases := []struct {
+		policy string
+		want   bool
+	}{
+		{OverflowBlock, true},
+		{OverflowDropLow, true},
+		{OverflowDropOldest, true},
+		{"", false},
+		{"drop", false},
+	}
+	for _, c := range cases {
+		if got := overflowValid(c.policy); got != c.want {
+			t.Errorf("%q: got %v", c.policy, got)
+		}
+	}
+}
+
+func TestAsyncOverflow(t *testing.T) {
+	logs := setLevelLogger(t, LogConfig{})
+	cases := []struct {
+		policy  string
+		infos   int
+		debug   bool
+		dropped map[zapcore.Level]uint64
+	}{
+		// 优先丢弃info/debug，warn/error保留
+		{OverflowDropLow, 2, false, map[zapcore.Level]uint64{zapcore.InfoLevel: 2, zapcore.DebugLevel: 1}},
+		{OverflowDropOldest, 1, true, map[zapcore.Level]uint64{zapcore.InfoLevel: 3}},
+	}
+	for _, c := range cases {
+		ws := &gateWriter{gate: make(chan struct{})}
+		w := newAsyncWriter("test-"+c.policy, ws, 4, c.policy)
+		l := zap.New(newAsyncCore(getEncoder(), w, zapcore.DebugLevel))
+		// 被worker取走后阻塞在写入
+		l.Info("first")
+		time.Sleep(50 * time.Millisecond)
+
+		start := time.Now()
+		for i := 0; i < 4; i++ {
+			l.Info("info")
+		}
+		l.Warn("warn1")
+		l.Debug("debug")
+		l.Error("err1")
+		if d := time.Since(start); d > 20*time.Millisecond {
+			t.Errorf("%s: blocked %v", c.policy, d)
+		}
+		close(ws.gate)
+		_ = l.Sync()
+
+		out := ws.String()
+		if strings.Count(out, `"info"`) != c.infos || strings.Contains(out, `"debug"`) != c.debug ||
+			!strings.Contains(out, "warn1") || !strings.Contains(out, "err1") || !strings.Contains(out, "first") {
+			t.Errorf("%s: output %s", c.policy, out)
+		}
+		for lvl, n := range c.dropped {
+			if got := w.dropped[lvl-zapcore.DebugLevel]; got != n {
+				t.Errorf("%s: dropped %s %d, want %d", c.policy, lvl, got, n)
+			}
+		}
+
+		// 汇报丢弃数后清零
+		reportDropped()
+		var report map[string]interface{}
+		for _, e := range logs.All() {
+			if m := e.ContextMap(); m["output"] == "test-"+c.policy {
+				report = m
+			}
+		}
+		if report == nil || report[zapcore.InfoLevel.String()] != c.dropped[zapcore.InfoLevel] {
+			t.Errorf("%s: report %v", c.policy, report)
+		}
+		if w.dropped[zapcore.InfoLevel-zapcore.DebugLevel] != 0 {
+			t.Errorf("%s: dropped not reset", c.policy)
+		}
+	}
+}
+
+func TestAsyncBlock(t *testing.T) {
+	ws := &gateWriter{gate: make(chan struct{})}
+	l := zap.New(newAsyncCore(getEncoder(), newAsyncWriter("test-block", ws, 4, OverflowBlock), zapcore.DebugLevel))
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(ws.gate)
+	}()
+
+	// 队列满时等待，不丢日志
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		l.Info("x")
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("not blocked")
+	}
+	_ = l.Sync()
+	if n := strings.Count(ws.String(), `"x"`); n != 10 {
+		t.Errorf("got %d entries", n)
+	}
+}
+
+func TestAsyncWriteError(t *testing.T) {
+	ws := &gateWriter{gate: make(chan struct{}), err: errors.New("disk full")}
+	close(ws.gate)
+	w := newAsyncWriter("test-error", ws, 4, OverflowBlock)
+	l := zap.New(newAsyncCore(getEncoder(), w, zapcore.DebugLevel))
+	l.Info("a")
+	l.Error("b")
+	_ = l.Sync()
+	// 写失败的日志计入丢弃数
+	if w.dropped[zapcore.InfoLevel-zapcore.DebugLevel] != 1 || w.dropped[zapcore.ErrorLevel-zapcore.DebugLevel] != 1 {
+		t.Errorf("dropped %v", w.dropped)
+	}
+}
@@ -0,0 +1,220 @@
+package klog
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/peerless6372/Lplot/env"
+	"github.com/peerless6372/Lplot/utils/metadata"
+	"github.com/peerless6372/gin"
+	"go.uber.org/zap"
+)
+
+// 日志相关的请求信息
+type logContext struct {
+	requestId string
+	uri       string
+	noLog     bool
+	debug     bool
+	fields    []Field
+}
+
+type detachedKey struct{}
+
+// WithFields 为后续日志附加自定义字段，字段保存在metadata中
+// *gin.Context 直接修改并返回原ctx，其他context返回新的ctx
+func WithFields(ctx context.Context, fields ...Field) context.Context {
+	if len(fields) == 0 {
+		return ctx
+	}
+	if c, ok := ctx.(*gin.Context); ok {
+		if c == nil {
+			return ctx
+		}
+		mc, ok := metadata.CtxFromGinContext(c)
+		if !ok {
+			mc = metadata.NewContext4Gin()
+			metadata.GinCtxWithCtx(c, mc)
+		}
+		md, _ := metadata.FromContext(mc)
+		md[metadata.LogFields] = appendFields(logFields(c), fields)
+		return c
+	}
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	md, ok := metadata.Lookup(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = metadata.MD{}
+	}
+	md[metadata.LogFields] = appendFields(logFields(ctx), fields)
+	return metadata.NewContext(ctx, md)
+}
+
+// Detach 返回一个不会随请求结束而取消的context，保留requestId、uri、日志字段以及metadata
+// 用于请求内启动的异步任务
+func Detach(ctx context.Context) context.Context {
+	out := context.Background()
+	if ctx == nil {
+		return out
+	}
+	if md, ok := metadata.Lookup(ctx); ok {
+		nmd := md.Copy()
+		// 与 metadata.WithContext 一致，避免异步任务复用已结束的trace
+		delete(nmd, metadata.Trace)
+		out = metadata.NewContext(out, nmd)
+	}
+	if lc, ok := logContextFrom(ctx); ok {
+		lc.fields = nil
+		out = context.WithValue(out, detachedKey{}, &lc)
+	}
+	return out
+}
+
+// 提供给业务使用的context版本日志打印方法，支持 *gin.Context、由其派生的context以及 Detach 后的context
+func DebugContext(ctx context.Context, msg string, fields ...Field) {
+	if l := ctxZapLogger(ctx); l != nil {
+		l.Debug(msg, fields...)
+	}
+}
+
+func InfoContext(ctx context.Context, msg string, fields ...Field) {
+	if l := ctxZapLogger(ctx); l != nil {
+		l.Info(msg, fields...)
+	}
+}
+
+func WarnContext(ctx context.Context, msg string, fields ...Field) {
+	if l := ctxZapLogger(ctx); l != nil {
+		l.Warn(msg, fields...)
+	}
+}
+
+func ErrorContext(ctx context.Context, msg string, fields ...Field) {
+	if l := ctxZapLogger(ctx); l != nil {
+		l.Error(msg, fields...)
+	}
+}
+
+func DebugfContext(ctx context.Context, format string, args ...interface{}) {
+	if l := ctxZapLogger(ctx); l != nil {
+		l.Debug(fmt.Sprintf(format, args...))
+	}
+}
+
+func InfofContext(ctx context.Context, format string, args ...interface{}) {
+	if l := ctxZapLogger(ctx); l != nil {
+		l.Info(fmt.Sprintf(format, args...))
+	}
+}
+
+func WarnfContext(ctx context.Context, format string, args ...interface{}) {
+	if l := ctxZapLogger(ctx); l != nil {
+		l.Warn(fmt.Sprintf(format, args...))
+	}
+}
+
+func ErrorfContext(ctx context.Context, format string, args ...interface{}) {
+	if l := ctxZapLogger(ctx); l != nil {
+		l.Error(fmt.Sprintf(format, args...))
+	}
+}
+
+// 带上请求通用字段的logger，NoLog时返回nil
+func ctxZapLogger(ctx context.Context) *zap.Logger {
+	m := GetZapLogger()
+	lc, ok := logContextFrom(ctx)
+	if !ok {
+		return m
+	}
+	if lc.noLog {
+		return nil
+	}
+	return m.With(lc.zapFields()...)
+}
+
+func ctxSugaredLogger(ctx context.Context) *zap.SugaredLogger {
+	s := GetLogger()
+	lc, ok := logContextFrom(ctx)
+	if !ok {
+		return s
+	}
+	return s.Desugar().With(lc.zapFields()...).Sugar()
+}
+
+func (lc logContext) zapFields() []Field {
+	fields := []Field{
+		zap.String("requestId", lc.requestId),
+		zap.String("module", env.GetAppName()),
+		zap.String("localIp", env.LocalIP),
+		zap.String("uri", lc.uri),
+	}
+	if lc.debug {
+		fields = append(fields, debugField())
+	}
+	return append(fields, lc.fields...)
+}
+
+// HasLogContext ctx中是否带有请求信息，为true时 *Context 系列方法会附加requestId、module等字段
+func HasLogContext(ctx context.Context) bool {
+	_, ok := logContextFrom(ctx)
+	return ok
+}
+
+// 从context中提取日志信息，没有任何请求信息时返回false
+func logContextFrom(ctx context.Context) (lc logContext, ok bool) {
+	if ctx == nil {
+		return lc, false
+	}
+	if c, isGin := ctx.(*gin.Context); isGin {
+		if c == nil {
+			return lc, false
+		}
+		lc = logContext{
+			requestId: GetRequestID(c),
+			uri:       c.GetString(ContextKeyUri),
+			noLog:     NoLog(c),
+			debug:     IsDebug(c),
+		}
+		ok = true
+	} else if d, isDetached := ctx.Value(detachedKey{}).(*logContext); isDetached {
+		lc, ok = *d, true
+	} else {
+		// 由 gin.Context 派生的context可以通过Value取到gin中保存的值
+		lc.requestId, _ = ctx.Value(ContextKeyRequestID).(string)
+		lc.uri, _ = ctx.Value(ContextKeyUri).(string)
+		lc.noLog, _ = ctx.Value(ContextKeyNoLog).(bool)
+		lc.debug, _ = ctx.Value(ContextKeyDebug).(bool)
+		ok = lc.requestId != "" || lc.uri != ""
+	}
+
+	lc.fields = logFields(ctx)
+	return lc, ok || len(lc.fields) > 0
+}
+
+func logFields(ctx context.Context) []Field {
+	md, ok := metadata.Lookup(ctx)
+	if !ok {
+		return nil
+	}
+	fields, _ := md[metadata.LogFields].([]Field)
+	return fields
+}
+
+// 每次生成新的slice，避免派生的context之间共享底层数组
+func appendFields(old, fields []Field) []Field {
+	out := make([]Field, 0, len(old)+len(fields))
+	out = append(out, old...)
+	return append(out, fields...)
+}
+
+// nil的 *gin.Context 转为nil接口，避免typed nil
+func ginContext(c *gin.Context) context.Context {
+	if c == nil {
+		return nil
+	}
+	return c
+}
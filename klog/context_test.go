@@ -0,0 +1,85 @@
+package klog
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/peerless6372/gin"
+)
+
+func TestContextLog(t *testing.T) {
+	logs := setLevelLogger(t, LogConfig{})
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/x", nil)
+	c.Request.Header.Set(RequestIDHeaderKey, "rid1")
+	c.Set(ContextKeyUri, "/x")
+	WithFields(c, String("uid", "42"))
+
+	derived, cancel := context.WithCancel(c)
+	detached := WithFields(Detach(c), String("job", "j"))
+	cancel()
+	// 非gin的context返回新的ctx，不影响原ctx
+	plain := WithFields(context.Background(), String("k", "v"))
+	plain2 := WithFields(plain, String("k2", "v2"))
+
+	cases := []struct {
+		name   string
+		log    func()
+		msg    string
+		fields map[string]interface{}
+		absent []string
+	}{
+		{"gin", func() { InfoContext(c, "a") }, "a",
+			map[string]interface{}{"requestId": "rid1", "uri": "/x", "uid": "42"}, nil},
+		{"derived", func() { InfoContext(derived, "b") }, "b",
+			map[string]interface{}{"requestId": "rid1", "uri": "/x", "uid": "42"}, nil},
+		// Detach 后请求结束也可以打印，保留请求信息
+		{"detached", func() { InfofContext(detached, "c %d", 1) }, "c 1",
+			map[string]interface{}{"requestId": "rid1", "uri": "/x", "uid": "42", "job": "j"}, nil},
+		{"background", func() { InfoContext(context.Background(), "d") }, "d", nil, []string{"requestId", "uid"}},
+		{"plain fields", func() { InfoContext(plain, "e") }, "e", map[string]interface{}{"k": "v"}, []string{"k2"}},
+		{"plain derived", func() { InfoContext(plain2, "f") }, "f", map[string]interface{}{"k": "v", "k2": "v2"}, nil},
+		{"gin logger", func() { InfoLogger(c, "g") }, "g",
+			map[string]interface{}{"requestId": "rid1", "uid": "42"}, nil},
+		{"nil", func() { InfoLogger(nil, "h") }, "h", nil, []string{"uid"}},
+	}
+	for _, cs := range cases {
+		n := logs.Len()
+		cs.log()
+		all := logs.All()
+		if len(all) != n+1 {
+			t.Errorf("%s: %d logs", cs.name, len(all)-n)
+			continue
+		}
+		e := all[n]
+		m := e.ContextMap()
+		if e.Message != cs.msg {
+			t.Errorf("%s: message %q", cs.name, e.Message)
+		}
+		for k, v := range cs.fields {
+			if m[k] != v {
+				t.Errorf("%s: %s = %v, want %v", cs.name, k, m[k], v)
+			}
+		}
+		for _, k := range cs.absent {
+			if _, ok := m[k]; ok {
+				t.Errorf("%s: unexpected %s", cs.name, k)
+			}
+		}
+	}
+
+	if detached.Err() != nil || !HasLogContext(detached) || HasLogContext(context.Background()) {
+		t.Errorf("detached err %v", detached.Err())
+	}
+
+	// 标记不打印日志后ctx日志不输出
+	SetNoLogFlag(c)
+	n := logs.Len()
+	InfoContext(c, "nolog")
+	InfoContext(derived, "nolog")
+	if logs.Len() != n {
+		t.Errorf("nolog: %d logs", logs.Len()-n)
+	}
+}
@@ -9,7 +9,6 @@ import (
 	"time"
 
 	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
 )
 
 // 对用户暴露的log配置
@@ -17,12 +16,30 @@ type Rotate struct {
 	Switch bool   `yaml:"switch"`
 	Unit   string `yaml:"unit"`
 	Count  int    `yaml:"count"`
+	// 单个文件的最大MB数，超过后在时间切割之外额外切割
+	MaxSize int `yaml:"maxSize"`
+	// 切割后的文件在后台gzip压缩
+	Compress bool `yaml:"compress"`
+	// 切割后的文件最长保留时间
+	MaxAge time.Duration `yaml:"maxAge"`
+	// 日志目录下所有日志的最大总MB数，超过后从最旧的切割文件开始删除
+	MaxTotalSize int `yaml:"maxTotalSize"`
+	// 收到SIGHUP时重新打开日志文件，用于外部logrotate
+	ReopenOnSighup bool `yaml:"reopenOnSighup"`
 }
 
 type Buffer struct {
 	Switch        bool          `yaml:"switch"`
 	Size          int           `yaml:"size"`
 	FlushInterval time.Duration `yaml:"flushInterval"`
+	// 异步写日志，每个输出一个有界队列，写日志不阻塞请求
+	Async bool `yaml:"async"`
+	// 每个输出的队列长度(条)，默认8192
+	AsyncSize int `yaml:"asyncSize"`
+	// 队列满时的策略：block、dropLow(默认)、dropOldest
+	Overflow string `yaml:"overflow"`
+	// 丢弃日志数的汇报周期，默认10s
+	DropReportInterval time.Duration `yaml:"dropReportInterval"`
 }
 
 // 日志切分相关的log配置,仅虚拟机线上支持
@@ -33,11 +50,23 @@ type LogConfig struct {
 	Path     string `yaml:"path"`
 	Rotate   Rotate `yaml:"rotate"`
 	Buffer   Buffer `yaml:"buffer"`
+	// 请求id的生成方式与header
+	RequestID RequestIDConf `yaml:"requestId"`
+	// 按模块(prot如redis/mysql，或日志topic)覆盖日志级别
+	Levels map[string]string `yaml:"levels"`
+	// 单请求开启debug日志的签名密钥，为空时不支持
+	DebugSecret string `yaml:"debugSecret"`
+	// 敏感信息脱敏规则
+	Redact RedactConf `yaml:"redact"`
+	// 按topic(access、module、server等)输出到各自的日志文件
+	SplitTopic bool `yaml:"splitTopic"`
+	// topic的文件、级别与切割配置，可以增加自定义topic
+	Topics map[string]TopicConf `yaml:"topics"`
+	// 额外的远端输出：syslog、tcp/udp json、http批量
+	Sinks []SinkConf `yaml:"sinks"`
 }
 
 type loggerConfig struct {
-	ZapLevel zapcore.Level
-
 	// 以下变量仅对开发环境生效
 	Stdout   bool
 	Log2File bool
@@ -48,16 +77,33 @@ type loggerConfig struct {
 	RotateUnit   string
 	RotateCount  int
 
+	RotateMaxSize      int
+	RotateCompress     bool
+	RotateMaxAge       time.Duration
+	RotateMaxTotalSize int
+	ReopenOnSighup     bool
+
 	// 缓冲区
 	BufferSwitch        bool
 	BufferSize          int
 	BufferFlushInterval time.Duration
+
+	// 异步
+	AsyncSwitch         bool
+	AsyncSize           int
+	AsyncOverflow       string
+	AsyncReportInterval time.Duration
+
+	// 按topic拆分文件
+	SplitTopic bool
+	Topics     map[string]TopicConf
+
+	// 远端输出
+	Sinks []SinkConf
 }
 
 // 全局配置 仅限Init函数进行变更
 var logConfig = loggerConfig{
-	ZapLevel: zapcore.InfoLevel,
-
 	Stdout:   false,
 	Log2File: true,
 	Path:     "./log",
@@ -76,12 +122,50 @@ func InitLog(conf LogConfig) *zap.SugaredLogger {
 		panic(err)
 	}
 
-	logConfig.ZapLevel = getLogLevel(conf.Level)
+	topics, err := checkTopics(conf)
+	if err != nil {
+		panic("log conf err: " + err.Error())
+	}
+	for t := range conf.Topics {
+		customTopics[t] = true
+	}
+	logConfig.SplitTopic = conf.SplitTopic
+	logConfig.Topics = topics
+
+	// 依赖自定义topic，需在topic之后检查
+	sinks, err := checkSinks(conf.Sinks)
+	if err != nil {
+		panic("log conf err: " + err.Error())
+	}
+	logConfig.Sinks = sinks
+
+	if err := ReloadLevel(conf); err != nil {
+		panic("log conf err: " + err.Error())
+	}
+	setRequestIDConf(conf.RequestID)
+	if err := SetRedactConf(conf.Redact); err != nil {
+		panic("log conf err: " + err.Error())
+	}
+
+	if conf.Buffer.Async {
+		if conf.Buffer.Overflow == "" {
+			conf.Buffer.Overflow = OverflowDropLow
+		}
+		if !overflowValid(conf.Buffer.Overflow) {
+			panic("log conf err: buffer overflow only support block、dropLow、dropOldest")
+		}
+	}
+	logConfig.AsyncSwitch = conf.Buffer.Async
+	logConfig.AsyncSize = conf.Buffer.AsyncSize
+	logConfig.AsyncOverflow = conf.Buffer.Overflow
+	logConfig.AsyncReportInterval = conf.Buffer.DropReportInterval
+
 	if env.IsDockerPlatform() {
 		// 容器环境
 		logConfig.Log2File = conf.Log2File
 		logConfig.Path = conf.Path
 		logConfig.Stdout = true
+		logConfig.ReopenOnSighup = conf.Rotate.ReopenOnSighup
 	} else {
 		if _, err := os.Stat(logConfig.Path); os.IsNotExist(err) {
 			err = os.MkdirAll(logConfig.Path, 0777)
@@ -110,6 +194,11 @@ func InitLog(conf LogConfig) *zap.SugaredLogger {
 		logConfig.RotateSwitch = conf.Rotate.Switch
 		logConfig.RotateUnit = conf.Rotate.Unit
 		logConfig.RotateCount = conf.Rotate.Count
+		logConfig.RotateMaxSize = conf.Rotate.MaxSize
+		logConfig.RotateCompress = conf.Rotate.Compress
+		logConfig.RotateMaxAge = conf.Rotate.MaxAge
+		logConfig.RotateMaxTotalSize = conf.Rotate.MaxTotalSize
+		logConfig.ReopenOnSighup = conf.Rotate.ReopenOnSighup
 		setRotateFlag(conf.Rotate.Switch)
 	}
 
@@ -117,6 +206,20 @@ func InitLog(conf LogConfig) *zap.SugaredLogger {
 	return SugaredLogger
 }
 
+// 全局的切割与保留配置
+func (c loggerConfig) rotate() Rotate {
+	return Rotate{
+		Switch:         c.RotateSwitch,
+		Unit:           c.RotateUnit,
+		Count:          c.RotateCount,
+		MaxSize:        c.RotateMaxSize,
+		Compress:       c.RotateCompress,
+		MaxAge:         c.RotateMaxAge,
+		MaxTotalSize:   c.RotateMaxTotalSize,
+		ReopenOnSighup: c.ReopenOnSighup,
+	}
+}
+
 func setRotateFlag(logSwitch bool) {
 	flagFile := path.Join(logConfig.Path, ".rotate")
 	if logSwitch {
@@ -16,6 +16,8 @@ const (
 	LogNameAccess = "access"
 	// module 日志文件名字
 	LogNameModule = "module"
+	// 镜像流量diff 日志名字
+	LogNameMirror = "mirror"
 )
 
 // RegisterCsseJSONEncoder registers a special jsonEncoder under "csse-json" name.
@@ -50,10 +52,13 @@ func (enc *jsonHexEncoder) EncodeEntry(ent zapcore.Entry, fields []zapcore.Field
 	switch fName {
 	case LogNameAccess:
 	case LogNameModule:
+	case LogNameMirror:
 	case LogNameServer:
 	default:
 		// 不识别的tp修改为 server
-		fName = LogNameServer
+		if !isTopic(fName) {
+			fName = LogNameServer
+		}
 	}
 
 	buf, err := enc.Encoder.EncodeEntry(ent, fields)
@@ -0,0 +1,322 @@
+package klog
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/peerless6372/gin"
+	"go.uber.org/zap/zapcore"
+)
+
+// 单个请求开启debug日志
+const (
+	ContextKeyDebug = "_log_debug"
+	// header值为 SignDebugToken 生成的签名
+	DebugHeaderKey = "X-Log-Debug"
+	// 签名的最长有效期，避免泄露的签名长期可用
+	maxDebugTokenTTL = 24 * time.Hour
+
+	// 不会被编码输出的标记字段
+	debugFieldKey = "_log_debug"
+)
+
+// 日志级别配置，修改时整体替换
+type levelState struct {
+	global  zapcore.Level
+	modules map[string]zapcore.Level
+	// 所有级别中的最低值，用于快速过滤
+	min zapcore.Level
+}
+
+var (
+	levelMu     sync.Mutex
+	levels      atomic.Value // *levelState
+	debugSecret atomic.Value // string
+)
+
+func init() {
+	levels.Store(&levelState{global: zapcore.InfoLevel, modules: map[string]zapcore.Level{}, min: zapcore.InfoLevel})
+	debugSecret.Store("")
+}
+
+func currentLevels() *levelState {
+	return levels.Load().(*levelState)
+}
+
+func storeLevels(global zapcore.Level, modules map[string]zapcore.Level) {
+	min := global
+	for _, l := range modules {
+		if l < min {
+			min = l
+		}
+	}
+	levels.Store(&levelState{global: global, modules: modules, min: min})
+}
+
+// 按 prot(redis/mysql/es/http...) > 日志topic > 全局 的顺序确定级别
+func (s *levelState) levelOf(prot, topic string) zapcore.Level {
+	if l, ok := s.modules[prot]; ok && prot != "" {
+		return l
+	}
+	if l, ok := s.modules[topic]; ok && topic != "" {
+		return l
+	}
+	return s.global
+}
+
+// ReloadLevel 按配置重新设置全局级别、模块及topic级别与debug签名密钥，用于配置热加载
+func ReloadLevel(conf LogConfig) error {
+	modules := make(map[string]zapcore.Level, len(conf.Levels))
+	for m, lv := range conf.Levels {
+		l, ok := parseLevel(lv)
+		if !ok {
+			return errors.New("invalid log level " + lv + " for " + m)
+		}
+		modules[m] = l
+	}
+	// topic配置中的级别，Levels 中的配置优先
+	for t, tc := range conf.Topics {
+		if _, ok := modules[t]; ok || tc.Level == "" {
+			continue
+		}
+		l, ok := parseLevel(tc.Level)
+		if !ok {
+			return errors.New("invalid log level " + tc.Level + " for topic " + t)
+		}
+		modules[t] = l
+	}
+
+	levelMu.Lock()
+	defer levelMu.Unlock()
+	debugSecret.Store(conf.DebugSecret)
+	storeLevels(getLogLevel(conf.Level), modules)
+	return nil
+}
+
+// SetLevel 运行时修改全局日志级别
+func SetLevel(level string) error {
+	l, ok := parseLevel(level)
+	if !ok {
+		return errors.New("invalid log level " + level)
+	}
+	levelMu.Lock()
+	defer levelMu.Unlock()
+	storeLevels(l, currentLevels().modules)
+	return nil
+}
+
+// SetModuleLevel 运行时修改模块(prot或topic)的日志级别，level为空时取消覆盖
+func SetModuleLevel(module, level string) error {
+	if module == "" {
+		return errors.New("empty module")
+	}
+	levelMu.Lock()
+	defer levelMu.Unlock()
+	s := currentLevels()
+	modules := make(map[string]zapcore.Level, len(s.modules)+1)
+	for m, l := range s.modules {
+		modules[m] = l
+	}
+	if level == "" {
+		delete(modules, module)
+	} else {
+		l, ok := parseLevel(level)
+		if !ok {
+			return errors.New("invalid log level " + level)
+		}
+		modules[module] = l
+	}
+	storeLevels(s.global, modules)
+	return nil
+}
+
+// GetLevel 当前的全局日志级别
+func GetLevel() string {
+	return currentLevels().global.String()
+}
+
+// GetModuleLevels 当前各模块覆盖的日志级别
+func GetModuleLevels() map[string]string {
+	s := currentLevels()
+	out := make(map[string]string, len(s.modules))
+	for m, l := range s.modules {
+		out[m] = l.String()
+	}
+	return out
+}
+
+// LevelHandler 查看与修改日志级别的http handler，挂在管理端口
+// GET 返回当前级别；PUT/POST 参数 level 与可选的 module，module 非空时 level 为空表示取消覆盖
+// 修改需在 DebugHeaderKey 中带 SignDebugToken 生成的签名，未配置 DebugSecret 时不允许修改
+func LevelHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			if !VerifyDebugToken(req.Header.Get(DebugHeaderKey)) {
+				http.Error(w, "invalid debug token", http.StatusForbidden)
+				return
+			}
+			level, module := req.FormValue("level"), req.FormValue("module")
+			var err error
+			if module != "" {
+				err = SetModuleLevel(module, level)
+			} else {
+				err = SetLevel(level)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			Warnf(nil, "log level changed, module: %s, level: %s", module, level)
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"level":   GetLevel(),
+			"modules": GetModuleLevels(),
+		})
+	})
+}
+
+// SignDebugToken 生成开启单请求debug日志的header值，格式为 过期时间戳.签名
+func SignDebugToken(secret string, expire time.Time) string {
+	ts := strconv.FormatInt(expire.Unix(), 10)
+	return ts + "." + debugSign(secret, ts)
+}
+
+// VerifyDebugToken 校验 DebugHeaderKey 的值，未配置密钥时总是返回false
+func VerifyDebugToken(token string) bool {
+	secret := debugSecret.Load().(string)
+	if secret == "" || token == "" {
+		return false
+	}
+	i := strings.IndexByte(token, '.')
+	if i <= 0 {
+		return false
+	}
+	ts, sign := token[:i], token[i+1:]
+	expire, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	now := time.Now()
+	if now.Unix() > expire || time.Unix(expire, 0).Sub(now) > maxDebugTokenTTL {
+		return false
+	}
+	return hmac.Equal([]byte(sign), []byte(debugSign(secret, ts)))
+}
+
+func debugSign(secret, ts string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SetDebugFlag 当前请求的日志忽略级别配置，全部输出
+func SetDebugFlag(ctx *gin.Context) {
+	ctx.Set(ContextKeyDebug, true)
+}
+
+func IsDebug(ctx *gin.Context) bool {
+	if ctx == nil {
+		return false
+	}
+	return ctx.GetBool(ContextKeyDebug)
+}
+
+func debugField() Field {
+	return Field{Key: debugFieldKey, Type: zapcore.SkipType}
+}
+
+func parseLevel(lv string) (zapcore.Level, bool) {
+	switch strings.ToUpper(lv) {
+	case "DEBUG":
+		return zapcore.DebugLevel, true
+	case "INFO":
+		return zapcore.InfoLevel, true
+	case "WARN":
+		return zapcore.WarnLevel, true
+	case "ERROR":
+		return zapcore.ErrorLevel, true
+	case "FATAL":
+		return zapcore.FatalLevel, true
+	}
+	return zapcore.InfoLevel, false
+}
+
+// 按运行时级别过滤日志的core
+// 模块可能在With或本次打印的字段中，所以在Write时判断
+// debug标记由请求上下文通过With带入，只对该请求的logger生效
+type levelCore struct {
+	zapcore.Core
+	prot  string
+	topic string
+	debug bool
+}
+
+func newLevelCore(core zapcore.Core) zapcore.Core {
+	return &levelCore{Core: core}
+}
+
+// 开启debug的请求由 With 带上标记，不受级别限制；其余按最低级别快速过滤
+func (c *levelCore) Enabled(lvl zapcore.Level) bool {
+	return c.debug || lvl >= currentLevels().min
+}
+
+func (c *levelCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := *c
+	clone.Core = c.Core.With(redactFields(fields))
+	clone.scan(fields)
+	return &clone
+}
+
+func (c *levelCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *levelCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	f := *c
+	f.scan(fields)
+	if !f.debug && ent.Level < currentLevels().levelOf(f.prot, f.topic) {
+		return nil
+	}
+
+	// 由内层core按级别分发到 .log / .log.wf / stdout，编码前统一脱敏
+	ent.Message = redactMessage(ent.Message)
+	if ce := c.Core.Check(ent, nil); ce != nil {
+		ce.ErrorOutput = zapcore.Lock(os.Stderr)
+		ce.Write(redactFields(fields)...)
+	}
+	return nil
+}
+
+func (c *levelCore) scan(fields []zapcore.Field) {
+	for _, f := range fields {
+		switch f.Key {
+		case "prot":
+			c.prot = f.String
+		case TopicType:
+			c.topic = f.String
+		case debugFieldKey:
+			c.debug = f.Type == zapcore.SkipType
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package klog
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/peerless6372/gin"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// 替换全局logger为observer，结束时恢复级别配置
+func setLevelLogger(t *testing.T, conf LogConfig) *observer.ObservedLogs {
+	t.Helper()
+	core, logs := observer.New(zapcore.DebugLevel)
+	zl, sl := ZapLogger, SugaredLogger
+	ZapLogger = zap.New(newLevelCore(core))
+	SugaredLogger = ZapLogger.Sugar()
+	if err := ReloadLevel(conf); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ZapLogger, SugaredLogger = zl, sl
+		_ = ReloadLevel(LogConfig{})
+	})
+	return logs
+}
+
+func TestReloadLevel(t *testing.T) {
+	if err := ReloadLevel(LogConfig{Levels: map[string]string{"redis": "bad"}}); err == nil {
+		t.Error("expect error for invalid module level")
+	}
+	if err := ReloadLevel(LogConfig{Topics: map[string]TopicConf{LogNameAccess: {Level: "bad"}}}); err == nil {
+		t.Error("expect error for invalid topic level")
+	}
+
+	setLevelLogger(t, LogConfig{
+		Level:  "info",
+		Levels: map[string]string{"redis": "warn", "mysql": "debug", LogNameAccess: "error"},
+		Topics: map[string]TopicConf{LogNameAccess: {Level: "debug"}, LogNameModule: {Level: "warn"}},
+	})
+	cases := []struct {
+		name  string
+		prot  string
+		topic string
+		want  zapcore.Level
+	}{
+		{"global", "", "", zapcore.InfoLevel},
+		{"prot", "redis", "", zapcore.WarnLevel},
+		{"prot over topic", "mysql", LogNameModule, zapcore.DebugLevel},
+		{"topic from topics", "http", LogNameModule, zapcore.WarnLevel},
+		{"levels over topics", "", LogNameAccess, zapcore.ErrorLevel},
+	}
+	s := currentLevels()
+	for _, c := range cases {
+		if got := s.levelOf(c.prot, c.topic); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.name, got, c.want)
+		}
+	}
+	if s.min != zapcore.DebugLevel {
+		t.Errorf("min %s", s.min)
+	}
+}
+
+func TestSetLevel(t *testing.T) {
+	logs := setLevelLogger(t, LogConfig{Level: "info"})
+
+	if err := SetLevel("nope"); err == nil {
+		t.Error("expect error for invalid level")
+	}
+	if err := SetModuleLevel("redis", "debug"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetLevel("warn"); err != nil {
+		t.Fatal(err)
+	}
+	if GetLevel() != "warn" || GetModuleLevels()["redis"] != "debug" {
+		t.Fatalf("levels %s %v", GetLevel(), GetModuleLevels())
+	}
+
+	DebugLogger(nil, "redis", String("prot", "redis"))
+	Info(nil, "info")
+	Warn(nil, "warn")
+
+	// 取消模块覆盖后跟随全局级别
+	if err := SetModuleLevel("redis", ""); err != nil {
+		t.Fatal(err)
+	}
+	DebugLogger(nil, "redis2", String("prot", "redis"))
+	if _, ok := GetModuleLevels()["redis"]; ok {
+		t.Error("module level not removed")
+	}
+
+	var got []string
+	for _, e := range logs.All() {
+		got = append(got, e.Message)
+	}
+	if len(got) != 2 || got[0] != "redis" || got[1] != "warn" {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestDebugToken(t *testing.T) {
+	setLevelLogger(t, LogConfig{DebugSecret: "s3"})
+	now := time.Now()
+	cases := []struct {
+		name  string
+		token string
+		want  bool
+	}{
+		{"valid", SignDebugToken("s3", now.Add(time.Minute)), true},
+		{"wrong secret", SignDebugToken("x", now.Add(time.Minute)), false},
+		{"expired", SignDebugToken("s3", now.Add(-time.Second)), false},
+		{"ttl too long", SignDebugToken("s3", now.Add(48*time.Hour)), false},
+		{"malformed", "abc", false},
+		{"empty", "", false},
+	}
+	for _, c := range cases {
+		if got := VerifyDebugToken(c.token); got != c.want {
+			t.Errorf("%s: got %v", c.name, got)
+		}
+	}
+
+	// 未配置密钥时不接受任何签名
+	_ = ReloadLevel(LogConfig{})
+	if VerifyDebugToken(SignDebugToken("", now.Add(time.Minute))) {
+		t.Error("token accepted without secret")
+	}
+}
+
+func TestRequestDebug(t *testing.T) {
+	logs := setLevelLogger(t, LogConfig{Level: "error", DebugSecret: "s3"})
+
+	// 配置了密钥不降低全局最低级别，未开启debug的请求在Enabled阶段过滤
+	if ZapLogger.Core().Enabled(zapcore.DebugLevel) {
+		t.Fatal("debug enabled globally")
+	}
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/", nil)
+	DebugLogger(c, "no")
+	if zapLogger(c).Core().Enabled(zapcore.DebugLevel) {
+		t.Fatal("debug enabled without flag")
+	}
+
+	SetDebugFlag(c)
+	if !zapLogger(c).Core().Enabled(zapcore.DebugLevel) {
+		t.Fatal("debug not enabled with flag")
+	}
+	DebugLogger(c, "yes", String("prot", "redis"))
+	Debugf(c, "yes2")
+	DebugContext(Detach(c), "yes3")
+	Debug(nil, "other request")
+
+	var got []string
+	for _, e := range logs.All() {
+		got = append(got, e.Message)
+		// 标记字段不输出
+		if _, ok := e.ContextMap()[debugFieldKey]; ok {
+			t.Errorf("%s: debug field encoded", e.Message)
+		}
+	}
+	if len(got) != 3 || got[0] != "yes" || got[1] != "yes2" || got[2] != "yes3" {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestLevelHandler(t *testing.T) {
+	setLevelLogger(t, LogConfig{Level: "info", DebugSecret: "s3"})
+	token := SignDebugToken("s3", time.Now().Add(time.Minute))
+
+	cases := []struct {
+		name   string
+		method string
+		target string
+		token  string
+		code   int
+		level  string
+	}{
+		{"get", http.MethodGet, "/", "", http.StatusOK, "info"},
+		{"put without token", http.MethodPut, "/?level=warn", "", http.StatusForbidden, "info"},
+		{"put bad token", http.MethodPut, "/?level=warn", SignDebugToken("x", time.Now().Add(time.Minute)), http.StatusForbidden, "info"},
+		{"put", http.MethodPut, "/?level=warn", token, http.StatusOK, "warn"},
+		{"post module", http.MethodPost, "/?module=redis&level=debug", token, http.StatusOK, "warn"},
+		{"invalid level", http.MethodPut, "/?level=nope", token, http.StatusBadRequest, "warn"},
+		{"method", http.MethodDelete, "/", token, http.StatusMethodNotAllowed, "warn"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.target, nil)
+		if c.token != "" {
+			req.Header.Set(DebugHeaderKey, c.token)
+		}
+		rec := httptest.NewRecorder()
+		LevelHandler().ServeHTTP(rec, req)
+		if rec.Code != c.code || GetLevel() != c.level {
+			t.Errorf("%s: code %d level %s", c.name, rec.Code, GetLevel())
+		}
+	}
+	if GetModuleLevels()["redis"] != "debug" {
+		t.Errorf("modules %v", GetModuleLevels())
+	}
+
+	// 未配置密钥时不允许修改
+	_ = ReloadLevel(LogConfig{Level: "info"})
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPut, "/?level=debug", nil)
+	req.Header.Set(DebugHeaderKey, token)
+	LevelHandler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden || GetLevel() != "info" {
+		t.Errorf("no secret: code %d level %s", rec.Code, GetLevel())
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"github.com/peerless6372/Lplot/env"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -55,15 +57,15 @@ const (
 // NewLogger 新建Logger，每一次新建会同时创建x.log与x.log.wf (access.log 不会生成wf)
 func newLogger() *zap.Logger {
 	var infoLevel = zap.LevelEnablerFunc(func(lvl zapcore.Level) bool {
-		return lvl >= logConfig.ZapLevel && lvl <= zapcore.InfoLevel
+		return lvl <= zapcore.InfoLevel
 	})
 
 	var errorLevel = zap.LevelEnablerFunc(func(lvl zapcore.Level) bool {
-		return lvl >= logConfig.ZapLevel && lvl >= zapcore.WarnLevel
+		return lvl >= zapcore.WarnLevel
 	})
 
 	var stdLevel = zap.LevelEnablerFunc(func(lvl zapcore.Level) bool {
-		return lvl >= logConfig.ZapLevel && lvl >= zapcore.DebugLevel
+		return lvl >= zapcore.DebugLevel
 	})
 
 	name := env.AppName
@@ -72,30 +74,24 @@ func newLogger() *zap.Logger {
 	}
 	var zapCore []zapcore.Core
 	if logConfig.Stdout {
-		c := zapcore.NewCore(
-			getEncoder(),
-			zapcore.AddSync(getLogWriter(name, txtLogStdout)),
-			stdLevel)
+		c := newOutputCore(name, txtLogStdout, stdLevel, Rotate{})
 		zapCore = append(zapCore, c)
 	}
 
 	// 仅开发环境有效，便于开发调试
-	if logConfig.Log2File {
-		zapCore = append(zapCore,
-			zapcore.NewCore(
-				getEncoder(),
-				zapcore.AddSync(getLogWriter(name, txtLogNormal)),
-				infoLevel))
-
-		zapCore = append(zapCore,
-			zapcore.NewCore(
-				getEncoder(),
-				zapcore.AddSync(getLogWriter(name, txtLogWarnFatal)),
-				errorLevel))
+	if logConfig.Log2File && logConfig.SplitTopic {
+		// 按topic输出到各自的文件
+		zapCore = append(zapCore, newTopicCore(infoLevel, errorLevel, stdLevel))
+	} else if logConfig.Log2File {
+		zapCore = append(zapCore, newOutputCore(name, txtLogNormal, infoLevel, logConfig.rotate()))
+		zapCore = append(zapCore, newOutputCore(name, txtLogWarnFatal, errorLevel, logConfig.rotate()))
 	}
 
-	// core
-	core := zapcore.NewTee(zapCore...)
+	// 远端输出同样受全局级别与脱敏控制
+	zapCore = append(zapCore, getSinkCores()...)
+
+	// core，级别由 levelCore 统一控制，支持运行时修改
+	core := newLevelCore(zapcore.NewTee(zapCore...))
 
 	// 开启开发模式，堆栈跟踪
 	caller := zap.WithCaller(true)
@@ -131,11 +127,60 @@ func getLogLevel(lv string) (level zapcore.Level) {
 	return level
 }
 
+// 一个输出(stdout或文件)的writer，开启异步时为异步队列
+type logOutput struct {
+	ws    zapcore.WriteSyncer
+	async *asyncWriter
+}
+
+var (
+	logOutputsMu sync.Mutex
+	// ZapLogger 与 SugaredLogger 等共用同一输出的writer与异步队列
+	logOutputs = map[string]logOutput{}
+)
+
+// 每个输出一个core，开启异步时写日志不阻塞调用方
+func newOutputCore(name, loggerType string, enab zapcore.LevelEnabler, rotate Rotate) zapcore.Core {
+	out := getLogOutput(name, loggerType, rotate)
+	if out.async != nil {
+		return newAsyncCore(getEncoder(), out.async, enab)
+	}
+	return zapcore.NewCore(getEncoder(), out.ws, enab)
+}
+
+func getLogOutput(name, loggerType string, rotate Rotate) logOutput {
+	output, key := txtLogStdout, txtLogStdout
+	if loggerType != txtLogStdout {
+		output = appendLogFileTail(name, loggerType)
+		key = filepath.Join(logConfig.Path, output)
+		if path, err := filepath.Abs(key); err == nil {
+			key = path
+		}
+	}
+
+	logOutputsMu.Lock()
+	defer logOutputsMu.Unlock()
+	if out, ok := logOutputs[key]; ok {
+		return out
+	}
+
+	out := logOutput{ws: getLogWriter(name, loggerType, rotate)}
+	if logConfig.AsyncSwitch {
+		out.async = newAsyncWriter(output, out.ws, logConfig.AsyncSize, logConfig.AsyncOverflow)
+	}
+	logOutputs[key] = out
+	return out
+}
+
 func getEncoder() zapcore.Encoder {
+	return NewCsseJSONEncoder(encoderConfig())
+}
+
+func encoderConfig() zapcore.EncoderConfig {
 	// time字段编码器
 	timeEncoder := zapcore.TimeEncoderOfLayout("2006-01-02 15:04:05.999999")
 
-	encoderCfg := zapcore.EncoderConfig{
+	return zapcore.EncoderConfig{
 		LevelKey:       "level",
 		TimeKey:        "time",
 		CallerKey:      "file",
@@ -147,17 +192,16 @@ func getEncoder() zapcore.Encoder {
 		EncodeTime:     timeEncoder,
 		EncodeDuration: zapcore.StringDurationEncoder,
 	}
-	return NewCsseJSONEncoder(encoderCfg)
 }
 
-func getLogWriter(name, loggerType string) (ws zapcore.WriteSyncer) {
+func getLogWriter(name, loggerType string, rotate Rotate) (ws zapcore.WriteSyncer) {
 	var w io.Writer
 	if loggerType == txtLogStdout {
 		// stdOut
 		w = os.Stdout
 	} else {
 		// 打印到 name.log 中
-		w = NewTimeFileLogWriter(appendLogFileTail(name, loggerType))
+		w = newTimeFileLogWriter(appendLogFileTail(name, loggerType), rotate)
 	}
 
 	ws = zapcore.AddSync(w)
@@ -190,6 +234,9 @@ func appendLogFileTail(appName, loggerType string) string {
 }
 
 func CloseLogger() {
+	// 先汇报丢弃数，Sync 时一并写出
+	reportDropped()
+
 	if SugaredLogger != nil {
 		_ = SugaredLogger.Sync()
 	}
@@ -0,0 +1,426 @@
+package klog
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// 日志脱敏配置，支持通过 SetRedactConf 热更新
+type RedactConf struct {
+	// 替换敏感值的掩码，默认 ***
+	Mask string `yaml:"mask"`
+	// 掩码后附加原值HMAC-SHA256的前8位，同一个值脱敏结果一致，便于排查时关联
+	Hash bool `yaml:"hash"`
+	// Hash 使用的密钥，开启 Hash 时必填，避免手机号等低熵的值被暴力还原
+	HashKey string `yaml:"hashKey"`
+	// 需要脱敏的header、cookie名，不区分大小写
+	Headers []string `yaml:"headers"`
+	Cookies []string `yaml:"cookies"`
+	// json字段，不含"."时匹配任意层级的同名字段，含"."时为从根开始的路径(数组透明)
+	JSONFields []string `yaml:"jsonFields"`
+	// 表单及query参数名
+	FormKeys []string `yaml:"formKeys"`
+	// 内置规则：phone、idcard、bearer、jwt
+	Builtins []string `yaml:"builtins"`
+	// 自定义正则
+	Patterns []RedactPattern `yaml:"patterns"`
+}
+
+type RedactPattern struct {
+	Name  string `yaml:"name"`
+	Regex string `yaml:"regex"`
+	// 替换内容，支持 $1 引用分组，为空时使用掩码
+	Replace string `yaml:"replace"`
+}
+
+const defaultRedactMask = "***"
+
+var builtinRedactPatterns = map[string]RedactPattern{
+	"phone":  {Name: "phone", Regex: `\b1[3-9]\d{9}\b`},
+	"idcard": {Name: "idcard", Regex: `\b\d{17}[\dXx]\b`},
+	"bearer": {Name: "bearer", Regex: `(?i)\b(bearer|basic)\s+[A-Za-z0-9\-._~+/]+=*`, Replace: "$1 " + defaultRedactMask},
+	"jwt":    {Name: "jwt", Regex: `\beyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`},
+}
+
+type redactPattern struct {
+	re      *regexp.Regexp
+	replace string
+}
+
+type redactor struct {
+	mask     string
+	hash     bool
+	hashKey  []byte
+	headers  map[string]bool
+	cookies  map[string]bool
+	keys     map[string]bool // 任意层级的json字段与表单参数
+	paths    map[string]bool // 从根开始的json路径
+	patterns []redactPattern
+}
+
+var redactRules atomic.Value // *redactor
+
+// SetRedactConf 更新脱敏规则，配置错误时保留原规则
+func SetRedactConf(conf RedactConf) error {
+	r := &redactor{
+		mask:    conf.Mask,
+		hash:    conf.Hash,
+		hashKey: []byte(conf.HashKey),
+		headers: lowerSet(conf.Headers),
+		cookies: lowerSet(conf.Cookies),
+		keys:    lowerSet(conf.FormKeys),
+		paths:   map[string]bool{},
+	}
+	if r.mask == "" {
+		r.mask = defaultRedactMask
+	}
+	if r.hash && len(r.hashKey) == 0 {
+		return errors.New("redact hash requires hashKey")
+	}
+	for _, f := range conf.JSONFields {
+		if strings.Contains(f, ".") {
+			r.paths[strings.ToLower(f)] = true
+		} else if f != "" {
+			r.keys[strings.ToLower(f)] = true
+		}
+	}
+
+	patterns := conf.Patterns
+	for _, name := range conf.Builtins {
+		p, ok := builtinRedactPatterns[name]
+		if !ok {
+			return errors.New("unknown redact builtin " + name)
+		}
+		patterns = append(patterns, p)
+	}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p.Regex)
+		if err != nil {
+			return errors.New("redact pattern " + p.Name + ": " + err.Error())
+		}
+		r.patterns = append(r.patterns, redactPattern{re: re, replace: p.Replace})
+	}
+
+	if len(r.headers) == 0 && len(r.cookies) == 0 && len(r.keys) == 0 && len(r.paths) == 0 && len(r.patterns) == 0 {
+		r = nil
+	}
+	redactRules.Store(r)
+	return nil
+}
+
+func currentRedactor() *redactor {
+	r, _ := redactRules.Load().(*redactor)
+	return r
+}
+
+// RedactHeader header脱敏
+func RedactHeader(name, value string) string {
+	r := currentRedactor()
+	if r == nil {
+		return value
+	}
+	if r.headers[strings.ToLower(name)] {
+		return r.maskValue(value)
+	}
+	return r.redactPatterns(value)
+}
+
+// RedactCookie cookie脱敏
+func RedactCookie(name, value string) string {
+	r := currentRedactor()
+	if r == nil {
+		return value
+	}
+	if r.cookies[strings.ToLower(name)] {
+		return r.maskValue(value)
+	}
+	return r.redactPatterns(value)
+}
+
+// RedactBody 请求/响应体脱敏，json按字段，表单按参数名，最后应用正则
+func RedactBody(body string) string {
+	r := currentRedactor()
+	if r == nil || body == "" {
+		return body
+	}
+	trimmed := strings.TrimSpace(body)
+	if trimmed != "" && (trimmed[0] == '{' || trimmed[0] == '[') {
+		if out, ok := r.redactJSON(trimmed); ok {
+			return r.redactPatterns(out)
+		}
+	} else if strings.Contains(body, "=") {
+		body = r.redactForm(body)
+	}
+	return r.redactPatterns(body)
+}
+
+// RedactURL url中query参数脱敏
+func RedactURL(u string) string {
+	r := currentRedactor()
+	if r == nil {
+		return u
+	}
+	if i := strings.IndexByte(u, '?'); i >= 0 {
+		u = u[:i+1] + r.redactForm(u[i+1:])
+	}
+	return r.redactPatterns(u)
+}
+
+// RedactString 只应用正则规则
+func RedactString(s string) string {
+	r := currentRedactor()
+	if r == nil {
+		return s
+	}
+	return r.redactPatterns(s)
+}
+
+func (r *redactor) maskValue(v string) string {
+	if v == "" {
+		return v
+	}
+	if !r.hash {
+		return r.mask
+	}
+	m := hmac.New(sha256.New, r.hashKey)
+	_, _ = m.Write([]byte(v))
+	return r.mask + hex.EncodeToString(m.Sum(nil)[:4])
+}
+
+func (r *redactor) redactPatterns(s string) string {
+	for _, p := range r.patterns {
+		if p.replace != "" {
+			s = p.re.ReplaceAllString(s, p.replace)
+		} else {
+			s = p.re.ReplaceAllStringFunc(s, r.maskValue)
+		}
+	}
+	return s
+}
+
+// 保持参数顺序，只替换命中的值
+func (r *redactor) redactForm(s string) string {
+	if len(r.keys) == 0 {
+		return s
+	}
+	pairs := strings.Split(s, "&")
+	changed := false
+	for i, pair := range pairs {
+		k, v := pair, ""
+		if j := strings.IndexByte(pair, '='); j >= 0 {
+			k, v = pair[:j], pair[j+1:]
+		} else {
+			continue
+		}
+		key, err := url.QueryUnescape(k)
+		if err != nil {
+			key = k
+		}
+		if r.keys[strings.ToLower(key)] {
+			if uv, err := url.QueryUnescape(v); err == nil {
+				v = uv
+			}
+			pairs[i] = k + "=" + r.maskValue(v)
+			changed = true
+		}
+	}
+	if !changed {
+		return s
+	}
+	return strings.Join(pairs, "&")
+}
+
+// 没有命中字段时返回原文，避免重新序列化改变格式
+func (r *redactor) redactJSON(s string) (string, bool) {
+	if len(r.keys) == 0 && len(r.paths) == 0 {
+		return s, true
+	}
+	d := json.NewDecoder(strings.NewReader(s))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return s, false
+	}
+	v, changed := r.walkJSON(v, "")
+	if !changed {
+		return s, true
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return s, false
+	}
+	return strings.TrimRight(buf.String(), "\n"), true
+}
+
+func (r *redactor) walkJSON(v interface{}, path string) (interface{}, bool) {
+	changed := false
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, child := range t {
+			p := strings.ToLower(k)
+			if path != "" {
+				p = path + "." + p
+			}
+			if r.keys[strings.ToLower(k)] || r.paths[p] {
+				t[k] = r.maskJSONValue(child)
+				changed = true
+				continue
+			}
+			if nv, c := r.walkJSON(child, p); c {
+				t[k] = nv
+				changed = true
+			}
+		}
+	case []interface{}:
+		for i, child := range t {
+			if nv, c := r.walkJSON(child, path); c {
+				t[i] = nv
+				changed = true
+			}
+		}
+	}
+	return v, changed
+}
+
+func (r *redactor) maskJSONValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case string:
+		return r.maskValue(t)
+	case json.Number:
+		return r.maskValue(t.String())
+	case nil:
+		return nil
+	default:
+		b, _ := json.Marshal(t)
+		return r.maskValue(string(b))
+	}
+}
+
+// 写日志前对字段统一脱敏：字段名命中时整体替换，否则应用正则
+// 字符串数组、对象等(zap.Strings、zap.Any)按json逐层处理
+func redactFields(fields []zapcore.Field) []zapcore.Field {
+	r := currentRedactor()
+	if r == nil {
+		return fields
+	}
+	var out []zapcore.Field
+	for i, f := range fields {
+		if f.Key == TopicType {
+			continue
+		}
+		nf, changed := r.redactField(f)
+		if !changed {
+			continue
+		}
+		if out == nil {
+			out = append([]zapcore.Field(nil), fields...)
+		}
+		out[i] = nf
+	}
+	if out == nil {
+		return fields
+	}
+	return out
+}
+
+// 日志消息只应用正则规则
+func redactMessage(msg string) string {
+	r := currentRedactor()
+	if r == nil {
+		return msg
+	}
+	return r.redactPatterns(msg)
+}
+
+func (r *redactor) redactField(f zapcore.Field) (zapcore.Field, bool) {
+	key := strings.ToLower(f.Key)
+	hit := r.keys[key] || r.headers[key] || r.cookies[key]
+
+	switch f.Type {
+	case zapcore.StringType:
+		s := r.redactPatterns(f.String)
+		if hit {
+			s = r.maskValue(f.String)
+		}
+		if s == f.String {
+			return f, false
+		}
+		f.String = s
+		return f, true
+	case zapcore.ArrayMarshalerType, zapcore.ObjectMarshalerType, zapcore.ReflectType:
+	default:
+		return f, false
+	}
+
+	// 通过编码器取出字段值后转为json结构
+	enc := zapcore.NewMapObjectEncoder()
+	f.AddTo(enc)
+	b, err := json.Marshal(enc.Fields[f.Key])
+	if err != nil {
+		return f, false
+	}
+	if hit {
+		return zapcore.Field{Key: f.Key, Type: zapcore.StringType, String: r.maskValue(string(b))}, true
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return f, false
+	}
+	v, c1 := r.walkJSON(v, "")
+	v, c2 := r.walkStrings(v)
+	if !c1 && !c2 {
+		return f, false
+	}
+	return zapcore.Field{Key: f.Key, Type: zapcore.ReflectType, Interface: v}, true
+}
+
+// 对json结构中的字符串应用正则规则
+func (r *redactor) walkStrings(v interface{}) (interface{}, bool) {
+	changed := false
+	switch t := v.(type) {
+	case string:
+		if s := r.redactPatterns(t); s != t {
+			return s, true
+		}
+	case map[string]interface{}:
+		for k, child := range t {
+			if nv, c := r.walkStrings(child); c {
+				t[k] = nv
+				changed = true
+			}
+		}
+	case []interface{}:
+		for i, child := range t {
+			if nv, c := r.walkStrings(child); c {
+				t[i] = nv
+				changed = true
+			}
+		}
+	}
+	return v, changed
+}
+
+func lowerSet(list []string) map[string]bool {
+	m := make(map[string]bool, len(list))
+	for _, s := range list {
+		if s != "" {
+			m[strings.ToLower(s)] = true
+		}
+	}
+	return m
+}
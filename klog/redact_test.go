@@ -0,0 +1,133 @@
+package klog
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func setRedactConf(t *testing.T, conf RedactConf) {
+	t.Helper()
+	if err := SetRedactConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = SetRedactConf(RedactConf{}) })
+}
+
+func TestSetRedactConfError(t *testing.T) {
+	cases := []struct {
+		name string
+		conf RedactConf
+	}{
+		{"unknown builtin", RedactConf{Builtins: []string{"nope"}}},
+		{"bad pattern", RedactConf{Patterns: []RedactPattern{{Name: "p", Regex: "("}}}},
+		{"hash without key", RedactConf{Hash: true, Builtins: []string{"phone"}}},
+	}
+	for _, c := range cases {
+		if err := SetRedactConf(c.conf); err == nil {
+			t.Errorf("%s: expect error", c.name)
+		}
+	}
+	_ = SetRedactConf(RedactConf{})
+}
+
+func TestRedactRules(t *testing.T) {
+	setRedactConf(t, RedactConf{
+		Headers:    []string{"Authorization"},
+		Cookies:    []string{"SESSION"},
+		JSONFields: []string{"password", "user.idNo"},
+		FormKeys:   []string{"token"},
+		Builtins:   []string{"phone", "idcard", "bearer", "jwt"},
+		Patterns:   []RedactPattern{{Name: "card", Regex: `card-(\d{4})\d+`, Replace: "card-$1****"}},
+	})
+
+	cases := []struct {
+		name string
+		fn   func(string) string
+		in   string
+		want string
+	}{
+		{"header hit", func(s string) string { return RedactHeader("authorization", s) }, "Basic abc", "***"},
+		{"header miss", func(s string) string { return RedactHeader("X-Id", s) }, "abc", "abc"},
+		{"header pattern", func(s string) string { return RedactHeader("X-Phone", s) }, "13812345678", "***"},
+		{"cookie hit", func(s string) string { return RedactCookie("session", s) }, "abc", "***"},
+		{"cookie miss", func(s string) string { return RedactCookie("x", s) }, "abc", "abc"},
+		{"json key any level", RedactBody, `{"a":{"password":"p"},"b":[{"password":12}]}`, `{"a":{"password":"***"},"b":[{"password":"***"}]}`},
+		{"json path", RedactBody, `{"user":{"idNo":"1","name":"n"},"idNo":"keep"}`, `{"idNo":"keep","user":{"idNo":"***","name":"n"}}`},
+		{"json path in array", RedactBody, `{"user":[{"idNo":"1"}]}`, `{"user":[{"idNo":"***"}]}`},
+		{"json untouched", RedactBody, `{"a": 1}`, `{"a": 1}`},
+		{"json pattern", RedactBody, `{"m":"call 13812345678"}`, `{"m":"call ***"}`},
+		{"form", RedactBody, "a=1&token=x%20y&b=2", "a=1&token=***&b=2"},
+		{"url query", RedactURL, "/p?token=1&q=2", "/p?token=***&q=2"},
+		{"url pattern", RedactURL, "/p/13812345678", "/p/***"},
+		{"builtin phone", RedactString, "tel 13812345678", "tel ***"},
+		{"builtin idcard", RedactString, "id 11010519491231002X", "id ***"},
+		{"builtin bearer", RedactString, "Authorization: Bearer abc.def", "Authorization: Bearer ***"},
+		{"builtin jwt", RedactString, "t=eyJhbGciOi.eyJzdWIi.sig", "t=***"},
+		{"custom pattern", RedactString, "card-12345678", "card-1234****"},
+		{"no match", RedactString, "hello", "hello"},
+	}
+	for _, c := range cases {
+		if got := c.fn(c.in); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestRedactHash(t *testing.T) {
+	setRedactConf(t, RedactConf{Builtins: []string{"phone"}, Hash: true, HashKey: "k1"})
+	a, b := RedactString("13812345678"), RedactString("x 13812345678")
+	m := hmac.New(sha256.New, []byte("k1"))
+	m.Write([]byte("13812345678"))
+	want := "***" + hex.EncodeToString(m.Sum(nil)[:4])
+	if a != want || b != "x "+want {
+		t.Fatalf("got %q %q, want %q", a, b, want)
+	}
+
+	// 密钥不同结果不同
+	setRedactConf(t, RedactConf{Builtins: []string{"phone"}, Hash: true, HashKey: "k2"})
+	if RedactString("13812345678") == a {
+		t.Fatal("hash not keyed")
+	}
+}
+
+func TestRedactLogFields(t *testing.T) {
+	setRedactConf(t, RedactConf{JSONFields: []string{"password"}, FormKeys: []string{"token", "userid"}, Builtins: []string{"phone"}})
+	core, logs := observer.New(zapcore.DebugLevel)
+	l := zap.New(newLevelCore(core)).With(String("w", "13900000000"), String("token", "t"))
+
+	type user struct {
+		Password string
+		Phone    string
+	}
+	l.Info("call 13812345678",
+		String(TopicType, LogNameAccess),
+		String("userid", "42"),
+		zap.Strings("s", []string{"a", "13700000000"}),
+		zap.Any("obj", map[string]interface{}{"password": "p", "x": []string{"13600000000"}}),
+		zap.Reflect("st", user{"p", "13500000000"}),
+		zap.Any("token", []int{1}),
+		Int("n", 1))
+
+	e := logs.All()[0]
+	all := e.Message
+	for k, v := range e.ContextMap() {
+		b, _ := json.Marshal(v)
+		all += k + string(b)
+	}
+	for _, s := range []string{"138", "139", "137", "136", "135", `"p"`, `"t"`, "[1]", `"42"`} {
+		if strings.Contains(all, s) {
+			t.Errorf("leaked %s in %s", s, all)
+		}
+	}
+	if m := e.ContextMap(); m[TopicType] != LogNameAccess || m["n"] != int64(1) {
+		t.Errorf("unexpected fields %v", m)
+	}
+}
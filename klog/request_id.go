@@ -0,0 +1,72 @@
+package klog
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+const (
+	RequestIDFormatRandom = "random"
+	RequestIDFormatTime   = "time"
+
+	RequestIDHeaderKey = "X-Request-Id"
+)
+
+// 请求id配置
+type RequestIDConf struct {
+	// random: 128位随机数；time: 48位毫秒时间戳 + 80位随机数，按时间有序。默认 random
+	Format string `yaml:"format"`
+	// 入口按顺序从这些header中取请求id，默认 X_BD_LOGID、X-Request-Id、Uber-Trace-Id
+	Headers []string `yaml:"headers"`
+	// 响应中回写请求id的header，默认 X-Request-Id，配置为 - 时不回写
+	ResponseHeader string `yaml:"responseHeader"`
+}
+
+var requestIDConf = RequestIDConf{
+	Format:         RequestIDFormatRandom,
+	Headers:        []string{LogIDHeaderKey, RequestIDHeaderKey, TraceHeaderKey},
+	ResponseHeader: RequestIDHeaderKey,
+}
+
+func setRequestIDConf(conf RequestIDConf) {
+	if conf.Format != "" {
+		requestIDConf.Format = conf.Format
+	}
+	if len(conf.Headers) > 0 {
+		requestIDConf.Headers = conf.Headers
+	}
+	switch conf.ResponseHeader {
+	case "":
+	case "-":
+		requestIDConf.ResponseHeader = ""
+	default:
+		requestIDConf.ResponseHeader = conf.ResponseHeader
+	}
+}
+
+// RequestIDResponseHeader 响应中回写请求id的header，为空时不回写
+func RequestIDResponseHeader() string {
+	return requestIDConf.ResponseHeader
+}
+
+func genRequestId() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	if requestIDConf.Format == RequestIDFormatTime {
+		var ts [8]byte
+		binary.BigEndian.PutUint64(ts[:], uint64(time.Now().UnixNano()/int64(time.Millisecond)))
+		copy(b[:6], ts[2:])
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// 上游传入的请求id会写入日志与下游header，只接受可见字符且长度不超过128
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	return strings.IndexFunc(id, func(r rune) bool { return r <= ' ' || r > '~' }) < 0
+}
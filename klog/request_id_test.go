@@ -0,0 +1,102 @@
+package klog
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/peerless6372/gin"
+)
+
+// 修改请求id配置，结束时恢复
+func setTestRequestIDConf(t *testing.T, conf RequestIDConf) {
+	t.Helper()
+	old := requestIDConf
+	setRequestIDConf(conf)
+	t.Cleanup(func() { requestIDConf = old })
+}
+
+func TestGenRequestId(t *testing.T) {
+	a, b := genRequestId(), genRequestId()
+	if len(a) != 32 || a == b {
+		t.Errorf("random: %s %s", a, b)
+	}
+
+	// 时间格式的请求id按时间有序
+	setTestRequestIDConf(t, RequestIDConf{Format: RequestIDFormatTime})
+	x := genRequestId()
+	time.Sleep(2 * time.Millisecond)
+	y := genRequestId()
+	if len(x) != 32 || x[:12] >= y[:12] {
+		t.Errorf("time: %s %s", x, y)
+	}
+}
+
+func TestValidRequestID(t *testing.T) {
+	cases := []struct {
+		id   string
+		want bool
+	}{
+		{"abc-123", true},
+		{"", false},
+		{"bad id", false},
+		{"bad\nid", false},
+		{"中文", false},
+		{strings.Repeat("a", 128), true},
+		{strings.Repeat("a", 129), false},
+	}
+	for _, c := range cases {
+		if got := validRequestID(c.id); got != c.want {
+			t.Errorf("%q: got %v", c.id, got)
+		}
+	}
+}
+
+func TestGetRequestID(t *testing.T) {
+	cases := []struct {
+		name    string
+		conf    RequestIDConf
+		headers map[string]string
+		want    string
+	}{
+		// 默认顺序 X_BD_LOGID、X-Request-Id、Uber-Trace-Id，跳过不合法的值
+		{"order", RequestIDConf{}, map[string]string{TraceHeaderKey: "tr", RequestIDHeaderKey: "rq", LogIDHeaderKey: "bad id"}, "rq"},
+		{"logid", RequestIDConf{}, map[string]string{LogIDHeaderKey: "lg", RequestIDHeaderKey: "rq"}, "lg"},
+		{"custom headers", RequestIDConf{Headers: []string{"X-Custom"}}, map[string]string{"X-Custom": "cu", LogIDHeaderKey: "lg"}, "cu"},
+		{"generated", RequestIDConf{}, nil, ""},
+	}
+	for _, c := range cases {
+		setTestRequestIDConf(t, c.conf)
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest("GET", "/", nil)
+		for k, v := range c.headers {
+			ctx.Request.Header.Set(k, v)
+		}
+		id := GetRequestID(ctx)
+		if (c.want == "" && len(id) != 32) || (c.want != "" && id != c.want) {
+			t.Errorf("%s: got %s, want %s", c.name, id, c.want)
+		}
+		// 同一请求内保持不变
+		if GetRequestID(ctx) != id || ctx.GetString(ContextKeyLogID) != id {
+			t.Errorf("%s: id changed", c.name)
+		}
+	}
+}
+
+func TestRequestIDResponseHeader(t *testing.T) {
+	cases := []struct {
+		conf string
+		want string
+	}{
+		{"", RequestIDHeaderKey},
+		{"X-Trace", "X-Trace"},
+		{"-", ""},
+	}
+	for _, c := range cases {
+		setTestRequestIDConf(t, RequestIDConf{ResponseHeader: c.conf})
+		if got := RequestIDResponseHeader(); got != c.want {
+			t.Errorf("%q: got %q, want %q", c.conf, got, c.want)
+		}
+	}
+}
@@ -3,15 +3,18 @@ package klog
 import (
 	"fmt"
 	"github.com/peerless6372/Lplot/utils"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
-	"sort"
+	"strconv"
+	"sync"
 	"time"
 )
 
 const (
+	megabyte       = 1024 * 1024
+	compressSuffix = ".gz"
+
 	// number of seconds in a day
 	secondInDay = 24 * 60 * 60
 	// number of seconds in a hour
@@ -36,30 +39,66 @@ type TimeFileLogWriter struct {
 	fileFilter *regexp.Regexp // for removing old log files
 
 	rolloverAt int64 // time.Unix()
+
+	mu   sync.Mutex
+	size int64 // 当前文件大小
+
+	maxSize      int64         // 单个文件最大字节数，0表示不按大小切割
+	compress     bool          // 切割后的文件gzip压缩
+	maxAge       time.Duration // 切割后的文件最长保留时间
+	maxTotalSize int64         // 日志目录的最大总字节数
+
+	// 压缩与清理在后台执行，不阻塞写日志
+	millOnce sync.Once
+	millCh   chan struct{}
 }
 
+var (
+	fileWritersMu sync.Mutex
+	// 同一文件只有一个writer，多个logger共用，保证切割时的锁与大小计数一致
+	fileWriters = map[string]*TimeFileLogWriter{}
+)
+
+// NewTimeFileLogWriter 使用全局的切割配置
 func NewTimeFileLogWriter(fName string) *TimeFileLogWriter {
-	w := &TimeFileLogWriter{
-		basename:     fName,
-		filename:     filepath.Join(logConfig.Path, fName),
-		rotateSwitch: logConfig.RotateSwitch,
-		rotateUnit:   logConfig.RotateUnit,
-		backupCount:  logConfig.RotateCount,
-	}
+	return newTimeFileLogWriter(fName, logConfig.rotate())
+}
+
+// 同一文件已有writer时直接返回，切割配置以首次创建时为准
+func newTimeFileLogWriter(fName string, rotate Rotate) *TimeFileLogWriter {
+	filename := filepath.Join(logConfig.Path, fName)
 
 	// get abs path
-	if path, err := filepath.Abs(w.filename); err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "NewTimeFileLogWriter(%s): %s\n", w.filename, err)
+	absFileName, err := filepath.Abs(filename)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "NewTimeFileLogWriter(%s): %s\n", filename, err)
 		return nil
-	} else {
-		w.absFileName = path
+	}
+
+	fileWritersMu.Lock()
+	defer fileWritersMu.Unlock()
+	if w, ok := fileWriters[absFileName]; ok {
+		return w
+	}
+
+	w := &TimeFileLogWriter{
+		basename:     fName,
+		filename:     filename,
+		absFileName:  absFileName,
+		rotateSwitch: rotate.Switch,
+		rotateUnit:   rotate.Unit,
+		backupCount:  rotate.Count,
+		maxSize:      int64(rotate.MaxSize) * megabyte,
+		compress:     rotate.Compress,
+		maxAge:       rotate.MaxAge,
+		maxTotalSize: int64(rotate.MaxTotalSize) * megabyte,
 	}
 
 	// prepare for w.interval, w.suffix and w.fileFilter
 	w.prepare()
 
 	if w.rotateSwitch {
-		if err := w.doRotate(); err != nil {
+		if err := w.doRotate(false); err != nil {
 			//panic(fmt.Errorf("NewTimeFileLogWriter doRotate(%q): %s\n", w.basename, err))
 			return nil
 		}
@@ -70,21 +109,49 @@ func NewTimeFileLogWriter(fName string) *TimeFileLogWriter {
 		}
 	}
 
+	if rotate.ReopenOnSighup {
+		watchSighup(w)
+	}
+	fileWriters[absFileName] = w
 	return w
 }
 
 func (w *TimeFileLogWriter) Write(p []byte) (n int, err error) {
 	// Guard against concurrent writes
-	//rl.mutex.Lock()
-	//defer rl.mutex.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		if err := w.openFile(); err != nil {
+			return 0, err
+		}
+	}
 
 	if w.rotateSwitch && w.shouldRollover() {
-		if err := w.doRotate(); err != nil {
+		if err := w.doRotate(false); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "log rotate(%s): %s\n", w.basename, err)
+		}
+	} else if w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.doRotate(true); err != nil {
 			_, _ = fmt.Fprintf(os.Stderr, "log rotate(%s): %s\n", w.basename, err)
 		}
 	}
 
-	return w.file.Write(p)
+	n, err = w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Reopen 关闭并重新打开日志文件，配合外部logrotate使用
+func (w *TimeFileLogWriter) Reopen() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file != nil {
+		_ = w.file.Close()
+		w.file = nil
+	}
+	return w.openFile()
 }
 
 func (w *TimeFileLogWriter) prepare() {
@@ -94,17 +161,17 @@ func (w *TimeFileLogWriter) prepare() {
 	case "D": // day
 		w.interval = 60 * 60 * 24
 		w.suffix = "%Y%m%d"
-		regRule = `^\d{4}\d{2}\d{2}$`
+		regRule = `^\d{4}\d{2}\d{2}(\.\d+)?(\.gz)?$`
 	case "M": // minute
 		w.interval = 60
 		w.suffix = "%Y%m%d%H%M"
-		regRule = `^\d{4}\d{2}\d{2}\d{2}\d{2}$`
+		regRule = `^\d{4}\d{2}\d{2}\d{2}\d{2}(\.\d+)?(\.gz)?$`
 	case "H": // hour, by default
 		fallthrough
 	default:
 		w.interval = 60 * 60
 		w.suffix = "%Y%m%d%H"
-		regRule = `^\d{4}\d{2}\d{2}\d{2}$`
+		regRule = `^\d{4}\d{2}\d{2}\d{2}(\.\d+)?(\.gz)?$`
 	}
 	w.fileFilter = regexp.MustCompile(regRule)
 
@@ -156,85 +223,51 @@ func (w *TimeFileLogWriter) doCreate() error {
 	}
 
 	// 重新打开文件
+	return w.openFile()
+}
+
+func (w *TimeFileLogWriter) openFile() error {
 	fd, err := os.OpenFile(w.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
 		return err
 	}
 	w.file = fd
-
+	w.size = 0
+	if info, err := fd.Stat(); err == nil {
+		w.size = info.Size()
+	}
 	return nil
 }
 
-// 文件自动切割功能
-func (w *TimeFileLogWriter) doRotate() error {
+// 文件自动切割功能，bySize 为true时表示文件超过了 maxSize
+func (w *TimeFileLogWriter) doRotate(bySize bool) error {
 	// Close any log file that may be open
 	if w.file != nil {
 		_ = w.file.Close()
+		w.file = nil
 	}
 
-	if w.shouldRollover() {
+	var err error
+	if bySize || w.shouldRollover() {
 		// rename file to backup name
-		if err := w.moveToBackup(); err != nil {
-			return err
-		}
+		err = w.moveToBackup(bySize)
 	}
 
-	// remove files, according to backupCount
-	if w.backupCount > 0 {
-		for _, fileName := range w.getFilesToDelete() {
-			_ = os.Remove(fileName)
-		}
+	// Open the log file，备份失败时也要重新打开，避免写入已关闭的文件
+	if e := w.openFile(); e != nil {
+		return e
 	}
-	// Open the log file
-	fd, err := os.OpenFile(w.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
-	if err != nil {
-		return err
-	}
-	w.file = fd
-
-	w.adjustRolloverAt()
-
-	return nil
-}
-
-// 同种类型的日志按时间排序，保留最新的 log.rotate.count 个日志文件
-func (w *TimeFileLogWriter) getFilesToDelete() []string {
-	dirName := filepath.Dir(w.filename)
-	baseName := filepath.Base(w.filename)
-
-	var result []string
-	fileInfos, err := ioutil.ReadDir(dirName)
-	if err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
-		return result
-	}
-
-	prefix := baseName + "."
-	plen := len(prefix)
-	for _, fileInfo := range fileInfos {
-		fileName := fileInfo.Name()
-		if len(fileName) >= plen {
-			if fileName[:plen] == prefix {
-				suffix := fileName[plen:]
-				if w.fileFilter.MatchString(suffix) {
-					result = append(result, filepath.Join(dirName, fileName))
-				}
-			}
-		}
+	if w.rotateSwitch {
+		w.adjustRolloverAt()
 	}
 
-	sort.Sort(sort.StringSlice(result))
-
-	if len(result) < w.backupCount {
-		result = result[0:0]
-	} else {
-		result = result[:len(result)-w.backupCount]
-	}
-	return result
+	// 压缩及清理旧文件
+	w.mill()
+	return err
 }
 
 // rename file to backup name
-func (w *TimeFileLogWriter) moveToBackup() error {
+func (w *TimeFileLogWriter) moveToBackup(bySize bool) error {
 	_, err := os.Lstat(w.filename)
 	if err != nil {
 		return nil
@@ -242,16 +275,11 @@ func (w *TimeFileLogWriter) moveToBackup() error {
 	// file exists
 
 	// get the time that this sequence started at and make it a TimeTuple
-	t := time.Unix(w.rolloverAt-w.interval, 0).Local()
-	fName := w.absFileName + "." + utils.Format(w.suffix, t)
-
-	// remove the file with fName if exist
-	if _, err := os.Stat(fName); err == nil {
-		err = os.Remove(fName)
-		if err != nil {
-			return fmt.Errorf("Rotate: %s\n", err)
-		}
+	t := time.Now()
+	if w.rotateSwitch {
+		t = time.Unix(w.rolloverAt-w.interval, 0).Local()
 	}
+	fName := w.backupName(w.absFileName+"."+utils.Format(w.suffix, t), bySize)
 
 	// Rename the file to its new found home
 	err = os.Rename(w.absFileName, fName)
@@ -261,6 +289,27 @@ func (w *TimeFileLogWriter) moveToBackup() error {
 	return nil
 }
 
+// 同一时间段内按大小切割出的文件加上序号，已存在同名文件(含压缩后的)时也加序号，不覆盖
+func (w *TimeFileLogWriter) backupName(base string, withIndex bool) string {
+	if !withIndex && !backupExists(base) {
+		return base
+	}
+	for i := 1; ; i++ {
+		name := base + "." + strconv.Itoa(i)
+		if !backupExists(name) {
+			return name
+		}
+	}
+}
+
+func backupExists(name string) bool {
+	if _, err := os.Lstat(name); err == nil {
+		return true
+	}
+	_, err := os.Lstat(name + compressSuffix)
+	return err == nil
+}
+
 // 更新下次切割时间
 func (w *TimeFileLogWriter) adjustRolloverAt() {
 	currTime := time.Now()
@@ -0,0 +1,226 @@
+package klog
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 任意日志的切割文件：name.时间[.序号][.gz]
+var backupFileRe = regexp.MustCompile(`\.\d{8}(\d{2}){0,2}(\.\d+)?(\.gz)?$`)
+
+// 多个writer共用日志目录，按目录总大小清理时串行执行
+var dirCleanMu sync.Mutex
+
+// 唤醒后台goroutine执行压缩与清理
+func (w *TimeFileLogWriter) mill() {
+	if !w.compress && w.backupCount <= 0 && w.maxAge <= 0 && w.maxTotalSize <= 0 {
+		return
+	}
+	w.millOnce.Do(func() {
+		w.millCh = make(chan struct{}, 1)
+		go func() {
+			for range w.millCh {
+				w.millRunOnce()
+			}
+		}()
+	})
+	select {
+	case w.millCh <- struct{}{}:
+	default:
+	}
+}
+
+func (w *TimeFileLogWriter) millRunOnce() {
+	if w.compress {
+		for _, f := range w.backups() {
+			if strings.HasSuffix(f.name, compressSuffix) {
+				continue
+			}
+			if err := compressFile(f.name); err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "log compress(%s): %s\n", f.name, err)
+			}
+		}
+	}
+
+	backups := w.backups()
+	// 按个数保留最新的 backupCount 个
+	if w.backupCount > 0 && len(backups) > w.backupCount {
+		for _, f := range backups[:len(backups)-w.backupCount] {
+			_ = os.Remove(f.name)
+		}
+		backups = backups[len(backups)-w.backupCount:]
+	}
+	// 按时间删除过期的
+	if w.maxAge > 0 {
+		cutoff := time.Now().Add(-w.maxAge)
+		for _, f := range backups {
+			if f.modTime.Before(cutoff) {
+				_ = os.Remove(f.name)
+			}
+		}
+	}
+	// 按目录总大小从最旧的切割文件开始删除
+	if w.maxTotalSize > 0 {
+		cleanDir(filepath.Dir(w.absFileName), w.maxTotalSize)
+	}
+}
+
+type backupFile struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// 当前日志的切割文件，按修改时间从旧到新排序
+func (w *TimeFileLogWriter) backups() []backupFile {
+	dirName := filepath.Dir(w.absFileName)
+	prefix := filepath.Base(w.absFileName) + "."
+
+	fileInfos, err := ioutil.ReadDir(dirName)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
+		return nil
+	}
+
+	var result []backupFile
+	for _, fi := range fileInfos {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasPrefix(name, prefix) || !w.fileFilter.MatchString(name[len(prefix):]) {
+			continue
+		}
+		result = append(result, backupFile{name: filepath.Join(dirName, name), size: fi.Size(), modTime: fi.ModTime()})
+	}
+	sortBackups(result)
+	return result
+}
+
+func cleanDir(dir string, maxTotalSize int64) {
+	dirCleanMu.Lock()
+	defer dirCleanMu.Unlock()
+
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "log clean(%q): %s\n", dir, err)
+		return
+	}
+
+	var total int64
+	var backups []backupFile
+	for _, fi := range fileInfos {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		total += fi.Size()
+		if backupFileRe.MatchString(fi.Name()) {
+			backups = append(backups, backupFile{name: filepath.Join(dir, fi.Name()), size: fi.Size(), modTime: fi.ModTime()})
+		}
+	}
+	sortBackups(backups)
+
+	// 正在写的文件不删除
+	for _, f := range backups {
+		if total <= maxTotalSize {
+			return
+		}
+		if err := os.Remove(f.name); err == nil {
+			total -= f.size
+		}
+	}
+}
+
+func sortBackups(files []backupFile) {
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].modTime.Equal(files[j].modTime) {
+			return files[i].name < files[j].name
+		}
+		return files[i].modTime.Before(files[j].modTime)
+	})
+}
+
+// gzip压缩后删除原文件，保留原文件的修改时间以便按时间清理
+func compressFile(name string) (err error) {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp := name + compressSuffix + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp)
+		}
+	}()
+
+	gz := gzip.NewWriter(dst)
+	if _, err = io.Copy(gz, src); err != nil {
+		_ = dst.Close()
+		return err
+	}
+	if err = gz.Close(); err != nil {
+		_ = dst.Close()
+		return err
+	}
+	if err = dst.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, name+compressSuffix); err != nil {
+		return err
+	}
+	_ = os.Chtimes(name+compressSuffix, info.ModTime(), info.ModTime())
+	return os.Remove(name)
+}
+
+// 收到SIGHUP时重新打开所有日志文件
+var (
+	sighupOnce    sync.Once
+	sighupMu      sync.Mutex
+	sighupWriters []*TimeFileLogWriter
+)
+
+func watchSighup(w *TimeFileLogWriter) {
+	sighupMu.Lock()
+	sighupWriters = append(sighupWriters, w)
+	sighupMu.Unlock()
+
+	sighupOnce.Do(func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGHUP)
+		go func() {
+			for range ch {
+				reopenAll()
+			}
+		}()
+	})
+}
+
+func reopenAll() {
+	sighupMu.Lock()
+	writers := append([]*TimeFileLogWriter(nil), sighupWriters...)
+	sighupMu.Unlock()
+
+	for _, w := range writers {
+		if err := w.Reopen(); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "log reopen(%s): %s\n", w.basename, err)
+		}
+	}
+}
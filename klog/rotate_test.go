@@ -0,0 +1,219 @@
+package klog
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// 日志目录指向临时目录，结束时恢复配置
+func setLogPath(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	old := logConfig
+	logConfig.Path = dir
+	t.Cleanup(func() { logConfig = old })
+	return dir
+}
+
+func TestFileWriterShared(t *testing.T) {
+	dir := setLogPath(t)
+	a := newTimeFileLogWriter("a.log", Rotate{})
+	if a == nil {
+		t.Fatal("create writer failed")
+	}
+
+	cases := []struct {
+		name   string
+		writer func() *TimeFileLogWriter
+		same   bool
+	}{
+		{"same name", func() *TimeFileLogWriter { return newTimeFileLogWriter("a.log", Rotate{MaxSize: 1}) }, true},
+		{"global rotate", func() *TimeFileLogWriter { return NewTimeFileLogWriter("a.log") }, true},
+		{"same file by path", func() *TimeFileLogWriter { return newTimeFileLogWriter("sub/../a.log", Rotate{}) }, true},
+		{"other file", func() *TimeFileLogWriter { return newTimeFileLogWriter("b.log", Rotate{}) }, false},
+	}
+	for _, c := range cases {
+		if w := c.writer(); (w == a) != c.same {
+			t.Errorf("%s: same %v", c.name, w == a)
+		}
+	}
+	// 切割配置以首次创建时为准
+	if a.maxSize != 0 {
+		t.Errorf("maxSize %d", a.maxSize)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.log")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLogOutputShared(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		setLogPath(t)
+		logConfig.AsyncSwitch = async
+
+		a := getLogOutput("shared", txtLogNormal, Rotate{})
+		b := getLogOutput("shared", txtLogNormal, Rotate{})
+		wf := getLogOutput("shared", txtLogWarnFatal, Rotate{})
+		if a != b || a == wf || (a.async != nil) != async {
+			t.Errorf("async %v: outputs %+v %+v %+v", async, a, b, wf)
+		}
+
+		// ZapLogger 与 SugaredLogger 的core写同一个writer
+		c1 := newOutputCore("shared", txtLogNormal, zapcore.InfoLevel, Rotate{})
+		c2 := newOutputCore("shared", txtLogNormal, zapcore.InfoLevel, Rotate{})
+		if async {
+			if c1.(*asyncCore).w != c2.(*asyncCore).w {
+				t.Error("async queue not shared")
+			}
+		}
+	}
+}
+
+func TestRotateBySize(t *testing.T) {
+	dir := setLogPath(t)
+	w := newTimeFileLogWriter("size.log", Rotate{Switch: true, Unit: "H"})
+	w.maxSize = 100
+
+	// 并发写入，每个文件不超过maxSize，且不丢失、不截断
+	line := strings.Repeat("x", 39) + "\n"
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				_, _ = w.Write([]byte(line))
+			}
+		}()
+	}
+	wg.Wait()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "size.log*"))
+	lines := 0
+	for _, f := range files {
+		info, _ := os.Stat(f)
+		if info.Size() > 100 {
+			t.Errorf("%s: size %d", f, info.Size())
+		}
+		fd, _ := os.Open(f)
+		sc := bufio.NewScanner(fd)
+		for sc.Scan() {
+			if sc.Text()+"\n" != line {
+				t.Errorf("%s: broken line %q", f, sc.Text())
+			}
+			lines++
+		}
+		_ = fd.Close()
+	}
+	if lines != 400 || len(files) != 200 {
+		t.Fatalf("files %d lines %d", len(files), lines)
+	}
+}
+
+func TestBackupName(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "a.log.2024010203")
+	cases := []struct {
+		name      string
+		exists    []string
+		withIndex bool
+		want      string
+	}{
+		{"new", nil, false, ""},
+		{"by size", nil, true, ".1"},
+		{"exists", []string{""}, false, ".1"},
+		{"compressed exists", []string{".gz"}, false, ".1"},
+		{"index exists", []string{"", ".1.gz", ".2"}, true, ".3"},
+	}
+	for _, c := range cases {
+		for _, f := range c.exists {
+			_ = ioutil.WriteFile(base+f, nil, 0644)
+		}
+		w := &TimeFileLogWriter{}
+		if got := w.backupName(base, c.withIndex); got != base+c.want {
+			t.Errorf("%s: got %s, want %s", c.name, filepath.Base(got), filepath.Base(base+c.want))
+		}
+		for _, f := range c.exists {
+			_ = os.Remove(base + f)
+		}
+	}
+}
+
+func TestMillRunOnce(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name   string
+		rotate Rotate
+		want   []string
+	}{
+		{"compress", Rotate{Compress: true},
+			[]string{"app.log", "app.log.2024010100.gz", "app.log.2024010101.gz", "app.log.2024010102.1.gz", "other.log.2024010100"}},
+		{"count", Rotate{Count: 1},
+			[]string{"app.log", "app.log.2024010102.1", "other.log.2024010100"}},
+		{"max age", Rotate{MaxAge: 90 * time.Minute},
+			[]string{"app.log", "app.log.2024010102.1", "other.log.2024010100"}},
+		// 按目录总大小清理时包括其他日志的切割文件，正在写的文件不删除
+		{"max total size", Rotate{MaxTotalSize: 1},
+			[]string{"app.log", "app.log.2024010102.1"}},
+	}
+	for _, c := range cases {
+		dir := setLogPath(t)
+		// 修改时间依次为3、2、1小时前
+		backups := []string{"app.log.2024010100", "app.log.2024010101", "app.log.2024010102.1"}
+		for i, f := range append(backups, "other.log.2024010100") {
+			name := filepath.Join(dir, f)
+			_ = ioutil.WriteFile(name, []byte(strings.Repeat("x", megabyte/2)), 0644)
+			mt := now.Add(-time.Duration(3-i%3) * time.Hour)
+			_ = os.Chtimes(name, mt, mt)
+		}
+		w := newTimeFileLogWriter("app.log", Rotate{Switch: true, Unit: "H"})
+		_, _ = w.Write([]byte("x\n"))
+		w.compress, w.backupCount, w.maxAge = c.rotate.Compress, c.rotate.Count, c.rotate.MaxAge
+		w.maxTotalSize = int64(c.rotate.MaxTotalSize) * megabyte
+		w.millRunOnce()
+
+		var got []string
+		entries, _ := ioutil.ReadDir(dir)
+		for _, e := range entries {
+			got = append(got, e.Name())
+		}
+		sort.Strings(got)
+		if strings.Join(got, " ") != strings.Join(c.want, " ") {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestReopen(t *testing.T) {
+	dir := setLogPath(t)
+	w := newTimeFileLogWriter("r.log", Rotate{})
+	_, _ = w.Write([]byte("a\n"))
+
+	// 外部logrotate移走文件后重新打开
+	_ = os.Rename(filepath.Join(dir, "r.log"), filepath.Join(dir, "r.log.1"))
+	if err := w.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte("b\n"))
+	cases := []struct {
+		file string
+		want string
+	}{
+		{"r.log.1", "a\n"},
+		{"r.log", "b\n"},
+	}
+	for _, c := range cases {
+		if b, _ := ioutil.ReadFile(filepath.Join(dir, c.file)); string(b) != c.want {
+			t.Errorf("%s: got %q, want %q", c.file, b, c.want)
+		}
+	}
+}
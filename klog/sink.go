@@ -0,0 +1,233 @@
+package klog
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// 额外的日志输出类型
+const (
+	SinkSyslog = "syslog"
+	SinkTCP    = "tcp"
+	SinkUDP    = "udp"
+	SinkHTTP   = "http"
+)
+
+// SinkConf 额外的日志输出，在本地文件与stdout之外发送到远端
+// 所有sink异步发送，队列满或发送失败时丢弃并计入 log_dropped_total
+type SinkConf struct {
+	// 用于错误输出与指标的名字，默认 类型-序号
+	Name string `yaml:"name"`
+	// syslog、tcp、udp(按行分隔的json)、http(批量)
+	Type string `yaml:"type"`
+	// 最低级别，默认info，在全局级别之后过滤
+	Level string `yaml:"level"`
+	// 只发送这些topic的日志，为空时发送所有topic
+	Topics []string `yaml:"topics"`
+	// 队列长度(条)，默认8192
+	QueueSize int `yaml:"queueSize"`
+
+	// syslog 的网络类型 udp、tcp、unix
+	Network string `yaml:"network"`
+	// syslog/tcp/udp 的地址，unix时为socket路径
+	Addr string `yaml:"addr"`
+	// syslog facility，默认1(user)
+	Facility int `yaml:"facility"`
+	// syslog APP-NAME，默认应用名
+	AppName string `yaml:"appName"`
+
+	// http 接收地址
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	// 每批最多的条数，默认500
+	BatchSize int `yaml:"batchSize"`
+	// 未满一批时的发送间隔，默认1s
+	FlushInterval time.Duration `yaml:"flushInterval"`
+	Gzip          bool          `yaml:"gzip"`
+	// 失败重试次数，默认3
+	Retry   int           `yaml:"retry"`
+	Timeout time.Duration `yaml:"timeout"`
+	// 重试仍失败的批次落盘的目录，为空时丢弃；恢复后按时间顺序重发
+	SpoolDir string `yaml:"spoolDir"`
+	// 落盘文件的最大总MB数，默认100
+	SpoolMaxSize int `yaml:"spoolMaxSize"`
+}
+
+var (
+	sinksOnce sync.Once
+	sinkCores []zapcore.Core
+)
+
+// 检查sink配置，补全默认值
+func checkSinks(sinks []SinkConf) ([]SinkConf, error) {
+	out := make([]SinkConf, 0, len(sinks))
+	for i, s := range sinks {
+		if s.Name == "" {
+			s.Name = s.Type + "-" + strconv.Itoa(i)
+		}
+		if s.Level != "" {
+			if _, ok := parseLevel(s.Level); !ok {
+				return nil, fmt.Errorf("sink %s: invalid level %s", s.Name, s.Level)
+			}
+		}
+		for _, t := range s.Topics {
+			if !isTopic(t) {
+				return nil, fmt.Errorf("sink %s: unknown topic %s", s.Name, t)
+			}
+		}
+
+		switch s.Type {
+		case SinkSyslog:
+			if s.Network == "" {
+				s.Network = "udp"
+			}
+			if s.Network != "udp" && s.Network != "tcp" && s.Network != "unix" {
+				return nil, fmt.Errorf("sink %s: syslog network only support udp、tcp、unix", s.Name)
+			}
+			if s.Facility == 0 {
+				s.Facility = 1
+			}
+			if s.Facility < 0 || s.Facility > 23 {
+				return nil, fmt.Errorf("sink %s: invalid syslog facility %d", s.Name, s.Facility)
+			}
+			fallthrough
+		case SinkTCP, SinkUDP:
+			if s.Addr == "" {
+				return nil, fmt.Errorf("sink %s: empty addr", s.Name)
+			}
+		case SinkHTTP:
+			if s.URL == "" {
+				return nil, fmt.Errorf("sink %s: empty url", s.Name)
+			}
+			if s.BatchSize <= 0 {
+				s.BatchSize = 500
+			}
+			if s.FlushInterval <= 0 {
+				s.FlushInterval = time.Second
+			}
+			if s.Retry <= 0 {
+				s.Retry = 3
+			}
+			if s.Timeout <= 0 {
+				s.Timeout = 5 * time.Second
+			}
+			if s.SpoolMaxSize <= 0 {
+				s.SpoolMaxSize = 100
+			}
+		default:
+			return nil, errors.New("unknown sink type " + s.Type)
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// 所有logger共用sink，避免重复建立连接
+func getSinkCores() []zapcore.Core {
+	sinksOnce.Do(func() {
+		for _, s := range logConfig.Sinks {
+			sinkCores = append(sinkCores, newSinkCore(s))
+		}
+	})
+	return sinkCores
+}
+
+func newSinkCore(s SinkConf) zapcore.Core {
+	level := zapcore.InfoLevel
+	if s.Level != "" {
+		level, _ = parseLevel(s.Level)
+	}
+
+	var (
+		out    zapcore.WriteSyncer
+		format func(ent zapcore.Entry, topic string, line []byte) []byte
+	)
+	switch s.Type {
+	case SinkSyslog:
+		sw := newSyslogFormatter(s)
+		out = newNetWriter(s.Network, s.Addr, sw.framing)
+		format = sw.format
+	case SinkTCP, SinkUDP:
+		out = newNetWriter(s.Type, s.Addr, nil)
+	case SinkHTTP:
+		out = newHTTPShipper(s)
+	}
+
+	c := &sinkCore{
+		LevelEnabler: level,
+		enc:          zapcore.NewJSONEncoder(encoderConfig()),
+		format:       format,
+		w:            newAsyncWriter(s.Name, out, s.QueueSize, OverflowDropLow),
+	}
+	if len(s.Topics) > 0 {
+		c.topics = make(map[string]bool, len(s.Topics))
+		for _, t := range s.Topics {
+			c.topics[t] = true
+		}
+	}
+	return c
+}
+
+// 发送到sink的core，topic以 _tp 字段保留在json中
+type sinkCore struct {
+	zapcore.LevelEnabler
+	enc    zapcore.Encoder
+	topics map[string]bool
+	format func(ent zapcore.Entry, topic string, line []byte) []byte
+	w      *asyncWriter
+
+	topic string
+}
+
+func (c *sinkCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := *c
+	clone.enc = c.enc.Clone()
+	for _, f := range fields {
+		f.AddTo(clone.enc)
+		if f.Key == TopicType && f.Type == zapcore.StringType {
+			clone.topic = f.String
+		}
+	}
+	return &clone
+}
+
+func (c *sinkCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *sinkCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	topic := c.topic
+	if len(fields) > 0 && fields[0].Key == TopicType {
+		topic = fields[0].String
+	}
+	if !isTopic(topic) {
+		topic = LogNameServer
+	}
+	if c.topics != nil && !c.topics[topic] {
+		return nil
+	}
+
+	buf, err := c.enc.EncodeEntry(ent, fields)
+	if err != nil {
+		return err
+	}
+	line := buf.Bytes()
+	if c.format != nil {
+		line = c.format(ent, topic, line)
+	}
+	c.w.push(ent.Level, line)
+	buf.Free()
+	return nil
+}
+
+func (c *sinkCore) Sync() error {
+	return c.w.Sync()
+}
@@ -0,0 +1,218 @@
+package klog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const spoolSuffix = ".ndjson"
+
+// 按批发送json行到http接口，失败重试，仍失败时落盘待恢复后重发
+type httpShipper struct {
+	conf   SinkConf
+	client *http.Client
+
+	mu    sync.Mutex
+	batch bytes.Buffer
+	count int
+
+	// 保证同一时间只有一个批次在发送，落盘文件按顺序重发
+	sendMu sync.Mutex
+}
+
+func newHTTPShipper(conf SinkConf) *httpShipper {
+	s := &httpShipper{
+		conf:   conf,
+		client: &http.Client{Timeout: conf.Timeout},
+	}
+	if conf.SpoolDir != "" {
+		if err := os.MkdirAll(conf.SpoolDir, 0755); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "log sink(%s) spool dir: %s\n", conf.Name, err)
+		}
+	}
+	go func() {
+		for range time.Tick(conf.FlushInterval) {
+			_ = s.Sync()
+		}
+	}()
+	return s
+}
+
+func (s *httpShipper) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	s.batch.Write(p)
+	if len(p) > 0 && p[len(p)-1] != '\n' {
+		s.batch.WriteByte('\n')
+	}
+	s.count++
+	full := s.count >= s.conf.BatchSize
+	s.mu.Unlock()
+
+	if full {
+		return len(p), s.Sync()
+	}
+	return len(p), nil
+}
+
+// Sync 立即发送当前批次
+func (s *httpShipper) Sync() error {
+	s.mu.Lock()
+	if s.count == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	body := append([]byte(nil), s.batch.Bytes()...)
+	s.batch.Reset()
+	s.count = 0
+	s.mu.Unlock()
+
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	if retry, err := s.send(body); err != nil {
+		// 已落盘的批次会在恢复后重发，不算丢弃
+		if retry && s.spool(body) {
+			return nil
+		}
+		return err
+	}
+	// 接收端恢复后重发落盘的批次
+	s.resendSpool()
+	return nil
+}
+
+// 返回的bool表示失败后是否值得稍后重发
+func (s *httpShipper) send(body []byte) (bool, error) {
+	payload := body
+	if s.conf.Gzip {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		_, _ = gz.Write(body)
+		_ = gz.Close()
+		payload = buf.Bytes()
+	}
+
+	var (
+		retry bool
+		err   error
+	)
+	backoff := 100 * time.Millisecond
+	for i := 0; i <= s.conf.Retry; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if retry, err = s.post(payload); err == nil || !retry {
+			return retry, err
+		}
+	}
+	return retry, err
+}
+
+// 返回是否可以重试
+func (s *httpShipper) post(payload []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, s.conf.URL, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if s.conf.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	for k, v := range s.conf.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("log sink http status %d", resp.StatusCode)
+	default:
+		// 4xx 重试也不会成功，也不落盘
+		return false, fmt.Errorf("log sink http status %d", resp.StatusCode)
+	}
+}
+
+// 落盘未发送成功的批次，超过总大小时删除最旧的，返回是否落盘成功
+func (s *httpShipper) spool(body []byte) bool {
+	if s.conf.SpoolDir == "" {
+		return false
+	}
+	name := filepath.Join(s.conf.SpoolDir, strconv.FormatInt(time.Now().UnixNano(), 10)+spoolSuffix)
+	if err := ioutil.WriteFile(name, body, 0644); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "log sink(%s) spool: %s\n", s.conf.Name, err)
+		return false
+	}
+
+	files := s.spoolFiles()
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	limit := int64(s.conf.SpoolMaxSize) * megabyte
+	for _, f := range files {
+		if total <= limit {
+			break
+		}
+		if os.Remove(f.name) == nil {
+			total -= f.size
+		}
+	}
+	return true
+}
+
+func (s *httpShipper) resendSpool() {
+	if s.conf.SpoolDir == "" {
+		return
+	}
+	for _, f := range s.spoolFiles() {
+		body, err := ioutil.ReadFile(f.name)
+		if err != nil {
+			continue
+		}
+		if retry, err := s.send(body); err != nil {
+			if retry {
+				return
+			}
+			// 接收端拒绝的批次重发也不会成功，删除后继续发送后面的
+			_, _ = fmt.Fprintf(os.Stderr, "log sink(%s) drop spooled %s: %s\n", s.conf.Name, filepath.Base(f.name), err)
+		}
+		_ = os.Remove(f.name)
+	}
+}
+
+// 按文件名(写入时间)从旧到新排序
+func (s *httpShipper) spoolFiles() []backupFile {
+	fileInfos, err := ioutil.ReadDir(s.conf.SpoolDir)
+	if err != nil {
+		return nil
+	}
+	var files []backupFile
+	for _, fi := range fileInfos {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), spoolSuffix) {
+			continue
+		}
+		files = append(files, backupFile{name: filepath.Join(s.conf.SpoolDir, fi.Name()), size: fi.Size()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	return files
+}
@@ -0,0 +1,179 @@
+package klog
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 记录收到的批次，按 status 返回状态码
+type testReceiver struct {
+	*httptest.Server
+	mu      sync.Mutex
+	batches []string
+	calls   int32
+	status  func(body string) int
+}
+
+func newTestReceiver(t *testing.T, status func(body string) int) *testReceiver {
+	r := &testReceiver{status: status}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&r.calls, 1)
+		body := req.Body
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(req.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = gz
+		}
+		b, _ := ioutil.ReadAll(body)
+		if code := r.status(string(b)); code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+		if req.Header.Get("Content-Type") != "application/x-ndjson" || req.Header.Get("X-Token") != "t" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.mu.Lock()
+		r.batches = append(r.batches, strings.TrimSpace(string(b)))
+		r.mu.Unlock()
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *testReceiver) got() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return strings.Join(r.batches, "|")
+}
+
+func newTestShipper(t *testing.T, url string, conf SinkConf) *httpShipper {
+	conf.Type, conf.URL = SinkHTTP, url
+	conf.FlushInterval = time.Hour
+	conf.Headers = map[string]string{"X-Token": "t"}
+	confs, err := checkSinks([]SinkConf{conf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newHTTPShipper(confs[0])
+}
+
+func TestHTTPShipperBatch(t *testing.T) {
+	for _, gz := range []bool{false, true} {
+		r := newTestReceiver(t, func(string) int { return http.StatusOK })
+		s := newTestShipper(t, r.URL, SinkConf{BatchSize: 2, Gzip: gz})
+		for i := 1; i <= 3; i++ {
+			if _, err := s.Write([]byte(`{"a":` + strconv.Itoa(i) + `}`)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// 满一批时发送，剩余的在Sync时发送
+		if got := r.got(); got != `{"a":1}`+"\n"+`{"a":2}` {
+			t.Fatalf("gzip %v: %q", gz, got)
+		}
+		if err := s.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		if got := r.got(); !strings.HasSuffix(got, `|{"a":3}`) {
+			t.Fatalf("gzip %v: %q", gz, got)
+		}
+	}
+}
+
+func TestHTTPShipperRetry(t *testing.T) {
+	cases := []struct {
+		name   string
+		codes  []int
+		calls  int32
+		err    bool
+		spools int
+	}{
+		{"ok", []int{200}, 1, false, 0},
+		{"retry then ok", []int{503, 429, 200}, 3, false, 0},
+		{"retry exhausted, spooled", []int{503, 503, 503, 503}, 3, false, 1},
+		{"rejected, not spooled", []int{400}, 1, true, 0},
+	}
+	for _, c := range cases {
+		var n int32
+		r := newTestReceiver(t, func(string) int {
+			i := atomic.AddInt32(&n, 1) - 1
+			return c.codes[i]
+		})
+		s := newTestShipper(t, r.URL, SinkConf{Retry: 2, SpoolDir: t.TempDir()})
+		_, _ = s.Write([]byte("x"))
+		err := s.Sync()
+		if (err != nil) != c.err || r.calls != c.calls || len(s.spoolFiles()) != c.spools {
+			t.Errorf("%s: err %v calls %d spools %d", c.name, err, r.calls, len(s.spoolFiles()))
+		}
+	}
+}
+
+func TestHTTPShipperSpoolResend(t *testing.T) {
+	var down int32 = 1
+	r := newTestReceiver(t, func(body string) int {
+		if atomic.LoadInt32(&down) == 1 {
+			return http.StatusServiceUnavailable
+		}
+		if strings.Contains(body, "bad") {
+			return http.StatusBadRequest
+		}
+		return http.StatusOK
+	})
+	dir := t.TempDir()
+	s := newTestShipper(t, r.URL, SinkConf{Retry: 1, BatchSize: 1, SpoolDir: dir})
+
+	// 接收端不可用时落盘，已落盘的批次不算写失败
+	for _, line := range []string{"a", "bad", "b"} {
+		if _, err := s.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := len(s.spoolFiles()); n != 3 {
+		t.Fatalf("spooled %d", n)
+	}
+
+	// 恢复后先发当前批次，再按时间顺序重发；被拒绝的批次删除，不阻塞后面的
+	atomic.StoreInt32(&down, 0)
+	if _, err := s.Write([]byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.got(); got != "c|a|b" {
+		t.Fatalf("got %q", got)
+	}
+	if n := len(s.spoolFiles()); n != 0 {
+		t.Fatalf("spool left %d", n)
+	}
+}
+
+func TestHTTPShipperSpoolMaxSize(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestShipper(t, "http://127.0.0.1:1", SinkConf{SpoolDir: dir, SpoolMaxSize: 1})
+	big := strings.Repeat("x", megabyte/2+1)
+	for i := 0; i < 3; i++ {
+		if !s.spool([]byte(big)) {
+			t.Fatal("spool failed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// 超过总大小时删除最旧的
+	files := s.spoolFiles()
+	if len(files) != 1 {
+		t.Fatalf("files %d", len(files))
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSuffix)); len(matches) != 1 || matches[0] != files[0].name {
+		t.Fatal(matches)
+	}
+}
@@ -0,0 +1,180 @@
+package klog
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/peerless6372/Lplot/env"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	sinkDialTimeout  = 3 * time.Second
+	sinkWriteTimeout = 5 * time.Second
+	sinkMinBackoff   = 100 * time.Millisecond
+	sinkMaxBackoff   = 30 * time.Second
+)
+
+var errSinkDown = errors.New("log sink unavailable")
+
+// 发送到tcp/udp/unix的writer，断开后按退避时间重连
+// 只在asyncWriter的goroutine中调用，不需要加锁
+type netWriter struct {
+	network string
+	addr    string
+	// tcp上的分帧，为空时原样发送
+	framing func(msg []byte) []byte
+
+	conn     net.Conn
+	nextDial time.Time
+	backoff  time.Duration
+}
+
+func newNetWriter(network, addr string, framing func([]byte) []byte) *netWriter {
+	return &netWriter{network: network, addr: addr, framing: framing, backoff: sinkMinBackoff}
+}
+
+func (w *netWriter) Write(p []byte) (int, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		if err := w.connect(); err != nil {
+			return 0, err
+		}
+		msg := p
+		if w.framing != nil && w.stream() {
+			msg = w.framing(p)
+		}
+		_ = w.conn.SetWriteDeadline(time.Now().Add(sinkWriteTimeout))
+		if _, err := w.conn.Write(msg); err == nil {
+			return len(p), nil
+		}
+		// 连接可能已被对端关闭，重连后再试一次
+		_ = w.conn.Close()
+		w.conn = nil
+	}
+	return 0, errSinkDown
+}
+
+func (w *netWriter) Sync() error {
+	return nil
+}
+
+func (w *netWriter) stream() bool {
+	return w.network == "tcp" || w.network == "unix"
+}
+
+func (w *netWriter) connect() error {
+	if w.conn != nil {
+		return nil
+	}
+	if time.Now().Before(w.nextDial) {
+		return errSinkDown
+	}
+
+	network := w.network
+	if network == "unix" {
+		// syslog的unix socket一般为数据报类型
+		if conn, err := net.DialTimeout("unixgram", w.addr, sinkDialTimeout); err == nil {
+			w.network = "unixgram"
+			w.onConnected(conn)
+			return nil
+		}
+	}
+	conn, err := net.DialTimeout(network, w.addr, sinkDialTimeout)
+	if err != nil {
+		w.nextDial = time.Now().Add(w.backoff)
+		if w.backoff *= 2; w.backoff > sinkMaxBackoff {
+			w.backoff = sinkMaxBackoff
+		}
+		return err
+	}
+	w.onConnected(conn)
+	return nil
+}
+
+func (w *netWriter) onConnected(conn net.Conn) {
+	w.conn = conn
+	w.backoff = sinkMinBackoff
+}
+
+// RFC5424 格式的syslog消息，MSG部分为json日志
+type syslogFormatter struct {
+	facility int
+	hostname string
+	appName  string
+	procID   string
+}
+
+func newSyslogFormatter(s SinkConf) *syslogFormatter {
+	hostname, _ := os.Hostname()
+	appName := s.AppName
+	if appName == "" {
+		appName = env.GetAppName()
+	}
+	return &syslogFormatter{
+		facility: s.Facility,
+		hostname: syslogField(hostname, 255),
+		appName:  syslogField(appName, 48),
+		procID:   strconv.Itoa(os.Getpid()),
+	}
+}
+
+// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID - MSG
+func (f *syslogFormatter) format(ent zapcore.Entry, topic string, line []byte) []byte {
+	var b bytes.Buffer
+	b.WriteByte('<')
+	b.WriteString(strconv.Itoa(f.facility*8 + syslogSeverity(ent.Level)))
+	b.WriteString(">1 ")
+	b.WriteString(ent.Time.Format("2006-01-02T15:04:05.000000Z07:00"))
+	b.WriteByte(' ')
+	b.WriteString(f.hostname)
+	b.WriteByte(' ')
+	b.WriteString(f.appName)
+	b.WriteByte(' ')
+	b.WriteString(f.procID)
+	b.WriteByte(' ')
+	b.WriteString(syslogField(topic, 32))
+	b.WriteString(" - ")
+	b.Write(bytes.TrimRight(line, "\n"))
+	return b.Bytes()
+}
+
+// tcp上使用 RFC6587 的octet counting分帧
+func (f *syslogFormatter) framing(msg []byte) []byte {
+	out := make([]byte, 0, len(msg)+8)
+	out = strconv.AppendInt(out, int64(len(msg)), 10)
+	out = append(out, ' ')
+	return append(out, msg...)
+}
+
+func syslogSeverity(l zapcore.Level) int {
+	switch l {
+	case zapcore.DebugLevel:
+		return 7
+	case zapcore.InfoLevel:
+		return 6
+	case zapcore.WarnLevel:
+		return 4
+	case zapcore.ErrorLevel:
+		return 3
+	default:
+		return 2
+	}
+}
+
+// header字段只允许可打印的ASCII，为空时为 "-"
+func syslogField(s string, max int) string {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s) && len(b) < max; i++ {
+		if s[i] > 32 && s[i] < 127 {
+			b = append(b, s[i])
+		}
+	}
+	if len(b) == 0 {
+		return "-"
+	}
+	return string(b)
+}
@@ -0,0 +1,292 @@
+package klog
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func sinkEntry(lvl zapcore.Level, msg string) zapcore.Entry {
+	return zapcore.Entry{Level: lvl, Time: time.Now(), Message: msg}
+}
+
+func topicField(topic string) zapcore.Field {
+	return zapcore.Field{Key: TopicType, Type: zapcore.StringType, String: topic}
+}
+
+func TestCheckSinks(t *testing.T) {
+	bad := []SinkConf{
+		{Type: "kafka"},
+		{Type: SinkTCP},
+		{Type: SinkHTTP},
+		{Type: SinkUDP, Addr: "x", Level: "bad"},
+		{Type: SinkUDP, Addr: "x", Topics: []string{"nope"}},
+		{Type: SinkSyslog, Addr: "x", Network: "sctp"},
+		{Type: SinkSyslog, Addr: "x", Facility: 24},
+	}
+	for _, s := range bad {
+		if _, err := checkSinks([]SinkConf{s}); err == nil {
+			t.Errorf("expect error for %+v", s)
+		}
+	}
+
+	out, err := checkSinks([]SinkConf{{Type: SinkSyslog, Addr: "x"}, {Type: SinkHTTP, URL: "http://x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := out[0]; s.Name != "syslog-0" || s.Network != "udp" || s.Facility != 1 {
+		t.Errorf("syslog defaults %+v", s)
+	}
+	if s := out[1]; s.BatchSize != 500 || s.FlushInterval != time.Second || s.Retry != 3 || s.SpoolMaxSize != 100 {
+		t.Errorf("http defaults %+v", s)
+	}
+}
+
+// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID - MSG
+var rfc5424 = regexp.MustCompile(`^<(\d+)>1 (\S+) (\S+) (\S+) (\d+) (\S+) - (\{.*\})$`)
+
+func checkRFC5424(t *testing.T, msg string, pri int, topic, text string) {
+	t.Helper()
+	m := rfc5424.FindStringSubmatch(msg)
+	if m == nil {
+		t.Fatalf("not rfc5424: %q", msg)
+	}
+	if m[1] != strconv.Itoa(pri) || m[4] != "app" || m[5] != strconv.Itoa(os.Getpid()) || m[6] != topic {
+		t.Fatalf("header %q", msg)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, m[2]); err != nil {
+		t.Fatalf("timestamp %q: %v", m[2], err)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal([]byte(m[7]), &body); err != nil || body["msg"] != text {
+		t.Fatalf("msg %q: %v", m[7], err)
+	}
+}
+
+// 读取 RFC6587 octet counting 分帧的消息
+func readFrame(r *bufio.Reader) (string, error) {
+	n, err := r.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	size, err := strconv.Atoi(strings.TrimSpace(n))
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, size)
+	_, err = io.ReadFull(r, b)
+	return string(b), err
+}
+
+func TestSinkSyslog(t *testing.T) {
+	dir := t.TempDir()
+	cases := []struct {
+		network string
+		listen  func(t *testing.T) (addr string, read func() string)
+	}{
+		{"udp", func(t *testing.T) (string, func() string) {
+			pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { pc.Close() })
+			return pc.LocalAddr().String(), func() string { return readPacket(t, pc) }
+		}},
+		{"tcp", func(t *testing.T) (string, func() string) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { ln.Close() })
+			return ln.Addr().String(), acceptFrames(t, ln)
+		}},
+		{"unix", func(t *testing.T) (string, func() string) {
+			// 数据报类型的syslog socket，如 /dev/log
+			addr := filepath.Join(dir, "dgram.sock")
+			pc, err := net.ListenPacket("unixgram", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { pc.Close() })
+			return addr, func() string { return readPacket(t, pc) }
+		}},
+		{"unix", func(t *testing.T) (string, func() string) {
+			addr := filepath.Join(dir, "stream.sock")
+			ln, err := net.Listen("unix", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { ln.Close() })
+			return addr, acceptFrames(t, ln)
+		}},
+	}
+	for _, c := range cases {
+		addr, read := c.listen(t)
+		confs, err := checkSinks([]SinkConf{{Type: SinkSyslog, Network: c.network, Addr: addr, AppName: "app", Facility: 16}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		core := newSinkCore(confs[0])
+		core.Check(sinkEntry(zapcore.ErrorLevel, "boom"), nil).Write(topicField(LogNameAccess))
+		core.Check(sinkEntry(zapcore.InfoLevel, "info"), nil).Write()
+		_ = core.Sync()
+
+		// local0(16)*8 + err(3)、info(6)，未知topic为server
+		checkRFC5424(t, read(), 131, LogNameAccess, "boom")
+		checkRFC5424(t, read(), 134, LogNameServer, "info")
+	}
+}
+
+func readPacket(t *testing.T, pc net.PacketConn) string {
+	t.Helper()
+	buf := make([]byte, 65536)
+	_ = pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func acceptFrames(t *testing.T, ln net.Listener) func() string {
+	frames := make(chan string, 16)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			f, err := readFrame(r)
+			if err != nil {
+				return
+			}
+			frames <- f
+		}
+	}()
+	return func() string {
+		t.Helper()
+		select {
+		case f := <-frames:
+			return f
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout")
+			return ""
+		}
+	}
+}
+
+func TestSinkLevelAndTopics(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	confs, err := checkSinks([]SinkConf{{Type: SinkUDP, Addr: pc.LocalAddr().String(), Level: "warn", Topics: []string{LogNameAccess}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newSinkCore(confs[0])
+	access := c.With([]zapcore.Field{topicField(LogNameAccess), {Key: "k", Type: zapcore.StringType, String: "v"}})
+	server := c.With([]zapcore.Field{topicField(LogNameServer)})
+
+	cases := []struct {
+		core zapcore.Core
+		lvl  zapcore.Level
+		msg  string
+	}{
+		{access, zapcore.InfoLevel, "low level"},
+		{server, zapcore.ErrorLevel, "other topic"},
+		{access, zapcore.ErrorLevel, "sent"},
+	}
+	for _, cs := range cases {
+		if ce := cs.core.Check(sinkEntry(cs.lvl, cs.msg), nil); ce != nil {
+			ce.Write()
+		}
+	}
+	_ = c.Sync()
+
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(readPacket(t, pc)), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["msg"] != "sent" || m["k"] != "v" || m[TopicType] != LogNameAccess {
+		t.Fatal(m)
+	}
+	_ = pc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := pc.ReadFrom(make([]byte, 1024)); err == nil {
+		t.Fatal("filtered entry sent")
+	}
+}
+
+func TestNetWriterReconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	w := newNetWriter("tcp", addr, nil)
+	if _, err := w.Write([]byte("down\n")); err == nil {
+		t.Fatal("expect error when receiver is down")
+	}
+	// 退避时间内不重新建连
+	if _, err := w.Write([]byte("down\n")); err != errSinkDown {
+		t.Fatalf("expect errSinkDown, got %v", err)
+	}
+
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip("address reused:", err)
+	}
+	defer ln.Close()
+	conns := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+		}
+	}()
+
+	time.Sleep(sinkMinBackoff + 20*time.Millisecond)
+	if _, err := w.Write([]byte("a\n")); err != nil {
+		t.Fatal(err)
+	}
+	first := <-conns
+	if line, _ := bufio.NewReader(first).ReadString('\n'); line != "a\n" {
+		t.Fatalf("got %q", line)
+	}
+
+	// 对端关闭连接后重连到新连接
+	_ = first.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		_, _ = w.Write([]byte("b\n"))
+		select {
+		case conn := <-conns:
+			defer conn.Close()
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+			if line, _ := bufio.NewReader(conn).ReadString('\n'); line != "b\n" {
+				t.Fatalf("got %q", line)
+			}
+			return
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	t.Fatal("not reconnected")
+}
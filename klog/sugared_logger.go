@@ -1,7 +1,6 @@
 package klog
 
 import (
-	"github.com/peerless6372/Lplot/env"
 	"github.com/peerless6372/gin"
 	"go.uber.org/zap"
 )
@@ -17,16 +16,7 @@ func GetLogger() (s *zap.SugaredLogger) {
 
 // 通用字段封装
 func sugaredLogger(ctx *gin.Context) *zap.SugaredLogger {
-	if ctx == nil {
-		return SugaredLogger
-	}
-
-	return SugaredLogger.With(
-		zap.String("requestId", GetRequestID(ctx)),
-		zap.String("module", env.GetAppName()),
-		zap.String("localIp", env.LocalIP),
-		zap.String("uri", ctx.GetString(ContextKeyUri)),
-	)
+	return ctxSugaredLogger(ginContext(ctx))
 }
 
 // 提供给业务使用的server log 日志打印方法
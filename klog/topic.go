@@ -0,0 +1,163 @@
+package klog
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// 按topic(_tp字段)拆分日志文件时单个topic的配置
+type TopicConf struct {
+	// 文件名，不含 .log 后缀，默认为topic名
+	File string `yaml:"file"`
+	// topic的日志级别，等同于 LogConfig.Levels 中以topic为key的配置
+	Level string `yaml:"level"`
+	// 为空时使用全局的切割与保留配置
+	Rotate *Rotate `yaml:"rotate"`
+}
+
+// 内置的topic，开启拆分时默认各自输出
+var builtinTopics = []string{LogNameServer, LogNameAccess, LogNameModule, LogNameMirror}
+
+// 用户自定义的topic，只在 InitLog 中修改
+var customTopics = map[string]bool{}
+
+func isTopic(name string) bool {
+	switch name {
+	case LogNameAccess, LogNameModule, LogNameMirror, LogNameServer:
+		return true
+	}
+	return customTopics[name]
+}
+
+// 检查并补全topic配置，返回生效的topic配置
+func checkTopics(conf LogConfig) (map[string]TopicConf, error) {
+	topics := make(map[string]TopicConf, len(builtinTopics)+len(conf.Topics))
+	for _, t := range builtinTopics {
+		topics[t] = TopicConf{}
+	}
+	for t, tc := range conf.Topics {
+		if t == "" || strings.ContainsAny(t, `/\. `) {
+			return nil, errors.New("invalid log topic " + t)
+		}
+		if tc.Rotate != nil {
+			r := *tc.Rotate
+			if r.Switch {
+				r.Unit = strings.ToUpper(r.Unit)
+				if !rotateUnitValid(r.Unit) {
+					return nil, errors.New("rotate unit of topic " + t + " only support D、H、M")
+				}
+			}
+			tc.Rotate = &r
+		}
+		topics[t] = tc
+	}
+	for t, tc := range topics {
+		if tc.File == "" {
+			tc.File = t
+			topics[t] = tc
+		}
+	}
+	return topics, nil
+}
+
+// 按topic分发到各自文件的core，未知topic写入server
+type topicCore struct {
+	routes map[string]zapcore.Core
+	def    zapcore.Core
+	enab   zapcore.LevelEnabler
+
+	topic string
+	with  []zapcore.Field
+	// 加上with字段后的各topic core，每个clone各自缓存
+	withCores *sync.Map
+}
+
+func newTopicCore(infoLevel, errorLevel, allLevel zapcore.LevelEnabler) zapcore.Core {
+	c := &topicCore{routes: make(map[string]zapcore.Core, len(logConfig.Topics)), enab: allLevel}
+	for t, tc := range logConfig.Topics {
+		rotate := logConfig.rotate()
+		if tc.Rotate != nil {
+			rotate = *tc.Rotate
+		}
+		if t == LogNameAccess {
+			// access.log 不生成wf
+			c.routes[t] = newOutputCore(tc.File, txtLogNormal, allLevel, rotate)
+			continue
+		}
+		c.routes[t] = zapcore.NewTee(
+			newOutputCore(tc.File, txtLogNormal, infoLevel, rotate),
+			newOutputCore(tc.File, txtLogWarnFatal, errorLevel, rotate))
+	}
+	c.def = c.routes[LogNameServer]
+	return c
+}
+
+func (c *topicCore) Enabled(lvl zapcore.Level) bool {
+	return c.enab.Enabled(lvl)
+}
+
+// With 的字段在写入时才加到对应topic的core上，避免每次With克隆所有topic
+func (c *topicCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := *c
+	clone.with = append(append([]zapcore.Field(nil), c.with...), fields...)
+	clone.withCores = &sync.Map{}
+	for _, f := range fields {
+		if f.Key == TopicType && f.Type == zapcore.StringType {
+			clone.topic = f.String
+		}
+	}
+	return &clone
+}
+
+func (c *topicCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *topicCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	topic := c.topic
+	if len(fields) > 0 && fields[0].Key == TopicType {
+		topic = fields[0].String
+	}
+	core := c.route(topic)
+
+	// 由topic的core按级别分发到 .log / .log.wf
+	if ce := core.Check(ent, nil); ce != nil {
+		ce.ErrorOutput = zapcore.Lock(os.Stderr)
+		ce.Write(fields...)
+	}
+	return nil
+}
+
+// topic对应的core，带with字段时按topic缓存
+func (c *topicCore) route(topic string) zapcore.Core {
+	core, ok := c.routes[topic]
+	if !ok {
+		topic = LogNameServer
+		core = c.def
+	}
+	if len(c.with) == 0 {
+		return core
+	}
+	if wc, ok := c.withCores.Load(topic); ok {
+		return wc.(zapcore.Core)
+	}
+	wc, _ := c.withCores.LoadOrStore(topic, core.With(c.with))
+	return wc.(zapcore.Core)
+}
+
+func (c *topicCore) Sync() error {
+	var err error
+	for _, core := range c.routes {
+		if e := core.Sync(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,197 @@
+package klog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestCheckTopics(t *testing.T) {
+	bad := []map[string]TopicConf{
+		{"": {}},
+		{"a/b": {}},
+		{"a.b": {}},
+		{"audit": {Rotate: &Rotate{Switch: true, Unit: "W"}}},
+	}
+	for _, topics := range bad {
+		if _, err := checkTopics(LogConfig{Topics: topics}); err == nil {
+			t.Errorf("expect error for %v", topics)
+		}
+	}
+
+	rotate := &Rotate{Switch: true, Unit: "d"}
+	topics, err := checkTopics(LogConfig{Topics: map[string]TopicConf{
+		LogNameModule: {File: "mod", Rotate: rotate},
+		"audit":       {Level: "warn"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		topic string
+		file  string
+		unit  string
+	}{
+		{LogNameServer, LogNameServer, ""},
+		{LogNameAccess, LogNameAccess, ""},
+		{LogNameMirror, LogNameMirror, ""},
+		{LogNameModule, "mod", "D"},
+		{"audit", "audit", ""},
+	}
+	for _, c := range cases {
+		tc, ok := topics[c.topic]
+		unit := ""
+		if ok && tc.Rotate != nil {
+			unit = tc.Rotate.Unit
+		}
+		if !ok || tc.File != c.file || unit != c.unit {
+			t.Errorf("%s: got %+v", c.topic, tc)
+		}
+	}
+	// 不修改调用方的配置
+	if rotate.Unit != "d" || len(topics) != 5 {
+		t.Errorf("rotate %+v topics %d", rotate, len(topics))
+	}
+}
+
+func TestTopicFiles(t *testing.T) {
+	dir := setLogPath(t)
+	logConfig.Stdout, logConfig.Log2File, logConfig.AsyncSwitch = false, true, false
+	conf := LogConfig{SplitTopic: true, Topics: map[string]TopicConf{
+		"audit":       {Level: "warn"},
+		LogNameModule: {File: "mod"},
+	}}
+	topics, err := checkTopics(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	customTopics["audit"] = true
+	logConfig.SplitTopic, logConfig.Topics = true, topics
+	if err := ReloadLevel(conf); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		customTopics = map[string]bool{}
+		_ = ReloadLevel(LogConfig{})
+	})
+
+	l := newLogger()
+	l.Info("acc", String(TopicType, LogNameAccess))
+	l.Warn("acc-warn", String(TopicType, LogNameAccess))
+	l.Info("mod", String(TopicType, LogNameModule))
+	l.Error("mod-err", String(TopicType, LogNameModule))
+	l.Info("srv")
+	l.Info("unknown", String(TopicType, "zzz"))
+	l.Info("audit-info", String(TopicType, "audit"))
+	l.Warn("audit-warn", String(TopicType, "audit"))
+	l.With(String(TopicType, LogNameMirror)).Info("mirror-with")
+	_ = l.Sync()
+
+	cases := []struct {
+		file string
+		want []string
+		not  []string
+	}{
+		// access.log 不拆分wf
+		{"access.log", []string{"acc", "acc-warn"}, nil},
+		{"mod.log", []string{"mod"}, []string{"mod-err"}},
+		{"mod.log.wf", []string{"mod-err"}, nil},
+		// 未知topic写入server
+		{"server.log", []string{"srv", "unknown"}, []string{"mod", "acc"}},
+		// topic级别为warn
+		{"audit.log", nil, []string{"audit-info"}},
+		{"audit.log.wf", []string{"audit-warn"}, nil},
+		{"mirror.log", []string{"mirror-with"}, nil},
+	}
+	for _, c := range cases {
+		b, _ := ioutil.ReadFile(filepath.Join(dir, c.file))
+		for _, w := range c.want {
+			if !strings.Contains(string(b), `"`+w+`"`) {
+				t.Errorf("%s: missing %s in %s", c.file, w, b)
+			}
+		}
+		for _, w := range c.not {
+			if strings.Contains(string(b), `"`+w+`"`) {
+				t.Errorf("%s: unexpected %s in %s", c.file, w, b)
+			}
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "access.log.wf")); err == nil {
+		t.Error("access.log.wf created")
+	}
+}
+
+// 记录With调用次数的core
+type withCountCore struct {
+	zapcore.Core
+	n *int32
+}
+
+func (c withCountCore) With(fields []zapcore.Field) zapcore.Core {
+	atomic.AddInt32(c.n, 1)
+	return withCountCore{Core: c.Core.With(fields), n: c.n}
+}
+
+func TestTopicWithCache(t *testing.T) {
+	var serverWith, accessWith int32
+	server, serverLogs := observer.New(zapcore.DebugLevel)
+	access, accessLogs := observer.New(zapcore.DebugLevel)
+	c := &topicCore{
+		routes: map[string]zapcore.Core{
+			LogNameServer: withCountCore{Core: server, n: &serverWith},
+			LogNameAccess: withCountCore{Core: access, n: &accessWith},
+		},
+		enab: zapcore.DebugLevel,
+	}
+	c.def = c.routes[LogNameServer]
+
+	w := c.With([]zapcore.Field{String("a", "1")})
+	w2 := w.With([]zapcore.Field{String("b", "2")})
+	acc := c.With([]zapcore.Field{String(TopicType, LogNameAccess)})
+
+	cases := []struct {
+		name        string
+		core        zapcore.Core
+		fields      []zapcore.Field
+		serverWith  int32
+		accessWith  int32
+		serverLines int
+		accessLines int
+	}{
+		{"no with", c, nil, 0, 0, 1, 0},
+		{"first write", w, nil, 1, 0, 2, 0},
+		{"cached", w, nil, 1, 0, 3, 0},
+		// 未知topic与server共用缓存
+		{"unknown topic", w, []zapcore.Field{String(TopicType, "zzz")}, 1, 0, 4, 0},
+		{"other topic", w, []zapcore.Field{String(TopicType, LogNameAccess)}, 1, 1, 4, 1},
+		{"other topic cached", w, []zapcore.Field{String(TopicType, LogNameAccess)}, 1, 1, 4, 2},
+		// 再次With的clone有自己的缓存
+		{"nested with", w2, nil, 2, 1, 5, 2},
+		{"topic from with", acc, nil, 2, 2, 5, 3},
+		{"topic from with cached", acc, nil, 2, 2, 5, 4},
+	}
+	for _, cs := range cases {
+		if err := cs.core.Write(zapcore.Entry{Message: cs.name}, cs.fields); err != nil {
+			t.Fatal(err)
+		}
+		if serverWith != cs.serverWith || accessWith != cs.accessWith ||
+			serverLogs.Len() != cs.serverLines || accessLogs.Len() != cs.accessLines {
+			t.Errorf("%s: with %d/%d lines %d/%d", cs.name, serverWith, accessWith, serverLogs.Len(), accessLogs.Len())
+		}
+	}
+
+	// with字段只出现在对应clone写入的日志中
+	all := serverLogs.All()
+	if m := all[0].ContextMap(); len(m) != 0 {
+		t.Errorf("no with: %v", m)
+	}
+	if m := all[4].ContextMap(); m["a"] != "1" || m["b"] != "2" {
+		t.Errorf("nested with: %v", m)
+	}
+}
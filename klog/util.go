@@ -3,8 +3,6 @@ package klog
 import (
 	"github.com/peerless6372/Lplot/utils/metadata"
 	"github.com/peerless6372/gin"
-	"strconv"
-	"time"
 )
 
 // util key
@@ -22,6 +20,8 @@ const (
 	LogIDHeaderKeyLower = "x_bd_logid"
 )
 
+// GetRequestID 获取请求id，同时保存在 ContextKeyRequestID 与 ContextKeyLogID 下
+// 优先使用上游header中的id(顺序见 RequestIDConf.Headers)，没有时新生成
 func GetRequestID(ctx *gin.Context) string {
 	if ctx == nil {
 		return genRequestId()
@@ -31,11 +31,16 @@ func GetRequestID(ctx *gin.Context) string {
 	if r := ctx.GetString(ContextKeyRequestID); r != "" {
 		return r
 	}
-
-	// 优先从header中获取
-	var requestId string
-	if ctx.Request != nil && ctx.Request.Header != nil {
-		requestId = ctx.Request.Header.Get(TraceHeaderKey)
+	requestId := ctx.GetString(ContextKeyLogID)
+
+	// 从header中获取
+	if requestId == "" && ctx.Request != nil && ctx.Request.Header != nil {
+		for _, h := range requestIDConf.Headers {
+			if v := ctx.Request.Header.Get(h); validRequestID(v) {
+				requestId = v
+				break
+			}
+		}
 	}
 
 	// 新生成
@@ -44,13 +49,7 @@ func GetRequestID(ctx *gin.Context) string {
 	}
 
 	ctx.Set(ContextKeyRequestID, requestId)
-	return requestId
-}
-
-func genRequestId() (requestId string) {
-	// 随机生成 todo: 随机生成的格式是否要统一成trace的格式
-	usec := uint64(time.Now().UnixNano())
-	requestId = strconv.FormatUint(usec&0x7FFFFFFF|0x80000000, 10)
+	ctx.Set(ContextKeyLogID, requestId)
 	return requestId
 }
 
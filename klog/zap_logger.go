@@ -1,7 +1,6 @@
 package klog
 
 import (
-	"github.com/peerless6372/Lplot/env"
 	"github.com/peerless6372/gin"
 	"go.uber.org/zap"
 )
@@ -13,18 +12,9 @@ func GetZapLogger() (l *zap.Logger) {
 	return ZapLogger
 }
 
+// gin版本的适配，通用字段见 ctxZapLogger
 func zapLogger(ctx *gin.Context) *zap.Logger {
-	m := GetZapLogger()
-	//m = m.WithOptions(zap.AddCallerSkip(1))
-	if ctx == nil {
-		return m
-	}
-	return m.With(
-		zap.String("requestId", GetRequestID(ctx)),
-		zap.String("module", env.GetAppName()),
-		zap.String("localIp", env.LocalIP),
-		zap.String("uri", ctx.GetString(ContextKeyUri)),
-	)
+	return ctxZapLogger(ginContext(ctx))
 }
 
 func DebugLogger(ctx *gin.Context, msg string, fields ...zap.Field) {
@@ -0,0 +1,150 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// DefBuckets 默认的耗时分桶，单位秒
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// 原子操作的float64
+type atomicFloat struct {
+	bits uint64
+}
+
+func (f *atomicFloat) add(v float64) {
+	for {
+		old := atomic.LoadUint64(&f.bits)
+		n := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&f.bits, old, n) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) set(v float64) {
+	atomic.StoreUint64(&f.bits, math.Float64bits(v))
+}
+
+func (f *atomicFloat) load() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&f.bits))
+}
+
+// Counter 只增不减的计数
+type Counter struct {
+	v atomicFloat
+}
+
+func (c *Counter) Inc() {
+	c.v.add(1)
+}
+
+// Add v 小于0时忽略
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		return
+	}
+	c.v.add(v)
+}
+
+type CounterVec struct {
+	f *family
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{f: r.register(name, help, typeCounter, labels, nil)}
+}
+
+// With 按label取值(与注册时的label顺序一致)获取counter
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.f.with(values, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+// Gauge 可增可减的当前值
+type Gauge struct {
+	v atomicFloat
+}
+
+func (g *Gauge) Set(v float64) {
+	g.v.set(v)
+}
+
+func (g *Gauge) Add(v float64) {
+	g.v.add(v)
+}
+
+func (g *Gauge) Inc() {
+	g.v.add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.v.add(-1)
+}
+
+type GaugeVec struct {
+	f *family
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{f: r.register(name, help, typeGauge, labels, nil)}
+}
+
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return v.f.with(values, func() interface{} { return &Gauge{} }).(*Gauge)
+}
+
+// Histogram 分桶统计，桶的上界为闭区间
+type Histogram struct {
+	upper  []float64
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upper, v)
+	h.mu.Lock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+	h.mu.Unlock()
+}
+
+// 返回累计的分桶计数
+func (h *Histogram) snapshot() (cumulative []uint64, count uint64, sum float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	cumulative = make([]uint64, len(h.counts))
+	var n uint64
+	for i, c := range h.counts {
+		n += c
+		cumulative[i] = n
+	}
+	return cumulative, h.count, h.sum
+}
+
+type HistogramVec struct {
+	f *family
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefBuckets
+	}
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	return &HistogramVec{f: r.register(name, help, typeHistogram, labels, b)}
+}
+
+func (v *HistogramVec) With(values ...string) *Histogram {
+	upper := v.f.buckets
+	return v.f.with(values, func() interface{} {
+		return &Histogram{upper: upper, counts: make([]uint64, len(upper))}
+	}).(*Histogram)
+}
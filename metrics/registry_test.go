@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("req_total", "Requests.\nline", "path", "code")
+	g := r.NewGaugeVec("temp", "T.")
+	// 桶边界乱序时排序
+	h := r.NewHistogramVec("lat_seconds", "L.", []float64{1, 0.1}, "path")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.With(`a"b`, "200").Inc()
+		}()
+	}
+	wg.Wait()
+	c.With("/x", "500").Add(2)
+	g.With().Set(-2.5)
+	h.With("/x").Observe(0.1)
+	h.With("/x").Observe(0.5)
+	h.With("/x").Observe(3)
+	// 采集前执行回调
+	r.OnCollect(func() { g.With().Add(1) })
+
+	var b bytes.Buffer
+	if err := r.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP lat_seconds L.
+# TYPE lat_seconds histogram
+lat_seconds_bucket{path="/x",le="0.1"} 1
+lat_seconds_bucket{path="/x",le="1"} 2
+lat_seconds_bucket{path="/x",le="+Inf"} 3
+lat_seconds_sum{path="/x"} 3.6
+lat_seconds_count{path="/x"} 3
+# HELP req_total Requests.\nline
+# TYPE req_total counter
+req_total{path="/x",code="500"} 2
+req_total{path="a\"b",code="200"} 100
+# HELP temp T.
+# TYPE temp gauge
+temp -1.5
+`
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(w.Body)
+	if !strings.Contains(string(body), "temp -0.5\n") || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("handler: %s %v", body, w.Header())
+	}
+}
+
+func TestRegister(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("req_total", "", "path")
+	// 同名同类型同label返回同一个指标
+	if r.NewCounterVec("req_total", "", "path").With("/a") != c.With("/a") {
+		t.Error("counter not shared")
+	}
+
+	cases := []struct {
+		name string
+		fn   func()
+	}{
+		{"other type", func() { r.NewGaugeVec("req_total", "", "path") }},
+		{"other labels", func() { r.NewCounterVec("req_total", "", "code") }},
+		{"invalid name", func() { r.NewCounterVec("a-b", "") }},
+		{"invalid label", func() { r.NewCounterVec("x_total", "", "le") }},
+		{"reserved label", func() { r.NewCounterVec("y_total", "", "__a") }},
+		{"label count", func() { c.With("/a", "200") }},
+	}
+	for _, cs := range cases {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: expect panic", cs.name)
+				}
+			}()
+			cs.fn()
+		}()
+	}
+}
+
+func TestFormatFloat(t *testing.T) {
+	cases := []struct {
+		v    float64
+		want string
+	}{
+		{1, "1"},
+		{0.25, "0.25"},
+		{1e21, "1e+21"},
+		{math.Inf(1), "+Inf"},
+		{math.Inf(-1), "-Inf"},
+		{math.NaN(), "NaN"},
+	}
+	for _, c := range cases {
+		if got := formatFloat(c.v); got != c.want {
+			t.Errorf("%v: got %s, want %s", c.v, got, c.want)
+		}
+	}
+}
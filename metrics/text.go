@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/peerless6372/gin"
+)
+
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// WriteText 以 Prometheus text 格式输出所有指标
+func (r *Registry) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range r.collect() {
+		all := f.snapshot()
+		if len(all) == 0 {
+			continue
+		}
+		bw.WriteString("# HELP " + f.name + " " + escapeHelp(f.help) + "\n")
+		bw.WriteString("# TYPE " + f.name + " " + f.typ + "\n")
+
+		for _, s := range all {
+			switch m := s.metric.(type) {
+			case *Counter:
+				writeSample(bw, f.name, f.labels, s.values, "", "", m.v.load())
+			case *Gauge:
+				writeSample(bw, f.name, f.labels, s.values, "", "", m.v.load())
+			case *Histogram:
+				cumulative, count, sum := m.snapshot()
+				for i, upper := range m.upper {
+					writeSample(bw, f.name+"_bucket", f.labels, s.values, "le", formatFloat(upper), float64(cumulative[i]))
+				}
+				writeSample(bw, f.name+"_bucket", f.labels, s.values, "le", "+Inf", float64(count))
+				writeSample(bw, f.name+"_sum", f.labels, s.values, "", "", sum)
+				writeSample(bw, f.name+"_count", f.labels, s.values, "", "", float64(count))
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// Handler 默认注册表的http handler，挂在管理端口的 /metrics
+func Handler() http.Handler {
+	return DefaultRegistry.Handler()
+}
+
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		_ = r.WriteText(w)
+	})
+}
+
+// GinHandler 需要在业务端口暴露指标时使用
+func GinHandler() gin.HandlerFunc {
+	h := Handler()
+	return func(ctx *gin.Context) {
+		h.ServeHTTP(ctx.Writer, ctx.Request)
+	}
+}
+
+func writeSample(w *bufio.Writer, name string, labels, values []string, extraName, extraValue string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(l + `="` + escapeLabel(values[i]) + `"`)
+		}
+		if extraName != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extraName + `="` + extraValue + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpReplacer  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelReplacer.Replace(s)
+}
@@ -77,16 +77,26 @@ func AccessLog() gin.HandlerFunc {
 		c.Writer = blw
 
 		c.Set(klog.ContextKeyUri, path)
-		_ = klog.GetRequestID(c)
+		requestId := klog.GetRequestID(c)
+		if h := klog.RequestIDResponseHeader(); h != "" {
+			c.Header(h, requestId)
+		}
+		// 带有效签名的请求输出全部级别的日志
+		if klog.VerifyDebugToken(c.GetHeader(klog.DebugHeaderKey)) {
+			klog.SetDebugFlag(c)
+		}
 		// 处理请求
+		serverInFlight.With().Inc()
 		c.Next()
+		serverInFlight.With().Dec()
+		observeRequest(c, start)
 
+		// 先脱敏再截断，避免截断后的json无法按字段脱敏
 		response := ""
 		if blw.body != nil {
-			if len(blw.body.String()) <= printResponseLen {
-				response = blw.body.String()
-			} else {
-				response = blw.body.String()[:printResponseLen]
+			response = klog.RedactBody(blw.body.String())
+			if len(response) > printResponseLen {
+				response = response[:printResponseLen]
 			}
 		}
 
@@ -111,11 +121,11 @@ func AccessLog() gin.HandlerFunc {
 			}
 		}
 		if !flag {
-			bodyStr = string(requestBody)
+			bodyStr = klog.RedactBody(string(requestBody))
 		}
 
 		if c.Request.URL.RawQuery != "" {
-			bodyStr += "&" + c.Request.URL.RawQuery
+			bodyStr += "&" + klog.RedactBody(c.Request.URL.RawQuery)
 		}
 
 		if len(bodyStr) > printRequestLen {
@@ -140,7 +150,7 @@ func AccessLog() gin.HandlerFunc {
 			klog.String("vc", getReqValueByKey(c, "vc")),
 			klog.String("vcname", getReqValueByKey(c, "vcname")),
 			klog.String("userid", getReqValueByKey(c, "userid")),
-			klog.String("uri", c.Request.RequestURI),
+			klog.String("uri", klog.RedactURL(c.Request.RequestURI)),
 			klog.String("host", c.Request.Host),
 			klog.String("method", c.Request.Method),
 			klog.String("httpProto", c.Request.Proto),
@@ -173,7 +183,7 @@ func getReqValueByKey(ctx *gin.Context, k string) string {
 func getCookie(ctx *gin.Context) string {
 	cStr := ""
 	for _, c := range ctx.Request.Cookies() {
-		cStr += fmt.Sprintf("%s=%s&", c.Name, c.Value)
+		cStr += fmt.Sprintf("%s=%s&", c.Name, klog.RedactCookie(c.Name, c.Value))
 	}
 	return strings.TrimRight(cStr, "&")
 }
@@ -1,6 +1,9 @@
 package middleware
 
 import (
+	"strconv"
+
+	"github.com/peerless6372/Lplot/base"
 	"github.com/peerless6372/Lplot/utils/metadata"
 	"github.com/peerless6372/gin"
 )
@@ -16,4 +19,62 @@ func UseMetadata(ctx *gin.Context) {
 	if _, ok := metadata.CtxFromGinContext(ctx); !ok {
 		metadata.GinCtxWithCtx(ctx, metadata.NewContext4Gin())
 	}
+
+	if isPressureTest(ctx) {
+		metadata.MarkPressureTest(ctx)
+	}
+	if isMirror(ctx) {
+		metadata.MarkMirror(ctx)
+	}
+	if color := requestColor(ctx); color != "" {
+		metadata.SetColor(ctx, color)
+	}
+}
+
+// 压测流量通过header或query参数标记
+func isPressureTest(ctx *gin.Context) bool {
+	if ctx.Request == nil {
+		return false
+	}
+	v := ctx.GetHeader(base.HttpHeaderPressureTest)
+	if v == "" {
+		v = ctx.Query(base.HttpUrlPressureTestKey)
+	}
+	if v == "" {
+		return false
+	}
+	if b, err := strconv.ParseBool(v); err == nil {
+		return b
+	}
+	return true
+}
+
+// 上游镜像过来的请求
+func isMirror(ctx *gin.Context) bool {
+	if ctx.Request == nil {
+		return false
+	}
+	v := ctx.GetHeader(base.HttpHeaderMirror)
+	if v == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	return err != nil || b
+}
+
+// 泳道名会拼到redis key与表名中，只接受字母、数字、- 和 _
+func requestColor(ctx *gin.Context) string {
+	if ctx.Request == nil {
+		return ""
+	}
+	color := ctx.GetHeader(base.HttpHeaderColor)
+	if color == "" || len(color) > 32 {
+		return ""
+	}
+	for _, r := range color {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return ""
+		}
+	}
+	return color
 }
@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/peerless6372/Lplot/metrics"
+	"github.com/peerless6372/Lplot/utils/metadata"
+	"github.com/peerless6372/gin"
+)
+
+// 入口请求的RED指标，route 为gin注册的路由，未匹配路由的请求记为 unknown
+// 镜像与压测流量不计入请求数与耗时，in_flight 反映实际负载，包含所有请求
+var (
+	serverRequests = metrics.NewCounterVec("http_server_requests_total",
+		"Total inbound http requests.", "route", "method", "code")
+	serverDuration = metrics.NewHistogramVec("http_server_request_duration_seconds",
+		"Inbound http request latency in seconds.", nil, "route", "method")
+	serverInFlight = metrics.NewGaugeVec("http_server_requests_in_flight",
+		"Inbound http requests being served.")
+)
+
+func metricsRoute(c *gin.Context) string {
+	if route := c.FullPath(); route != "" {
+		return route
+	}
+	return "unknown"
+}
+
+func observeRequest(c *gin.Context, start time.Time) {
+	if metadata.IsMirror(c) || metadata.IsPressureTest(c) {
+		return
+	}
+	route := metricsRoute(c)
+	method := c.Request.Method
+	serverRequests.With(route, method, strconv.Itoa(c.Writer.Status())).Inc()
+	serverDuration.With(route, method).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/peerless6372/Lplot/metrics"
+	"github.com/peerless6372/Lplot/utils/metadata"
+	"github.com/peerless6372/gin"
+)
+
+// 读取指标当前值，指标为全局累计，按前后差值断言
+func metricValue(series string) float64 {
+	var b bytes.Buffer
+	_ = metrics.DefaultRegistry.WriteText(&b)
+	for _, line := range strings.Split(b.String(), "\n") {
+		if strings.HasPrefix(line, series+" ") {
+			v, _ := strconv.ParseFloat(strings.TrimPrefix(line, series+" "), 64)
+			return v
+		}
+	}
+	return 0
+}
+
+func TestObserveRequest(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	cases := []struct {
+		name    string
+		route   string
+		mark    func(c *gin.Context)
+		counted bool
+	}{
+		{"real", "/metrics-real/:id", nil, true},
+		{"mirror", "/metrics-mirror/:id", metadata.MarkMirror, false},
+		{"pressure", "/metrics-pressure/:id", metadata.MarkPressureTest, false},
+	}
+	for _, c := range cases {
+		r := gin.New()
+		if c.mark != nil {
+			r.Use(func(ctx *gin.Context) { c.mark(ctx) })
+		}
+		r.Use(AccessLog())
+		r.GET(c.route, func(ctx *gin.Context) { ctx.String(201, "x") })
+		counter := `http_server_requests_total{route="` + c.route + `",method="GET",code="201"}`
+		histogram := `http_server_request_duration_seconds_count{route="` + c.route + `",method="GET"}`
+		n, h := metricValue(counter), metricValue(histogram)
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", strings.Replace(c.route, ":id", "1", 1), nil))
+
+		want := 0.0
+		if c.counted {
+			want = 1
+		}
+		if dn, dh := metricValue(counter)-n, metricValue(histogram)-h; dn != want || dh != want {
+			t.Errorf("%s: counted %v %v, want %v", c.name, dn, dh, want)
+		}
+	}
+}
+
+func TestObserveUnknownRoute(t *testing.T) {
+	r := gin.New()
+	r.Use(AccessLog())
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics-nope", nil))
+	var b bytes.Buffer
+	metrics.DefaultRegistry.WriteText(&b)
+	if s := b.String(); !strings.Contains(s, `route="unknown",method="GET",code="404"}`) || !strings.Contains(s, "http_server_requests_in_flight 0") {
+		t.Fatal(s)
+	}
+}
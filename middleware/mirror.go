@@ -0,0 +1,320 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/peerless6372/Lplot/base"
+	"github.com/peerless6372/Lplot/klog"
+	"github.com/peerless6372/Lplot/utils/metadata"
+	"github.com/peerless6372/gin"
+)
+
+type MirrorConf struct {
+	// 镜像流量的下游，复用client的地址、超时、重试与拦截器
+	Client *base.ApiClient `yaml:"-"`
+
+	// 默认镜像比例，0-100
+	Percent float64 `yaml:"percent"`
+	// 按路由(gin注册的path，如 /api/user/:id)指定镜像比例，优先于 Percent
+	Routes map[string]float64 `yaml:"routes"`
+
+	// 是否对比主响应与镜像响应，差异写入 mirror 日志
+	Diff bool `yaml:"diff"`
+	// diff 时忽略的json字段路径，如 data.time
+	IgnoreFields []string `yaml:"ignoreFields"`
+
+	// 请求体/响应体超过该大小时不做镜像/diff，默认1MB
+	MaxBodySize int64 `yaml:"maxBodySize"`
+	// 同时进行中的镜像请求上限，超过时丢弃，默认100
+	MaxConcurrency int `yaml:"maxConcurrency"`
+}
+
+// 镜像请求diff最多记录的差异字段数
+const mirrorMaxDiffs = 20
+
+// Mirror 按比例把请求异步复制到影子下游，镜像请求带 base.HttpHeaderMirror 标记
+// 镜像请求在主请求处理完成后发出，不影响主请求的耗时与结果
+func Mirror(conf MirrorConf) gin.HandlerFunc {
+	if conf.MaxBodySize <= 0 {
+		conf.MaxBodySize = 1 << 20
+	}
+	if conf.MaxConcurrency <= 0 {
+		conf.MaxConcurrency = 100
+	}
+	ignore := make(map[string]bool, len(conf.IgnoreFields))
+	for _, f := range conf.IgnoreFields {
+		ignore[f] = true
+	}
+	sem := make(chan struct{}, conf.MaxConcurrency)
+
+	return func(ctx *gin.Context) {
+		if conf.Client == nil || metadata.IsMirror(ctx) || !conf.sampled(ctx.FullPath()) {
+			ctx.Next()
+			return
+		}
+
+		var body []byte
+		if ctx.Request.Body != nil && ctx.Request.Body != http.NoBody {
+			if ctx.Request.ContentLength > conf.MaxBodySize {
+				ctx.Next()
+				return
+			}
+			var err error
+			body, err = ioutil.ReadAll(io.LimitReader(ctx.Request.Body, conf.MaxBodySize+1))
+			ctx.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+			if err != nil || int64(len(body)) > conf.MaxBodySize {
+				ctx.Next()
+				return
+			}
+		}
+
+		var w *mirrorWriter
+		if conf.Diff {
+			w = &mirrorWriter{ResponseWriter: ctx.Writer, limit: conf.MaxBodySize}
+			ctx.Writer = w
+		}
+
+		ctx.Next()
+
+		select {
+		case sem <- struct{}{}:
+		default:
+			klog.DebugLogger(ctx, "mirror request dropped",
+				klog.String(klog.TopicType, klog.LogNameModule),
+				klog.String("service", conf.Client.Service))
+			return
+		}
+
+		cp := mirrorContext(ctx)
+		req := mirrorRequest{
+			method: ctx.Request.Method,
+			path:   ctx.Request.URL.Path,
+			query:  ctx.Request.URL.RawQuery,
+			route:  ctx.FullPath(),
+			header: ctx.Request.Header.Clone(),
+			body:   body,
+		}
+		if w != nil && !w.overflow {
+			req.primaryCode = w.Status()
+			req.primaryBody = w.body.Bytes()
+			req.diff = true
+		}
+
+		go func() {
+			defer func() {
+				<-sem
+				if r := recover(); r != nil {
+					klog.ErrorLogger(cp, "mirror request panic",
+						klog.String(klog.TopicType, klog.LogNameModule),
+						klog.Any("panic", r))
+				}
+			}()
+			conf.mirror(cp, &req, ignore)
+		}()
+	}
+}
+
+func (conf *MirrorConf) sampled(route string) bool {
+	percent := conf.Percent
+	if p, ok := conf.Routes[route]; ok {
+		percent = p
+	}
+	if percent <= 0 {
+		return false
+	}
+	return percent >= 100 || rand.Float64()*100 < percent
+}
+
+// 镜像请求使用独立的metadata，标记只作用于镜像请求
+func mirrorContext(ctx *gin.Context) *gin.Context {
+	cp := ctx.Copy()
+	md := metadata.MD{}
+	if c, ok := metadata.CtxFromGinContext(ctx); ok {
+		if m, ok := metadata.FromContext(c); ok {
+			md = m.Copy()
+		}
+	}
+	md[metadata.Mirror] = true
+	metadata.GinCtxWithCtx(cp, metadata.NewContext(context.Background(), md))
+	return cp
+}
+
+type mirrorRequest struct {
+	method string
+	path   string
+	query  string
+	route  string
+	header http.Header
+	body   []byte
+
+	diff        bool
+	primaryCode int
+	primaryBody []byte
+}
+
+func (conf *MirrorConf) mirror(ctx *gin.Context, req *mirrorRequest, ignore map[string]bool) {
+	base.RemoveHopHeaders(req.header)
+	req.header.Del("Content-Length")
+	req.header.Del("Accept-Encoding")
+	headers := make(map[string]string, len(req.header))
+	for k := range req.header {
+		headers[k] = req.header.Get(k)
+	}
+
+	path := req.path
+	if req.query != "" {
+		path += "?" + req.query
+	}
+	opts := base.HttpRequestOptions{
+		Headers:      headers,
+		BodyType:     req.header.Get("Content-Type"),
+		BodyReader:   bytes.NewReader(req.body),
+		PathTemplate: req.route,
+	}
+	res, err := conf.Client.HttpStream(ctx, req.method, path, opts)
+	if err != nil {
+		klog.WarnLogger(ctx, "mirror request error: "+err.Error(),
+			klog.String(klog.TopicType, klog.LogNameModule),
+			klog.String("service", conf.Client.Service))
+		return
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, conf.MaxBodySize+1))
+	_ = res.Body.Close()
+	if !req.diff || err != nil || int64(len(data)) > conf.MaxBodySize {
+		return
+	}
+
+	diffs := diffResponse(req.primaryBody, data, ignore)
+	if req.primaryCode != res.HttpCode {
+		diffs = append([]string{"httpCode"}, diffs...)
+	}
+	if len(diffs) == 0 {
+		return
+	}
+	klog.InfoLogger(ctx, "mirror response diff",
+		klog.String(klog.TopicType, klog.LogNameMirror),
+		klog.String("service", conf.Client.Service),
+		klog.String("method", req.method),
+		klog.String("route", req.route),
+		klog.String("requestUri", path),
+		klog.Int("primaryCode", req.primaryCode),
+		klog.Int("shadowCode", res.HttpCode),
+		klog.Strings("diffs", diffs),
+		klog.String("primary", truncate(klog.RedactBody(string(req.primaryBody)), printResponseLen)),
+		klog.String("shadow", truncate(klog.RedactBody(string(data)), printResponseLen)))
+}
+
+// 返回不一致的字段路径，非json响应整体比较
+func diffResponse(a, b []byte, ignore map[string]bool) []string {
+	var va, vb interface{}
+	if decodeJson(a, &va) != nil || decodeJson(b, &vb) != nil {
+		if bytes.Equal(bytes.TrimSpace(a), bytes.TrimSpace(b)) {
+			return nil
+		}
+		return []string{"body"}
+	}
+	var diffs []string
+	diffValue("", va, vb, ignore, &diffs)
+	return diffs
+}
+
+func decodeJson(data []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+func diffValue(path string, a, b interface{}, ignore map[string]bool, diffs *[]string) {
+	if len(*diffs) >= mirrorMaxDiffs || ignore[path] {
+		return
+	}
+	name := path
+	if name == "" {
+		name = "$"
+	}
+
+	switch x := a.(type) {
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok {
+			*diffs = append(*diffs, name)
+			return
+		}
+		keys := make([]string, 0, len(x)+len(y))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		for k := range y {
+			if _, ok := x[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			diffValue(p, x[k], y[k], ignore, diffs)
+		}
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			*diffs = append(*diffs, name)
+			return
+		}
+		for i := range x {
+			diffValue(path+"["+strconv.Itoa(i)+"]", x[i], y[i], ignore, diffs)
+		}
+	default:
+		if !reflect.DeepEqual(a, b) {
+			*diffs = append(*diffs, name)
+		}
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		s = s[:n]
+	}
+	return s
+}
+
+// 缓存主响应用于diff，超过limit后不再缓存
+type mirrorWriter struct {
+	gin.ResponseWriter
+	body     bytes.Buffer
+	limit    int64
+	overflow bool
+}
+
+func (w *mirrorWriter) Write(b []byte) (int, error) {
+	w.capture(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *mirrorWriter) WriteString(s string) (int, error) {
+	w.capture([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *mirrorWriter) capture(b []byte) {
+	if w.overflow {
+		return
+	}
+	if int64(w.body.Len()+len(b)) > w.limit {
+		w.overflow = true
+		w.body.Reset()
+		return
+	}
+	w.body.Write(b)
+}
@@ -0,0 +1,138 @@
+package middleware
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/peerless6372/Lplot/base"
+	"github.com/peerless6372/Lplot/klog"
+	"github.com/peerless6372/gin"
+)
+
+// 日志写到临时目录
+func TestMain(m *testing.M) {
+	dir, _ := ioutil.TempDir("", "middleware")
+	klog.InitLog(klog.LogConfig{Level: "debug", Path: dir, Log2File: true})
+	// 提前创建logger，避免并发请求懒加载时竞争
+	klog.GetZapLogger()
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestMirrorSampled(t *testing.T) {
+	conf := &MirrorConf{Percent: 100, Routes: map[string]float64{"/off": 0, "/half": 50}}
+	cases := []struct {
+		route string
+		want  bool
+	}{
+		{"/any", true},
+		// 路由比例优先
+		{"/off", false},
+	}
+	for _, c := range cases {
+		if got := conf.sampled(c.route); got != c.want {
+			t.Errorf("%s: got %v", c.route, got)
+		}
+	}
+	hits := 0
+	for i := 0; i < 1000; i++ {
+		if conf.sampled("/half") {
+			hits++
+		}
+	}
+	if hits < 350 || hits > 650 {
+		t.Errorf("/half: hits %d", hits)
+	}
+}
+
+func TestDiffResponse(t *testing.T) {
+	cases := []struct {
+		name   string
+		a, b   string
+		ignore map[string]bool
+		want   string
+	}{
+		{"equal", `{"a":1,"b":2}`, `{"b":2,"a":1}`, nil, ""},
+		{"fields", `{"a":[1,2],"b":{"c":1},"t":1}`, `{"a":[1,3],"b":{"d":1},"t":2}`, map[string]bool{"t": true}, "a[1],b.c,b.d"},
+		{"nested ignore", `{"data":{"t":1,"x":1}}`, `{"data":{"t":2,"x":1}}`, map[string]bool{"data.t": true}, ""},
+		{"array length", `{"a":[1]}`, `{"a":[1,2]}`, nil, "a"},
+		// 大整数按字面值比较
+		{"big number", `{"id":12345678901234567890}`, `{"id":12345678901234567891}`, nil, "id"},
+		{"text equal", "ok\n", "ok", nil, ""},
+		{"text", "ok", "fail", nil, "body"},
+	}
+	for _, c := range cases {
+		if got := strings.Join(diffResponse([]byte(c.a), []byte(c.b), c.ignore), ","); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestMirror(t *testing.T) {
+	got := make(chan string, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		got <- r.Method + " " + r.URL.RequestURI() + " " + string(b) + " " + r.Header.Get(base.HttpHeaderMirror) + " " + r.Header.Get("X-A")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"errNo":0,"data":{"a":2}}`))
+	}))
+	defer shadow.Close()
+
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	r.Use(Metadata(), Mirror(MirrorConf{
+		Client:       &base.ApiClient{Service: "shadow", Domain: shadow.URL},
+		Routes:       map[string]float64{"/u/:id": 100},
+		Diff:         true,
+		IgnoreFields: []string{"data.t"},
+		MaxBodySize:  10,
+	}))
+	handler := func(c *gin.Context) {
+		b, _ := c.GetRawData()
+		c.JSON(http.StatusOK, gin.H{"errNo": 0, "data": gin.H{"a": 1, "t": string(b)}})
+	}
+	r.POST("/u/:id", handler)
+	r.POST("/other", handler)
+
+	cases := []struct {
+		name   string
+		path   string
+		body   string
+		mirror bool
+		want   string
+	}{
+		{"mirrored", "/u/1?x=1", "hello", false, "POST /u/1?x=1 hello 1 b"},
+		{"not sampled", "/other", "hello", false, ""},
+		// 镜像流量不再镜像
+		{"mirror request", "/u/1", "hello", true, ""},
+		// 请求体超限时不镜像，主请求不受影响
+		{"body too large", "/u/1", strings.Repeat("x", 11), false, ""},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, c.path, strings.NewReader(c.body))
+		req.Header.Set("X-A", "b")
+		if c.mirror {
+			req.Header.Set(base.HttpHeaderMirror, "1")
+		}
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"t":"`+c.body+`"`) {
+			t.Errorf("%s: primary %d %s", c.name, w.Code, w.Body.String())
+		}
+
+		var s string
+		select {
+		case s = <-got:
+		case <-time.After(300 * time.Millisecond):
+		}
+		if s != c.want {
+			t.Errorf("%s: mirror %q, want %q", c.name, s, c.want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"bytes"
+	"io/ioutil"
+	"time"
+
+	"github.com/peerless6372/Lplot/base"
+	"github.com/peerless6372/Lplot/klog"
+	"github.com/peerless6372/Lplot/redis"
+	"github.com/peerless6372/gin"
+)
+
+const ContextKeyAppKey = "_app_key"
+
+var (
+	ErrSignature = base.Error{ErrNo: 4001, ErrMsg: "invalid signature"}
+	ErrSignSkew  = base.Error{ErrNo: 4002, ErrMsg: "request timestamp expired"}
+	ErrSignNonce = base.Error{ErrNo: 4003, ErrMsg: "replayed request"}
+)
+
+type SignConf struct {
+	// appKey -> appSecret
+	Apps map[string]string `yaml:"apps"`
+	// 允许的客户端时钟偏差，默认5分钟
+	MaxSkew time.Duration `yaml:"maxSkew"`
+	// nonce 在redis中的key前缀
+	NoncePrefix string `yaml:"noncePrefix"`
+	// 是否接受请求体未参与签名(base.UnsignedPayload)的流式请求，如文件上传
+	AllowUnsignedPayload bool `yaml:"allowUnsignedPayload"`
+
+	// 用于nonce防重放，为空时不做重放检查
+	NonceRedis *redis.Redis `yaml:"-"`
+}
+
+// 服务间调用签名校验，与 base.ApiClient 配置 appkey/appsecret 后的签名方式对应
+func SignVerify(conf SignConf) gin.HandlerFunc {
+	if conf.MaxSkew <= 0 {
+		conf.MaxSkew = 5 * time.Minute
+	}
+	if conf.NoncePrefix == "" {
+		conf.NoncePrefix = "sign:nonce:"
+	}
+
+	secret := func(appKey string) (string, bool) {
+		s, ok := conf.Apps[appKey]
+		return s, ok && s != ""
+	}
+
+	return func(ctx *gin.Context) {
+		unsigned := base.IsUnsignedPayload(ctx.Request)
+		if unsigned && !conf.AllowUnsignedPayload {
+			klog.WarnLogger(ctx, "sign verify unsigned payload not allowed", klog.String("appKey", ctx.GetHeader(base.HttpHeaderAppKey)))
+			base.RenderJsonAbort(ctx, ErrSignature)
+			return
+		}
+
+		// 请求体未参与签名时不读取，保持流式
+		var body []byte
+		if ctx.Request.Body != nil && !unsigned {
+			var err error
+			if body, err = ctx.GetRawData(); err != nil {
+				klog.WarnLogger(ctx, "sign verify read body error: "+err.Error())
+			}
+			ctx.Request.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+		}
+
+		appKey, timestamp, nonce, err := base.VerifyRequest(ctx.Request, body, secret)
+		if err != nil {
+			klog.WarnLogger(ctx, "sign verify failed: "+err.Error(), klog.String("appKey", appKey))
+			base.RenderJsonAbort(ctx, ErrSignature)
+			return
+		}
+
+		skew := time.Since(time.Unix(timestamp, 0))
+		if skew > conf.MaxSkew || skew < -conf.MaxSkew {
+			klog.WarnLogger(ctx, "sign verify timestamp skew", klog.String("appKey", appKey), klog.Duration("skew", skew))
+			base.RenderJsonAbort(ctx, ErrSignSkew)
+			return
+		}
+
+		if conf.NonceRedis != nil {
+			// nonce 在时钟偏差窗口内有效，过期后时间戳校验即可拒绝
+			expire := uint64(2 * conf.MaxSkew / time.Second)
+			ok, err := conf.NonceRedis.SetNxByEX(ctx, conf.NoncePrefix+appKey+":"+nonce, timestamp, expire)
+			if err != nil {
+				// redis 不可用时拒绝请求，避免重放检查失效
+				klog.ErrorLogger(ctx, "sign verify nonce check error: "+err.Error(), klog.String("appKey", appKey))
+				base.RenderJsonAbort(ctx, ErrSignNonce)
+				return
+			}
+			if !ok {
+				klog.WarnLogger(ctx, "sign verify nonce replayed", klog.String("appKey", appKey), klog.String("nonce", nonce))
+				base.RenderJsonAbort(ctx, ErrSignNonce)
+				return
+			}
+		}
+
+		ctx.Set(ContextKeyAppKey, appKey)
+		ctx.Next()
+	}
+}
@@ -0,0 +1,231 @@
+package middleware
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/peerless6372/Lplot/base"
+	"github.com/peerless6372/Lplot/redis"
+	"github.com/peerless6372/gin"
+)
+
+// 只实现 SET key value EX n NX 的redis，用于nonce防重放
+func newNonceRedis(t *testing.T) *redis.Redis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var mu sync.Mutex
+	keys := map[string]bool{}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					args, err := readCommand(r)
+					if err != nil {
+						return
+					}
+					reply := "+OK\r\n"
+					if strings.ToUpper(args[0]) == "SET" {
+						mu.Lock()
+						if keys[args[1]] {
+							reply = "$-1\r\n"
+						}
+						keys[args[1]] = true
+						mu.Unlock()
+					}
+					_, _ = conn.Write([]byte(reply))
+				}
+			}()
+		}
+	}()
+
+	r, err := redis.InitRedisClient(redis.RedisConf{Service: "nonce", Addr: ln.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		b := make([]byte, size+2)
+		if _, err = io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args = append(args, string(b[:size]))
+	}
+	return args, nil
+}
+
+func newSignRouter(conf SignConf) *gin.Engine {
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	r.Use(SignVerify(conf))
+	r.Any("/sign/*path", func(ctx *gin.Context) {
+		b, _ := ioutil.ReadAll(ctx.Request.Body)
+		ctx.String(http.StatusOK, "ok "+strconv.Itoa(len(b)))
+	})
+	return r
+}
+
+func errNo(body string) int {
+	var r base.DefaultRender
+	if err := json.Unmarshal([]byte(body), &r); err != nil {
+		return 0
+	}
+	return r.ErrNo
+}
+
+// 按指定时间戳与nonce签名
+func signAt(req *http.Request, body, secret string, ts time.Time, nonce string) {
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	canonical := base.CanonicalRequest(req.Method, req.URL.EscapedPath(), req.URL.Query(), []byte(body), timestamp, nonce)
+	req.Header.Set(base.HttpHeaderAppKey, "app")
+	req.Header.Set(base.HttpHeaderTimestamp, timestamp)
+	req.Header.Set(base.HttpHeaderNonce, nonce)
+	req.Header.Set(base.HttpHeaderSignature, base.Sign(secret, canonical))
+}
+
+func TestSignVerify(t *testing.T) {
+	const body = "a=1&b=2"
+	cases := []struct {
+		name  string
+		allow bool
+		build func(req *http.Request)
+		errNo int
+	}{
+		{"signed", false, func(req *http.Request) { base.SignRequest(req, []byte(body), "app", "sec") }, 0},
+		{"missing headers", false, func(req *http.Request) {}, 4001},
+		{"unknown app", false, func(req *http.Request) { base.SignRequest(req, []byte(body), "other", "sec") }, 4001},
+		{"wrong secret", false, func(req *http.Request) { base.SignRequest(req, []byte(body), "app", "bad") }, 4001},
+		{"body tampered", false, func(req *http.Request) { base.SignRequest(req, []byte("a=1&b=3"), "app", "sec") }, 4001},
+		{"within skew", false, func(req *http.Request) { signAt(req, body, "sec", time.Now().Add(-time.Minute), "n1") }, 0},
+		{"expired", false, func(req *http.Request) { signAt(req, body, "sec", time.Now().Add(-10*time.Minute), "n2") }, 4002},
+		{"future", false, func(req *http.Request) { signAt(req, body, "sec", time.Now().Add(10*time.Minute), "n3") }, 4002},
+		{"unsigned payload not allowed", false, func(req *http.Request) { base.SignStreamRequest(req, "app", "sec") }, 4001},
+		{"unsigned payload", true, func(req *http.Request) { base.SignStreamRequest(req, "app", "sec") }, 0},
+		// 签名时带body摘要，不能通过加header改为不校验body
+		{"unsigned marker added", true, func(req *http.Request) {
+			base.SignRequest(req, []byte("x"), "app", "sec")
+			req.Header.Set(base.HttpHeaderContentSha256, base.UnsignedPayload)
+		}, 4001},
+	}
+	for _, c := range cases {
+		r := newSignRouter(SignConf{Apps: map[string]string{"app": "sec"}, AllowUnsignedPayload: c.allow})
+		req := httptest.NewRequest(http.MethodPost, "/sign/x?q=1", strings.NewReader(body))
+		c.build(req)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if got := errNo(rec.Body.String()); got != c.errNo {
+			t.Errorf("%s: errNo %d, body %s", c.name, got, rec.Body.String())
+			continue
+		}
+		// 校验通过后请求体仍可完整读取
+		if c.errNo == 0 && rec.Body.String() != "ok 7" {
+			t.Errorf("%s: body %s", c.name, rec.Body.String())
+		}
+	}
+}
+
+func TestSignVerifyNonce(t *testing.T) {
+	r := newSignRouter(SignConf{Apps: map[string]string{"app": "sec"}, NonceRedis: newNonceRedis(t)})
+	send := func(build func(req *http.Request)) int {
+		req := httptest.NewRequest(http.MethodGet, "/sign/x", nil)
+		build(req)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return errNo(rec.Body.String())
+	}
+
+	ts := time.Now()
+	cases := []struct {
+		name  string
+		build func(req *http.Request)
+		errNo int
+	}{
+		{"first", func(req *http.Request) { signAt(req, "", "sec", ts, "n1") }, 0},
+		{"replayed", func(req *http.Request) { signAt(req, "", "sec", ts, "n1") }, 4003},
+		{"new nonce", func(req *http.Request) { signAt(req, "", "sec", ts, "n2") }, 0},
+		{"client signed", func(req *http.Request) { base.SignRequest(req, nil, "app", "sec") }, 0},
+		{"client signed again", func(req *http.Request) { base.SignRequest(req, nil, "app", "sec") }, 0},
+	}
+	for _, c := range cases {
+		if got := send(c.build); got != c.errNo {
+			t.Errorf("%s: errNo %d, want %d", c.name, got, c.errNo)
+		}
+	}
+}
+
+func TestSignApiClient(t *testing.T) {
+	var mu sync.Mutex
+	unsigned := map[string]bool{}
+	r := newSignRouter(SignConf{Apps: map[string]string{"app": "sec"}, AllowUnsignedPayload: true, NonceRedis: newNonceRedis(t)})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		unsigned[req.URL.Path] = base.IsUnsignedPayload(req)
+		mu.Unlock()
+		r.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+
+	client := &base.ApiClient{Service: "sign", Domain: srv.URL, AppKey: "app", AppSecret: "sec"}
+	file := strings.Repeat("x", 1<<20)
+	cases := []struct {
+		name     string
+		path     string
+		do       func(path string) (*base.ApiResult, error)
+		unsigned bool
+	}{
+		{"get", "/sign/get", func(path string) (*base.ApiResult, error) {
+			return client.HttpGet(nil, path, base.HttpRequestOptions{Data: map[string]string{"q": "1"}})
+		}, false},
+		{"post", "/sign/post", func(path string) (*base.ApiResult, error) {
+			return client.HttpPost(nil, path, base.HttpRequestOptions{Data: map[string]string{"a": "1"}})
+		}, false},
+		// 上传的请求体不读入内存签名
+		{"upload", "/sign/upload", func(path string) (*base.ApiResult, error) {
+			return client.HttpUpload(nil, path, base.HttpRequestOptions{
+				Files: []base.UploadFile{{FieldName: "f", FileName: "f.txt", Reader: strings.NewReader(file)}},
+			})
+		}, true},
+	}
+	for _, c := range cases {
+		res, err := c.do(c.path)
+		if err != nil || !strings.HasPrefix(string(res.Response), "ok ") {
+			t.Errorf("%s: %v %v", c.name, err, res)
+			continue
+		}
+		if unsigned[c.path] != c.unsigned {
+			t.Errorf("%s: unsigned payload %v", c.name, unsigned[c.path])
+		}
+	}
+}
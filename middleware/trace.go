@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"fmt"
+
+	"github.com/peerless6372/Lplot/klog"
+	"github.com/peerless6372/Lplot/trace"
+	"github.com/peerless6372/gin"
+)
+
+// Trace 为每个请求创建入口span，上游带 traceparent 时加入上游的trace
+// 需要先调用 trace.Init，未初始化时不做处理
+func Trace() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		route := ctx.FullPath()
+		if route == "" {
+			route = ctx.Request.URL.Path
+		}
+		span := trace.StartServerSpan(ctx, ctx.Request.Method+" "+route)
+		if span == nil {
+			ctx.Next()
+			return
+		}
+		defer span.End()
+
+		span.SetAttr("http.method", ctx.Request.Method)
+		span.SetAttr("http.route", route)
+		span.SetAttr("http.target", ctx.Request.URL.Path)
+		span.SetAttr("requestId", klog.GetRequestID(ctx))
+		klog.AddNotice(ctx, "traceId", span.TraceID())
+
+		ctx.Next()
+
+		status := ctx.Writer.Status()
+		span.SetAttr("http.status_code", status)
+		if status >= 500 {
+			span.SetError(fmt.Errorf("http status %d", status))
+		} else if len(ctx.Errors) > 0 {
+			span.SetError(ctx.Errors.Last())
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/peerless6372/Lplot/base"
+	"github.com/peerless6372/Lplot/trace"
+	"github.com/peerless6372/gin"
+)
+
+type spanExporter struct {
+	lock  sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (e *spanExporter) Export(spans []*trace.SpanData) error {
+	e.lock.Lock()
+	e.spans = append(e.spans, spans...)
+	e.lock.Unlock()
+	return nil
+}
+
+func (e *spanExporter) Shutdown(context.Context) error { return nil }
+
+func TestTrace(t *testing.T) {
+	var down string
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		down = r.Header.Get(trace.HeaderTraceparent)
+	}))
+	defer ds.Close()
+	client := &base.ApiClient{Service: "down", Domain: ds.URL}
+
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	r.Use(Metadata(), Trace())
+	r.GET("/x/:id", func(c *gin.Context) {
+		_, _ = client.HttpGet(c, "/y", base.HttpRequestOptions{})
+		if c.Param("id") == "err" {
+			c.Status(http.StatusInternalServerError)
+		}
+	})
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	cases := []struct {
+		name      string
+		path      string
+		parent    string
+		init      bool
+		spans     int
+		parentID  string
+		sameTrace bool
+		err       bool
+	}{
+		{"upstream", "/x/1", "00-" + traceID + "-00f067aa0ba902b7-01", true, 2, "00f067aa0ba902b7", true, false},
+		{"new trace", "/x/1", "", true, 2, "", false, false},
+		{"5xx", "/x/err", "", true, 2, "", false, true},
+		// 未初始化时不创建span
+		{"not init", "/x/1", "", false, 0, "", false, false},
+	}
+	for _, c := range cases {
+		e := &spanExporter{}
+		if c.init {
+			if err := trace.Init(trace.Conf{Service: "svc", CustomExporter: e}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		down = ""
+		req := httptest.NewRequest(http.MethodGet, c.path, nil)
+		if c.parent != "" {
+			req.Header.Set(trace.HeaderTraceparent, c.parent)
+		}
+		r.ServeHTTP(httptest.NewRecorder(), req)
+		_ = trace.Shutdown(context.Background())
+
+		e.lock.Lock()
+		spans := e.spans
+		e.lock.Unlock()
+		if len(spans) != c.spans {
+			t.Errorf("%s: spans %d, want %d", c.name, len(spans), c.spans)
+			continue
+		}
+		if c.spans == 0 {
+			if down != "" {
+				t.Errorf("%s: traceparent %s", c.name, down)
+			}
+			continue
+		}
+
+		var server, client *trace.SpanData
+		for _, s := range spans {
+			if s.Kind == "server" {
+				server = s
+			} else {
+				client = s
+			}
+		}
+		if server == nil || client == nil {
+			t.Errorf("%s: spans %+v", c.name, spans)
+			continue
+		}
+		if server.Name != "GET /x/:id" || server.ParentID != c.parentID || (server.TraceID == traceID) != c.sameTrace ||
+			(server.Error != "") != c.err || server.Attributes["http.route"] != "/x/:id" {
+			t.Errorf("%s: server span %+v", c.name, server)
+		}
+		// 下游收到client span作为父span
+		if client.TraceID != server.TraceID || client.ParentID != server.SpanID ||
+			down != "00-"+client.TraceID+"-"+client.SpanID+"-01" {
+			t.Errorf("%s: client span %+v traceparent %s", c.name, client, down)
+		}
+	}
+}
@@ -14,14 +14,21 @@ func (r *Redis) Lua(ctx *gin.Context, script string, keyCount int, keysAndArgs .
 
 	lua := redigo.NewScript(keyCount, script)
 
+	span := r.startSpan(ctx, "EVALSHA")
+	defer span.End()
+
 	addr, conn, err := r.choosePool(ctx)
 	if err != nil {
+		span.SetError(err)
 		return nil, err
 	}
 
 	defer conn.Close()
 
-	reply, err := lua.Do(conn, keysAndArgs...)
+	span.SetAttr("net.peer.name", addr)
+	reply, err := lua.Do(conn, r.shadowScriptArgs(ctx, keyCount, keysAndArgs)...)
+	span.SetError(err)
+	r.observe("EVALSHA", err, start)
 
 	ralCode := 0
 	msg := "pipeline exec succ"
@@ -0,0 +1,36 @@
+package redis
+
+import (
+	"time"
+
+	"github.com/peerless6372/Lplot/metrics"
+)
+
+var (
+	redisCommands = metrics.NewCounterVec("redis_commands_total",
+		"Total redis commands.", "service", "command", "result")
+	redisDuration = metrics.NewHistogramVec("redis_command_duration_seconds",
+		"Redis command latency in seconds.", nil, "service", "command")
+	redisPool = metrics.NewGaugeVec("redis_pool_connections",
+		"Redis pool connections by state.", "service", "state")
+)
+
+func (r *Redis) observe(command string, err error, start time.Time) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	redisCommands.With(r.Service, command, result).Inc()
+	redisDuration.With(r.Service, command).Observe(time.Since(start).Seconds())
+}
+
+// 采集时读取连接池状态，连接池未创建时不上报
+func (r *Redis) collectPool() {
+	if r.pool[r.conf.Addr] == nil {
+		return
+	}
+	inUse, idle, active := r.Stats()
+	redisPool.With(r.Service, "in_use").Set(float64(inUse))
+	redisPool.With(r.Service, "idle").Set(float64(idle))
+	redisPool.With(r.Service, "active").Set(float64(active))
+}
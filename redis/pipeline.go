@@ -47,6 +47,21 @@ func (p *Pipeline) Put(ctx *gin.Context, cmd string, args ...interface{}) error
 
 func (p *Pipeline) Exec(ctx *gin.Context) (res []interface{}, err error) {
 	start := time.Now()
+	span := p.redis.startSpan(ctx, "pipeline")
+	span.SetAttr("db.commands", len(p.cmds))
+	defer func() {
+		span.SetError(err)
+		span.End()
+		p.redis.observe("PIPELINE", err, start)
+	}()
+
+	// 有任一命令不支持压测/泳道隔离时整个pipeline不执行
+	args := make([][]interface{}, len(p.cmds))
+	for i := range p.cmds {
+		if args[i], err = p.redis.shadowArgs(ctx, p.cmds[i].cmd, p.cmds[i].args); err != nil {
+			return nil, err
+		}
+	}
 
 	addr, conn, err := p.redis.choosePool(ctx)
 	if err != nil {
@@ -55,8 +70,9 @@ func (p *Pipeline) Exec(ctx *gin.Context) (res []interface{}, err error) {
 
 	defer conn.Close()
 
+	span.SetAttr("net.peer.name", addr)
 	for i := range p.cmds {
-		err = conn.Send(p.cmds[i].cmd, p.cmds[i].args...)
+		err = conn.Send(p.cmds[i].cmd, args[i]...)
 	}
 
 	err = conn.Flush()
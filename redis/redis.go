@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"github.com/peerless6372/Lplot/env"
 	"github.com/peerless6372/Lplot/klog"
+	"github.com/peerless6372/Lplot/metrics"
 	"github.com/peerless6372/Lplot/utils"
+	"strings"
 	"time"
 
 	redigo "github.com/gomodule/redigo/redis"
@@ -27,6 +29,10 @@ type RedisConf struct {
 	ConnTimeOut     time.Duration `yaml:"connTimeOut"`
 	ReadTimeOut     time.Duration `yaml:"readTimeOut"`
 	WriteTimeOut    time.Duration `yaml:"writeTimeOut"`
+	// 压测流量访问的key前缀，默认 pt:
+	PressurePrefix string `yaml:"pressurePrefix"`
+	// 泳道流量的key是否加上 "泳道:" 前缀，与默认泳道数据隔离
+	ColorKey bool `yaml:"colorKey"`
 }
 
 func (conf *RedisConf) checkConf() {
@@ -53,6 +59,9 @@ func (conf *RedisConf) checkConf() {
 	if conf.WriteTimeOut == 0 {
 		conf.WriteTimeOut = 1200 * time.Millisecond
 	}
+	if conf.PressurePrefix == "" {
+		conf.PressurePrefix = defaultPressurePrefix
+	}
 }
 
 // 日志打印Do args部分支持的最大长度
@@ -71,6 +80,7 @@ func InitRedisClient(conf RedisConf) (*Redis, error) {
 		pool:    nil,
 		conf:    conf,
 	}
+	metrics.OnCollect(c.collectPool)
 	return c, nil
 }
 
@@ -126,6 +136,17 @@ func (r *Redis) choosePool(ctx *gin.Context) (selectedAddr string, conn redigo.C
 
 func (r *Redis) Do(ctx *gin.Context, commandName string, args ...interface{}) (reply interface{}, err error) {
 	start := time.Now()
+	span := r.startSpan(ctx, commandName)
+	defer func() {
+		span.SetError(err)
+		span.End()
+		r.observe(strings.ToUpper(commandName), err, start)
+	}()
+
+	if args, err = r.shadowArgs(ctx, commandName, args); err != nil {
+		klog.WarnLogger(ctx, err.Error(), klog.String(klog.TopicType, klog.LogNameModule), klog.String("prot", "redis"))
+		return reply, err
+	}
 
 	// 根据service随机选一个host对应的连接池中的连接
 	addr, conn, err := r.choosePool(ctx)
@@ -144,6 +165,7 @@ func (r *Redis) Do(ctx *gin.Context, commandName string, args ...interface{}) (r
 		return reply, err
 	}
 
+	span.SetAttr("net.peer.name", addr)
 	reply, err = conn.Do(commandName, args...)
 	if e := conn.Close(); e != nil {
 		klog.WarnLogger(ctx, "connection close error: "+e.Error(), klog.String(klog.TopicType, klog.LogNameModule), klog.String("prot", "redis"))
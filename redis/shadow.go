@@ -0,0 +1,230 @@
+package redis
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/peerless6372/Lplot/utils/metadata"
+	"github.com/peerless6372/gin"
+)
+
+// 压测流量的key默认前缀
+const defaultPressurePrefix = "pt:"
+
+// 当前请求访问的key需要加的前缀：压测前缀 + 泳道前缀，线上默认泳道为空
+func (r *Redis) keyPrefix(ctx *gin.Context) string {
+	prefix := ""
+	if r.conf.ColorKey {
+		if color := metadata.GetColor(ctx); color != "" {
+			prefix = color + ":"
+		}
+	}
+	if metadata.IsPressureTest(ctx) {
+		prefix = r.conf.PressurePrefix + prefix
+	}
+	return prefix
+}
+
+// 压测/泳道流量访问的key加上前缀，与线上数据隔离
+// 无法确定key位置的命令不执行，避免压测流量读写线上数据
+func (r *Redis) shadowArgs(ctx *gin.Context, cmd string, args []interface{}) ([]interface{}, error) {
+	prefix := r.keyPrefix(ctx)
+	if prefix == "" {
+		return args, nil
+	}
+
+	name := strings.ToUpper(cmd)
+	if name == "SCAN" {
+		return shadowScan(prefix, args), nil
+	}
+	idx, ok := keyIndexes(name, args)
+	if !ok {
+		return nil, fmt.Errorf("redis command %s is not supported for pressure test or color traffic", name)
+	}
+	if len(idx) == 0 {
+		return args, nil
+	}
+	out := make([]interface{}, len(args))
+	copy(out, args)
+	for _, i := range idx {
+		if i < len(out) {
+			out[i] = shadowKey(prefix, out[i])
+		}
+	}
+	return out, nil
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]，只遍历带前缀的key
+func shadowScan(prefix string, args []interface{}) []interface{} {
+	out := make([]interface{}, len(args), len(args)+2)
+	copy(out, args)
+	for i := 1; i+1 < len(out); i += 2 {
+		if strings.EqualFold(fmt.Sprint(out[i]), "MATCH") {
+			out[i+1] = globEscaper.Replace(prefix) + fmt.Sprint(out[i+1])
+			return out
+		}
+	}
+	return append(out, "MATCH", globEscaper.Replace(prefix)+"*")
+}
+
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// 已带前缀的key(如SCAN/KEYS返回的key)不重复添加
+func shadowKey(p string, key interface{}) interface{} {
+	switch k := key.(type) {
+	case string:
+		if strings.HasPrefix(k, p) {
+			return k
+		}
+		return p + k
+	case []byte:
+		if bytes.HasPrefix(k, []byte(p)) {
+			return k
+		}
+		return append([]byte(p), k...)
+	default:
+		return shadowKey(p, fmt.Sprint(k))
+	}
+}
+
+// Lua 脚本的前 keyCount 个参数为key
+func (r *Redis) shadowScriptArgs(ctx *gin.Context, keyCount int, keysAndArgs []interface{}) []interface{} {
+	if keyCount <= 0 {
+		return keysAndArgs
+	}
+	prefix := r.keyPrefix(ctx)
+	if prefix == "" {
+		return keysAndArgs
+	}
+	out := make([]interface{}, len(keysAndArgs))
+	copy(out, keysAndArgs)
+	for i := 0; i < keyCount && i < len(out); i++ {
+		out[i] = shadowKey(prefix, out[i])
+	}
+	return out
+}
+
+// 第一个参数为key的命令
+var firstKeyCommands = map[string]bool{}
+
+func init() {
+	for _, cmd := range strings.Fields(`
+		GET SET SETNX SETEX PSETEX GETSET GETDEL GETEX APPEND STRLEN INCR INCRBY INCRBYFLOAT DECR DECRBY
+		GETRANGE SETRANGE SUBSTR GETBIT SETBIT BITCOUNT BITPOS BITFIELD BITFIELD_RO
+		EXPIRE PEXPIRE EXPIREAT PEXPIREAT EXPIRETIME PEXPIRETIME TTL PTTL PERSIST TYPE DUMP RESTORE KEYS
+		HSET HSETNX HGET HMSET HMGET HDEL HEXISTS HGETALL HKEYS HVALS HLEN HINCRBY HINCRBYFLOAT HSTRLEN HSCAN HRANDFIELD
+		LPUSH RPUSH LPUSHX RPUSHX LPOP RPOP LLEN LRANGE LINDEX LSET LREM LTRIM LINSERT LPOS
+		SADD SREM SMEMBERS SISMEMBER SMISMEMBER SCARD SPOP SRANDMEMBER SSCAN
+		ZADD ZREM ZSCORE ZMSCORE ZINCRBY ZCARD ZCOUNT ZRANGE ZREVRANGE ZRANGEBYSCORE ZREVRANGEBYSCORE
+		ZRANGEBYLEX ZREVRANGEBYLEX ZLEXCOUNT ZRANK ZREVRANK ZREMRANGEBYRANK ZREMRANGEBYSCORE ZREMRANGEBYLEX
+		ZPOPMIN ZPOPMAX ZSCAN ZRANDMEMBER
+		PFADD GEOADD GEOPOS GEODIST GEOHASH GEOSEARCH
+		XADD XLEN XRANGE XREVRANGE XDEL XTRIM XACK XPENDING XCLAIM XAUTOCLAIM`) {
+		firstKeyCommands[cmd] = true
+	}
+}
+
+// 命令中哪些参数是key，ok为false表示不支持的命令
+func keyIndexes(cmd string, args []interface{}) (idx []int, ok bool) {
+	n := len(args)
+	if firstKeyCommands[cmd] {
+		return []int{0}, true
+	}
+	switch cmd {
+	case "PING", "ECHO", "INFO", "TIME", "SELECT", "AUTH", "MULTI", "EXEC", "DISCARD", "UNWATCH",
+		"DBSIZE", "SCRIPT", "CLIENT", "CONFIG", "RANDOMKEY", "PUBLISH", "SUBSCRIBE", "SLOWLOG", "COMMAND":
+		return nil, true
+	case "DEL", "UNLINK", "EXISTS", "TOUCH", "WATCH", "MGET", "SINTER", "SUNION", "SDIFF",
+		"SINTERSTORE", "SUNIONSTORE", "SDIFFSTORE", "PFCOUNT", "PFMERGE":
+		return rangeIndexes(0, n), true
+	case "MSET", "MSETNX":
+		idx := make([]int, 0, n/2)
+		for i := 0; i < n; i += 2 {
+			idx = append(idx, i)
+		}
+		return idx, true
+	case "RENAME", "RENAMENX", "RPOPLPUSH", "SMOVE", "LMOVE", "BRPOPLPUSH", "BLMOVE", "COPY",
+		"ZRANGESTORE", "GEOSEARCHSTORE":
+		return rangeIndexes(0, 2), true
+	case "BLPOP", "BRPOP", "BZPOPMIN", "BZPOPMAX":
+		// 最后一个参数为timeout
+		return rangeIndexes(0, n-1), true
+	case "BITOP":
+		// operation destkey key [key ...]
+		return rangeIndexes(1, n), true
+	case "ZUNIONSTORE", "ZINTERSTORE", "ZDIFFSTORE":
+		// destination numkeys key [key ...]
+		return append([]int{0}, rangeIndexes(2, 2+numKeys(args, 1))...), true
+	case "ZUNION", "ZINTER", "ZDIFF", "SINTERCARD":
+		// numkeys key [key ...]
+		return rangeIndexes(1, 1+numKeys(args, 0)), true
+	case "EVAL", "EVALSHA":
+		// script numkeys key [key ...]
+		return rangeIndexes(2, 2+numKeys(args, 1)), true
+	case "SORT", "SORT_RO", "GEORADIUS", "GEORADIUS_RO", "GEORADIUSBYMEMBER", "GEORADIUSBYMEMBER_RO":
+		// key ... [STORE key] [STOREDIST key]
+		return append([]int{0}, optionIndexes(args, 1, "STORE", "STOREDIST")...), true
+	case "XREAD", "XREADGROUP":
+		// ... STREAMS key [key ...] id [id ...]
+		for i := 0; i < n; i++ {
+			if strings.EqualFold(fmt.Sprint(args[i]), "STREAMS") {
+				return rangeIndexes(i+1, i+1+(n-i-1)/2), true
+			}
+		}
+		return nil, false
+	case "OBJECT", "XINFO", "XGROUP":
+		// subcommand key ...，HELP 等子命令没有key
+		if n < 2 {
+			return nil, true
+		}
+		return []int{1}, true
+	case "MEMORY":
+		// MEMORY USAGE key，其余子命令没有key
+		if n > 0 && strings.EqualFold(fmt.Sprint(args[0]), "USAGE") {
+			return []int{1}, n > 1
+		}
+		return nil, true
+	}
+	// FLUSHALL、FLUSHDB、MIGRATE 等命令以及未知命令不支持
+	return nil, false
+}
+
+// 选项名之后的参数为key，如 STORE key
+func optionIndexes(args []interface{}, from int, options ...string) []int {
+	var idx []int
+	for i := from; i+1 < len(args); i++ {
+		for _, o := range options {
+			if strings.EqualFold(fmt.Sprint(args[i]), o) {
+				idx = append(idx, i+1)
+			}
+		}
+	}
+	return idx
+}
+
+func rangeIndexes(from, to int) []int {
+	if to <= from {
+		return nil
+	}
+	idx := make([]int, 0, to-from)
+	for i := from; i < to; i++ {
+		idx = append(idx, i)
+	}
+	return idx
+}
+
+func numKeys(args []interface{}, i int) int {
+	if i >= len(args) {
+		return 0
+	}
+	n, err := strconv.Atoi(fmt.Sprint(args[i]))
+	if err != nil || n < 0 {
+		return 0
+	}
+	if i+1+n > len(args) {
+		return len(args) - i - 1
+	}
+	return n
+}
@@ -0,0 +1,146 @@
+package redis
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/peerless6372/Lplot/utils/metadata"
+	"github.com/peerless6372/gin"
+)
+
+func newShadowCtx(mark ...func(c *gin.Context)) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/", nil)
+	for _, m := range mark {
+		m(c)
+	}
+	return c
+}
+
+func TestShadowArgs(t *testing.T) {
+	r := &Redis{conf: RedisConf{PressurePrefix: "pt:"}}
+	pressure := newShadowCtx(metadata.MarkPressureTest)
+	cases := []struct {
+		name string
+		ctx  *gin.Context
+		args []interface{}
+		want string
+	}{
+		{"online", newShadowCtx(), []interface{}{"MSET", "a", "1", "b", "2"}, "[a 1 b 2]"},
+		{"first key", pressure, []interface{}{"HSET", "h", "f", "v"}, "[pt:h f v]"},
+		{"lower case", pressure, []interface{}{"get", "k"}, "[pt:k]"},
+		{"bytes key", pressure, []interface{}{"GET", []byte("k")}, "[[112 116 58 107]]"},
+		{"already prefixed", pressure, []interface{}{"GET", "pt:x"}, "[pt:x]"},
+		{"all keys", pressure, []interface{}{"DEL", "a", "b"}, "[pt:a pt:b]"},
+		{"mset", pressure, []interface{}{"MSET", "a", "1", "b", "2"}, "[pt:a 1 pt:b 2]"},
+		{"two keys", pressure, []interface{}{"RENAME", "a", "b"}, "[pt:a pt:b]"},
+		{"blocking timeout", pressure, []interface{}{"BLPOP", "a", "b", 5}, "[pt:a pt:b 5]"},
+		{"bitop", pressure, []interface{}{"BITOP", "AND", "d", "a", "b"}, "[AND pt:d pt:a pt:b]"},
+		{"numkeys store", pressure, []interface{}{"ZUNIONSTORE", "d", 2, "a", "b", "WEIGHTS", 1, 2}, "[pt:d 2 pt:a pt:b WEIGHTS 1 2]"},
+		{"numkeys overflow", pressure, []interface{}{"ZUNIONSTORE", "d", 5, "k"}, "[pt:d 5 pt:k]"},
+		{"numkeys", pressure, []interface{}{"ZINTER", 2, "a", "b", "WITHSCORES"}, "[2 pt:a pt:b WITHSCORES]"},
+		{"eval", pressure, []interface{}{"EVAL", "s", 1, "k", "v"}, "[s 1 pt:k v]"},
+		{"store option", pressure, []interface{}{"GEORADIUS", "k", 1, 2, 3, "km", "STORE", "d"}, "[pt:k 1 2 3 km STORE pt:d]"},
+		{"sort", pressure, []interface{}{"SORT", "k", "LIMIT", 0, 1, "store", "d"}, "[pt:k LIMIT 0 1 store pt:d]"},
+		{"streams", pressure, []interface{}{"XREAD", "COUNT", 1, "STREAMS", "s1", "s2", 0, 0}, "[COUNT 1 STREAMS pt:s1 pt:s2 0 0]"},
+		{"subcommand", pressure, []interface{}{"OBJECT", "ENCODING", "k"}, "[ENCODING pt:k]"},
+		{"subcommand help", pressure, []interface{}{"OBJECT", "HELP"}, "[HELP]"},
+		{"memory usage", pressure, []interface{}{"MEMORY", "USAGE", "k"}, "[USAGE pt:k]"},
+		{"memory stats", pressure, []interface{}{"MEMORY", "STATS"}, "[STATS]"},
+		{"no key", pressure, []interface{}{"SLOWLOG", "GET", 10}, "[GET 10]"},
+		{"ping", pressure, []interface{}{"PING"}, "[]"},
+		{"scan", pressure, []interface{}{"SCAN", 0}, "[0 MATCH pt:*]"},
+		{"scan match", pressure, []interface{}{"SCAN", 0, "MATCH", "user*", "COUNT", 10}, "[0 MATCH pt:user* COUNT 10]"},
+		{"reject flushall", pressure, []interface{}{"FLUSHALL", "ASYNC"}, "error"},
+		{"reject flushdb", pressure, []interface{}{"FLUSHDB"}, "error"},
+		{"reject migrate", pressure, []interface{}{"MIGRATE", "h", 1, "k", 0, 1}, "error"},
+		{"reject unknown", pressure, []interface{}{"FOO", "k"}, "error"},
+		{"reject streams missing", pressure, []interface{}{"XREAD", "COUNT", 1}, "error"},
+		{"reject memory usage without key", pressure, []interface{}{"MEMORY", "USAGE"}, "error"},
+	}
+	for _, c := range cases {
+		in := append([]interface{}(nil), c.args[1:]...)
+		out, err := r.shadowArgs(c.ctx, c.args[0].(string), c.args[1:])
+		got := fmt.Sprint(out)
+		if err != nil {
+			got = "error"
+		}
+		if got != c.want {
+			t.Errorf("%s: got %s, want %s", c.name, got, c.want)
+		}
+		// 不修改调用方的参数
+		if fmt.Sprint(c.args[1:]) != fmt.Sprint(in) {
+			t.Errorf("%s: args modified %v", c.name, c.args[1:])
+		}
+	}
+}
+
+func TestShadowScriptArgs(t *testing.T) {
+	r := &Redis{conf: RedisConf{PressurePrefix: "pt:"}}
+	cases := []struct {
+		name     string
+		ctx      *gin.Context
+		keyCount int
+		args     []interface{}
+		want     string
+	}{
+		{"online", newShadowCtx(), 1, []interface{}{"k", "v"}, "[k v]"},
+		{"keys only", newShadowCtx(metadata.MarkPressureTest), 2, []interface{}{"a", "b", "v"}, "[pt:a pt:b v]"},
+		{"no key", newShadowCtx(metadata.MarkPressureTest), 0, []interface{}{"v"}, "[v]"},
+		{"key count overflow", newShadowCtx(metadata.MarkPressureTest), 3, []interface{}{"a"}, "[pt:a]"},
+	}
+	for _, c := range cases {
+		if got := fmt.Sprint(r.shadowScriptArgs(c.ctx, c.keyCount, c.args)); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestShadowScan(t *testing.T) {
+	cases := []struct {
+		prefix string
+		args   []interface{}
+		want   string
+	}{
+		{"pt:", []interface{}{0}, "[0 MATCH pt:*]"},
+		{"pt:", []interface{}{0, "count", 10, "match", "u*"}, "[0 count 10 match pt:u*]"},
+		// 前缀中的glob字符需要转义
+		{"p*t?:", []interface{}{0}, `[0 MATCH p\*t\?:*]`},
+		{"[pt]:", []interface{}{0, "MATCH", "k"}, `[0 MATCH \[pt\]:k]`},
+	}
+	for _, c := range cases {
+		if got := fmt.Sprint(shadowScan(c.prefix, c.args)); got != c.want {
+			t.Errorf("%s %v: got %s, want %s", c.prefix, c.args, got, c.want)
+		}
+	}
+}
+
+func TestShadowColor(t *testing.T) {
+	blue := func(c *gin.Context) { metadata.SetColor(c, "blue") }
+	cases := []struct {
+		name     string
+		colorKey bool
+		ctx      *gin.Context
+		args     []interface{}
+		want     string
+	}{
+		{"default color", true, newShadowCtx(), []interface{}{"GET", "k"}, "[k]"},
+		{"color key", true, newShadowCtx(blue), []interface{}{"MSET", "a", "1", "b", "2"}, "[blue:a 1 blue:b 2]"},
+		{"color key disabled", false, newShadowCtx(blue), []interface{}{"GET", "k"}, "[k]"},
+		{"color and pressure", true, newShadowCtx(blue, metadata.MarkPressureTest), []interface{}{"DEL", "a"}, "[pt:blue:a]"},
+		{"color scan", true, newShadowCtx(blue), []interface{}{"SCAN", 0}, "[0 MATCH blue:*]"},
+		{"color reject", true, newShadowCtx(blue), []interface{}{"FLUSHDB"}, "error"},
+	}
+	for _, c := range cases {
+		r := &Redis{conf: RedisConf{PressurePrefix: "pt:", ColorKey: c.colorKey}}
+		out, err := r.shadowArgs(c.ctx, c.args[0].(string), c.args[1:])
+		got := fmt.Sprint(out)
+		if err != nil {
+			got = "error"
+		}
+		if got != c.want {
+			t.Errorf("%s: got %s, want %s", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package redis
+
+import (
+	"github.com/peerless6372/Lplot/trace"
+	"github.com/peerless6372/gin"
+)
+
+// redis命令的client span，调用方负责 End
+func (r *Redis) startSpan(ctx *gin.Context, operation string) *trace.Span {
+	span := trace.StartSpan(ctx, "redis "+operation, trace.SpanKindClient)
+	span.SetAttr("db.system", "redis")
+	span.SetAttr("db.operation", operation)
+	span.SetAttr("peer.service", r.Service)
+	return span
+}
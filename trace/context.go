@@ -0,0 +1,160 @@
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// W3C Trace Context header
+const (
+	HeaderTraceparent = "traceparent"
+	HeaderTracestate  = "tracestate"
+)
+
+const (
+	traceparentVersion = "00"
+	flagSampled        = 0x01
+	maxTracestateLen   = 512
+)
+
+var ErrInvalidTraceparent = errors.New("invalid traceparent")
+
+type TraceID [16]byte
+
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+type SpanID [8]byte
+
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// SpanContext 跨进程传递的链路信息
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Flags      byte
+	TraceState string
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+func (sc SpanContext) Sampled() bool {
+	return sc.Flags&flagSampled != 0
+}
+
+// Traceparent 生成 traceparent header，如 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func (sc SpanContext) Traceparent() string {
+	var b strings.Builder
+	b.Grow(55)
+	b.WriteString(traceparentVersion)
+	b.WriteByte('-')
+	b.WriteString(sc.TraceID.String())
+	b.WriteByte('-')
+	b.WriteString(sc.SpanID.String())
+	b.WriteByte('-')
+	b.WriteString(hex.EncodeToString([]byte{sc.Flags}))
+	return b.String()
+}
+
+// ParseTraceparent 解析 traceparent header，高版本只取前4段
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	s = strings.TrimSpace(s)
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' {
+		return sc, ErrInvalidTraceparent
+	}
+	version := s[:2]
+	if !isLowerHex(version) || version == "ff" {
+		return sc, ErrInvalidTraceparent
+	}
+	if version == traceparentVersion && len(s) != 55 {
+		return sc, ErrInvalidTraceparent
+	}
+	if len(s) > 55 && s[55] != '-' {
+		return sc, ErrInvalidTraceparent
+	}
+
+	if !decodeHex(sc.TraceID[:], s[3:35]) || !decodeHex(sc.SpanID[:], s[36:52]) {
+		return sc, ErrInvalidTraceparent
+	}
+	var flags [1]byte
+	if !decodeHex(flags[:], s[53:55]) {
+		return sc, ErrInvalidTraceparent
+	}
+	sc.Flags = flags[0]
+	if !sc.IsValid() {
+		return sc, ErrInvalidTraceparent
+	}
+	return sc, nil
+}
+
+// ParseTracestate 校验 tracestate，超长或格式不对时丢弃
+func ParseTracestate(s string) string {
+	s = strings.TrimSpace(s)
+	if s == "" || len(s) > maxTracestateLen {
+		return ""
+	}
+	members := strings.Split(s, ",")
+	if len(members) > 32 {
+		return ""
+	}
+	out := members[:0]
+	for _, m := range members {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+		if i := strings.IndexByte(m, '='); i <= 0 || i == len(m)-1 {
+			return ""
+		}
+		out = append(out, m)
+	}
+	return strings.Join(out, ",")
+}
+
+func decodeHex(dst []byte, s string) bool {
+	if !isLowerHex(s) {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func newTraceID() (t TraceID) {
+	for !t.IsValid() {
+		_, _ = rand.Read(t[:])
+	}
+	return t
+}
+
+func newSpanID() (s SpanID) {
+	for !s.IsValid() {
+		_, _ = rand.Read(s[:])
+	}
+	return s
+}
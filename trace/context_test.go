@@ -0,0 +1,66 @@
+package trace
+
+import "testing"
+
+func TestTraceparent(t *testing.T) {
+	cases := []struct {
+		name    string
+		in      string
+		valid   bool
+		sampled bool
+		emit    string // 重新生成的traceparent，为空时与输入一致
+	}{
+		{"sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true, ""},
+		{"not sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false, ""},
+		{"spaces", " 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01 ", true, true, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{"future version", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{"empty", "", false, false, ""},
+		{"zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false, ""},
+		{"zero span id", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false, ""},
+		{"version ff", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false, ""},
+		{"upper hex", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false, false, ""},
+		{"v00 with extra", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-x", false, false, ""},
+		{"bad separator", "00_4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false, ""},
+		{"bad flags", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz", false, false, ""},
+	}
+	for _, c := range cases {
+		sc, err := ParseTraceparent(c.in)
+		if (err == nil) != c.valid {
+			t.Errorf("%s: err %v", c.name, err)
+			continue
+		}
+		if !c.valid {
+			continue
+		}
+		want := c.emit
+		if want == "" {
+			want = c.in
+		}
+		if sc.Sampled() != c.sampled || sc.Traceparent() != want {
+			t.Errorf("%s: sampled %v emit %q, want %q", c.name, sc.Sampled(), sc.Traceparent(), want)
+		}
+	}
+}
+
+func TestTracestate(t *testing.T) {
+	long := "a="
+	for len(long) <= maxTracestateLen {
+		long += "x"
+	}
+	cases := []struct {
+		in, want string
+	}{
+		{"a=1, b=2", "a=1,b=2"},
+		{"a=1,,b=2", "a=1,b=2"},
+		{"bad", ""},
+		{"a=", ""},
+		{"=1", ""},
+		{long, ""},
+		{"", ""},
+	}
+	for _, c := range cases {
+		if got := ParseTracestate(c.in); got != c.want {
+			t.Errorf("%q: got %q, want %q", c.in, got, c.want)
+		}
+	}
+}
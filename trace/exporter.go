@@ -0,0 +1,61 @@
+package trace
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Exporter 批量导出span，由后台goroutine串行调用
+type Exporter interface {
+	Export(spans []*SpanData) error
+	Shutdown(ctx context.Context) error
+}
+
+// FileExporter 每个span一行json，追加写入文件
+type FileExporter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileExporter(name string) (*FileExporter, error) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{file: f}, nil
+}
+
+func (e *FileExporter) Export(spans []*SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.file == nil {
+		return os.ErrClosed
+	}
+
+	w := bufio.NewWriter(e.file)
+	enc := json.NewEncoder(w)
+	for _, s := range spans {
+		if err := enc.Encode(s); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func (e *FileExporter) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.file == nil {
+		return nil
+	}
+	err := e.file.Close()
+	e.file = nil
+	return err
+}
@@ -0,0 +1,177 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const otlpTracesPath = "/v1/traces"
+
+// OTLP status code，span kind 与 SpanKind 取值一致
+const otlpStatusError = 2
+
+// OTLPExporter 以 OTLP/HTTP json 格式上报到collector
+type OTLPExporter struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+}
+
+// NewOTLPExporter endpoint 未带path时使用 /v1/traces
+func NewOTLPExporter(endpoint string, headers map[string]string, timeout time.Duration) (*OTLPExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid otlp endpoint: %q", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = otlpTracesPath
+	}
+	return &OTLPExporter{
+		endpoint: u.String(),
+		headers:  headers,
+		client:   &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (e *OTLPExporter) Export(spans []*SpanData) error {
+	if len(spans) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp export http code %d: %s", resp.StatusCode, data)
+	}
+	return nil
+}
+
+func (e *OTLPExporter) Shutdown(ctx context.Context) error {
+	e.client.CloseIdleConnections()
+	return nil
+}
+
+// OTLP json 编码，traceId/spanId 使用hex，时间为纳秒字符串
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	TraceState        string         `json:"traceState,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func otlpRequest(spans []*SpanData) map[string]interface{} {
+	// 按服务分组
+	byService := make(map[string][]otlpSpan)
+	var services []string
+	for _, s := range spans {
+		if _, ok := byService[s.Service]; !ok {
+			services = append(services, s.Service)
+		}
+		byService[s.Service] = append(byService[s.Service], toOTLPSpan(s))
+	}
+
+	resourceSpans := make([]interface{}, 0, len(services))
+	for _, service := range services {
+		resourceSpans = append(resourceSpans, map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpKeyValue{otlpAttr("service.name", service)},
+			},
+			"scopeSpans": []interface{}{
+				map[string]interface{}{
+					"scope": map[string]string{"name": "github.com/peerless6372/Lplot/trace"},
+					"spans": byService[service],
+				},
+			},
+		})
+	}
+	return map[string]interface{}{"resourceSpans": resourceSpans}
+}
+
+func toOTLPSpan(s *SpanData) otlpSpan {
+	o := otlpSpan{
+		TraceID:           s.TraceID,
+		SpanID:            s.SpanID,
+		ParentSpanID:      s.ParentID,
+		TraceState:        s.TraceState,
+		Name:              s.Name,
+		Kind:              int(s.kind),
+		StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+	}
+	keys := make([]string, 0, len(s.Attributes))
+	for k := range s.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		o.Attributes = append(o.Attributes, otlpAttr(k, s.Attributes[k]))
+	}
+	if s.Error != "" {
+		o.Status = &otlpStatus{Code: otlpStatusError, Message: s.Error}
+	}
+	return o
+}
+
+func otlpAttr(key string, v interface{}) otlpKeyValue {
+	var val map[string]interface{}
+	switch x := v.(type) {
+	case string:
+		val = map[string]interface{}{"stringValue": x}
+	case bool:
+		val = map[string]interface{}{"boolValue": x}
+	case int:
+		val = map[string]interface{}{"intValue": strconv.FormatInt(int64(x), 10)}
+	case int64:
+		val = map[string]interface{}{"intValue": strconv.FormatInt(x, 10)}
+	case float64:
+		val = map[string]interface{}{"doubleValue": x}
+	default:
+		val = map[string]interface{}{"stringValue": fmt.Sprint(x)}
+	}
+	return otlpKeyValue{Key: key, Value: val}
+}
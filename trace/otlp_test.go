@@ -0,0 +1,240 @@
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type otlpPayload struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []otlpKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []struct {
+			Spans []otlpSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+// 本地collector，记录每次上报的请求
+type testCollector struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []*http.Request
+	spans    [][]otlpSpan
+	services []string
+	code     int
+	got      chan struct{}
+}
+
+func newTestCollector(t *testing.T) *testCollector {
+	c := &testCollector{code: http.StatusOK, got: make(chan struct{}, 16)}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p otlpPayload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Error(err)
+		}
+		var spans []otlpSpan
+		c.mu.Lock()
+		for _, rs := range p.ResourceSpans {
+			for _, a := range rs.Resource.Attributes {
+				if a.Key == "service.name" {
+					c.services = append(c.services, a.Value["stringValue"].(string))
+				}
+			}
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+		c.requests = append(c.requests, r)
+		c.spans = append(c.spans, spans)
+		code := c.code
+		c.mu.Unlock()
+		w.WriteHeader(code)
+		c.got <- struct{}{}
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+func TestNewOTLPExporter(t *testing.T) {
+	cases := []struct {
+		endpoint string
+		want     string
+		err      bool
+	}{
+		{"http://127.0.0.1:4318", "http://127.0.0.1:4318/v1/traces", false},
+		{"http://127.0.0.1:4318/", "http://127.0.0.1:4318/v1/traces", false},
+		{"https://collector/custom/traces", "https://collector/custom/traces", false},
+		{"127.0.0.1:4318", "", true},
+		{"://x", "", true},
+	}
+	for _, c := range cases {
+		e, err := NewOTLPExporter(c.endpoint, nil, time.Second)
+		if (err != nil) != c.err {
+			t.Errorf("%s: err %v", c.endpoint, err)
+			continue
+		}
+		if err == nil && e.endpoint != c.want {
+			t.Errorf("%s: got %s, want %s", c.endpoint, e.endpoint, c.want)
+		}
+	}
+}
+
+func TestOTLPExportBatch(t *testing.T) {
+	col := newTestCollector(t)
+	err := Init(Conf{Service: "svc", Exporter: ExporterOTLP, OTLPEndpoint: col.URL,
+		OTLPHeaders: map[string]string{"X-Token": "t"}, BatchSize: 2, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := StartSpan(context.Background(), "root", SpanKindServer)
+	ctx := ContextWithSpan(context.Background(), root)
+	for i := 0; i < 4; i++ {
+		child := StartSpan(ctx, "child", SpanKindClient)
+		child.SetAttr("n", i)
+		if i == 0 {
+			child.SetError(errors.New("boom"))
+		}
+		child.End()
+	}
+	root.End()
+	if err := Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	col.mu.Lock()
+	defer col.mu.Unlock()
+	// 5个span按每批2个上报
+	if len(col.spans) != 3 || len(col.spans[0]) != 2 || len(col.spans[1]) != 2 || len(col.spans[2]) != 1 {
+		t.Fatalf("batches %v", col.spans)
+	}
+	for _, r := range col.requests {
+		if r.URL.Path != otlpTracesPath || r.Header.Get("X-Token") != "t" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("request %s %v", r.URL.Path, r.Header)
+		}
+	}
+	for _, s := range col.services {
+		if s != "svc" {
+			t.Errorf("service %s", s)
+		}
+	}
+
+	var children, errored int
+	for _, batch := range col.spans {
+		for _, s := range batch {
+			if s.TraceID != root.sc.TraceID.String() {
+				t.Errorf("trace id %s", s.TraceID)
+			}
+			if s.Name == "root" {
+				if s.ParentSpanID != "" || s.Kind != int(SpanKindServer) {
+					t.Errorf("root %+v", s)
+				}
+				continue
+			}
+			children++
+			if s.ParentSpanID != root.sc.SpanID.String() || len(s.Attributes) != 1 || s.Attributes[0].Value["intValue"] == nil {
+				t.Errorf("child %+v", s)
+			}
+			if s.Status != nil && s.Status.Code == otlpStatusError && s.Status.Message == "boom" {
+				errored++
+			}
+		}
+	}
+	if children != 4 || errored != 1 {
+		t.Fatalf("children %d errored %d", children, errored)
+	}
+}
+
+func TestOTLPExportInterval(t *testing.T) {
+	col := newTestCollector(t)
+	if err := Init(Conf{Service: "svc", Exporter: ExporterOTLP, OTLPEndpoint: col.URL, FlushInterval: 20 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	defer Shutdown(context.Background())
+
+	for i := 0; i < 3; i++ {
+		StartSpan(context.Background(), "x", SpanKindInternal).End()
+	}
+	// 未攒满一批时按间隔上报
+	select {
+	case <-col.got:
+	case <-time.After(time.Second):
+		t.Fatal("no export before interval")
+	}
+	col.mu.Lock()
+	defer col.mu.Unlock()
+	if len(col.spans) != 1 || len(col.spans[0]) != 3 {
+		t.Fatalf("batches %v", col.spans)
+	}
+}
+
+func TestOTLPExportError(t *testing.T) {
+	col := newTestCollector(t)
+	col.code = http.StatusServiceUnavailable
+	e, err := NewOTLPExporter(col.URL, nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := &SpanData{TraceID: newTraceID().String(), SpanID: newSpanID().String(), Name: "x", Service: "svc"}
+	if err := e.Export([]*SpanData{data}); err == nil {
+		t.Fatal("expect error")
+	}
+	if err := e.Export(nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransportPropagation(t *testing.T) {
+	col := newTestCollector(t)
+	if err := Init(Conf{Service: "svc", Exporter: ExporterOTLP, OTLPEndpoint: col.URL, FlushInterval: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got SpanContext
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = ParseTraceparent(r.Header.Get(HeaderTraceparent))
+	}))
+	defer downstream.Close()
+
+	upstream, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	root := currentTracer().newSpan(upstream, "root", SpanKindServer, time.Now())
+	req, _ := http.NewRequest(http.MethodGet, downstream.URL+"/x", nil)
+	req = req.WithContext(ContextWithSpan(context.Background(), root))
+	resp, err := (&http.Client{Transport: &Transport{System: "es", Service: "search"}}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	root.End()
+	if req.Header.Get(HeaderTraceparent) != "" {
+		t.Fatal("caller request mutated")
+	}
+	if err := Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.TraceID != upstream.TraceID || got.SpanID == root.sc.SpanID || !got.Sampled() {
+		t.Fatalf("downstream traceparent %+v", got)
+	}
+	col.mu.Lock()
+	defer col.mu.Unlock()
+	var client *otlpSpan
+	for _, batch := range col.spans {
+		for i, s := range batch {
+			if s.Name == "es GET" {
+				client = &batch[i]
+			}
+		}
+	}
+	if client == nil || client.SpanID != got.SpanID.String() || client.ParentSpanID != root.sc.SpanID.String() {
+		t.Fatalf("client span %+v", client)
+	}
+}
@@ -0,0 +1,219 @@
+package trace
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/peerless6372/gin"
+)
+
+// gin.Context 中保存当前span的key，string类型使由gin.Context派生的context也能取到
+const ContextKeySpan = "_trace_span"
+
+type spanKey struct{}
+
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = iota + 1
+	SpanKindServer
+	SpanKindClient
+)
+
+func (k SpanKind) String() string {
+	switch k {
+	case SpanKindServer:
+		return "server"
+	case SpanKindClient:
+		return "client"
+	default:
+		return "internal"
+	}
+}
+
+// Span 一次调用，方法对nil安全，未初始化tracer时StartSpan返回nil
+type Span struct {
+	tracer *Tracer
+	name   string
+	kind   SpanKind
+	sc     SpanContext
+	parent SpanID
+	start  time.Time
+
+	mu    sync.Mutex
+	attrs map[string]interface{}
+	err   string
+	ended bool
+}
+
+// SpanData 导出的span
+type SpanData struct {
+	Service    string                 `json:"service"`
+	Name       string                 `json:"name"`
+	Kind       string                 `json:"kind"`
+	TraceID    string                 `json:"traceId"`
+	SpanID     string                 `json:"spanId"`
+	ParentID   string                 `json:"parentSpanId,omitempty"`
+	TraceState string                 `json:"traceState,omitempty"`
+	Start      time.Time              `json:"start"`
+	End        time.Time              `json:"end"`
+	Duration   float64                `json:"duration"` // 毫秒
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+
+	kind SpanKind
+}
+
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return s.sc.TraceID.String()
+}
+
+func (s *Span) SetAttr(key string, val interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	if s.attrs == nil {
+		s.attrs = make(map[string]interface{})
+	}
+	s.attrs[key] = val
+}
+
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.ended {
+		s.err = err.Error()
+	}
+	s.mu.Unlock()
+}
+
+func (s *Span) End() {
+	s.EndAt(time.Now())
+}
+
+// EndAt 结束span，重复调用只有第一次生效
+func (s *Span) EndAt(end time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	data := &SpanData{
+		Service:    s.tracer.conf.Service,
+		Name:       s.name,
+		Kind:       s.kind.String(),
+		TraceID:    s.sc.TraceID.String(),
+		SpanID:     s.sc.SpanID.String(),
+		TraceState: s.sc.TraceState,
+		Start:      s.start,
+		End:        end,
+		Duration:   float64(end.Sub(s.start).Nanoseconds()/1e4) / 100.0,
+		Attributes: s.attrs,
+		Error:      s.err,
+		kind:       s.kind,
+	}
+	s.mu.Unlock()
+
+	if s.parent.IsValid() {
+		data.ParentID = s.parent.String()
+	}
+	if s.sc.Sampled() {
+		s.tracer.processor.enqueue(data)
+	}
+}
+
+// Inject 把链路信息写入下游请求的header
+func (s *Span) Inject(h http.Header) {
+	if s == nil {
+		return
+	}
+	h.Set(HeaderTraceparent, s.sc.Traceparent())
+	if s.sc.TraceState != "" {
+		h.Set(HeaderTracestate, s.sc.TraceState)
+	}
+}
+
+// StartServerSpan 根据请求header中的traceparent创建入口span，并保存到gin.Context
+func StartServerSpan(c *gin.Context, name string) *Span {
+	t := currentTracer()
+	if t == nil || c == nil || c.Request == nil {
+		return nil
+	}
+
+	var parent SpanContext
+	if sc, err := ParseTraceparent(c.GetHeader(HeaderTraceparent)); err == nil {
+		parent = sc
+		parent.TraceState = ParseTracestate(c.GetHeader(HeaderTracestate))
+	}
+	s := t.newSpan(parent, name, SpanKindServer, time.Now())
+	c.Set(ContextKeySpan, s)
+	return s
+}
+
+// StartSpan 创建当前span的子span，ctx 可以是 *gin.Context 或由其派生的context
+func StartSpan(ctx context.Context, name string, kind SpanKind) *Span {
+	return StartSpanAt(ctx, name, kind, time.Now())
+}
+
+// StartSpanAt 指定开始时间创建子span，用于调用结束后才能拿到信息的场景(如gorm Trace)
+func StartSpanAt(ctx context.Context, name string, kind SpanKind, start time.Time) *Span {
+	t := currentTracer()
+	if t == nil {
+		return nil
+	}
+	var parent SpanContext
+	if p := SpanFromContext(ctx); p != nil {
+		parent = p.sc
+	}
+	return t.newSpan(parent, name, kind, start)
+}
+
+// SpanFromContext 获取ctx中的当前span
+func SpanFromContext(ctx context.Context) *Span {
+	if c, ok := ctx.(*gin.Context); ok {
+		if c == nil {
+			return nil
+		}
+		if v, ok := c.Get(ContextKeySpan); ok {
+			s, _ := v.(*Span)
+			return s
+		}
+		return nil
+	}
+	if ctx == nil {
+		return nil
+	}
+	if s, ok := ctx.Value(spanKey{}).(*Span); ok {
+		return s
+	}
+	s, _ := ctx.Value(ContextKeySpan).(*Span)
+	return s
+}
+
+// ContextWithSpan 把span放入非gin的context，用于异步任务等场景
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
@@ -0,0 +1,250 @@
+package trace
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/peerless6372/Lplot/env"
+	"github.com/peerless6372/Lplot/klog"
+)
+
+const (
+	ExporterFile = "file"
+	ExporterOTLP = "otlp"
+)
+
+type Conf struct {
+	// 服务名，默认 env.GetAppName()
+	Service string `yaml:"service"`
+	// 入口请求(无上游采样标记时)的采样率 0-1，默认1
+	SampleRate *float64 `yaml:"sampleRate"`
+
+	// 内置exporter: file / otlp，Exporter 不为空时忽略
+	Exporter string `yaml:"exporter"`
+	// file exporter 写入的文件，默认 ./log/trace.log
+	File string `yaml:"file"`
+	// otlp exporter 地址，如 http://127.0.0.1:4318
+	OTLPEndpoint string            `yaml:"otlpEndpoint"`
+	OTLPHeaders  map[string]string `yaml:"otlpHeaders"`
+	OTLPTimeout  time.Duration     `yaml:"otlpTimeout"`
+
+	// 队列满时丢弃span，默认2048
+	QueueSize int `yaml:"queueSize"`
+	// 每批导出的span数，默认512
+	BatchSize int `yaml:"batchSize"`
+	// 未攒满一批时的导出间隔，默认5s
+	FlushInterval time.Duration `yaml:"flushInterval"`
+
+	// 自定义exporter
+	CustomExporter Exporter `yaml:"-"`
+}
+
+func (conf *Conf) checkConf() {
+	if conf.Service == "" {
+		conf.Service = env.GetAppName()
+	}
+	if conf.SampleRate == nil {
+		rate := 1.0
+		conf.SampleRate = &rate
+	}
+	if conf.File == "" {
+		conf.File = "./log/trace.log"
+	}
+	if conf.OTLPTimeout == 0 {
+		conf.OTLPTimeout = 10 * time.Second
+	}
+	if conf.QueueSize <= 0 {
+		conf.QueueSize = 2048
+	}
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = 512
+	}
+	if conf.FlushInterval <= 0 {
+		conf.FlushInterval = 5 * time.Second
+	}
+}
+
+type Tracer struct {
+	conf      Conf
+	processor *batchProcessor
+}
+
+// 全局tracer(*Tracer)，Init/Shutdown 时替换，请求中并发读取
+var (
+	globalTracer atomic.Value
+	initLock     sync.Mutex
+)
+
+func currentTracer() *Tracer {
+	t, _ := globalTracer.Load().(*Tracer)
+	return t
+}
+
+// Init 初始化全局tracer，未初始化时不创建span
+func Init(conf Conf) error {
+	conf.checkConf()
+
+	exporter := conf.CustomExporter
+	if exporter == nil {
+		var err error
+		switch conf.Exporter {
+		case ExporterOTLP:
+			exporter, err = NewOTLPExporter(conf.OTLPEndpoint, conf.OTLPHeaders, conf.OTLPTimeout)
+		default:
+			exporter, err = NewFileExporter(conf.File)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	initLock.Lock()
+	defer initLock.Unlock()
+	old := currentTracer()
+	globalTracer.Store(&Tracer{
+		conf:      conf,
+		processor: newBatchProcessor(exporter, conf.QueueSize, conf.BatchSize, conf.FlushInterval),
+	})
+	if old != nil {
+		_ = old.processor.shutdown(context.Background())
+	}
+	return nil
+}
+
+// Shutdown 导出剩余的span并关闭exporter，服务退出前调用
+func Shutdown(ctx context.Context) error {
+	initLock.Lock()
+	t := currentTracer()
+	globalTracer.Store((*Tracer)(nil))
+	initLock.Unlock()
+	if t == nil {
+		return nil
+	}
+	return t.processor.shutdown(ctx)
+}
+
+// Dropped 队列满被丢弃的span数
+func Dropped() uint64 {
+	if t := currentTracer(); t != nil {
+		return atomic.LoadUint64(&t.processor.dropped)
+	}
+	return 0
+}
+
+// 有上游时沿用上游的trace与采样结果，否则按采样率新建trace
+func (t *Tracer) newSpan(parent SpanContext, name string, kind SpanKind, start time.Time) *Span {
+	s := &Span{
+		tracer: t,
+		name:   name,
+		kind:   kind,
+		start:  start,
+	}
+	if parent.IsValid() {
+		s.sc = SpanContext{
+			TraceID:    parent.TraceID,
+			SpanID:     newSpanID(),
+			Flags:      parent.Flags,
+			TraceState: parent.TraceState,
+		}
+		s.parent = parent.SpanID
+		return s
+	}
+
+	s.sc = SpanContext{TraceID: newTraceID(), SpanID: newSpanID()}
+	if rate := *t.conf.SampleRate; rate >= 1 || rand.Float64() < rate {
+		s.sc.Flags |= flagSampled
+	}
+	return s
+}
+
+// 异步批量导出，不阻塞业务请求
+type batchProcessor struct {
+	exporter  Exporter
+	queue     chan *SpanData
+	batchSize int
+	interval  time.Duration
+
+	dropped uint64
+	once    sync.Once
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newBatchProcessor(exporter Exporter, queueSize, batchSize int, interval time.Duration) *batchProcessor {
+	p := &batchProcessor{
+		exporter:  exporter,
+		queue:     make(chan *SpanData, queueSize),
+		batchSize: batchSize,
+		interval:  interval,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *batchProcessor) enqueue(s *SpanData) {
+	select {
+	case p.queue <- s:
+	default:
+		atomic.AddUint64(&p.dropped, 1)
+	}
+}
+
+func (p *batchProcessor) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	batch := make([]*SpanData, 0, p.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := p.exporter.Export(batch); err != nil {
+			klog.WarnLogger(nil, "trace export error: "+err.Error(),
+				klog.String(klog.TopicType, klog.LogNameModule),
+				klog.String("prot", "trace"),
+				klog.Int("spans", len(batch)))
+		}
+		batch = make([]*SpanData, 0, p.batchSize)
+	}
+
+	for {
+		select {
+		case s := <-p.queue:
+			batch = append(batch, s)
+			if len(batch) >= p.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-p.stop:
+			for {
+				select {
+				case s := <-p.queue:
+					batch = append(batch, s)
+					if len(batch) >= p.batchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (p *batchProcessor) shutdown(ctx context.Context) error {
+	p.once.Do(func() { close(p.stop) })
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return p.exporter.Shutdown(ctx)
+}
@@ -0,0 +1,83 @@
+package trace
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type countExporter struct {
+	spans int
+}
+
+func (e *countExporter) Export(spans []*SpanData) error { e.spans += len(spans); return nil }
+func (e *countExporter) Shutdown(context.Context) error { return nil }
+
+func TestSampleRate(t *testing.T) {
+	zero, one := 0.0, 1.0
+	sampled, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	unsampled, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	cases := []struct {
+		name   string
+		rate   *float64
+		parent SpanContext
+		want   int
+	}{
+		{"rate 1", &one, SpanContext{}, 1},
+		{"rate 0", &zero, SpanContext{}, 0},
+		{"upstream sampled", &zero, sampled, 1},
+		{"upstream not sampled", &one, unsampled, 0},
+	}
+	for _, c := range cases {
+		e := &countExporter{}
+		if err := Init(Conf{SampleRate: c.rate, CustomExporter: e}); err != nil {
+			t.Fatal(err)
+		}
+		currentTracer().newSpan(c.parent, "x", SpanKindServer, time.Now()).End()
+		if err := Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if e.spans != c.want {
+			t.Errorf("%s: exported %d, want %d", c.name, e.spans, c.want)
+		}
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "trace.log")
+	if err := Init(Conf{Service: "s", File: f}); err != nil {
+		t.Fatal(err)
+	}
+	StartSpan(nil, "x", SpanKindInternal).End()
+	if err := Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(f)
+	if !strings.Contains(string(data), `"name":"x"`) || !strings.Contains(string(data), `"service":"s"`) {
+		t.Fatal(string(data))
+	}
+	if StartSpan(nil, "y", SpanKindInternal) != nil {
+		t.Fatal("span created after shutdown")
+	}
+}
+
+// Init/Shutdown 与创建span并发，配合 -race 检查
+func TestTracerSwap(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			_ = Init(Conf{CustomExporter: &countExporter{}})
+		}
+		_ = Shutdown(context.Background())
+	}()
+	for i := 0; i < 1000; i++ {
+		if s := StartSpan(context.Background(), "x", SpanKindInternal); s != nil {
+			s.End()
+		}
+	}
+	<-done
+}
@@ -0,0 +1,52 @@
+package trace
+
+import (
+	"net/http"
+)
+
+// Transport 为每次http请求创建client span并透传traceparent，用于第三方sdk(如es)的http.Client
+// 父span从 req.Context() 中获取
+type Transport struct {
+	Next http.RoundTripper
+	// span名前缀及 db.system 属性，如 elasticsearch
+	System  string
+	Service string
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.Next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	span := StartSpan(req.Context(), t.System+" "+req.Method, SpanKindClient)
+	if span == nil {
+		return next.RoundTrip(req)
+	}
+	defer span.End()
+
+	r := req.Clone(req.Context())
+	span.Inject(r.Header)
+	span.SetAttr("db.system", t.System)
+	span.SetAttr("peer.service", t.Service)
+	span.SetAttr("http.method", req.Method)
+	span.SetAttr("http.target", req.URL.Path)
+
+	resp, err := next.RoundTrip(r)
+	if err != nil {
+		span.SetError(err)
+		return resp, err
+	}
+	span.SetAttr("http.status_code", resp.StatusCode)
+	if resp.StatusCode >= 500 {
+		span.SetError(errStatus(resp.StatusCode))
+	}
+	return resp, nil
+}
+
+// http状态码错误，用于标记span失败
+type errStatus int
+
+func (e errStatus) Error() string {
+	return "http status " + http.StatusText(int(e))
+}
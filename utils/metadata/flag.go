@@ -0,0 +1,102 @@
+package metadata
+
+import (
+	"context"
+
+	"github.com/peerless6372/gin"
+)
+
+// IsPressureTest 判断是否为压测流量，支持 *gin.Context 以及由其派生的context
+func IsPressureTest(ctx context.Context) bool {
+	return flag(ctx, PressureTest)
+}
+
+// MarkPressureTest 标记当前请求为压测流量
+func MarkPressureTest(c *gin.Context) {
+	mark(c, PressureTest)
+}
+
+// IsMirror 判断是否为镜像流量，镜像请求的结果不应计入真实业务
+func IsMirror(ctx context.Context) bool {
+	return flag(ctx, Mirror)
+}
+
+// MarkMirror 标记当前请求为镜像流量
+func MarkMirror(c *gin.Context) {
+	mark(c, Mirror)
+}
+
+// GetColor 获取当前请求所在的泳道，默认泳道返回空
+func GetColor(ctx context.Context) string {
+	if md := lookup(ctx); md != nil {
+		return String(md, Color)
+	}
+	return ""
+}
+
+// SetColor 设置当前请求所在的泳道，下游调用、redis/mysql据此路由
+func SetColor(c *gin.Context, color string) {
+	if md := mdForWrite(c); md != nil {
+		md[Color] = color
+	}
+}
+
+// Lookup 获取请求的metadata，支持 *gin.Context 以及由其派生的context
+// 返回的MD不要修改，需要修改时先Copy
+func Lookup(ctx context.Context) (MD, bool) {
+	if md := lookup(ctx); md != nil {
+		return FromContext(md)
+	}
+	return nil, false
+}
+
+func flag(ctx context.Context, key string) bool {
+	if md := lookup(ctx); md != nil {
+		return Bool(md, key)
+	}
+	return false
+}
+
+// 查找请求的metadata，支持 *gin.Context 以及由其派生的context
+func lookup(ctx context.Context) context.Context {
+	if c, ok := ctx.(*gin.Context); ok {
+		if c == nil {
+			return nil
+		}
+		if md, ok := CtxFromGinContext(c); ok {
+			return md
+		}
+		return nil
+	}
+	if ctx == nil {
+		return nil
+	}
+
+	if _, ok := FromContext(ctx); ok {
+		return ctx
+	}
+	// 由 gin.Context 派生的context(如 WithTimeout)可以取到gin中保存的metadata
+	if md, ok := ctx.Value(_CTX_KEY).(context.Context); ok {
+		return md
+	}
+	return nil
+}
+
+func mark(c *gin.Context, key string) {
+	if md := mdForWrite(c); md != nil {
+		md[key] = true
+	}
+}
+
+func mdForWrite(c *gin.Context) MD {
+	if c == nil {
+		return nil
+	}
+	ctx, ok := CtxFromGinContext(c)
+	if !ok {
+		ctx = NewContext4Gin()
+		GinCtxWithCtx(c, ctx)
+	}
+	md, _ := FromContext(ctx)
+	return md
+}
@@ -21,6 +21,8 @@ const (
 
 	// Log
 	Notice = "notice"
+	// 通过 klog.WithFields 附加的日志字段
+	LogFields = "log_fields"
 
 	// Timeout
 
@@ -36,6 +38,11 @@ const (
 
 	Mirror = "mirror"
 
+	// PressureTest
+	// 全链路压测流量标记
+
+	PressureTest = "pressure_test"
+
 	// Mid
 	// 外网账户用户id
 